@@ -21,6 +21,7 @@ import (
 	"github.com/Blinkuu/qms/internal/core/services/rate"
 	"github.com/Blinkuu/qms/internal/core/services/server"
 	allocstorage "github.com/Blinkuu/qms/internal/core/storage/alloc"
+	ratestorage "github.com/Blinkuu/qms/internal/core/storage/rate"
 	"github.com/Blinkuu/qms/internal/handlers"
 	"github.com/Blinkuu/qms/pkg/cloud"
 	"github.com/Blinkuu/qms/pkg/cloud/native"
@@ -152,25 +153,72 @@ func (a *App) Run(ctx context.Context) error {
 		rateProxyHandler := handlers.NewRateHTTPHandler(a.proxy)
 		allocProxyHandler := handlers.NewAllocHTTPHandler(a.proxy)
 		v1ApiRouter.Handle("/allow", rateProxyHandler.Allow()).Methods(http.MethodPost)
+		v1ApiRouter.Handle("/reserve", rateProxyHandler.Reserve()).Methods(http.MethodPost)
+		v1ApiRouter.Handle("/cancel", rateProxyHandler.Cancel()).Methods(http.MethodPost)
+		v1ApiRouter.Handle("/acquire", rateProxyHandler.Acquire()).Methods(http.MethodPost)
+		v1ApiRouter.Handle("/release", rateProxyHandler.Release()).Methods(http.MethodPost)
 		v1ApiRouter.Handle("/view", allocProxyHandler.View()).Methods(http.MethodPost)
+		v1ApiRouter.Handle("/view/holders", allocProxyHandler.ViewHolders()).Methods(http.MethodPost)
+		v1ApiRouter.Handle("/view/history", allocProxyHandler.History()).Methods(http.MethodGet)
 		v1ApiRouter.Handle("/alloc", allocProxyHandler.Alloc()).Methods(http.MethodPost)
+		v1ApiRouter.Handle("/alloc/batch", allocProxyHandler.AllocBatch()).Methods(http.MethodPost)
 		v1ApiRouter.Handle("/free", allocProxyHandler.Free()).Methods(http.MethodPost)
+		v1ApiRouter.Handle("/renew", allocProxyHandler.Renew()).Methods(http.MethodPost)
+		v1ApiRouter.Handle("/watch", allocProxyHandler.Watch()).Methods(http.MethodPost)
+
+		quotaProxyHandler := handlers.NewQuotaHTTPHandler(a.proxy, a.proxy)
+		v1ApiRouter.Handle("/admin/quotas", quotaProxyHandler.Create()).Methods(http.MethodPost)
+		v1ApiRouter.Handle("/admin/quotas", quotaProxyHandler.Update()).Methods(http.MethodPut)
+		v1ApiRouter.Handle("/admin/quotas", quotaProxyHandler.Delete()).Methods(http.MethodDelete)
+		v1ApiRouter.Handle("/admin/quotas", quotaProxyHandler.List()).Methods(http.MethodGet)
 
 		{
 			v1InternalApiRouter := v1ApiRouter.PathPrefix("/internal").Subrouter()
 
 			rateHandler := handlers.NewRateHTTPHandler(a.rate)
 			v1InternalApiRouter.Handle("/allow", rateHandler.Allow()).Methods(http.MethodPost)
+			v1InternalApiRouter.Handle("/reserve", rateHandler.Reserve()).Methods(http.MethodPost)
+			v1InternalApiRouter.Handle("/cancel", rateHandler.Cancel()).Methods(http.MethodPost)
+			v1InternalApiRouter.Handle("/acquire", rateHandler.Acquire()).Methods(http.MethodPost)
+			v1InternalApiRouter.Handle("/release", rateHandler.Release()).Methods(http.MethodPost)
 
 			allocHandler := handlers.NewAllocHTTPHandler(a.alloc)
 			v1InternalApiRouter.Handle("/view", allocHandler.View()).Methods(http.MethodPost)
+			v1InternalApiRouter.Handle("/view/holders", allocHandler.ViewHolders()).Methods(http.MethodPost)
+			v1InternalApiRouter.Handle("/view/history", allocHandler.History()).Methods(http.MethodGet)
 			v1InternalApiRouter.Handle("/alloc", allocHandler.Alloc()).Methods(http.MethodPost)
+			v1InternalApiRouter.Handle("/alloc/batch", allocHandler.AllocBatch()).Methods(http.MethodPost)
 			v1InternalApiRouter.Handle("/free", allocHandler.Free()).Methods(http.MethodPost)
+			v1InternalApiRouter.Handle("/renew", allocHandler.Renew()).Methods(http.MethodPost)
+			v1InternalApiRouter.Handle("/watch", allocHandler.Watch()).Methods(http.MethodPost)
+
+			quotaHandler := handlers.NewQuotaHTTPHandler(a.rate, a.alloc)
+			v1InternalApiRouter.Handle("/admin/quotas", quotaHandler.Create()).Methods(http.MethodPost)
+			v1InternalApiRouter.Handle("/admin/quotas", quotaHandler.Update()).Methods(http.MethodPut)
+			v1InternalApiRouter.Handle("/admin/quotas", quotaHandler.Delete()).Methods(http.MethodDelete)
+			v1InternalApiRouter.Handle("/admin/quotas", quotaHandler.List()).Methods(http.MethodGet)
+
+			backupHandler := handlers.NewBackupHTTPHandler(a.alloc)
+			v1InternalApiRouter.Handle("/admin/backup", backupHandler.Backup()).Methods(http.MethodGet)
+			v1InternalApiRouter.Handle("/admin/restore", backupHandler.Restore()).Methods(http.MethodPost)
+
+			exportHandler := handlers.NewExportHTTPHandler(a.alloc)
+			v1InternalApiRouter.Handle("/admin/export", exportHandler.Export()).Methods(http.MethodGet)
+			v1InternalApiRouter.Handle("/admin/import", exportHandler.Import()).Methods(http.MethodPost)
 
 			if a.cfg.AllocConfig.Storage.Backend == allocstorage.Raft {
 				raftHandler := handlers.NewRaftHTTPHandler(a.alloc)
 				v1InternalApiRouter.Handle("/raft/join", raftHandler.Join()).Methods(http.MethodPost)
 				v1InternalApiRouter.Handle("/raft/exit", raftHandler.Exit()).Methods(http.MethodPost)
+
+				raftShardHandler := handlers.NewRaftShardHTTPHandler(a.alloc)
+				v1InternalApiRouter.Handle("/raft/invoke", raftShardHandler.Invoke()).Methods(http.MethodPost)
+			}
+
+			if a.cfg.RateConfig.Storage.Backend == ratestorage.Raft {
+				rateRaftHandler := handlers.NewRaftHTTPHandler(a.rate)
+				v1InternalApiRouter.Handle("/raft/rate/join", rateRaftHandler.Join()).Methods(http.MethodPost)
+				v1InternalApiRouter.Handle("/raft/rate/exit", rateRaftHandler.Exit()).Methods(http.MethodPost)
 			}
 		}
 	}
@@ -261,9 +309,17 @@ func (a *App) initProxy() (services.Service, error) {
 	allocClient := alloc.NewClient(
 		a.logger.With("service", proxy.ServiceName, "component", alloc.ClientName),
 	)
+	// Approximate quotas are counted by every rate instance, so the proxy does not route them by the hash ring.
+	proxyCfg := a.cfg.ProxyConfig
+	for _, q := range a.cfg.RateConfig.Quotas {
+		if q.Strategy.Approximate {
+			proxyCfg.ApproximateRateQuotas = append(proxyCfg.ApproximateRateQuotas, q.Namespace+"/"+q.Resource)
+		}
+	}
+
 	var err error
 	a.proxy, err = proxy.NewService(
-		a.cfg.ProxyConfig,
+		proxyCfg,
 		a.logger.With("service", proxy.ServiceName),
 		a.discoverer,
 		memberlistClient,
@@ -277,7 +333,9 @@ func (a *App) initAlloc() (services.Service, error) {
 	var err error
 	a.alloc, err = alloc.NewService(
 		a.cfg.AllocConfig,
+		a.clock,
 		a.logger.With("service", alloc.ServiceName),
+		a.reg,
 		a.memberlist,
 	)
 	return a.alloc, err
@@ -289,6 +347,8 @@ func (a *App) initRate() (services.Service, error) {
 		a.cfg.RateConfig,
 		a.clock,
 		a.logger.With("service", rate.ServiceName),
+		a.reg,
+		a.memberlist,
 	)
 	return a.rate, err
 }
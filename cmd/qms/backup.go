@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	backupCommand  = "backup"
+	restoreCommand = "restore"
+
+	defaultAddress = "127.0.0.1:6789"
+)
+
+// runCommand runs the subcommand named by the first argument, if any, and reports whether it did. The subcommands talk
+// to a running node over its HTTP API.
+func runCommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+
+	switch args[0] {
+	case backupCommand:
+		return true, backup(args[1:])
+	case restoreCommand:
+		return true, restore(args[1:])
+	case exportCommand:
+		return true, exportQuotas(args[1:])
+	case importCommand:
+		return true, importQuotas(args[1:])
+	default:
+		return false, nil
+	}
+}
+
+// backup streams a backup of the alloc storage of a node to a file. The backup is written to a temporary file first,
+// so that an interrupted backup does not leave a truncated file behind.
+func backup(args []string) error {
+	fs := flag.NewFlagSet(backupCommand, flag.ExitOnError)
+	address := fs.String("address", defaultAddress, "Address of the HTTP server of the node to back up")
+	file := fs.String("file", "qms.backup", "File to write the backup to")
+	_ = fs.Parse(args)
+
+	res, err := http.Get(fmt.Sprintf("http://%s/api/v1/internal/admin/backup", *address))
+	if err != nil {
+		return fmt.Errorf("failed to get backup: %w", err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if err := responseError(res); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(*file), filepath.Base(*file)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err := io.Copy(tmp, res.Body); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to sync backup: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close backup: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), *file); err != nil {
+		return fmt.Errorf("failed to rename backup: %w", err)
+	}
+
+	return nil
+}
+
+// restore loads a backup from a file into the alloc storage of a node, which must not have any quotas yet.
+func restore(args []string) error {
+	fs := flag.NewFlagSet(restoreCommand, flag.ExitOnError)
+	address := fs.String("address", defaultAddress, "Address of the HTTP server of the node to restore")
+	file := fs.String("file", "qms.backup", "File to read the backup from")
+	_ = fs.Parse(args)
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	res, err := http.Post(fmt.Sprintf("http://%s/api/v1/internal/admin/restore", *address), "application/octet-stream", f)
+	if err != nil {
+		return fmt.Errorf("failed to post backup: %w", err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	return responseError(res)
+}
+
+// responseError returns the error reported by a response, if it does not have the status OK.
+func responseError(res *http.Response) error {
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	msg, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	return fmt.Errorf("unexpected status code %d: %s", res.StatusCode, strings.TrimSpace(string(msg)))
+}
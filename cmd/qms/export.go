@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/export"
+	"github.com/Blinkuu/qms/pkg/dto"
+)
+
+const (
+	exportCommand = "export"
+	importCommand = "import"
+
+	jsonFormat = "json"
+	yamlFormat = "yaml"
+)
+
+// exportQuotas writes the state of the alloc quotas of a node to a file, in JSON or YAML, so that it can be reviewed and
+// imported into a node with another storage backend.
+func exportQuotas(args []string) error {
+	fs := flag.NewFlagSet(exportCommand, flag.ExitOnError)
+	address := fs.String("address", defaultAddress, "Address of the HTTP server of the node to export from")
+	file := fs.String("file", "quotas.yaml", "File to write the quotas to")
+	format := fs.String("format", "", "Format of the file, json or yaml. Defaults to the extension of the file")
+	_ = fs.Parse(args)
+
+	f, err := fileFormat(*file, *format)
+	if err != nil {
+		return err
+	}
+
+	body, err := getExport(*address)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	switch f {
+	case jsonFormat:
+		data, err = json.MarshalIndent(body, "", "  ")
+	default:
+		data, err = yaml.Marshal(body)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to marshal quotas: %w", err)
+	}
+
+	if f == jsonFormat {
+		data = append(data, '\n')
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(*file), filepath.Base(*file)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write quotas: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close quotas: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), *file); err != nil {
+		return fmt.Errorf("failed to rename quotas: %w", err)
+	}
+
+	return nil
+}
+
+// importQuotas writes the state of the alloc quotas in a file written by exportQuotas into a node, overwriting the
+// quotas that exist. A dry run prints what the import would change instead.
+func importQuotas(args []string) error {
+	fs := flag.NewFlagSet(importCommand, flag.ExitOnError)
+	address := fs.String("address", defaultAddress, "Address of the HTTP server of the node to import into")
+	file := fs.String("file", "quotas.yaml", "File to read the quotas from")
+	format := fs.String("format", "", "Format of the file, json or yaml. Defaults to the extension of the file")
+	dryRun := fs.Bool("dry-run", false, "Print the changes the import would make, without making them")
+	_ = fs.Parse(args)
+
+	f, err := fileFormat(*file, *format)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		return fmt.Errorf("failed to read quotas: %w", err)
+	}
+
+	var body dto.ImportRequestBody
+	switch f {
+	case jsonFormat:
+		err = json.Unmarshal(data, &body)
+	default:
+		err = yaml.UnmarshalStrict(data, &body)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal quotas: %w", err)
+	}
+
+	if *dryRun {
+		current, err := getExport(*address)
+		if err != nil {
+			return err
+		}
+
+		changes := export.Diff(exportItems(current.Quotas), exportItems(body.Quotas))
+		if len(changes) == 0 {
+			fmt.Println("no changes")
+		}
+
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+
+		return nil
+	}
+
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal quotas: %w", err)
+	}
+
+	res, err := http.Post(fmt.Sprintf("http://%s/api/v1/internal/admin/import", *address), "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("failed to post quotas: %w", err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if err := responseError(res); err != nil {
+		return err
+	}
+
+	var resBody dto.ResponseBody[dto.ImportResponseBody]
+	if err := json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+		return fmt.Errorf("failed to decode response body: %w", err)
+	}
+
+	if resBody.Status != dto.StatusOK {
+		return fmt.Errorf("unexpected status %d: %s", resBody.Status, resBody.Msg)
+	}
+
+	return nil
+}
+
+// getExport returns the state of the alloc quotas of a node.
+func getExport(address string) (dto.ExportResponseBody, error) {
+	res, err := http.Get(fmt.Sprintf("http://%s/api/v1/internal/admin/export", address))
+	if err != nil {
+		return dto.ExportResponseBody{}, fmt.Errorf("failed to get quotas: %w", err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if err := responseError(res); err != nil {
+		return dto.ExportResponseBody{}, err
+	}
+
+	var body dto.ResponseBody[dto.ExportResponseBody]
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return dto.ExportResponseBody{}, fmt.Errorf("failed to decode response body: %w", err)
+	}
+
+	return body.Result, nil
+}
+
+// fileFormat returns the format of a file, which is taken from its extension unless given.
+func fileFormat(file, format string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".json":
+			format = jsonFormat
+		case ".yaml", ".yml":
+			format = yamlFormat
+		}
+	}
+
+	switch format {
+	case jsonFormat, yamlFormat:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown format %q of %s, expected %s or %s", format, file, jsonFormat, yamlFormat)
+	}
+}
+
+// exportItems returns the items of exported quotas, ordered by export.Sort.
+func exportItems(quotas []dto.ExportedQuota) []export.Item {
+	items := make([]export.Item, 0, len(quotas))
+	for _, q := range quotas {
+		items = append(items, export.NewItemFromDTO(q))
+	}
+
+	export.Sort(items)
+
+	return items
+}
@@ -32,6 +32,15 @@ import (
 )
 
 func main() {
+	if ok, err := runCommand(os.Args[1:]); ok {
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "failed to run %s: %v\n", os.Args[1], err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	logger := log.Must(log.NewZapLogger("qms", "info", []string{"stdout"}))
 	defer func() {
 		err := logger.Close()
@@ -1,19 +1,39 @@
 package domain
 
 type Instance struct {
-	Service    string `json:"service"`
-	Hostname   string `json:"hostname"`
-	Host       string `json:"host"`
-	HTTPPort   int    `json:"http_port"`
-	GossipPort int    `json:"gossip_port"`
+	Service    string       `json:"service"`
+	Hostname   string       `json:"hostname"`
+	Host       string       `json:"host"`
+	HTTPPort   int          `json:"http_port"`
+	GossipPort int          `json:"gossip_port"`
+	Meta       InstanceMeta `json:"meta"`
 }
 
-func NewInstance(service, hostname, host string, httpPort, gossipPort int) Instance {
+func NewInstance(service, hostname, host string, httpPort, gossipPort int, meta InstanceMeta) Instance {
 	return Instance{
 		Service:    service,
 		Hostname:   hostname,
 		Host:       host,
 		HTTPPort:   httpPort,
 		GossipPort: gossipPort,
+		Meta:       meta,
 	}
 }
+
+// InstanceMeta is published by an instance through memberlist. Shards is the number of raft shards of its cluster, and
+// ShardIDs are the shards it hosts a replica of.
+type InstanceMeta struct {
+	Shards   uint64   `json:"shards,omitempty"`
+	ShardIDs []uint64 `json:"shard_ids,omitempty"`
+}
+
+// HostsShard returns true if the instance hosts a replica of the shard.
+func (m InstanceMeta) HostsShard(shardID uint64) bool {
+	for _, id := range m.ShardIDs {
+		if id == shardID {
+			return true
+		}
+	}
+
+	return false
+}
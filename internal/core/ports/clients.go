@@ -5,6 +5,11 @@ import (
 	"time"
 
 	"github.com/Blinkuu/qms/internal/core/domain"
+	allocbatch "github.com/Blinkuu/qms/internal/core/storage/alloc/batch"
+	allochistory "github.com/Blinkuu/qms/internal/core/storage/alloc/history"
+	allocquota "github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+	allocwatch "github.com/Blinkuu/qms/internal/core/storage/alloc/watch"
+	ratequota "github.com/Blinkuu/qms/internal/core/storage/rate/quota"
 )
 
 type MemberlistServiceClient interface {
@@ -12,11 +17,32 @@ type MemberlistServiceClient interface {
 }
 
 type RateServiceClient interface {
-	Allow(ctx context.Context, addrs []string, namespace, resource string, tokens int64) (waitTime time.Duration, ok bool, err error)
+	Allow(ctx context.Context, addrs []string, namespace, resource, key string, tokens int64, maxWait time.Duration) (waitTime time.Duration, ok bool, err error)
+	Reserve(ctx context.Context, addrs []string, namespace, resource, key string, tokens int64, maxWait time.Duration) (reservationID string, readyAt time.Time, ok bool, err error)
+	Cancel(ctx context.Context, addrs []string, namespace, resource, key, reservationID string) (ok bool, err error)
+	Acquire(ctx context.Context, addrs []string, namespace, resource string, tokens int64) (permitID string, ok bool, err error)
+	Release(ctx context.Context, addrs []string, namespace, resource, permitID string) (ok bool, err error)
+
+	// Quota management requests are sent to every address instead of the first available one.
+	CreateRateQuota(ctx context.Context, addrs []string, namespace, resource string, cfg ratequota.Config) error
+	UpdateRateQuota(ctx context.Context, addrs []string, namespace, resource string, cfg ratequota.Config) error
+	DeleteRateQuota(ctx context.Context, addrs []string, namespace, resource string) error
+	ListRateQuotas(ctx context.Context, addrs []string) ([]ratequota.Quota, error)
 }
 
 type AllocServiceClient interface {
 	View(ctx context.Context, addrs []string, namespace, resource string) (allocated, capacity, version int64, err error)
-	Alloc(ctx context.Context, addrs []string, namespace, resource string, tokens, version int64) (remainingTokens, currentVersion int64, ok bool, err error)
-	Free(ctx context.Context, addrs []string, namespace, resource string, tokens, version int64) (remainingTokens, currentVersion int64, ok bool, err error)
+	ViewHolders(ctx context.Context, addrs []string, namespace, resource string) (allocated, capacity, version int64, holders map[string]int64, err error)
+	Alloc(ctx context.Context, addrs []string, namespace, resource, holder string, tokens, version int64, ttl, maxWait time.Duration, idempotencyKey string) (remainingTokens, currentVersion int64, leaseID string, ok, overSoftLimit bool, err error)
+	AllocBatch(ctx context.Context, addrs []string, items []allocbatch.Item) (results []allocbatch.Result, ok bool, err error)
+	Free(ctx context.Context, addrs []string, namespace, resource, holder string, tokens, version int64, leaseID, idempotencyKey string) (remainingTokens, currentVersion int64, ok bool, err error)
+	Renew(ctx context.Context, addrs []string, namespace, resource, leaseID string, ttl time.Duration) (expiresAt time.Time, ok bool, err error)
+	Watch(ctx context.Context, addrs []string, namespace, resource string) (events <-chan allocwatch.Event, err error)
+	History(ctx context.Context, addrs []string, namespace, resource string, from, to time.Time, step time.Duration) (samples []allochistory.Sample, err error)
+
+	// Quota management requests are sent to every address instead of the first available one.
+	CreateAllocQuota(ctx context.Context, addrs []string, namespace, resource string, cfg allocquota.Config) error
+	UpdateAllocQuota(ctx context.Context, addrs []string, namespace, resource string, cfg allocquota.Config) error
+	DeleteAllocQuota(ctx context.Context, addrs []string, namespace, resource string) error
+	ListAllocQuotas(ctx context.Context, addrs []string) ([]allocquota.Quota, error)
 }
@@ -2,11 +2,18 @@ package ports
 
 import (
 	"context"
+	"io"
 	"time"
 
 	"github.com/grafana/dskit/services"
 
 	"github.com/Blinkuu/qms/internal/core/domain"
+	allocbatch "github.com/Blinkuu/qms/internal/core/storage/alloc/batch"
+	allocexport "github.com/Blinkuu/qms/internal/core/storage/alloc/export"
+	allochistory "github.com/Blinkuu/qms/internal/core/storage/alloc/history"
+	allocquota "github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+	allocwatch "github.com/Blinkuu/qms/internal/core/storage/alloc/watch"
+	ratequota "github.com/Blinkuu/qms/internal/core/storage/rate/quota"
 )
 
 type PingService interface {
@@ -17,27 +24,82 @@ type PingService interface {
 type MemberlistService interface {
 	services.NamedService
 	Members(ctx context.Context) ([]domain.Instance, error)
+	Broadcast(channel, key string, payload []byte)
+	Subscribe(channel string, delegate GossipDelegate)
+	UpdateMeta(meta domain.InstanceMeta) error
+}
+
+// GossipDelegate receives application state gossiped between members on a channel.
+type GossipDelegate interface {
+	// NotifyMsg is invoked with a payload broadcast by another member.
+	NotifyMsg(payload []byte)
+
+	// LocalState returns the full state sent to another member during a push/pull sync.
+	LocalState() []byte
+
+	// MergeRemoteState is invoked with the full state of another member received during a push/pull sync.
+	MergeRemoteState(state []byte)
 }
 
 type RateService interface {
 	services.NamedService
-	Allow(ctx context.Context, namespace, resource string, tokens int64) (waitTime time.Duration, ok bool, err error)
+	Allow(ctx context.Context, namespace, resource, key string, tokens int64, maxWait time.Duration) (waitTime time.Duration, ok bool, err error)
+	Reserve(ctx context.Context, namespace, resource, key string, tokens int64, maxWait time.Duration) (reservationID string, readyAt time.Time, ok bool, err error)
+	Cancel(ctx context.Context, namespace, resource, key, reservationID string) (ok bool, err error)
+	Acquire(ctx context.Context, namespace, resource string, tokens int64) (permitID string, ok bool, err error)
+	Release(ctx context.Context, namespace, resource, permitID string) (ok bool, err error)
 }
 
 type AllocService interface {
 	services.NamedService
 	View(ctx context.Context, namespace, resource string) (allocated, capacity, version int64, err error)
-	Alloc(ctx context.Context, namespace, resource string, tokens, version int64) (remainingTokens, currentVersion int64, ok bool, err error)
-	Free(ctx context.Context, namespace, resource string, tokens, version int64) (remainingTokens, currentVersion int64, ok bool, err error)
+	ViewHolders(ctx context.Context, namespace, resource string) (allocated, capacity, version int64, holders map[string]int64, err error)
+	Alloc(ctx context.Context, namespace, resource, holder string, tokens, version int64, ttl, maxWait time.Duration, idempotencyKey string) (remainingTokens, currentVersion int64, leaseID string, ok, overSoftLimit bool, err error)
+	AllocBatch(ctx context.Context, items []allocbatch.Item) (results []allocbatch.Result, ok bool, err error)
+	Free(ctx context.Context, namespace, resource, holder string, tokens, version int64, leaseID, idempotencyKey string) (remainingTokens, currentVersion int64, ok bool, err error)
+	Renew(ctx context.Context, namespace, resource, leaseID string, ttl time.Duration) (expiresAt time.Time, ok bool, err error)
+	Watch(ctx context.Context, namespace, resource string) (events <-chan allocwatch.Event, err error)
+	History(ctx context.Context, namespace, resource string, from, to time.Time, step time.Duration) (samples []allochistory.Sample, err error)
+}
+
+type RateQuotaService interface {
+	CreateRateQuota(ctx context.Context, namespace, resource string, cfg ratequota.Config) error
+	UpdateRateQuota(ctx context.Context, namespace, resource string, cfg ratequota.Config) error
+	DeleteRateQuota(ctx context.Context, namespace, resource string) error
+	ListRateQuotas(ctx context.Context) ([]ratequota.Quota, error)
+}
+
+type AllocQuotaService interface {
+	CreateAllocQuota(ctx context.Context, namespace, resource string, cfg allocquota.Config) error
+	UpdateAllocQuota(ctx context.Context, namespace, resource string, cfg allocquota.Config) error
+	DeleteAllocQuota(ctx context.Context, namespace, resource string) error
+	ListAllocQuotas(ctx context.Context) ([]allocquota.Quota, error)
 }
 
 type ProxyService interface {
 	services.NamedService
 	RateService
 	AllocService
+	RateQuotaService
+	AllocQuotaService
+}
+
+type BackupService interface {
+	Backup(ctx context.Context, w io.Writer) error
+	Restore(ctx context.Context, r io.Reader) error
+}
+
+type ExportService interface {
+	Export(ctx context.Context) (items []allocexport.Item, err error)
+	Import(ctx context.Context, items []allocexport.Item) error
 }
 
 type RaftService interface {
-	Join(ctx context.Context, replicaID uint64, raftAddr string) (alreadyMember bool, err error)
-	Exit(ctx context.Context, replicaID uint64) error
+	Join(ctx context.Context, replicaID uint64, raftAddr string) (added []uint64, members []uint64, err error)
+	Exit(ctx context.Context, replicaID uint64, shardIDs []uint64) error
+}
+
+// RaftShardService invokes the encoded commands forwarded by peers on the raft shards hosted by the instance.
+type RaftShardService interface {
+	InvokeShard(ctx context.Context, shardID uint64, cmd []byte) (result []byte, err error)
 }
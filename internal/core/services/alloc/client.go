@@ -1,17 +1,26 @@
 package alloc
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/go-cleanhttp"
 	"github.com/hashicorp/go-retryablehttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/batch"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/history"
+	allocquota "github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/watch"
+	"github.com/Blinkuu/qms/pkg/caller"
 	"github.com/Blinkuu/qms/pkg/dto"
 	"github.com/Blinkuu/qms/pkg/log"
 )
@@ -28,9 +37,14 @@ type Client struct {
 	client *http.Client
 }
 
+// NewClient returns a client forwarding the caller and the trace of each request, so that the audit log of the instance
+// owning the quota records them.
 func NewClient(logger log.Logger) *Client {
+	httpClient := cleanhttp.DefaultPooledClient()
+	httpClient.Transport = caller.NewTransport(otelhttp.NewTransport(httpClient.Transport))
+
 	client := retryablehttp.Client{
-		HTTPClient:   cleanhttp.DefaultPooledClient(),
+		HTTPClient:   httpClient,
 		Logger:       logger,
 		RetryWaitMin: defaultRetryWaitMin,
 		RetryWaitMax: defaultRetryWaitMax,
@@ -94,18 +108,67 @@ func (c *Client) View(ctx context.Context, addrs []string, namespace, resource s
 	return 0, 0, 0, errors.New("all attempts failed")
 }
 
-func (c *Client) Alloc(ctx context.Context, addrs []string, namespace, resource string, tokens, version int64) (int64, int64, bool, error) {
+func (c *Client) ViewHolders(ctx context.Context, addrs []string, namespace, resource string) (int64, int64, int64, map[string]int64, error) {
+	for _, addr := range addrs {
+		url := fmt.Sprintf("http://%s/api/v1/internal/view/holders", addr)
+		body := dto.ViewRequestBody{Namespace: namespace, Resource: resource}
+		var bodyBuffer bytes.Buffer
+		if err := json.NewEncoder(&bodyBuffer).Encode(body); err != nil {
+			return 0, 0, 0, nil, fmt.Errorf("failed to encode view request body: %w", err)
+		}
+
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &bodyBuffer)
+		if err != nil {
+			return 0, 0, 0, nil, fmt.Errorf("failed to create new request with context: %w", err)
+		}
+
+		res, err := c.client.Do(r)
+		if err != nil {
+			c.logger.Warn("failed to do request", "err", err)
+			continue
+		}
+		defer func() {
+			if err := res.Body.Close(); err != nil {
+				c.logger.Warn("failed to close response body: %w", err)
+			}
+		}()
+
+		if res.StatusCode != http.StatusOK {
+			c.logger.Warn("invalid http status code", "statusCode", res.StatusCode)
+			continue
+		}
+
+		resBody := dto.ResponseBody[dto.ViewHoldersResponseBody]{}
+		if err := json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+			c.logger.Warn("failed to decode response body", "err", err)
+			continue
+		}
+
+		switch resBody.Status {
+		case dto.StatusOK:
+			return resBody.Result.Allocated, resBody.Result.Capacity, resBody.Result.Version, resBody.Result.Holders, nil
+		case dto.StatusAllocNotFound:
+			return 0, 0, 0, nil, ErrNotFound
+		default:
+			return 0, 0, 0, nil, fmt.Errorf("invalid status code: statusCode=%d", resBody.Status)
+		}
+	}
+
+	return 0, 0, 0, nil, errors.New("all attempts failed")
+}
+
+func (c *Client) Alloc(ctx context.Context, addrs []string, namespace, resource, holder string, tokens, version int64, ttl, maxWait time.Duration, idempotencyKey string) (int64, int64, string, bool, bool, error) {
 	for _, addr := range addrs {
 		url := fmt.Sprintf("http://%s/api/v1/internal/alloc", addr)
-		body := dto.AllocRequestBody{Namespace: namespace, Resource: resource, Tokens: tokens, Version: version}
+		body := dto.AllocRequestBody{Namespace: namespace, Resource: resource, Holder: holder, Tokens: tokens, Version: version, TTL: ttl.Nanoseconds(), MaxWait: maxWait.Nanoseconds(), IdempotencyKey: idempotencyKey}
 		var bodyBuffer bytes.Buffer
 		if err := json.NewEncoder(&bodyBuffer).Encode(body); err != nil {
-			return 0, 0, false, fmt.Errorf("failed to encode alloc request body: %w", err)
+			return 0, 0, "", false, false, fmt.Errorf("failed to encode alloc request body: %w", err)
 		}
 
 		r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &bodyBuffer)
 		if err != nil {
-			return 0, 0, false, fmt.Errorf("failed to create new request with context: %w", err)
+			return 0, 0, "", false, false, fmt.Errorf("failed to create new request with context: %w", err)
 		}
 
 		res, err := c.client.Do(r)
@@ -132,23 +195,83 @@ func (c *Client) Alloc(ctx context.Context, addrs []string, namespace, resource
 
 		switch resBody.Status {
 		case dto.StatusOK:
-			return resBody.Result.RemainingTokens, resBody.Result.CurrentVersion, resBody.Result.OK, nil
+			return resBody.Result.RemainingTokens, resBody.Result.CurrentVersion, resBody.Result.LeaseID, resBody.Result.OK, resBody.Result.OverSoftLimit, nil
 		case dto.StatusAllocNotFound:
-			return 0, 0, false, ErrNotFound
+			return 0, 0, "", false, false, ErrNotFound
 		case dto.StatusAllocInvalidVersion:
-			return 0, 0, false, ErrInvalidVersion
+			return 0, 0, "", false, false, ErrInvalidVersion
 		default:
-			return 0, 0, false, fmt.Errorf("invalid status code: statusCode=%d", resBody.Status)
+			return 0, 0, "", false, false, fmt.Errorf("invalid status code: statusCode=%d", resBody.Status)
 		}
 	}
 
-	return 0, 0, false, errors.New("all attempts failed")
+	return 0, 0, "", false, false, errors.New("all attempts failed")
 }
 
-func (c *Client) Free(ctx context.Context, addrs []string, namespace, resource string, tokens, version int64) (int64, int64, bool, error) {
+func (c *Client) AllocBatch(ctx context.Context, addrs []string, items []batch.Item) ([]batch.Result, bool, error) {
+	body := dto.AllocBatchRequestBody{Items: make([]dto.AllocBatchItem, 0, len(items))}
+	for _, item := range items {
+		body.Items = append(body.Items, item.DTO())
+	}
+
+	for _, addr := range addrs {
+		url := fmt.Sprintf("http://%s/api/v1/internal/alloc/batch", addr)
+		var bodyBuffer bytes.Buffer
+		if err := json.NewEncoder(&bodyBuffer).Encode(body); err != nil {
+			return nil, false, fmt.Errorf("failed to encode alloc batch request body: %w", err)
+		}
+
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &bodyBuffer)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to create new request with context: %w", err)
+		}
+
+		res, err := c.client.Do(r)
+		if err != nil {
+			c.logger.Warn("failed to do request", "err", err)
+			continue
+		}
+		defer func() {
+			if err := res.Body.Close(); err != nil {
+				c.logger.Warn("failed to close response body: %w", err)
+			}
+		}()
+
+		if res.StatusCode != http.StatusOK {
+			c.logger.Warn("invalid http status code", "statusCode", res.StatusCode)
+			continue
+		}
+
+		resBody := dto.ResponseBody[dto.AllocBatchResponseBody]{}
+		if err := json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+			c.logger.Warn("failed to decode response body", "err", err)
+			continue
+		}
+
+		switch resBody.Status {
+		case dto.StatusOK:
+			results := make([]batch.Result, 0, len(resBody.Result.Items))
+			for _, result := range resBody.Result.Items {
+				results = append(results, batch.NewResultFromDTO(result))
+			}
+
+			return results, resBody.Result.OK, nil
+		case dto.StatusAllocBatchNotFound:
+			return nil, false, ErrNotFound
+		case dto.StatusAllocBatchInvalidVersion:
+			return nil, false, ErrInvalidVersion
+		default:
+			return nil, false, fmt.Errorf("invalid status code: statusCode=%d", resBody.Status)
+		}
+	}
+
+	return nil, false, errors.New("all attempts failed")
+}
+
+func (c *Client) Free(ctx context.Context, addrs []string, namespace, resource, holder string, tokens, version int64, leaseID, idempotencyKey string) (int64, int64, bool, error) {
 	for _, addr := range addrs {
 		url := fmt.Sprintf("http://%s/api/v1/internal/free", addr)
-		body := dto.FreeRequestBody{Namespace: namespace, Resource: resource, Tokens: tokens, Version: version}
+		body := dto.FreeRequestBody{Namespace: namespace, Resource: resource, Holder: holder, Tokens: tokens, Version: version, LeaseID: leaseID, IdempotencyKey: idempotencyKey}
 		var bodyBuffer bytes.Buffer
 		if err := json.NewEncoder(&bodyBuffer).Encode(body); err != nil {
 			return 0, 0, false, fmt.Errorf("failed to encode free request body: %w", err)
@@ -195,3 +318,326 @@ func (c *Client) Free(ctx context.Context, addrs []string, namespace, resource s
 
 	return 0, 0, false, errors.New("all attempts failed")
 }
+
+func (c *Client) Renew(ctx context.Context, addrs []string, namespace, resource, leaseID string, ttl time.Duration) (time.Time, bool, error) {
+	for _, addr := range addrs {
+		url := fmt.Sprintf("http://%s/api/v1/internal/renew", addr)
+		body := dto.RenewRequestBody{Namespace: namespace, Resource: resource, LeaseID: leaseID, TTL: ttl.Nanoseconds()}
+		var bodyBuffer bytes.Buffer
+		if err := json.NewEncoder(&bodyBuffer).Encode(body); err != nil {
+			return time.Time{}, false, fmt.Errorf("failed to encode renew request body: %w", err)
+		}
+
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &bodyBuffer)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("failed to create new request with context: %w", err)
+		}
+
+		res, err := c.client.Do(r)
+		if err != nil {
+			c.logger.Warn("failed to do request", "err", err)
+			continue
+		}
+		defer func() {
+			if err := res.Body.Close(); err != nil {
+				c.logger.Warn("failed to close response body: %w", err)
+			}
+		}()
+
+		if res.StatusCode != http.StatusOK {
+			c.logger.Warn("invalid http status code", "statusCode", res.StatusCode)
+			continue
+		}
+
+		resBody := dto.ResponseBody[dto.RenewResponseBody]{}
+		if err := json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+			c.logger.Warn("failed to decode response body", "err", err)
+			continue
+		}
+
+		switch resBody.Status {
+		case dto.StatusOK:
+			return resBody.Result.ExpiresAt, resBody.Result.OK, nil
+		case dto.StatusRenewNotFound:
+			return time.Time{}, false, ErrNotFound
+		default:
+			return time.Time{}, false, fmt.Errorf("invalid status code: statusCode=%d", resBody.Status)
+		}
+	}
+
+	return time.Time{}, false, errors.New("all attempts failed")
+}
+
+// Watch streams the changes of a quota from the first instance accepting the request. The returned channel is closed once
+// the stream ends, either because ctx is done or because the instance closed it.
+func (c *Client) Watch(ctx context.Context, addrs []string, namespace, resource string) (<-chan watch.Event, error) {
+	for _, addr := range addrs {
+		url := fmt.Sprintf("http://%s/api/v1/internal/watch", addr)
+		body := dto.ViewRequestBody{Namespace: namespace, Resource: resource}
+		var bodyBuffer bytes.Buffer
+		if err := json.NewEncoder(&bodyBuffer).Encode(body); err != nil {
+			return nil, fmt.Errorf("failed to encode watch request body: %w", err)
+		}
+
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &bodyBuffer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new request with context: %w", err)
+		}
+
+		res, err := c.client.Do(r)
+		if err != nil {
+			c.logger.Warn("failed to do request", "err", err)
+			continue
+		}
+
+		if res.StatusCode != http.StatusOK {
+			c.logger.Warn("invalid http status code", "statusCode", res.StatusCode)
+			c.closeBody(res)
+			continue
+		}
+
+		// Errors are sent as regular response bodies instead of event streams.
+		if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+			resBody := dto.ResponseBody[dto.WatchEvent]{}
+			err := json.NewDecoder(res.Body).Decode(&resBody)
+			c.closeBody(res)
+			if err != nil {
+				c.logger.Warn("failed to decode response body", "err", err)
+				continue
+			}
+
+			switch resBody.Status {
+			case dto.StatusAllocNotFound:
+				return nil, ErrNotFound
+			default:
+				return nil, fmt.Errorf("invalid status code: statusCode=%d", resBody.Status)
+			}
+		}
+
+		events := make(chan watch.Event)
+		go func() {
+			defer close(events)
+			defer c.closeBody(res)
+
+			scanner := bufio.NewScanner(res.Body)
+			for scanner.Scan() {
+				line := scanner.Text()
+				if !strings.HasPrefix(line, "data: ") {
+					continue
+				}
+
+				var e dto.WatchEvent
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+					c.logger.Warn("failed to decode watch event", "err", err)
+					return
+				}
+
+				select {
+				case events <- watch.NewEventFromDTO(e):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		return events, nil
+	}
+
+	return nil, errors.New("all attempts failed")
+}
+
+func (c *Client) History(ctx context.Context, addrs []string, namespace, resource string, from, to time.Time, step time.Duration) ([]history.Sample, error) {
+	query := url.Values{}
+	query.Set("namespace", namespace)
+	query.Set("resource", resource)
+	query.Set("from", from.Format(time.RFC3339Nano))
+	query.Set("to", to.Format(time.RFC3339Nano))
+	query.Set("step", step.String())
+
+	for _, addr := range addrs {
+		endpoint := fmt.Sprintf("http://%s/api/v1/internal/view/history?%s", addr, query.Encode())
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new request with context: %w", err)
+		}
+
+		res, err := c.client.Do(r)
+		if err != nil {
+			c.logger.Warn("failed to do request", "err", err)
+			continue
+		}
+		defer c.closeBody(res)
+
+		if res.StatusCode != http.StatusOK {
+			c.logger.Warn("invalid http status code", "statusCode", res.StatusCode)
+			continue
+		}
+
+		resBody := dto.ResponseBody[dto.HistoryResponseBody]{}
+		if err := json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+			c.logger.Warn("failed to decode response body", "err", err)
+			continue
+		}
+
+		switch resBody.Status {
+		case dto.StatusOK:
+			samples := make([]history.Sample, 0, len(resBody.Result.Samples))
+			for _, sample := range resBody.Result.Samples {
+				samples = append(samples, history.NewSampleFromDTO(sample))
+			}
+
+			return samples, nil
+		case dto.StatusHistoryNotFound:
+			return nil, ErrNotFound
+		case dto.StatusHistoryNotSupported:
+			return nil, ErrNotSupported
+		default:
+			return nil, fmt.Errorf("invalid status code: statusCode=%d", resBody.Status)
+		}
+	}
+
+	return nil, errors.New("all attempts failed")
+}
+
+func (c *Client) closeBody(res *http.Response) {
+	if err := res.Body.Close(); err != nil {
+		c.logger.Warn("failed to close response body: %w", err)
+	}
+}
+
+// CreateAllocQuota registers a quota on every instance. It fails with ErrAlreadyExists only if the quota exists on all of
+// them, so it can be retried after a partial failure.
+func (c *Client) CreateAllocQuota(ctx context.Context, addrs []string, namespace, resource string, cfg allocquota.Config) error {
+	body := dto.QuotaRequestBody{Kind: dto.QuotaKindAlloc, Namespace: namespace, Resource: resource, Strategy: cfg.DTO()}
+
+	return c.broadcastQuota(ctx, addrs, http.MethodPost, body)
+}
+
+func (c *Client) UpdateAllocQuota(ctx context.Context, addrs []string, namespace, resource string, cfg allocquota.Config) error {
+	body := dto.QuotaRequestBody{Kind: dto.QuotaKindAlloc, Namespace: namespace, Resource: resource, Strategy: cfg.DTO()}
+
+	return c.broadcastQuota(ctx, addrs, http.MethodPut, body)
+}
+
+func (c *Client) DeleteAllocQuota(ctx context.Context, addrs []string, namespace, resource string) error {
+	body := dto.DeleteQuotaRequestBody{Kind: dto.QuotaKindAlloc, Namespace: namespace, Resource: resource}
+
+	return c.broadcastQuota(ctx, addrs, http.MethodDelete, body)
+}
+
+// ListAllocQuotas returns the union of the quotas of all instances.
+func (c *Client) ListAllocQuotas(ctx context.Context, addrs []string) ([]allocquota.Quota, error) {
+	var quotas []allocquota.Quota
+	seen := make(map[string]struct{})
+	for _, addr := range addrs {
+		url := fmt.Sprintf("http://%s/api/v1/internal/admin/quotas?kind=%s", addr, dto.QuotaKindAlloc)
+		resBody, err := doQuotaRequest[dto.ListQuotasResponseBody](ctx, c.client, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list quotas on %s: %w", addr, err)
+		}
+
+		if resBody.Status != dto.StatusOK {
+			return nil, quotaStatusError(resBody.Status, resBody.Msg)
+		}
+
+		for _, q := range resBody.Result.Quotas {
+			id := strings.Join([]string{q.Namespace, q.Resource}, "_")
+			if _, found := seen[id]; found {
+				continue
+			}
+
+			seen[id] = struct{}{}
+			quotas = append(quotas, allocquota.Quota{Namespace: q.Namespace, Resource: q.Resource, Strategy: allocquota.NewConfigFromDTO(q.Strategy)})
+		}
+	}
+
+	return quotas, nil
+}
+
+// broadcastQuota sends a quota management request to every instance, since each of them keeps its own copy of the
+// quotas. It succeeds if any instance applied the request, and fails with ErrNotFound or ErrAlreadyExists only if all
+// of them reported it.
+func (c *Client) broadcastQuota(ctx context.Context, addrs []string, method string, body any) error {
+	if len(addrs) == 0 {
+		return errors.New("no instances to send the request to")
+	}
+
+	var (
+		applied  bool
+		statuses = make(map[int]string)
+	)
+	for _, addr := range addrs {
+		url := fmt.Sprintf("http://%s/api/v1/internal/admin/quotas", addr)
+		resBody, err := doQuotaRequest[dto.QuotaResponseBody](ctx, c.client, method, url, body)
+		if err != nil {
+			return fmt.Errorf("failed to send quota request to %s: %w", addr, err)
+		}
+
+		switch resBody.Status {
+		case dto.StatusOK:
+			applied = true
+		case dto.StatusQuotaNotFound, dto.StatusQuotaAlreadyExists:
+			statuses[resBody.Status] = resBody.Msg
+		default:
+			return quotaStatusError(resBody.Status, resBody.Msg)
+		}
+	}
+
+	if applied {
+		return nil
+	}
+
+	for status, msg := range statuses {
+		return quotaStatusError(status, msg)
+	}
+
+	return nil
+}
+
+func doQuotaRequest[T any](ctx context.Context, client *http.Client, method, url string, body any) (dto.ResponseBody[T], error) {
+	var bodyBuffer bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&bodyBuffer).Encode(body); err != nil {
+			return dto.ResponseBody[T]{}, fmt.Errorf("failed to encode quota request body: %w", err)
+		}
+	}
+
+	r, err := http.NewRequestWithContext(ctx, method, url, &bodyBuffer)
+	if err != nil {
+		return dto.ResponseBody[T]{}, fmt.Errorf("failed to create new request with context: %w", err)
+	}
+
+	res, err := client.Do(r)
+	if err != nil {
+		return dto.ResponseBody[T]{}, fmt.Errorf("failed to do request: %w", err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		return dto.ResponseBody[T]{}, fmt.Errorf("invalid http status code: statusCode=%d", res.StatusCode)
+	}
+
+	resBody := dto.ResponseBody[T]{}
+	if err := json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+		return dto.ResponseBody[T]{}, fmt.Errorf("failed to decode response body: %w", err)
+	}
+
+	return resBody, nil
+}
+
+func quotaStatusError(status int, msg string) error {
+	switch status {
+	case dto.StatusQuotaNotFound:
+		return ErrNotFound
+	case dto.StatusQuotaAlreadyExists:
+		return ErrAlreadyExists
+	case dto.StatusQuotaCapacityBelowAllocated:
+		return ErrCapacityBelowAllocated
+	case dto.StatusQuotaInvalid:
+		return fmt.Errorf("%s: %w", msg, ErrInvalidQuota)
+	default:
+		return fmt.Errorf("invalid status code: statusCode=%d", status)
+	}
+}
@@ -2,18 +2,28 @@ package alloc
 
 import (
 	"flag"
+	"time"
 
 	"github.com/Blinkuu/qms/internal/core/storage/alloc"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/audit"
 	"github.com/Blinkuu/qms/pkg/strutil"
 )
 
 type Config struct {
-	Quotas  quotaList    `yaml:"quotas"`
-	Storage alloc.Config `yaml:"storage"`
+	Quotas                quotaList     `yaml:"quotas"`
+	LeaseExpiryInterval   time.Duration `yaml:"lease_expiry_interval"`
+	PeriodResetInterval   time.Duration `yaml:"period_reset_interval"`
+	HistorySampleInterval time.Duration `yaml:"history_sample_interval"`
+	Storage               alloc.Config  `yaml:"storage"`
+	Audit                 audit.Config  `yaml:"audit"`
 }
 
 func (c *Config) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix string) {
 	f.Var(&c.Quotas, strutil.WithPrefixOrDefault(prefix, "quotas"), "")
+	f.DurationVar(&c.LeaseExpiryInterval, strutil.WithPrefixOrDefault(prefix, "lease_expiry_interval"), time.Second, "")
+	f.DurationVar(&c.PeriodResetInterval, strutil.WithPrefixOrDefault(prefix, "period_reset_interval"), time.Second, "")
+	f.DurationVar(&c.HistorySampleInterval, strutil.WithPrefixOrDefault(prefix, "history_sample_interval"), 10*time.Second, "")
 
 	c.Storage.RegisterFlagsWithPrefix(f, strutil.WithPrefixOrDefault(prefix, "storage"))
+	c.Audit.RegisterFlagsWithPrefix(f, strutil.WithPrefixOrDefault(prefix, "audit"))
 }
@@ -7,4 +7,10 @@ import (
 var (
 	ErrNotFound       = errors.New("not found")
 	ErrInvalidVersion = errors.New("invalid version")
+	ErrNotSupported   = errors.New("not supported")
+
+	ErrAlreadyExists          = errors.New("already exists")
+	ErrInvalidQuota           = errors.New("invalid quota")
+	ErrCapacityBelowAllocated = errors.New("capacity below allocated tokens")
+	ErrInvalidBackup          = errors.New("invalid backup")
 )
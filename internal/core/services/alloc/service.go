@@ -4,43 +4,90 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	"github.com/Blinkuu/qms/internal/core/ports"
 	"github.com/Blinkuu/qms/internal/core/storage"
 	"github.com/Blinkuu/qms/internal/core/storage/alloc"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/audit"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/batch"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/export"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/history"
 	"github.com/Blinkuu/qms/internal/core/storage/alloc/local"
 	"github.com/Blinkuu/qms/internal/core/storage/alloc/memory"
+	allocquota "github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
 	"github.com/Blinkuu/qms/internal/core/storage/alloc/raft"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/watch"
+	"github.com/Blinkuu/qms/pkg/caller"
 	"github.com/Blinkuu/qms/pkg/log"
 )
 
 const (
 	ServiceName = "alloc"
+
+	// waitRetryInterval is how often the head of a wait queue retries its alloc even if the quota does not change, which
+	// happens if the tokens are held back by an ancestor.
+	waitRetryInterval = 100 * time.Millisecond
+
+	// configCaller is the caller recorded in the audit log for the quotas of the configuration file.
+	configCaller = "config"
 )
 
 type Service struct {
 	services.NamedService
 	cfg        Config
+	clock      clock.Clock
 	logger     log.Logger
 	memberlist ports.MemberlistService
 	storage    alloc.Storage
+	audit      *audit.Log
+	waits      *waitQueues
+
+	overSoftLimit  *prometheus.CounterVec
+	waitQueueDepth *prometheus.GaugeVec
 }
 
-func NewService(cfg Config, logger log.Logger, memberlist ports.MemberlistService) (*Service, error) {
-	st, err := newStorageFromConfig(cfg, logger, memberlist)
+func NewService(cfg Config, clock clock.Clock, logger log.Logger, reg prometheus.Registerer, memberlist ports.MemberlistService) (*Service, error) {
+	auditLog, err := audit.NewLogFromConfig(cfg.Audit, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create audit log from config: %w", err)
+	}
+
+	st, err := newStorageFromConfig(cfg, clock, logger, memberlist, auditLog)
 	if err != nil {
+		_ = auditLog.Close()
 		return nil, fmt.Errorf("failed to create storage from config: %w", err)
 	}
 
 	s := &Service{
 		NamedService: nil,
 		cfg:          cfg,
+		clock:        clock,
 		logger:       logger,
 		memberlist:   memberlist,
 		storage:      st,
+		audit:        auditLog,
+		waits:        newWaitQueues(),
+		overSoftLimit: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name:      "alloc_over_soft_limit_total",
+			Namespace: "default",
+			Subsystem: "qms",
+			Help:      "The total number of allocations that left a quota over its soft limit",
+		}, []string{"namespace", "resource"}),
+		waitQueueDepth: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name:      "alloc_wait_queue_depth",
+			Namespace: "default",
+			Subsystem: "qms",
+			Help:      "The number of allocations waiting for tokens of a quota",
+		}, []string{"namespace", "resource"}),
 	}
 
 	s.NamedService = services.NewBasicService(s.start, s.run, s.stop).WithName(ServiceName)
@@ -63,25 +110,175 @@ func (s *Service) View(ctx context.Context, namespace, resource string) (int64,
 	return allocated, capacity, version, nil
 }
 
-func (s *Service) Alloc(ctx context.Context, namespace, resource string, tokens, version int64) (int64, int64, bool, error) {
-	remainingTokens, currentVersion, ok, err := s.storage.Alloc(ctx, namespace, resource, tokens, version)
+// ViewHolders returns the state of a quota along with the tokens allocated by each holder.
+func (s *Service) ViewHolders(ctx context.Context, namespace, resource string) (int64, int64, int64, map[string]int64, error) {
+	allocated, capacity, version, holders, err := s.storage.ViewHolders(ctx, namespace, resource)
 	if err != nil {
 		switch {
 		case errors.Is(err, storage.ErrNotFound):
-			return 0, 0, false, ErrNotFound
+			return 0, 0, 0, nil, ErrNotFound
+		default:
+		}
+
+		return 0, 0, 0, nil, fmt.Errorf("failed to view: %w", err)
+	}
+
+	return allocated, capacity, version, holders, nil
+}
+
+// Alloc allocates tokens from a quota on behalf of the holder, if any. With a positive ttl the tokens are leased, and
+// the returned lease has to be renewed before it expires, or its tokens are freed. A successful alloc with an
+// idempotency key is remembered for the idempotency window, and retries with the same key return its original result.
+// Allocations leaving the quota over its soft limit succeed, but are flagged and counted. With a positive maxWait an
+// alloc lacking tokens waits for them, in a FIFO queue per quota, for up to maxWait. While allocs are waiting, the ones
+// arriving later join the queue, or fail right away if they do not wait, so that the queued ones are not starved. The
+// queues are kept by each service, so allocs are only ordered against the ones sent to the same instance. Allocs asking
+// for more tokens than the limit of the quota never wait, since no free would make room for them.
+func (s *Service) Alloc(ctx context.Context, namespace, resource, holder string, tokens, version int64, ttl, maxWait time.Duration, idempotencyKey string) (int64, int64, string, bool, bool, error) {
+	id := strings.Join([]string{namespace, resource}, "_")
+	if s.waits.len(id) > 0 {
+		if maxWait <= 0 {
+			return s.queued(ctx, namespace, resource, version)
+		}
+
+		return s.waitAlloc(ctx, namespace, resource, holder, tokens, version, ttl, maxWait, idempotencyKey)
+	}
+
+	remainingTokens, currentVersion, leaseID, ok, overSoftLimit, err := s.alloc(ctx, namespace, resource, holder, tokens, version, ttl, idempotencyKey)
+	if err != nil || ok || maxWait <= 0 || s.neverFits(ctx, namespace, resource, tokens, remainingTokens, currentVersion) {
+		return remainingTokens, currentVersion, leaseID, ok, overSoftLimit, err
+	}
+
+	return s.waitAlloc(ctx, namespace, resource, holder, tokens, version, ttl, maxWait, idempotencyKey)
+}
+
+// waitAlloc queues an alloc until it reaches the head of the queue of the quota, and then retries it whenever the quota
+// changes, until it succeeds or maxWait passes.
+func (s *Service) waitAlloc(ctx context.Context, namespace, resource, holder string, tokens, version int64, ttl, maxWait time.Duration, idempotencyKey string) (int64, int64, string, bool, bool, error) {
+	waitCtx, cancel := s.clock.WithTimeout(ctx, maxWait)
+	defer cancel()
+
+	events, err := s.storage.Watch(waitCtx, namespace, resource)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			return 0, 0, "", false, false, ErrNotFound
+		default:
+		}
+
+		return 0, 0, "", false, false, fmt.Errorf("failed to watch: %w", err)
+	}
+
+	id := strings.Join([]string{namespace, resource}, "_")
+	w, depth := s.waits.enqueue(id)
+	s.waitQueueDepth.WithLabelValues(namespace, resource).Set(float64(depth))
+	defer func() {
+		s.waitQueueDepth.WithLabelValues(namespace, resource).Set(float64(s.waits.remove(id, w)))
+	}()
+
+	select {
+	case <-w.turn:
+	case <-waitCtx.Done():
+		return s.queued(ctx, namespace, resource, version)
+	}
+
+	ticker := s.clock.Ticker(waitRetryInterval)
+	defer ticker.Stop()
+
+	for attempt := 0; ; attempt++ {
+		// The attempts use ctx, so that one in flight is not failed by maxWait passing.
+		remainingTokens, currentVersion, leaseID, ok, overSoftLimit, err := s.alloc(ctx, namespace, resource, holder, tokens, version, ttl, idempotencyKey)
+		if err != nil || ok {
+			return remainingTokens, currentVersion, leaseID, ok, overSoftLimit, err
+		}
+
+		// Allocs queued behind others have not been checked before, and must not hold the head until maxWait passes.
+		if attempt == 0 && s.neverFits(ctx, namespace, resource, tokens, remainingTokens, currentVersion) {
+			return remainingTokens, currentVersion, "", false, false, nil
+		}
+
+		select {
+		case _, open := <-events:
+			if !open {
+				return remainingTokens, currentVersion, "", false, false, nil
+			}
+		case <-ticker.C:
+		case <-waitCtx.Done():
+			return remainingTokens, currentVersion, "", false, false, nil
+		}
+	}
+}
+
+// neverFits reports whether an alloc that failed with remainingTokens at currentVersion asks for more tokens than the
+// limit of the quota. The limit is only known if the quota has not changed since, and is assumed to fit otherwise.
+func (s *Service) neverFits(ctx context.Context, namespace, resource string, tokens, remainingTokens, currentVersion int64) bool {
+	allocated, _, version, err := s.storage.View(ctx, namespace, resource)
+	if err != nil || version != currentVersion {
+		return false
+	}
+
+	return tokens > remainingTokens+allocated
+}
+
+// queued fails an alloc held back by the allocs waiting for the quota. No tokens are reported as remaining, since the
+// waiting allocs take precedence.
+func (s *Service) queued(ctx context.Context, namespace, resource string, version int64) (int64, int64, string, bool, bool, error) {
+	_, _, currentVersion, err := s.View(ctx, namespace, resource)
+	if err != nil {
+		return 0, 0, "", false, false, err
+	}
+
+	if version != 0 && currentVersion != version {
+		return 0, 0, "", false, false, ErrInvalidVersion
+	}
+
+	return 0, currentVersion, "", false, false, nil
+}
+
+func (s *Service) alloc(ctx context.Context, namespace, resource, holder string, tokens, version int64, ttl time.Duration, idempotencyKey string) (int64, int64, string, bool, bool, error) {
+	remainingTokens, currentVersion, leaseID, ok, overSoftLimit, err := s.storage.Alloc(ctx, namespace, resource, holder, tokens, version, ttl, idempotencyKey)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			return 0, 0, "", false, false, ErrNotFound
 		case errors.Is(err, storage.ErrInvalidVersion):
-			return 0, 0, false, ErrInvalidVersion
+			return 0, 0, "", false, false, ErrInvalidVersion
 		default:
 		}
 
-		return 0, 0, false, fmt.Errorf("failed to alloc: %w", err)
+		return 0, 0, "", false, false, fmt.Errorf("failed to alloc: %w", err)
 	}
 
-	return remainingTokens, currentVersion, ok, nil
+	if overSoftLimit {
+		s.overSoftLimit.WithLabelValues(namespace, resource).Inc()
+	}
+
+	return remainingTokens, currentVersion, leaseID, ok, overSoftLimit, nil
+}
+
+// AllocBatch allocates tokens from several quotas all-or-nothing. Returns false, and allocates nothing, if any of the
+// quotas lacks tokens.
+func (s *Service) AllocBatch(ctx context.Context, items []batch.Item) ([]batch.Result, bool, error) {
+	results, ok, err := s.storage.AllocBatch(ctx, items)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			return nil, false, ErrNotFound
+		case errors.Is(err, storage.ErrInvalidVersion):
+			return nil, false, ErrInvalidVersion
+		default:
+		}
+
+		return nil, false, fmt.Errorf("failed to alloc batch: %w", err)
+	}
+
+	return results, ok, nil
 }
 
-func (s *Service) Free(ctx context.Context, namespace, resource string, tokens, version int64) (int64, int64, bool, error) {
-	remainingTokens, currentVersion, ok, err := s.storage.Free(ctx, namespace, resource, tokens, version)
+// Free frees tokens of a quota. A holder can only free the tokens it owns, and without a holder only unowned tokens can
+// be freed. With a lease ID the tokens of the lease are freed, and tokens is ignored. Idempotency keys work as in Alloc.
+func (s *Service) Free(ctx context.Context, namespace, resource, holder string, tokens, version int64, leaseID, idempotencyKey string) (int64, int64, bool, error) {
+	remainingTokens, currentVersion, ok, err := s.storage.Free(ctx, namespace, resource, holder, tokens, version, leaseID, idempotencyKey)
 	if err != nil {
 		switch {
 		case errors.Is(err, storage.ErrNotFound):
@@ -97,22 +294,196 @@ func (s *Service) Free(ctx context.Context, namespace, resource string, tokens,
 	return remainingTokens, currentVersion, ok, nil
 }
 
-func (s *Service) Join(ctx context.Context, replicaID uint64, raftAddr string) (bool, error) {
+// Renew extends a lease to ttl from now. Returns false if the lease is unknown or has already expired.
+func (s *Service) Renew(ctx context.Context, namespace, resource, leaseID string, ttl time.Duration) (time.Time, bool, error) {
+	expiresAt, ok, err := s.storage.Renew(ctx, namespace, resource, leaseID, ttl)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			return time.Time{}, false, ErrNotFound
+		default:
+		}
+
+		return time.Time{}, false, fmt.Errorf("failed to renew: %w", err)
+	}
+
+	return expiresAt, ok, nil
+}
+
+// Watch returns the changes of a quota, starting with its current state, until ctx is done.
+func (s *Service) Watch(ctx context.Context, namespace, resource string) (<-chan watch.Event, error) {
+	events, err := s.storage.Watch(ctx, namespace, resource)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			return nil, ErrNotFound
+		default:
+		}
+
+		return nil, fmt.Errorf("failed to watch: %w", err)
+	}
+
+	return events, nil
+}
+
+// History returns the usage of a quota in the windows of its history starting between from and to, downsampled to
+// step. Only the local and raft backends keep the history.
+func (s *Service) History(ctx context.Context, namespace, resource string, from, to time.Time, step time.Duration) ([]history.Sample, error) {
+	samples, err := s.storage.History(ctx, namespace, resource, from, to, step)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			return nil, ErrNotFound
+		case errors.Is(err, storage.ErrNotSupported):
+			return nil, ErrNotSupported
+		default:
+		}
+
+		return nil, fmt.Errorf("failed to get history: %w", err)
+	}
+
+	return samples, nil
+}
+
+// Backup writes a consistent snapshot of the storage to w. With the raft backend every shard is backed up.
+func (s *Service) Backup(ctx context.Context, w io.Writer) error {
+	if err := s.storage.Backup(ctx, w); err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotSupported):
+			return ErrNotSupported
+		default:
+		}
+
+		return fmt.Errorf("failed to backup: %w", err)
+	}
+
+	return nil
+}
+
+// Restore loads a backup written by Backup into the storage, which must not have any quotas yet.
+func (s *Service) Restore(ctx context.Context, r io.Reader) error {
+	if err := s.storage.Restore(ctx, r); err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotSupported):
+			return ErrNotSupported
+		case errors.Is(err, storage.ErrAlreadyExists):
+			return ErrAlreadyExists
+		case errors.Is(err, storage.ErrInvalidConfig):
+			return fmt.Errorf("%s: %w", err, ErrInvalidBackup)
+		default:
+		}
+
+		return fmt.Errorf("failed to restore: %w", err)
+	}
+
+	return nil
+}
+
+// Export returns the state of all quotas, so that they can be imported into a storage of another backend.
+func (s *Service) Export(ctx context.Context) ([]export.Item, error) {
+	items, err := s.storage.Export(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export: %w", err)
+	}
+
+	return items, nil
+}
+
+// Import writes the state of exported quotas into the storage, overwriting the quotas that exist. Items are sorted
+// first, so that parents are imported before their children.
+func (s *Service) Import(ctx context.Context, items []export.Item) error {
+	export.Sort(items)
+	if err := s.storage.Import(ctx, items); err != nil {
+		return fmt.Errorf("failed to import: %w", quotaError(err))
+	}
+
+	return nil
+}
+
+func (s *Service) CreateAllocQuota(ctx context.Context, namespace, resource string, cfg allocquota.Config) error {
+	if err := s.storage.RegisterQuota(ctx, namespace, resource, cfg); err != nil {
+		return fmt.Errorf("failed to register quota: %w", quotaError(err))
+	}
+
+	return nil
+}
+
+// UpdateAllocQuota changes the capacity of a quota. The shrink policy of cfg decides what happens to the allocated tokens
+// if the capacity is set below them.
+func (s *Service) UpdateAllocQuota(ctx context.Context, namespace, resource string, cfg allocquota.Config) error {
+	if err := s.storage.UpdateQuota(ctx, namespace, resource, cfg); err != nil {
+		return fmt.Errorf("failed to update quota: %w", quotaError(err))
+	}
+
+	return nil
+}
+
+func (s *Service) DeleteAllocQuota(ctx context.Context, namespace, resource string) error {
+	if err := s.storage.DeleteQuota(ctx, namespace, resource); err != nil {
+		return fmt.Errorf("failed to delete quota: %w", quotaError(err))
+	}
+
+	return nil
+}
+
+func (s *Service) ListAllocQuotas(ctx context.Context) ([]allocquota.Quota, error) {
+	quotas, err := s.storage.ListQuotas(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list quotas: %w", quotaError(err))
+	}
+
+	sort.Slice(quotas, func(i, j int) bool {
+		if quotas[i].Namespace != quotas[j].Namespace {
+			return quotas[i].Namespace < quotas[j].Namespace
+		}
+
+		return quotas[i].Resource < quotas[j].Resource
+	})
+
+	return quotas, nil
+}
+
+func (s *Service) Join(ctx context.Context, replicaID uint64, raftAddr string) ([]uint64, []uint64, error) {
 	raftStorage, ok := s.storage.(*raft.Storage)
 	if !ok {
-		return false, errors.New("underlying storage is not a raft storage")
+		return nil, nil, errors.New("underlying storage is not a raft storage")
 	}
 
 	return raftStorage.AddRaftReplica(ctx, replicaID, raftAddr)
 }
 
-func (s *Service) Exit(ctx context.Context, replicaID uint64) error {
+func (s *Service) Exit(ctx context.Context, replicaID uint64, shardIDs []uint64) error {
 	raftStorage, ok := s.storage.(*raft.Storage)
 	if !ok {
 		return errors.New("underlying storage is not a raft storage")
 	}
 
-	return raftStorage.RemoveRaftReplica(ctx, replicaID)
+	return raftStorage.RemoveRaftReplica(ctx, replicaID, shardIDs)
+}
+
+func (s *Service) InvokeShard(ctx context.Context, shardID uint64, cmd []byte) ([]byte, error) {
+	raftStorage, ok := s.storage.(*raft.Storage)
+	if !ok {
+		return nil, errors.New("underlying storage is not a raft storage")
+	}
+
+	return raftStorage.InvokeShard(ctx, shardID, cmd)
+}
+
+// quotaError maps errors of quota management in storage to errors of the service.
+func quotaError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return ErrNotFound
+	case errors.Is(err, storage.ErrAlreadyExists):
+		return ErrAlreadyExists
+	case errors.Is(err, storage.ErrCapacityBelowAllocated):
+		return ErrCapacityBelowAllocated
+	case errors.Is(err, storage.ErrInvalidConfig):
+		return fmt.Errorf("%s: %w", err, ErrInvalidQuota)
+	default:
+		return err
+	}
 }
 
 func (s *Service) start(_ context.Context) error {
@@ -124,9 +495,45 @@ func (s *Service) start(_ context.Context) error {
 func (s *Service) run(ctx context.Context) error {
 	s.logger.Info("running alloc service")
 
-	<-ctx.Done()
+	ticker := s.clock.Ticker(s.cfg.LeaseExpiryInterval)
+	defer ticker.Stop()
 
-	return nil
+	periodTicker := s.clock.Ticker(s.cfg.PeriodResetInterval)
+	defer periodTicker.Stop()
+
+	historyTicker := s.clock.Ticker(s.cfg.HistorySampleInterval)
+	defer historyTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			expired, err := s.storage.ExpireLeases(ctx)
+			if err != nil {
+				s.logger.Warn("failed to expire leases", "err", err)
+				continue
+			}
+
+			if expired > 0 {
+				s.logger.Debug("expired leases", "count", expired)
+			}
+		case <-periodTicker.C:
+			reset, err := s.storage.ResetPeriods(ctx)
+			if err != nil {
+				s.logger.Warn("failed to reset periods", "err", err)
+				continue
+			}
+
+			if reset > 0 {
+				s.logger.Debug("reset periods", "count", reset)
+			}
+		case <-historyTicker.C:
+			if _, err := s.storage.RecordHistory(ctx); err != nil {
+				s.logger.Warn("failed to record history", "err", err)
+			}
+		}
+	}
 }
 
 func (s *Service) stop(err error) error {
@@ -136,33 +543,32 @@ func (s *Service) stop(err error) error {
 		s.logger.Error("alloc service returned error from running state", "err", err)
 	}
 
-	return s.storage.Shutdown(context.TODO())
+	shutdownErr := s.storage.Shutdown(context.TODO())
+	if err := s.audit.Close(); err != nil {
+		s.logger.Warn("failed to close audit log", "err", err)
+	}
+
+	return shutdownErr
 }
 
-func newStorageFromConfig(cfg Config, logger log.Logger, memberlist ports.MemberlistService) (alloc.Storage, error) {
+func newStorageFromConfig(cfg Config, clock clock.Clock, logger log.Logger, memberlist ports.MemberlistService, auditLog *audit.Log) (alloc.Storage, error) {
 	var st alloc.Storage
 
 	switch cfg.Storage.Backend {
 	case alloc.Memory:
-		st = memory.NewStorage()
+		st = memory.NewStorage(clock, cfg.Storage.IdempotencyWindow, auditLog)
 	case alloc.Local:
 		var err error
-		st, err = local.NewStorage(cfg.Storage.Local, logger)
+		st, err = local.NewStorage(cfg.Storage.Local, clock, cfg.Storage.IdempotencyWindow, logger, auditLog)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create new local storage: %w", err)
 		}
 	case alloc.Raft:
-		raftStorage, err := raft.NewStorage(cfg.Storage.Raft, logger, memberlist)
+		raftStorage, err := raft.NewStorage(cfg.Storage.Raft, clock, cfg.Storage.IdempotencyWindow, logger, memberlist, auditLog)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create new raft storage: %w", err)
 		}
 
-		go func() {
-			if err := raftStorage.Run(context.Background()); err != nil {
-				logger.Panic("failed to run raft storage", "err", err)
-			}
-		}()
-
 		if err := raftStorage.AwaitHealthy(context.Background()); err != nil {
 			return nil, fmt.Errorf("failed to await healthy for raft storage: %w", err)
 		}
@@ -174,8 +580,21 @@ func newStorageFromConfig(cfg Config, logger log.Logger, memberlist ports.Member
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+
+	ctx = caller.NewContext(ctx, configCaller)
 	for _, quota := range cfg.Quotas {
+		// Every instance has the same configuration, so a raft replica only registers the quotas of the shards it hosts,
+		// leaving the others to the replicas hosting them.
+		if raftStorage, ok := st.(*raft.Storage); ok && !raftStorage.HostsQuota(quota.Namespace, quota.Resource) {
+			continue
+		}
+
 		err := st.RegisterQuota(ctx, quota.Namespace, quota.Resource, quota.Strategy)
+		if errors.Is(err, storage.ErrAlreadyExists) {
+			// The quota was persisted before the restart, so the configuration may have changed since.
+			err = st.UpdateQuota(ctx, quota.Namespace, quota.Resource, quota.Strategy)
+		}
+
 		if err != nil {
 			logger.Warn("failed to register quota", "err", err)
 		}
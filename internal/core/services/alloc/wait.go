@@ -0,0 +1,77 @@
+package alloc
+
+import (
+	"sync"
+)
+
+// waitQueues holds the allocs waiting for tokens, in their arrival order, per quota. Only the head of a queue may
+// allocate, so a waiting alloc is not starved by smaller ones arriving later.
+type waitQueues struct {
+	queues map[string][]*waiter
+	mu     *sync.Mutex
+}
+
+// waiter is an alloc waiting for tokens. Its turn channel is closed once it reaches the head of its queue.
+type waiter struct {
+	turn chan struct{}
+}
+
+func newWaitQueues() *waitQueues {
+	return &waitQueues{
+		queues: make(map[string][]*waiter),
+		mu:     &sync.Mutex{},
+	}
+}
+
+// enqueue appends a waiter to the queue of a quota, and returns it along with the depth of the queue.
+func (q *waitQueues) enqueue(id string) (*waiter, int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	w := &waiter{turn: make(chan struct{})}
+	if len(q.queues[id]) == 0 {
+		close(w.turn)
+	}
+
+	q.queues[id] = append(q.queues[id], w)
+
+	return w, len(q.queues[id])
+}
+
+// remove takes a waiter off the queue of a quota, handing the turn to the next one if it was the head, and returns the
+// depth of the queue.
+func (q *waitQueues) remove(id string, w *waiter) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queue := q.queues[id]
+	for i := range queue {
+		if queue[i] != w {
+			continue
+		}
+
+		queue = append(queue[:i], queue[i+1:]...)
+		if i == 0 && len(queue) > 0 {
+			close(queue[0].turn)
+		}
+
+		break
+	}
+
+	if len(queue) == 0 {
+		delete(q.queues, id)
+		return 0
+	}
+
+	q.queues[id] = queue
+
+	return len(queue)
+}
+
+// len returns the depth of the queue of a quota.
+func (q *waitQueues) len(id string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.queues[id])
+}
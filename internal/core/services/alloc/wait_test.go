@@ -0,0 +1,100 @@
+package alloc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Blinkuu/qms/internal/core/storage/alloc"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/audit"
+	allocquota "github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+	"github.com/Blinkuu/qms/pkg/log"
+)
+
+func TestWaitQueues_Remove_HandsTurnToNextWaiterInArrivalOrder(t *testing.T) {
+	// Given
+	q := newWaitQueues()
+	first, _ := q.enqueue("namespace_resource")
+	second, _ := q.enqueue("namespace_resource")
+	third, depth := q.enqueue("namespace_resource")
+
+	// When
+	depthAfterThird := q.remove("namespace_resource", third)
+	depthAfterFirst := q.remove("namespace_resource", first)
+
+	// Then
+	assert.Equal(t, 3, depth)
+	assert.Equal(t, 2, depthAfterThird)
+	assert.Equal(t, 1, depthAfterFirst)
+	assert.Equal(t, 1, q.len("namespace_resource"))
+	select {
+	case <-second.turn:
+	default:
+		assert.Fail(t, "second waiter does not have the turn")
+	}
+}
+
+func TestService_Alloc_WaitsForFreedTokensAndHoldsBackLaterAllocs(t *testing.T) {
+	// Given
+	cfg := Config{
+		Quotas:  quotaList{{Namespace: "namespace", Resource: "resource", Strategy: allocquota.Config{Capacity: 10}}},
+		Storage: alloc.Config{Backend: alloc.Memory, IdempotencyWindow: time.Minute},
+		Audit:   audit.Config{Sink: audit.None},
+	}
+	s, err := NewService(cfg, clock.New(), log.NewNoopLogger(), prometheus.NewRegistry(), nil)
+	require.NoError(t, err)
+	_, _, _, ok, _, err := s.Alloc(context.Background(), "namespace", "resource", "", 10, 0, 0, 0, "")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// When
+	waited := make(chan bool)
+	go func() {
+		_, _, _, ok, _, _ := s.Alloc(context.Background(), "namespace", "resource", "", 5, 0, 0, 5*time.Second, "")
+		waited <- ok
+	}()
+	assert.Eventually(t, func() bool { return s.waits.len("namespace_resource") == 1 }, time.Second, time.Millisecond)
+	_, _, ok, freeErr := s.Free(context.Background(), "namespace", "resource", "", 1, 0, "", "")
+	remainingTokens, _, _, heldBack, _, allocErr := s.Alloc(context.Background(), "namespace", "resource", "", 1, 0, 0, 0, "")
+	_, _, _, freeAllErr := s.Free(context.Background(), "namespace", "resource", "", 9, 0, "", "")
+
+	// Then
+	assert.NoError(t, freeErr)
+	assert.True(t, ok)
+	assert.NoError(t, allocErr)
+	assert.False(t, heldBack)
+	assert.EqualValues(t, 0, remainingTokens)
+	assert.NoError(t, freeAllErr)
+	assert.True(t, <-waited)
+	assert.Equal(t, 0, s.waits.len("namespace_resource"))
+}
+
+func TestService_Alloc_DoesNotWaitForMoreTokensThanTheLimit(t *testing.T) {
+	// Given
+	cfg := Config{
+		Quotas:  quotaList{{Namespace: "namespace", Resource: "resource", Strategy: allocquota.Config{Capacity: 10}}},
+		Storage: alloc.Config{Backend: alloc.Memory, IdempotencyWindow: time.Minute},
+		Audit:   audit.Config{Sink: audit.None},
+	}
+	s, err := NewService(cfg, clock.New(), log.NewNoopLogger(), prometheus.NewRegistry(), nil)
+	require.NoError(t, err)
+	_, _, _, ok, _, err := s.Alloc(context.Background(), "namespace", "resource", "", 4, 0, 0, 0, "")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// When
+	start := time.Now()
+	remainingTokens, _, _, ok, _, err := s.Alloc(context.Background(), "namespace", "resource", "", 11, 0, 0, time.Minute, "")
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.EqualValues(t, 6, remainingTokens)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, 0, s.waits.len("namespace_resource"))
+}
@@ -19,6 +19,7 @@ type Config struct {
 	MaxJoinBackoff   time.Duration       `yaml:"max_join_backoff"`
 	MaxJoinRetries   int                 `yaml:"max_join_retries"`
 	LeaveTimeout     time.Duration       `yaml:"leave_timeout"`
+	UpdateTimeout    time.Duration       `yaml:"update_timeout"`
 	JoinAddresses    flagext.StringSlice `yaml:"join_addresses"`
 }
 
@@ -32,5 +33,6 @@ func (c *Config) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix string) {
 	f.DurationVar(&c.MaxJoinBackoff, strutil.WithPrefixOrDefault(prefix, "max_join_backoff"), 30*time.Second, "")
 	f.IntVar(&c.MaxJoinRetries, strutil.WithPrefixOrDefault(prefix, "max_join_retries"), 10, "")
 	f.DurationVar(&c.LeaveTimeout, strutil.WithPrefixOrDefault(prefix, "leave_timeout"), 10*time.Second, "")
+	f.DurationVar(&c.UpdateTimeout, strutil.WithPrefixOrDefault(prefix, "update_timeout"), 10*time.Second, "")
 	f.Var(&c.JoinAddresses, strutil.WithPrefixOrDefault(prefix, "join_addresses"), "")
 }
@@ -0,0 +1,166 @@
+package memberlist
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+
+	"github.com/Blinkuu/qms/internal/core/domain"
+	"github.com/Blinkuu/qms/internal/core/ports"
+	"github.com/Blinkuu/qms/pkg/log"
+)
+
+// envelope routes a gossiped payload to the delegate subscribed to its channel.
+type envelope struct {
+	Channel string `json:"channel"`
+	Key     string `json:"key,omitempty"`
+	Payload []byte `json:"payload"`
+}
+
+type broadcast struct {
+	name string
+	msg  []byte
+}
+
+func (b *broadcast) Invalidates(other memberlist.Broadcast) bool {
+	named, ok := other.(memberlist.NamedBroadcast)
+	return ok && named.Name() == b.name
+}
+
+func (b *broadcast) Name() string {
+	return b.name
+}
+
+func (b *broadcast) Message() []byte {
+	return b.msg
+}
+
+func (b *broadcast) Finished() {}
+
+// delegate multiplexes the memberlist delegate between gossip channels.
+type delegate struct {
+	logger     log.Logger
+	broadcasts *memberlist.TransmitLimitedQueue
+	channels   map[string]ports.GossipDelegate
+	meta       []byte
+	mu         *sync.RWMutex
+}
+
+func newDelegate(logger log.Logger) *delegate {
+	return &delegate{
+		logger:     logger,
+		broadcasts: nil,
+		channels:   make(map[string]ports.GossipDelegate),
+		meta:       nil,
+		mu:         &sync.RWMutex{},
+	}
+}
+
+func (d *delegate) subscribe(channel string, gossipDelegate ports.GossipDelegate) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.channels[channel] = gossipDelegate
+}
+
+func (d *delegate) broadcast(channel, key string, payload []byte) {
+	msg, err := json.Marshal(envelope{Channel: channel, Key: key, Payload: payload})
+	if err != nil {
+		d.logger.Warn("failed to encode broadcast", "channel", channel, "err", err)
+		return
+	}
+
+	// Broadcasts with the same name invalidate each other, so only the latest payload for a key is gossiped.
+	d.broadcasts.QueueBroadcast(&broadcast{name: channel + "/" + key, msg: msg})
+}
+
+func (d *delegate) setMeta(meta domain.InstanceMeta) error {
+	buf, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode meta: %w", err)
+	}
+
+	if len(buf) > memberlist.MetaMaxSize {
+		return fmt.Errorf("meta exceeds %d bytes: size=%d", memberlist.MetaMaxSize, len(buf))
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.meta = buf
+
+	return nil
+}
+
+func (d *delegate) NodeMeta(limit int) []byte {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if len(d.meta) > limit {
+		d.logger.Warn("meta exceeds limit", "size", len(d.meta), "limit", limit)
+		return nil
+	}
+
+	return d.meta
+}
+
+func (d *delegate) NotifyMsg(msg []byte) {
+	var e envelope
+	if err := json.Unmarshal(msg, &e); err != nil {
+		d.logger.Warn("failed to decode broadcast", "err", err)
+		return
+	}
+
+	d.mu.RLock()
+	gossipDelegate, found := d.channels[e.Channel]
+	d.mu.RUnlock()
+
+	if found {
+		gossipDelegate.NotifyMsg(e.Payload)
+	}
+}
+
+func (d *delegate) GetBroadcasts(overhead, limit int) [][]byte {
+	return d.broadcasts.GetBroadcasts(overhead, limit)
+}
+
+func (d *delegate) LocalState(_ bool) []byte {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	states := make(map[string][]byte, len(d.channels))
+	for channel, gossipDelegate := range d.channels {
+		states[channel] = gossipDelegate.LocalState()
+	}
+
+	buf, err := json.Marshal(states)
+	if err != nil {
+		d.logger.Warn("failed to encode local state", "err", err)
+		return nil
+	}
+
+	return buf
+}
+
+func (d *delegate) MergeRemoteState(buf []byte, _ bool) {
+	if len(buf) == 0 {
+		return
+	}
+
+	var states map[string][]byte
+	if err := json.Unmarshal(buf, &states); err != nil {
+		d.logger.Warn("failed to decode remote state", "err", err)
+		return
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for channel, state := range states {
+		if gossipDelegate, found := d.channels[channel]; found {
+			gossipDelegate.MergeRemoteState(state)
+		}
+	}
+}
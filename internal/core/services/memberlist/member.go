@@ -1,6 +1,7 @@
 package memberlist
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -62,5 +63,12 @@ func nodeToInstance(node *memberlist.Node) (domain.Instance, error) {
 		return domain.Instance{}, fmt.Errorf("failed to split member name: memberName=%s", node.Name)
 	}
 
-	return domain.NewInstance(member.Service, member.Hostname, node.Addr.String(), member.HTTPPort, member.GossipPort), nil
+	var meta domain.InstanceMeta
+	if len(node.Meta) > 0 {
+		if err := json.Unmarshal(node.Meta, &meta); err != nil {
+			return domain.Instance{}, fmt.Errorf("failed to decode member meta: memberName=%s: %w", node.Name, err)
+		}
+	}
+
+	return domain.NewInstance(member.Service, member.Hostname, node.Addr.String(), member.HTTPPort, member.GossipPort, meta), nil
 }
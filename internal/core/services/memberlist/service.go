@@ -13,6 +13,7 @@ import (
 	"github.com/hashicorp/memberlist"
 
 	"github.com/Blinkuu/qms/internal/core/domain"
+	"github.com/Blinkuu/qms/internal/core/ports"
 	"github.com/Blinkuu/qms/pkg/cloud"
 	"github.com/Blinkuu/qms/pkg/log"
 )
@@ -27,6 +28,7 @@ type Service struct {
 	logger     log.Logger
 	discoverer cloud.Discoverer
 	memberlist *memberlist.Memberlist
+	delegate   *delegate
 }
 
 func NewService(cfg Config, logger log.Logger, discoverer cloud.Discoverer, eventDelegate EventDelegate, service string, httpPort int) (*Service, error) {
@@ -35,8 +37,10 @@ func NewService(cfg Config, logger log.Logger, discoverer cloud.Discoverer, even
 		return nil, fmt.Errorf("failed to read hostname: %w", err)
 	}
 
+	d := newDelegate(logger)
 	listCfg := memberlist.DefaultLANConfig()
 	listCfg.Events = eventDelegateAdapter{EventDelegate: eventDelegate}
+	listCfg.Delegate = d
 	listCfg.Name = newMember(service, hostname, listCfg.BindPort, httpPort).String()
 	listCfg.BindAddr = cfg.BindAddress
 	listCfg.BindPort = cfg.BindPort
@@ -47,12 +51,18 @@ func NewService(cfg Config, logger log.Logger, discoverer cloud.Discoverer, even
 		return nil, fmt.Errorf("failed to create memberlist: %w", err)
 	}
 
+	d.broadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes:       list.NumMembers,
+		RetransmitMult: listCfg.RetransmitMult,
+	}
+
 	s := &Service{
 		NamedService: nil,
 		cfg:          cfg,
 		logger:       logger,
 		discoverer:   discoverer,
 		memberlist:   list,
+		delegate:     d,
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -81,6 +91,31 @@ func (s *Service) Members(_ context.Context) ([]domain.Instance, error) {
 	return result, nil
 }
 
+// Broadcast gossips a payload to the members subscribed to a channel. A pending broadcast with the same channel and key
+// is replaced by the new one.
+func (s *Service) Broadcast(channel, key string, payload []byte) {
+	s.delegate.broadcast(channel, key, payload)
+}
+
+// Subscribe registers the delegate receiving payloads gossiped on a channel.
+func (s *Service) Subscribe(channel string, gossipDelegate ports.GossipDelegate) {
+	s.delegate.subscribe(channel, gossipDelegate)
+}
+
+// UpdateMeta publishes the metadata of this member to the others. It is gossiped along with the state of the member,
+// so other members learn of it eventually rather than right away.
+func (s *Service) UpdateMeta(meta domain.InstanceMeta) error {
+	if err := s.delegate.setMeta(meta); err != nil {
+		return err
+	}
+
+	if err := s.memberlist.UpdateNode(s.cfg.UpdateTimeout); err != nil {
+		return fmt.Errorf("failed to update node: %w", err)
+	}
+
+	return nil
+}
+
 func (s *Service) start(_ context.Context) error {
 	s.logger.Info("starting memberlist service")
 
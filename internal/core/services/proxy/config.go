@@ -11,16 +11,21 @@ import (
 const (
 	HashRingLBStrategy   = "hash-ring"
 	RoundRobinLBStrategy = "round-robin"
+	ShardLBStrategy      = "shard"
 )
 
 type Config struct {
-	RateAddresses   flagext.StringSlice `yaml:"rate_addresses"`
-	AllocLBStrategy string              `yaml:"alloc_lb_strategy"`
-	AllocAddresses  flagext.StringSlice `yaml:"alloc_addresses"`
+	RateAddresses         flagext.StringSlice `yaml:"rate_addresses"`
+	RateReplicationFactor int                 `yaml:"rate_replication_factor"`
+	ApproximateRateQuotas flagext.StringSlice `yaml:"approximate_rate_quotas"`
+	AllocLBStrategy       string              `yaml:"alloc_lb_strategy"`
+	AllocAddresses        flagext.StringSlice `yaml:"alloc_addresses"`
 }
 
 func (c *Config) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix string) {
 	f.Var(&c.RateAddresses, strutil.WithPrefixOrDefault(prefix, "rate_addresses"), "")
+	f.IntVar(&c.RateReplicationFactor, strutil.WithPrefixOrDefault(prefix, "rate_replication_factor"), 1, "")
+	f.Var(&c.ApproximateRateQuotas, strutil.WithPrefixOrDefault(prefix, "approximate_rate_quotas"), "")
 	f.StringVar(&c.AllocLBStrategy, strutil.WithPrefixOrDefault(prefix, "alloc_lb_strategy"), HashRingLBStrategy, "")
 	f.Var(&c.AllocAddresses, strutil.WithPrefixOrDefault(prefix, "alloc_addresses"), "")
 }
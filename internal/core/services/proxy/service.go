@@ -2,7 +2,9 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"strconv"
 	"strings"
@@ -14,8 +16,15 @@ import (
 
 	"github.com/Blinkuu/qms/internal/core/domain"
 	"github.com/Blinkuu/qms/internal/core/ports"
+	allocbatch "github.com/Blinkuu/qms/internal/core/storage/alloc/batch"
+	allochistory "github.com/Blinkuu/qms/internal/core/storage/alloc/history"
+	allocquota "github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/raft"
+	allocwatch "github.com/Blinkuu/qms/internal/core/storage/alloc/watch"
+	ratequota "github.com/Blinkuu/qms/internal/core/storage/rate/quota"
 	"github.com/Blinkuu/qms/pkg/cloud"
 	"github.com/Blinkuu/qms/pkg/log"
+	"github.com/Blinkuu/qms/pkg/math"
 )
 
 const (
@@ -29,10 +38,12 @@ type Service struct {
 	discoverer       cloud.Discoverer
 	memberlistClient ports.MemberlistServiceClient
 
-	rateClient   ports.RateServiceClient
-	rateMembers  []domain.Instance
-	rateHashRing *hashring.HashRing
-	rateMu       *sync.RWMutex
+	rateClient       ports.RateServiceClient
+	rateMembers      []domain.Instance
+	rateHashRing     *hashring.HashRing
+	rateHashRingSize int
+	rateApproximate  map[string]struct{}
+	rateMu           *sync.RWMutex
 
 	allocClient   ports.AllocServiceClient
 	allocMembers  []domain.Instance
@@ -50,6 +61,8 @@ func NewService(cfg Config, logger log.Logger, discoverer cloud.Discoverer, memb
 		rateClient:       rateClient,
 		rateMembers:      nil,
 		rateHashRing:     hashring.New(nil),
+		rateHashRingSize: 0,
+		rateApproximate:  make(map[string]struct{}, len(cfg.ApproximateRateQuotas)),
 		rateMu:           &sync.RWMutex{},
 		allocClient:      allocClient,
 		allocMembers:     nil,
@@ -57,87 +70,316 @@ func NewService(cfg Config, logger log.Logger, discoverer cloud.Discoverer, memb
 		allocMu:          &sync.RWMutex{},
 	}
 
+	for _, q := range cfg.ApproximateRateQuotas {
+		namespace, resource, found := strings.Cut(q, "/")
+		if !found {
+			return nil, fmt.Errorf("invalid approximate rate quota, expected namespace/resource: %s", q)
+		}
+
+		s.rateApproximate[strings.Join([]string{namespace, resource}, "_")] = struct{}{}
+	}
+
 	s.NamedService = services.NewBasicService(s.start, s.run, s.stop).WithName(ServiceName)
 
 	return s, nil
 }
 
-func (s *Service) Allow(ctx context.Context, namespace, resource string, tokens int64) (time.Duration, bool, error) {
+func (s *Service) Allow(ctx context.Context, namespace, resource, key string, tokens int64, maxWait time.Duration) (time.Duration, bool, error) {
+	// The rate instance must answer before the deadline of this request, so it cannot wait longer than that.
+	if deadline, ok := ctx.Deadline(); ok && maxWait > 0 {
+		maxWait = math.Min(maxWait, time.Until(deadline))
+	}
+
 	s.rateMu.RLock()
 	defer s.rateMu.RUnlock()
 
-	addrs, err := s.hashRingLocked(namespace, resource)
+	if _, found := s.rateApproximate[strings.Join([]string{namespace, resource}, "_")]; found {
+		return s.rateClient.Allow(ctx, s.rateSpreadLocked(), namespace, resource, key, tokens, maxWait)
+	}
+
+	addrs, err := s.rateReplicasLocked(namespace, rateRingKey(resource, key))
 	if err != nil {
 		return 0, false, fmt.Errorf("failed to pick addresses from hash ring: %w", err)
 	}
 
-	return s.rateClient.Allow(ctx, addrs, namespace, resource, tokens)
+	return s.rateClient.Allow(ctx, addrs, namespace, resource, key, tokens, maxWait)
+}
+
+func (s *Service) Reserve(ctx context.Context, namespace, resource, key string, tokens int64, maxWait time.Duration) (string, time.Time, bool, error) {
+	s.rateMu.RLock()
+	defer s.rateMu.RUnlock()
+
+	addrs, err := s.rateReplicasLocked(namespace, rateRingKey(resource, key))
+	if err != nil {
+		return "", time.Time{}, false, fmt.Errorf("failed to pick addresses from hash ring: %w", err)
+	}
+
+	return s.rateClient.Reserve(ctx, addrs, namespace, resource, key, tokens, maxWait)
+}
+
+func (s *Service) Cancel(ctx context.Context, namespace, resource, key, reservationID string) (bool, error) {
+	s.rateMu.RLock()
+	defer s.rateMu.RUnlock()
+
+	addrs, err := s.rateReplicasLocked(namespace, rateRingKey(resource, key))
+	if err != nil {
+		return false, fmt.Errorf("failed to pick addresses from hash ring: %w", err)
+	}
+
+	return s.rateClient.Cancel(ctx, addrs, namespace, resource, key, reservationID)
+}
+
+func (s *Service) Acquire(ctx context.Context, namespace, resource string, tokens int64) (string, bool, error) {
+	s.rateMu.RLock()
+	defer s.rateMu.RUnlock()
+
+	addrs, err := s.hashRingLocked(namespace, resource)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to pick addresses from hash ring: %w", err)
+	}
+
+	return s.rateClient.Acquire(ctx, addrs, namespace, resource, tokens)
+}
+
+func (s *Service) Release(ctx context.Context, namespace, resource, permitID string) (bool, error) {
+	s.rateMu.RLock()
+	defer s.rateMu.RUnlock()
+
+	addrs, err := s.hashRingLocked(namespace, resource)
+	if err != nil {
+		return false, fmt.Errorf("failed to pick addresses from hash ring: %w", err)
+	}
+
+	return s.rateClient.Release(ctx, addrs, namespace, resource, permitID)
 }
 
 func (s *Service) View(ctx context.Context, namespace, resource string) (int64, int64, int64, error) {
 	s.allocMu.RLock()
 	defer s.allocMu.RUnlock()
 
-	var addrs []string
-	switch s.cfg.AllocLBStrategy {
-	case HashRingLBStrategy:
-		a, err := s.hashRingLocked(namespace, resource)
+	addrs, err := s.allocAddrsLocked(namespace, resource)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return s.allocClient.View(ctx, addrs, namespace, resource)
+}
+
+func (s *Service) ViewHolders(ctx context.Context, namespace, resource string) (int64, int64, int64, map[string]int64, error) {
+	s.allocMu.RLock()
+	defer s.allocMu.RUnlock()
+
+	addrs, err := s.allocAddrsLocked(namespace, resource)
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+
+	return s.allocClient.ViewHolders(ctx, addrs, namespace, resource)
+}
+
+func (s *Service) Alloc(ctx context.Context, namespace, resource, holder string, tokens, version int64, ttl, maxWait time.Duration, idempotencyKey string) (int64, int64, string, bool, bool, error) {
+	s.allocMu.RLock()
+	defer s.allocMu.RUnlock()
+
+	addrs, err := s.allocAddrsLocked(namespace, resource)
+	if err != nil {
+		return 0, 0, "", false, false, err
+	}
+
+	return s.allocClient.Alloc(ctx, addrs, namespace, resource, holder, tokens, version, ttl, maxWait, idempotencyKey)
+}
+
+// AllocBatch forwards a batch to a single alloc instance, which allocates it atomically. With the hash ring strategy,
+// all quotas of the batch have to be owned by the same instance. With the shard strategy, the batch goes to a replica of
+// the shard of its first quota, which coordinates the batch and has the other shards prepared by their own replicas.
+func (s *Service) AllocBatch(ctx context.Context, items []allocbatch.Item) ([]allocbatch.Result, bool, error) {
+	s.allocMu.RLock()
+	defer s.allocMu.RUnlock()
+
+	if len(items) == 0 {
+		return nil, false, errors.New("batch has no items")
+	}
+
+	addrs, err := s.allocAddrsLocked(items[0].Namespace, items[0].Resource)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if s.cfg.AllocLBStrategy == HashRingLBStrategy {
+		for _, item := range items[1:] {
+			a, err := s.hashRingLocked(item.Namespace, item.Resource)
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to pick addresses from hash ring: %w", err)
+			}
+
+			if addrs[0] != a[0] {
+				return nil, false, fmt.Errorf("batch spans quotas owned by different alloc instances: %s and %s", addrs[0], a[0])
+			}
+		}
+	}
+
+	return s.allocClient.AllocBatch(ctx, addrs, items)
+}
+
+func (s *Service) Free(ctx context.Context, namespace, resource, holder string, tokens, version int64, leaseID, idempotencyKey string) (int64, int64, bool, error) {
+	s.allocMu.RLock()
+	defer s.allocMu.RUnlock()
+
+	addrs, err := s.allocAddrsLocked(namespace, resource)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	return s.allocClient.Free(ctx, addrs, namespace, resource, holder, tokens, version, leaseID, idempotencyKey)
+}
+
+func (s *Service) Renew(ctx context.Context, namespace, resource, leaseID string, ttl time.Duration) (time.Time, bool, error) {
+	s.allocMu.RLock()
+	defer s.allocMu.RUnlock()
+
+	addrs, err := s.allocAddrsLocked(namespace, resource)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	return s.allocClient.Renew(ctx, addrs, namespace, resource, leaseID, ttl)
+}
+
+// Watch forwards the watch of a quota to the instance owning it. The stream lasts until ctx is done or the instance ends
+// it.
+func (s *Service) Watch(ctx context.Context, namespace, resource string) (<-chan allocwatch.Event, error) {
+	s.allocMu.RLock()
+	defer s.allocMu.RUnlock()
+
+	addrs, err := s.allocAddrsLocked(namespace, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.allocClient.Watch(ctx, addrs, namespace, resource)
+}
+
+func (s *Service) History(ctx context.Context, namespace, resource string, from, to time.Time, step time.Duration) ([]allochistory.Sample, error) {
+	s.allocMu.RLock()
+	defer s.allocMu.RUnlock()
+
+	addrs, err := s.allocAddrsLocked(namespace, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.allocClient.History(ctx, addrs, namespace, resource, from, to, step)
+}
+
+func (s *Service) CreateRateQuota(ctx context.Context, namespace, resource string, cfg ratequota.Config) error {
+	s.rateMu.RLock()
+	defer s.rateMu.RUnlock()
+
+	return s.rateClient.CreateRateQuota(ctx, s.rateSpreadLocked(), namespace, resource, cfg)
+}
+
+func (s *Service) UpdateRateQuota(ctx context.Context, namespace, resource string, cfg ratequota.Config) error {
+	s.rateMu.RLock()
+	defer s.rateMu.RUnlock()
+
+	return s.rateClient.UpdateRateQuota(ctx, s.rateSpreadLocked(), namespace, resource, cfg)
+}
+
+func (s *Service) DeleteRateQuota(ctx context.Context, namespace, resource string) error {
+	s.rateMu.RLock()
+	defer s.rateMu.RUnlock()
+
+	return s.rateClient.DeleteRateQuota(ctx, s.rateSpreadLocked(), namespace, resource)
+}
+
+func (s *Service) ListRateQuotas(ctx context.Context) ([]ratequota.Quota, error) {
+	s.rateMu.RLock()
+	defer s.rateMu.RUnlock()
+
+	return s.rateClient.ListRateQuotas(ctx, s.rateSpreadLocked())
+}
+
+func (s *Service) CreateAllocQuota(ctx context.Context, namespace, resource string, cfg allocquota.Config) error {
+	s.allocMu.RLock()
+	defer s.allocMu.RUnlock()
+
+	addrs := s.roundRobinLocked()
+	if s.cfg.AllocLBStrategy == ShardLBStrategy {
+		a, err := s.shardReplicasLocked(namespace, resource)
 		if err != nil {
-			return 0, 0, 0, fmt.Errorf("failed to pick addresses from hash ring: %w", err)
+			return fmt.Errorf("failed to pick replicas of shard: %w", err)
 		}
 
 		addrs = a
-	case RoundRobinLBStrategy:
-		addrs = s.roundRobinLocked()
-	default:
-		return 0, 0, 0, fmt.Errorf("%s is not a supported alloc_lb_strategy", s.cfg.AllocLBStrategy)
 	}
 
-	return s.allocClient.View(ctx, addrs, namespace, resource)
+	return s.allocClient.CreateAllocQuota(ctx, addrs, namespace, resource, cfg)
 }
 
-func (s *Service) Alloc(ctx context.Context, namespace, resource string, tokens, version int64) (int64, int64, bool, error) {
+func (s *Service) UpdateAllocQuota(ctx context.Context, namespace, resource string, cfg allocquota.Config) error {
 	s.allocMu.RLock()
 	defer s.allocMu.RUnlock()
 
-	var addrs []string
-	switch s.cfg.AllocLBStrategy {
-	case HashRingLBStrategy:
-		a, err := s.hashRingLocked(namespace, resource)
+	addrs := s.roundRobinLocked()
+	if s.cfg.AllocLBStrategy == ShardLBStrategy {
+		a, err := s.shardReplicasLocked(namespace, resource)
 		if err != nil {
-			return 0, 0, false, fmt.Errorf("failed to pick addresses from hash ring: %w", err)
+			return fmt.Errorf("failed to pick replicas of shard: %w", err)
 		}
 
 		addrs = a
-	case RoundRobinLBStrategy:
-		addrs = s.roundRobinLocked()
-	default:
-		return 0, 0, false, fmt.Errorf("%s is not a supported alloc_lb_strategy", s.cfg.AllocLBStrategy)
 	}
 
-	return s.allocClient.Alloc(ctx, addrs, namespace, resource, tokens, version)
+	return s.allocClient.UpdateAllocQuota(ctx, addrs, namespace, resource, cfg)
 }
 
-func (s *Service) Free(ctx context.Context, namespace, resource string, tokens, version int64) (int64, int64, bool, error) {
+func (s *Service) DeleteAllocQuota(ctx context.Context, namespace, resource string) error {
 	s.allocMu.RLock()
 	defer s.allocMu.RUnlock()
 
-	var addrs []string
+	addrs := s.roundRobinLocked()
+	if s.cfg.AllocLBStrategy == ShardLBStrategy {
+		a, err := s.shardReplicasLocked(namespace, resource)
+		if err != nil {
+			return fmt.Errorf("failed to pick replicas of shard: %w", err)
+		}
+
+		addrs = a
+	}
+
+	return s.allocClient.DeleteAllocQuota(ctx, addrs, namespace, resource)
+}
+
+func (s *Service) ListAllocQuotas(ctx context.Context) ([]allocquota.Quota, error) {
+	s.allocMu.RLock()
+	defer s.allocMu.RUnlock()
+
+	return s.allocClient.ListAllocQuotas(ctx, s.roundRobinLocked())
+}
+
+// allocAddrsLocked returns the addresses of the alloc instances to send the requests of a quota to, picked by the
+// configured alloc_lb_strategy.
+func (s *Service) allocAddrsLocked(namespace, resource string) ([]string, error) {
 	switch s.cfg.AllocLBStrategy {
 	case HashRingLBStrategy:
-		a, err := s.hashRingLocked(namespace, resource)
+		addrs, err := s.hashRingLocked(namespace, resource)
 		if err != nil {
-			return 0, 0, false, fmt.Errorf("failed to pick addresses from hash ring: %w", err)
+			return nil, fmt.Errorf("failed to pick addresses from hash ring: %w", err)
 		}
 
-		addrs = a
+		return addrs, nil
+	case ShardLBStrategy:
+		addrs, err := s.shardReplicasLocked(namespace, resource)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pick replicas of shard: %w", err)
+		}
+
+		return addrs, nil
 	case RoundRobinLBStrategy:
-		addrs = s.roundRobinLocked()
+		return s.roundRobinLocked(), nil
 	default:
-		return 0, 0, false, fmt.Errorf("%s is not a supported alloc_lb_strategy", s.cfg.AllocLBStrategy)
+		return nil, fmt.Errorf("%s is not a supported alloc_lb_strategy", s.cfg.AllocLBStrategy)
 	}
-
-	return s.allocClient.Free(ctx, addrs, namespace, resource, tokens, version)
 }
 
 func (s *Service) roundRobinLocked() []string {
@@ -161,6 +403,101 @@ func (s *Service) hashRingLocked(namespace, resource string) ([]string, error) {
 	return []string{addr}, nil
 }
 
+// shardReplicasLocked returns the addresses of the alloc instances hosting the shard of a quota, starting at a random
+// one. The shards are published by the instances as memberlist metadata. Any replica can serve the requests of its
+// shard, since raft forwards proposals to the leader.
+func (s *Service) shardReplicasLocked(namespace, resource string) ([]string, error) {
+	var shards uint64
+	for _, instance := range s.allocMembers {
+		if instance.Meta.Shards > 0 {
+			shards = instance.Meta.Shards
+			break
+		}
+	}
+
+	if shards == 0 {
+		return nil, errors.New("no alloc instance publishes its shards")
+	}
+
+	shardID := raft.ShardIDFromString(strings.Join([]string{namespace, resource}, "_"), shards)
+	var replicas []domain.Instance
+	for _, instance := range s.allocMembers {
+		if instance.Meta.HostsShard(shardID) {
+			replicas = append(replicas, instance)
+		}
+	}
+
+	if len(replicas) == 0 {
+		return nil, fmt.Errorf("no alloc instance hosts shard: shardID=%d", shardID)
+	}
+
+	addrs := make([]string, 0, len(replicas))
+	offset := rand.Intn(len(replicas))
+	for i := range replicas {
+		instance := replicas[(offset+i)%len(replicas)]
+		addrs = append(addrs, net.JoinHostPort(instance.Host, strconv.Itoa(instance.HTTPPort)))
+	}
+
+	return addrs, nil
+}
+
+// rateReplicasLocked returns the addresses of the replica set of a rate quota, starting with its owner. The rate client
+// tries them in order, so the next replica takes over the quota when the owner is unavailable.
+func (s *Service) rateReplicasLocked(namespace, resource string) ([]string, error) {
+	if s.cfg.RateReplicationFactor <= 1 {
+		return s.hashRingLocked(namespace, resource)
+	}
+
+	id := strings.Join([]string{namespace, resource}, "_")
+	vNodes, ok := s.rateHashRing.GetNodes(id, s.rateHashRingSize)
+	if !ok {
+		return nil, fmt.Errorf("failed to get addresses from ring: id=%s", id)
+	}
+
+	addrs := make([]string, 0, s.cfg.RateReplicationFactor)
+	seen := make(map[string]struct{}, s.cfg.RateReplicationFactor)
+	for _, vNode := range vNodes {
+		addr := s.trimVNodePrefix(vNode)
+		if _, found := seen[addr]; found {
+			continue
+		}
+
+		seen[addr] = struct{}{}
+		addrs = append(addrs, addr)
+		if len(addrs) == s.cfg.RateReplicationFactor {
+			break
+		}
+	}
+
+	return addrs, nil
+}
+
+// rateSpreadLocked returns the addresses of all rate instances, starting at a random one. It is used for requests that
+// any instance can answer, like those of approximate quotas, which every instance counts locally.
+func (s *Service) rateSpreadLocked() []string {
+	addrs := make([]string, 0, len(s.rateMembers))
+	if len(s.rateMembers) == 0 {
+		return addrs
+	}
+
+	offset := rand.Intn(len(s.rateMembers))
+	for i := range s.rateMembers {
+		instance := s.rateMembers[(offset+i)%len(s.rateMembers)]
+		addrs = append(addrs, net.JoinHostPort(instance.Host, strconv.Itoa(instance.HTTPPort)))
+	}
+
+	return addrs
+}
+
+// rateRingKey spreads limiters of quota templates across rate instances, since they are independent per key.
+func rateRingKey(resource, key string) string {
+	if key == "" {
+		return resource
+	}
+
+	return strings.Join([]string{resource, key}, "_")
+}
+
 func (s *Service) start(_ context.Context) error {
 	s.logger.Info("starting proxy service")
 
@@ -243,6 +580,7 @@ func (s *Service) updateRateMembersAndHashRing(newMembers []domain.Instance, num
 
 	s.rateMembers = newMembers
 	s.rateHashRing = hashring.New(nodes)
+	s.rateHashRingSize = len(nodes)
 }
 
 func (s *Service) updateAllocMembersAndHashRing(newMembers []domain.Instance, numVNodes int) {
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Blinkuu/qms/internal/core/domain"
+	"github.com/Blinkuu/qms/internal/core/ports"
+	allocbatch "github.com/Blinkuu/qms/internal/core/storage/alloc/batch"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/raft"
+	"github.com/Blinkuu/qms/pkg/log"
+)
+
+// fakeAllocClient records the addresses the proxy sends alloc requests to.
+type fakeAllocClient struct {
+	ports.AllocServiceClient
+	addrs []string
+}
+
+func (c *fakeAllocClient) View(_ context.Context, addrs []string, _, _ string) (int64, int64, int64, error) {
+	c.addrs = addrs
+
+	return 0, 0, 0, nil
+}
+
+func (c *fakeAllocClient) AllocBatch(_ context.Context, addrs []string, _ []allocbatch.Item) ([]allocbatch.Result, bool, error) {
+	c.addrs = addrs
+
+	return nil, true, nil
+}
+
+// fakeRateClient records the addresses the proxy sends rate requests to.
+type fakeRateClient struct {
+	ports.RateServiceClient
+	addrs []string
+}
+
+func (c *fakeRateClient) Allow(_ context.Context, addrs []string, _, _, _ string, _ int64, _ time.Duration) (time.Duration, bool, error) {
+	c.addrs = addrs
+
+	return 0, true, nil
+}
+
+func newTestService(t *testing.T, cfg Config, rateClient ports.RateServiceClient, allocClient ports.AllocServiceClient) *Service {
+	s, err := NewService(cfg, log.NewNoopLogger(), nil, nil, rateClient, allocClient)
+	require.NoError(t, err)
+
+	return s
+}
+
+// shardedInstances returns an alloc instance per shard, each hosting only its own shard.
+func shardedInstances(shards uint64) []domain.Instance {
+	instances := make([]domain.Instance, 0, shards)
+	for shardID := uint64(1); shardID <= shards; shardID++ {
+		meta := domain.InstanceMeta{Shards: shards, ShardIDs: []uint64{shardID}}
+		instances = append(instances, domain.NewInstance("alloc", "alloc", fmt.Sprintf("10.0.0.%d", shardID), 6789, 7946, meta))
+	}
+
+	return instances
+}
+
+// resourceInShard returns a resource of the namespace whose quota falls into the shard.
+func resourceInShard(t *testing.T, namespace string, shardID, shards uint64) string {
+	for i := 0; i < 1000; i++ {
+		resource := "resource" + strconv.Itoa(i)
+		if raft.ShardIDFromString(strings.Join([]string{namespace, resource}, "_"), shards) == shardID {
+			return resource
+		}
+	}
+
+	require.FailNow(t, "no resource falls into shard", "shardID=%d", shardID)
+
+	return ""
+}
+
+func addr(instance domain.Instance) string {
+	return net.JoinHostPort(instance.Host, strconv.Itoa(instance.HTTPPort))
+}
+
+func TestService_View_SendsRequestToReplicasOfShardOfQuota(t *testing.T) {
+	// Given
+	allocClient := &fakeAllocClient{}
+	s := newTestService(t, Config{AllocLBStrategy: ShardLBStrategy}, nil, allocClient)
+	instances := shardedInstances(3)
+	instances = append(instances, domain.NewInstance("alloc", "alloc", "10.0.0.4", 6789, 7946, domain.InstanceMeta{Shards: 3, ShardIDs: []uint64{2, 3}}))
+	s.updateAllocMembersAndHashRing(instances, 10)
+	resource := resourceInShard(t, "namespace", 2, 3)
+
+	// When
+	_, _, _, err := s.View(context.Background(), "namespace", resource)
+
+	// Then
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{addr(instances[1]), addr(instances[3])}, allocClient.addrs)
+}
+
+func TestService_View_FailsWithoutPublishedShards(t *testing.T) {
+	// Given
+	s := newTestService(t, Config{AllocLBStrategy: ShardLBStrategy}, nil, &fakeAllocClient{})
+	s.updateAllocMembersAndHashRing([]domain.Instance{domain.NewInstance("alloc", "alloc", "10.0.0.1", 6789, 7946, domain.InstanceMeta{})}, 10)
+
+	// When
+	_, _, _, err := s.View(context.Background(), "namespace", "resource")
+
+	// Then
+	assert.ErrorContains(t, err, "no alloc instance publishes its shards")
+}
+
+func TestService_AllocBatch_SendsBatchSpanningShardsToReplicaOfShardOfFirstQuota(t *testing.T) {
+	// Given
+	allocClient := &fakeAllocClient{}
+	s := newTestService(t, Config{AllocLBStrategy: ShardLBStrategy}, nil, allocClient)
+	instances := shardedInstances(3)
+	s.updateAllocMembersAndHashRing(instances, 10)
+	items := []allocbatch.Item{
+		{Namespace: "namespace", Resource: resourceInShard(t, "namespace", 3, 3), Tokens: 1},
+		{Namespace: "namespace", Resource: resourceInShard(t, "namespace", 1, 3), Tokens: 1},
+	}
+
+	// When
+	_, ok, err := s.AllocBatch(context.Background(), items)
+
+	// Then
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{addr(instances[2])}, allocClient.addrs)
+}
+
+func TestService_Allow_SendsRequestToReplicaSetOfQuotaStartingWithOwner(t *testing.T) {
+	// Given
+	rateClient := &fakeRateClient{}
+	s := newTestService(t, Config{RateReplicationFactor: 2}, rateClient, nil)
+	s.updateRateMembersAndHashRing(shardedInstances(3), 10)
+	owner, err := s.hashRingLocked("namespace", "resource")
+	require.NoError(t, err)
+
+	// When
+	_, ok, err := s.Allow(context.Background(), "namespace", "resource", "", 1, 0)
+
+	// Then
+	require.NoError(t, err)
+	assert.True(t, ok)
+	require.Len(t, rateClient.addrs, 2)
+	assert.Equal(t, owner[0], rateClient.addrs[0])
+	assert.NotEqual(t, rateClient.addrs[0], rateClient.addrs[1])
+}
+
+func TestService_Allow_SpreadsRequestsOfApproximateQuotaOverAllInstances(t *testing.T) {
+	// Given
+	rateClient := &fakeRateClient{}
+	s := newTestService(t, Config{RateReplicationFactor: 1, ApproximateRateQuotas: []string{"namespace/resource"}}, rateClient, nil)
+	instances := shardedInstances(3)
+	s.updateRateMembersAndHashRing(instances, 10)
+
+	// When
+	_, ok, err := s.Allow(context.Background(), "namespace", "resource", "", 1, 0)
+
+	// Then
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.ElementsMatch(t, []string{addr(instances[0]), addr(instances[1]), addr(instances[2])}, rateClient.addrs)
+}
+
+func TestService_View_SendsRequestToAllInstancesWithRoundRobin(t *testing.T) {
+	// Given
+	allocClient := &fakeAllocClient{}
+	s := newTestService(t, Config{AllocLBStrategy: RoundRobinLBStrategy}, nil, allocClient)
+	instances := shardedInstances(2)
+	s.updateAllocMembersAndHashRing(instances, 10)
+
+	// When
+	_, _, _, err := s.View(context.Background(), "namespace", "resource")
+
+	// Then
+	require.NoError(t, err)
+	assert.Equal(t, []string{addr(instances[0]), addr(instances[1])}, allocClient.addrs)
+}
+
+func TestService_AllocBatch_FailsWithUnsupportedStrategy(t *testing.T) {
+	// Given
+	s := newTestService(t, Config{AllocLBStrategy: "unknown"}, nil, &fakeAllocClient{})
+
+	// When
+	_, _, err := s.AllocBatch(context.Background(), []allocbatch.Item{{Namespace: "namespace", Resource: "resource", Tokens: 1}})
+
+	// Then
+	assert.EqualError(t, err, "unknown is not a supported alloc_lb_strategy")
+}
@@ -0,0 +1,84 @@
+package rate
+
+import (
+	"encoding/json"
+
+	"github.com/google/uuid"
+
+	"github.com/Blinkuu/qms/internal/core/ports"
+	"github.com/Blinkuu/qms/internal/core/storage/rate/memory"
+	"github.com/Blinkuu/qms/pkg/log"
+)
+
+const (
+	ApproximateGossipChannel = "rate-approximate"
+)
+
+type approximator interface {
+	ApproximateCounts() []memory.ApproximateCount
+	MergeApproximateCounts(peer string, counts []memory.ApproximateCount)
+}
+
+type approximateReport struct {
+	Node   string                    `json:"node"`
+	Counts []memory.ApproximateCount `json:"counts"`
+}
+
+// approximateSyncer gossips the local counts of approximate quotas and merges the counts reported by other rate
+// instances. Counts are only meaningful for the current window, so there is no state to exchange on join.
+type approximateSyncer struct {
+	node       string
+	storage    approximator
+	memberlist ports.MemberlistService
+	logger     log.Logger
+}
+
+func newApproximateSyncer(storage approximator, memberlist ports.MemberlistService, logger log.Logger) *approximateSyncer {
+	s := &approximateSyncer{
+		node:       uuid.NewString(),
+		storage:    storage,
+		memberlist: memberlist,
+		logger:     logger,
+	}
+
+	memberlist.Subscribe(ApproximateGossipChannel, s)
+
+	return s
+}
+
+// sync broadcasts the counts that are due for a sync. Broadcasts are keyed by node, so a newer report of a node
+// replaces the older one still waiting in the queue.
+func (s *approximateSyncer) sync() {
+	counts := s.storage.ApproximateCounts()
+	if len(counts) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(approximateReport{Node: s.node, Counts: counts})
+	if err != nil {
+		s.logger.Warn("failed to encode approximate counts", "err", err)
+		return
+	}
+
+	s.memberlist.Broadcast(ApproximateGossipChannel, s.node, payload)
+}
+
+func (s *approximateSyncer) NotifyMsg(payload []byte) {
+	var report approximateReport
+	if err := json.Unmarshal(payload, &report); err != nil {
+		s.logger.Warn("failed to decode approximate counts", "err", err)
+		return
+	}
+
+	if report.Node == s.node {
+		return
+	}
+
+	s.storage.MergeApproximateCounts(report.Node, report.Counts)
+}
+
+func (s *approximateSyncer) LocalState() []byte {
+	return nil
+}
+
+func (s *approximateSyncer) MergeRemoteState(_ []byte) {}
@@ -7,11 +7,13 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/go-cleanhttp"
 	"github.com/hashicorp/go-retryablehttp"
 
+	ratequota "github.com/Blinkuu/qms/internal/core/storage/rate/quota"
 	"github.com/Blinkuu/qms/pkg/dto"
 	"github.com/Blinkuu/qms/pkg/log"
 )
@@ -45,10 +47,10 @@ func NewClient(logger log.Logger) *Client {
 	}
 }
 
-func (c *Client) Allow(ctx context.Context, addrs []string, namespace, resource string, tokens int64) (time.Duration, bool, error) {
+func (c *Client) Allow(ctx context.Context, addrs []string, namespace, resource, key string, tokens int64, maxWait time.Duration) (time.Duration, bool, error) {
 	for _, addr := range addrs {
 		url := fmt.Sprintf("http://%s/api/v1/internal/allow", addr)
-		body := dto.AllowRequestBody{Namespace: namespace, Resource: resource, Tokens: tokens}
+		body := dto.AllowRequestBody{Namespace: namespace, Resource: resource, Key: key, Tokens: tokens, MaxWait: maxWait.Nanoseconds()}
 		var bodyBuffer bytes.Buffer
 		if err := json.NewEncoder(&bodyBuffer).Encode(body); err != nil {
 			return 0, false, fmt.Errorf("failed to encode allow request body: %w", err)
@@ -93,3 +95,338 @@ func (c *Client) Allow(ctx context.Context, addrs []string, namespace, resource
 
 	return 0, false, errors.New("all attempts failed")
 }
+
+func (c *Client) Reserve(ctx context.Context, addrs []string, namespace, resource, key string, tokens int64, maxWait time.Duration) (string, time.Time, bool, error) {
+	for _, addr := range addrs {
+		url := fmt.Sprintf("http://%s/api/v1/internal/reserve", addr)
+		body := dto.ReserveRequestBody{Namespace: namespace, Resource: resource, Key: key, Tokens: tokens, MaxWait: maxWait.Nanoseconds()}
+		var bodyBuffer bytes.Buffer
+		if err := json.NewEncoder(&bodyBuffer).Encode(body); err != nil {
+			return "", time.Time{}, false, fmt.Errorf("failed to encode reserve request body: %w", err)
+		}
+
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &bodyBuffer)
+		if err != nil {
+			return "", time.Time{}, false, fmt.Errorf("failed to create new request with context: %w", err)
+		}
+
+		res, err := c.client.Do(r)
+		if err != nil {
+			c.logger.Warn("failed to do request", "err", err)
+			continue
+		}
+		defer func() {
+			if err := res.Body.Close(); err != nil {
+				c.logger.Warn("failed to close response body: %w", err)
+			}
+		}()
+
+		if res.StatusCode != http.StatusOK {
+			c.logger.Warn("invalid http status code", "statusCode", res.StatusCode)
+			continue
+		}
+
+		resBody := dto.ResponseBody[dto.ReserveResponseBody]{}
+		if err := json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+			c.logger.Warn("failed to decode response body", "err", err)
+			continue
+		}
+
+		switch resBody.Status {
+		case dto.StatusOK:
+			return resBody.Result.ReservationID, resBody.Result.ReadyAt, resBody.Result.OK, nil
+		case dto.StatusReserveNotFound:
+			return "", time.Time{}, false, ErrNotFound
+		case dto.StatusReserveNotSupported:
+			return "", time.Time{}, false, ErrNotSupported
+		default:
+			return "", time.Time{}, false, fmt.Errorf("invalid status code: statusCode=%d", resBody.Status)
+		}
+	}
+
+	return "", time.Time{}, false, errors.New("all attempts failed")
+}
+
+func (c *Client) Cancel(ctx context.Context, addrs []string, namespace, resource, key, reservationID string) (bool, error) {
+	for _, addr := range addrs {
+		url := fmt.Sprintf("http://%s/api/v1/internal/cancel", addr)
+		body := dto.CancelRequestBody{Namespace: namespace, Resource: resource, Key: key, ReservationID: reservationID}
+		var bodyBuffer bytes.Buffer
+		if err := json.NewEncoder(&bodyBuffer).Encode(body); err != nil {
+			return false, fmt.Errorf("failed to encode cancel request body: %w", err)
+		}
+
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &bodyBuffer)
+		if err != nil {
+			return false, fmt.Errorf("failed to create new request with context: %w", err)
+		}
+
+		res, err := c.client.Do(r)
+		if err != nil {
+			c.logger.Warn("failed to do request", "err", err)
+			continue
+		}
+		defer func() {
+			if err := res.Body.Close(); err != nil {
+				c.logger.Warn("failed to close response body: %w", err)
+			}
+		}()
+
+		if res.StatusCode != http.StatusOK {
+			c.logger.Warn("invalid http status code", "statusCode", res.StatusCode)
+			continue
+		}
+
+		resBody := dto.ResponseBody[dto.CancelResponseBody]{}
+		if err := json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+			c.logger.Warn("failed to decode response body", "err", err)
+			continue
+		}
+
+		switch resBody.Status {
+		case dto.StatusOK:
+			return resBody.Result.OK, nil
+		case dto.StatusCancelNotFound:
+			return false, ErrNotFound
+		default:
+			return false, fmt.Errorf("invalid status code: statusCode=%d", resBody.Status)
+		}
+	}
+
+	return false, errors.New("all attempts failed")
+}
+
+func (c *Client) Acquire(ctx context.Context, addrs []string, namespace, resource string, tokens int64) (string, bool, error) {
+	for _, addr := range addrs {
+		url := fmt.Sprintf("http://%s/api/v1/internal/acquire", addr)
+		body := dto.AcquireRequestBody{Namespace: namespace, Resource: resource, Tokens: tokens}
+		var bodyBuffer bytes.Buffer
+		if err := json.NewEncoder(&bodyBuffer).Encode(body); err != nil {
+			return "", false, fmt.Errorf("failed to encode acquire request body: %w", err)
+		}
+
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &bodyBuffer)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to create new request with context: %w", err)
+		}
+
+		res, err := c.client.Do(r)
+		if err != nil {
+			c.logger.Warn("failed to do request", "err", err)
+			continue
+		}
+		defer func() {
+			if err := res.Body.Close(); err != nil {
+				c.logger.Warn("failed to close response body: %w", err)
+			}
+		}()
+
+		if res.StatusCode != http.StatusOK {
+			c.logger.Warn("invalid http status code", "statusCode", res.StatusCode)
+			continue
+		}
+
+		resBody := dto.ResponseBody[dto.AcquireResponseBody]{}
+		if err := json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+			c.logger.Warn("failed to decode response body", "err", err)
+			continue
+		}
+
+		switch resBody.Status {
+		case dto.StatusOK:
+			return resBody.Result.PermitID, resBody.Result.OK, nil
+		case dto.StatusAcquireNotFound:
+			return "", false, ErrNotFound
+		default:
+			return "", false, fmt.Errorf("invalid status code: statusCode=%d", resBody.Status)
+		}
+	}
+
+	return "", false, errors.New("all attempts failed")
+}
+
+func (c *Client) Release(ctx context.Context, addrs []string, namespace, resource, permitID string) (bool, error) {
+	for _, addr := range addrs {
+		url := fmt.Sprintf("http://%s/api/v1/internal/release", addr)
+		body := dto.ReleaseRequestBody{Namespace: namespace, Resource: resource, PermitID: permitID}
+		var bodyBuffer bytes.Buffer
+		if err := json.NewEncoder(&bodyBuffer).Encode(body); err != nil {
+			return false, fmt.Errorf("failed to encode release request body: %w", err)
+		}
+
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &bodyBuffer)
+		if err != nil {
+			return false, fmt.Errorf("failed to create new request with context: %w", err)
+		}
+
+		res, err := c.client.Do(r)
+		if err != nil {
+			c.logger.Warn("failed to do request", "err", err)
+			continue
+		}
+		defer func() {
+			if err := res.Body.Close(); err != nil {
+				c.logger.Warn("failed to close response body: %w", err)
+			}
+		}()
+
+		if res.StatusCode != http.StatusOK {
+			c.logger.Warn("invalid http status code", "statusCode", res.StatusCode)
+			continue
+		}
+
+		resBody := dto.ResponseBody[dto.ReleaseResponseBody]{}
+		if err := json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+			c.logger.Warn("failed to decode response body", "err", err)
+			continue
+		}
+
+		switch resBody.Status {
+		case dto.StatusOK:
+			return resBody.Result.OK, nil
+		case dto.StatusReleaseNotFound:
+			return false, ErrNotFound
+		default:
+			return false, fmt.Errorf("invalid status code: statusCode=%d", resBody.Status)
+		}
+	}
+
+	return false, errors.New("all attempts failed")
+}
+
+// CreateRateQuota registers a quota on every instance. It fails with ErrAlreadyExists only if the quota exists on all of
+// them, so it can be retried after a partial failure.
+func (c *Client) CreateRateQuota(ctx context.Context, addrs []string, namespace, resource string, cfg ratequota.Config) error {
+	body := dto.QuotaRequestBody{Kind: dto.QuotaKindRate, Namespace: namespace, Resource: resource, Strategy: cfg.DTO()}
+
+	return c.broadcastQuota(ctx, addrs, http.MethodPost, body)
+}
+
+func (c *Client) UpdateRateQuota(ctx context.Context, addrs []string, namespace, resource string, cfg ratequota.Config) error {
+	body := dto.QuotaRequestBody{Kind: dto.QuotaKindRate, Namespace: namespace, Resource: resource, Strategy: cfg.DTO()}
+
+	return c.broadcastQuota(ctx, addrs, http.MethodPut, body)
+}
+
+func (c *Client) DeleteRateQuota(ctx context.Context, addrs []string, namespace, resource string) error {
+	body := dto.DeleteQuotaRequestBody{Kind: dto.QuotaKindRate, Namespace: namespace, Resource: resource}
+
+	return c.broadcastQuota(ctx, addrs, http.MethodDelete, body)
+}
+
+// ListRateQuotas returns the union of the quotas of all instances.
+func (c *Client) ListRateQuotas(ctx context.Context, addrs []string) ([]ratequota.Quota, error) {
+	var quotas []ratequota.Quota
+	seen := make(map[string]struct{})
+	for _, addr := range addrs {
+		url := fmt.Sprintf("http://%s/api/v1/internal/admin/quotas?kind=%s", addr, dto.QuotaKindRate)
+		resBody, err := doQuotaRequest[dto.ListQuotasResponseBody](ctx, c.client, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list quotas on %s: %w", addr, err)
+		}
+
+		if resBody.Status != dto.StatusOK {
+			return nil, quotaStatusError(resBody.Status, resBody.Msg)
+		}
+
+		for _, q := range resBody.Result.Quotas {
+			id := strings.Join([]string{q.Namespace, q.Resource}, "_")
+			if _, found := seen[id]; found {
+				continue
+			}
+
+			seen[id] = struct{}{}
+			quotas = append(quotas, ratequota.Quota{Namespace: q.Namespace, Resource: q.Resource, Strategy: ratequota.NewConfigFromDTO(q.Strategy)})
+		}
+	}
+
+	return quotas, nil
+}
+
+// broadcastQuota sends a quota management request to every instance, since each of them keeps its own copy of the
+// quotas. It succeeds if any instance applied the request, and fails with ErrNotFound or ErrAlreadyExists only if all
+// of them reported it.
+func (c *Client) broadcastQuota(ctx context.Context, addrs []string, method string, body any) error {
+	if len(addrs) == 0 {
+		return errors.New("no instances to send the request to")
+	}
+
+	var (
+		applied  bool
+		statuses = make(map[int]string)
+	)
+	for _, addr := range addrs {
+		url := fmt.Sprintf("http://%s/api/v1/internal/admin/quotas", addr)
+		resBody, err := doQuotaRequest[dto.QuotaResponseBody](ctx, c.client, method, url, body)
+		if err != nil {
+			return fmt.Errorf("failed to send quota request to %s: %w", addr, err)
+		}
+
+		switch resBody.Status {
+		case dto.StatusOK:
+			applied = true
+		case dto.StatusQuotaNotFound, dto.StatusQuotaAlreadyExists:
+			statuses[resBody.Status] = resBody.Msg
+		default:
+			return quotaStatusError(resBody.Status, resBody.Msg)
+		}
+	}
+
+	if applied {
+		return nil
+	}
+
+	for status, msg := range statuses {
+		return quotaStatusError(status, msg)
+	}
+
+	return nil
+}
+
+func doQuotaRequest[T any](ctx context.Context, client *http.Client, method, url string, body any) (dto.ResponseBody[T], error) {
+	var bodyBuffer bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&bodyBuffer).Encode(body); err != nil {
+			return dto.ResponseBody[T]{}, fmt.Errorf("failed to encode quota request body: %w", err)
+		}
+	}
+
+	r, err := http.NewRequestWithContext(ctx, method, url, &bodyBuffer)
+	if err != nil {
+		return dto.ResponseBody[T]{}, fmt.Errorf("failed to create new request with context: %w", err)
+	}
+
+	res, err := client.Do(r)
+	if err != nil {
+		return dto.ResponseBody[T]{}, fmt.Errorf("failed to do request: %w", err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		return dto.ResponseBody[T]{}, fmt.Errorf("invalid http status code: statusCode=%d", res.StatusCode)
+	}
+
+	resBody := dto.ResponseBody[T]{}
+	if err := json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+		return dto.ResponseBody[T]{}, fmt.Errorf("failed to decode response body: %w", err)
+	}
+
+	return resBody, nil
+}
+
+func quotaStatusError(status int, msg string) error {
+	switch status {
+	case dto.StatusQuotaNotFound:
+		return ErrNotFound
+	case dto.StatusQuotaAlreadyExists:
+		return ErrAlreadyExists
+	case dto.StatusQuotaNotSupported:
+		return ErrNotSupported
+	case dto.StatusQuotaInvalid:
+		return fmt.Errorf("%s: %w", msg, ErrInvalidQuota)
+	default:
+		return fmt.Errorf("invalid status code: statusCode=%d", status)
+	}
+}
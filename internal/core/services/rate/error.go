@@ -5,5 +5,10 @@ import (
 )
 
 var (
-	ErrNotFound = errors.New("not found")
+	ErrNotFound        = errors.New("not found")
+	ErrNotSupported    = errors.New("not supported")
+	ErrInvalidArgument = errors.New("invalid argument")
+
+	ErrAlreadyExists = errors.New("already exists")
+	ErrInvalidQuota  = errors.New("invalid quota")
 )
@@ -4,38 +4,54 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/benbjohnson/clock"
 	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/Blinkuu/qms/internal/core/ports"
 	"github.com/Blinkuu/qms/internal/core/storage"
-	"github.com/Blinkuu/qms/internal/core/storage/alloc"
 	"github.com/Blinkuu/qms/internal/core/storage/rate"
 	"github.com/Blinkuu/qms/internal/core/storage/rate/memory"
+	ratequota "github.com/Blinkuu/qms/internal/core/storage/rate/quota"
+	"github.com/Blinkuu/qms/internal/core/storage/rate/raft"
+	"github.com/Blinkuu/qms/internal/core/storage/rate/replicated"
 	"github.com/Blinkuu/qms/pkg/log"
+	"github.com/Blinkuu/qms/pkg/math"
 )
 
 const (
 	ServiceName = "rate"
+
+	approximateSyncTick = 100 * time.Millisecond
 )
 
 type Service struct {
 	services.NamedService
+	clock   clock.Clock
 	logger  log.Logger
 	storage rate.Storage
+	syncer  *approximateSyncer
 }
 
-func NewService(cfg Config, clock clock.Clock, logger log.Logger) (*Service, error) {
-	storage, err := storageFromConfig(cfg, clock, logger)
+func NewService(cfg Config, clock clock.Clock, logger log.Logger, reg prometheus.Registerer, memberlist ports.MemberlistService) (*Service, error) {
+	storage, err := storageFromConfig(cfg, clock, logger, reg, memberlist)
 	if err != nil {
 		return nil, fmt.Errorf("failed create storage from config: %w", err)
 	}
 
 	s := &Service{
 		NamedService: nil,
+		clock:        clock,
 		logger:       logger,
 		storage:      storage,
+		syncer:       nil,
+	}
+
+	if a, ok := storage.(approximator); ok {
+		s.syncer = newApproximateSyncer(a, memberlist, logger)
 	}
 
 	s.NamedService = services.NewBasicService(s.start, s.run, s.stop).WithName(ServiceName)
@@ -43,8 +59,70 @@ func NewService(cfg Config, clock clock.Clock, logger log.Logger) (*Service, err
 	return s, nil
 }
 
-func (s *Service) Allow(ctx context.Context, namespace, resource string, tokens int64) (time.Duration, bool, error) {
-	waitTime, ok, err := s.storage.Allow(ctx, namespace, resource, tokens)
+// Allow checks whether tokens can be taken from a rate quota. If maxWait is positive, the request is held until the
+// tokens are available, but for no longer than maxWait or the deadline of ctx. Otherwise, it returns immediately.
+// Tokens are reserved for a held request where the storage supports it, and the reservation is cancelled if ctx is done
+// before they are available, so that a caller going away does not keep them.
+func (s *Service) Allow(ctx context.Context, namespace, resource, key string, tokens int64, maxWait time.Duration) (time.Duration, bool, error) {
+	if deadline, ok := ctx.Deadline(); ok && maxWait > 0 {
+		maxWait = math.Min(maxWait, deadline.Sub(s.clock.Now()))
+	}
+
+	if maxWait <= 0 {
+		return s.allow(ctx, namespace, resource, key, tokens)
+	}
+
+	reservationID, readyAt, ok, err := s.storage.Reserve(ctx, namespace, resource, key, tokens, maxWait)
+	switch {
+	case errors.Is(err, storage.ErrNotSupported):
+		return s.allowPolling(ctx, namespace, resource, key, tokens, maxWait)
+	case errors.Is(err, storage.ErrNotFound):
+		return 0, false, ErrNotFound
+	case err != nil:
+		return 0, false, fmt.Errorf("failed to reserve: %w", err)
+	case !ok:
+		// The tokens are not available within maxWait, and the caller is told how long they would take.
+		if readyAt.IsZero() {
+			return 0, false, nil
+		}
+
+		return readyAt.Sub(s.clock.Now()), false, nil
+	}
+
+	if err := s.sleep(ctx, readyAt.Sub(s.clock.Now())); err != nil {
+		// ctx is done, so the reservation is cancelled without it.
+		if _, cancelErr := s.storage.Cancel(context.Background(), namespace, resource, reservationID); cancelErr != nil {
+			s.logger.Warn("failed to cancel reservation", "namespace", namespace, "resource", resource, "err", cancelErr)
+		}
+
+		return 0, false, fmt.Errorf("failed to wait for tokens: %w", err)
+	}
+
+	return 0, true, nil
+}
+
+// allowPolling holds a request on a storage that cannot reserve tokens, by retrying it once the tokens may be
+// available. Nothing is taken while the request waits, so there is nothing to give back if ctx is done.
+func (s *Service) allowPolling(ctx context.Context, namespace, resource, key string, tokens int64, maxWait time.Duration) (time.Duration, bool, error) {
+	waitDeadline := s.clock.Now().Add(maxWait)
+	for {
+		waitTime, ok, err := s.allow(ctx, namespace, resource, key, tokens)
+		if err != nil || ok {
+			return waitTime, ok, err
+		}
+
+		if waitTime <= 0 || waitTime > waitDeadline.Sub(s.clock.Now()) {
+			return waitTime, false, nil
+		}
+
+		if err := s.sleep(ctx, waitTime); err != nil {
+			return 0, false, fmt.Errorf("failed to wait for tokens: %w", err)
+		}
+	}
+}
+
+func (s *Service) allow(ctx context.Context, namespace, resource, key string, tokens int64) (time.Duration, bool, error) {
+	waitTime, ok, err := s.storage.Allow(ctx, namespace, resource, key, tokens, 0)
 	if err != nil {
 		switch {
 		case errors.Is(err, storage.ErrNotFound):
@@ -52,12 +130,167 @@ func (s *Service) Allow(ctx context.Context, namespace, resource string, tokens
 		default:
 		}
 
-		return 0, false, fmt.Errorf("failed to view: %w", err)
+		return 0, false, fmt.Errorf("failed to allow: %w", err)
 	}
 
 	return waitTime, ok, nil
 }
 
+func (s *Service) Reserve(ctx context.Context, namespace, resource, key string, tokens int64, maxWait time.Duration) (string, time.Time, bool, error) {
+	reservationID, readyAt, ok, err := s.storage.Reserve(ctx, namespace, resource, key, tokens, maxWait)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			return "", time.Time{}, false, ErrNotFound
+		case errors.Is(err, storage.ErrNotSupported):
+			return "", time.Time{}, false, ErrNotSupported
+		default:
+		}
+
+		return "", time.Time{}, false, fmt.Errorf("failed to reserve: %w", err)
+	}
+
+	return reservationID, readyAt, ok, nil
+}
+
+// Cancel cancels a reservation. The key is not needed to find the reservation, but it is accepted so that callers can
+// route the request the same way as the reservation.
+func (s *Service) Cancel(ctx context.Context, namespace, resource, _, reservationID string) (bool, error) {
+	ok, err := s.storage.Cancel(ctx, namespace, resource, reservationID)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return false, ErrNotFound
+		}
+
+		return false, fmt.Errorf("failed to cancel: %w", err)
+	}
+
+	return ok, nil
+}
+
+func (s *Service) Acquire(ctx context.Context, namespace, resource string, tokens int64) (string, bool, error) {
+	permitID, ok, err := s.storage.Acquire(ctx, namespace, resource, tokens)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			return "", false, ErrNotFound
+		case errors.Is(err, storage.ErrInvalidArgument):
+			return "", false, fmt.Errorf("%s: %w", err, ErrInvalidArgument)
+		default:
+		}
+
+		return "", false, fmt.Errorf("failed to acquire: %w", err)
+	}
+
+	return permitID, ok, nil
+}
+
+func (s *Service) Release(ctx context.Context, namespace, resource, permitID string) (bool, error) {
+	ok, err := s.storage.Release(ctx, namespace, resource, permitID)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			return false, ErrNotFound
+		default:
+		}
+
+		return false, fmt.Errorf("failed to release: %w", err)
+	}
+
+	return ok, nil
+}
+
+func (s *Service) CreateRateQuota(ctx context.Context, namespace, resource string, cfg ratequota.Config) error {
+	if err := s.storage.RegisterQuota(ctx, namespace, resource, cfg); err != nil {
+		return fmt.Errorf("failed to register quota: %w", quotaError(err))
+	}
+
+	return nil
+}
+
+func (s *Service) UpdateRateQuota(ctx context.Context, namespace, resource string, cfg ratequota.Config) error {
+	if err := s.storage.UpdateQuota(ctx, namespace, resource, cfg); err != nil {
+		return fmt.Errorf("failed to update quota: %w", quotaError(err))
+	}
+
+	return nil
+}
+
+func (s *Service) DeleteRateQuota(ctx context.Context, namespace, resource string) error {
+	if err := s.storage.DeleteQuota(ctx, namespace, resource); err != nil {
+		return fmt.Errorf("failed to delete quota: %w", quotaError(err))
+	}
+
+	return nil
+}
+
+func (s *Service) ListRateQuotas(ctx context.Context) ([]ratequota.Quota, error) {
+	quotas, err := s.storage.ListQuotas(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list quotas: %w", quotaError(err))
+	}
+
+	sort.Slice(quotas, func(i, j int) bool {
+		if quotas[i].Namespace != quotas[j].Namespace {
+			return quotas[i].Namespace < quotas[j].Namespace
+		}
+
+		return quotas[i].Resource < quotas[j].Resource
+	})
+
+	return quotas, nil
+}
+
+func (s *Service) Join(ctx context.Context, replicaID uint64, raftAddr string) ([]uint64, []uint64, error) {
+	raftStorage, ok := s.storage.(*raft.Storage)
+	if !ok {
+		return nil, nil, errors.New("underlying storage is not a raft storage")
+	}
+
+	return raftStorage.AddRaftReplica(ctx, replicaID, raftAddr)
+}
+
+func (s *Service) Exit(ctx context.Context, replicaID uint64, shardIDs []uint64) error {
+	raftStorage, ok := s.storage.(*raft.Storage)
+	if !ok {
+		return errors.New("underlying storage is not a raft storage")
+	}
+
+	return raftStorage.RemoveRaftReplica(ctx, replicaID, shardIDs)
+}
+
+// quotaError maps errors of quota management in storage to errors of the service.
+func quotaError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return ErrNotFound
+	case errors.Is(err, storage.ErrNotSupported):
+		return ErrNotSupported
+	case errors.Is(err, storage.ErrAlreadyExists):
+		return ErrAlreadyExists
+	case errors.Is(err, storage.ErrInvalidConfig):
+		return fmt.Errorf("%s: %w", err, ErrInvalidQuota)
+	default:
+		return err
+	}
+}
+
+func (s *Service) sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := s.clock.Timer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 func (s *Service) start(_ context.Context) error {
 	s.logger.Info("starting rate service")
 
@@ -67,9 +300,23 @@ func (s *Service) start(_ context.Context) error {
 func (s *Service) run(ctx context.Context) error {
 	s.logger.Info("running rate service")
 
-	<-ctx.Done()
+	if s.syncer == nil {
+		<-ctx.Done()
 
-	return nil
+		return nil
+	}
+
+	ticker := s.clock.Ticker(approximateSyncTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			s.syncer.sync()
+		}
+	}
 }
 
 func (s *Service) stop(err error) error {
@@ -82,11 +329,32 @@ func (s *Service) stop(err error) error {
 	return s.storage.Shutdown(context.TODO())
 }
 
-func storageFromConfig(cfg Config, clock clock.Clock, logger log.Logger) (rate.Storage, error) {
-	var storage rate.Storage
+func storageFromConfig(cfg Config, clock clock.Clock, logger log.Logger, reg prometheus.Registerer, memberlist ports.MemberlistService) (rate.Storage, error) {
+	var st rate.Storage
 	switch cfg.Storage.Backend {
-	case alloc.Memory:
-		storage = memory.NewStorage(clock)
+	case rate.Memory:
+		st = memory.NewStorage(clock, reg)
+	case rate.Replicated:
+		replicatedStorage := replicated.NewStorage(cfg.Storage.Replicated, clock, logger, reg, memberlist)
+
+		go func() {
+			if err := replicatedStorage.Run(context.Background()); err != nil {
+				logger.Panic("failed to run replicated storage", "err", err)
+			}
+		}()
+
+		st = replicatedStorage
+	case rate.Raft:
+		raftStorage, err := raft.NewStorage(cfg.Storage.Raft, clock, logger, memberlist)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new raft storage: %w", err)
+		}
+
+		if err := raftStorage.AwaitHealthy(context.Background()); err != nil {
+			return nil, fmt.Errorf("failed to await healthy for raft storage: %w", err)
+		}
+
+		st = raftStorage
 	default:
 		return nil, fmt.Errorf("%s backend is not supported", cfg.Storage.Backend)
 	}
@@ -94,11 +362,11 @@ func storageFromConfig(cfg Config, clock clock.Clock, logger log.Logger) (rate.S
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	for _, quota := range cfg.Quotas {
-		err := storage.RegisterQuota(ctx, quota.Namespace, quota.Resource, quota.Strategy)
-		if err != nil {
+		err := st.RegisterQuota(ctx, quota.Namespace, quota.Resource, quota.Strategy)
+		if err != nil && !errors.Is(err, storage.ErrAlreadyExists) {
 			logger.Warn("failed to register quota", "err", err)
 		}
 	}
 
-	return storage, nil
+	return st, nil
 }
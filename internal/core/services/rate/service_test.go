@@ -0,0 +1,71 @@
+package rate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Blinkuu/qms/internal/core/storage/rate/memory"
+	ratequota "github.com/Blinkuu/qms/internal/core/storage/rate/quota"
+	"github.com/Blinkuu/qms/pkg/log"
+)
+
+func TestService_Allow_CancelsReservationWhenContextIsDoneWhileWaiting(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	st := memory.NewStorage(c, prometheus.NewRegistry())
+	err := st.RegisterQuota(context.Background(), "namespace", "resource", ratequota.Config{Algorithm: memory.GCRAAlgorithm, Unit: "minute", RequestPerUnit: 1})
+	require.NoError(t, err)
+	s := &Service{clock: c, logger: log.NewNoopLogger(), storage: st}
+	_, ok, err := s.Allow(context.Background(), "namespace", "resource", "", 1, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// When
+	_, ok, err = s.Allow(ctx, "namespace", "resource", "", 1, time.Minute)
+
+	// Then
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, ok)
+
+	c.Add(time.Minute)
+	_, ok, err = s.Allow(context.Background(), "namespace", "resource", "", 1, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestService_Allow_ReturnsWaitTimeOfTokenBucketWhenTokensAreNotAvailableWithinMaxWait(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	st := memory.NewStorage(c, prometheus.NewRegistry())
+	err := st.RegisterQuota(context.Background(), "namespace", "resource", ratequota.Config{Algorithm: memory.TokenBucketAlgorithm, Unit: "second", RequestPerUnit: 1})
+	require.NoError(t, err)
+	s := &Service{clock: c, logger: log.NewNoopLogger(), storage: st}
+	_, ok, err := s.Allow(context.Background(), "namespace", "resource", "", 1, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// When
+	wait, ok, err := s.Allow(context.Background(), "namespace", "resource", "", 1, 500*time.Millisecond)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	// When
+	wait, ok, err = s.Allow(context.Background(), "namespace", "resource", "", 1, 0)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Zero(t, wait)
+}
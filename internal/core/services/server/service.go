@@ -38,6 +38,7 @@ func NewService(cfg Config, clock clock.Clock, logger log.Logger, reg prometheus
 	router.Use(
 		gorillamux.TimeoutMiddleware(10*time.Second),
 		gorillamux.TraceMiddleware(tp, "gorillamux"),
+		gorillamux.CallerMiddleware(),
 		gorillamux.MetricsMiddleware(clock, reg, "default", "qms", "gorillamux"),
 		gorillamux.LogMiddleware(logger, "gorillamux"),
 	)
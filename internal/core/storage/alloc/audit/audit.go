@@ -0,0 +1,127 @@
+package audit
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/Blinkuu/qms/pkg/caller"
+	"github.com/Blinkuu/qms/pkg/dto"
+	"github.com/Blinkuu/qms/pkg/log"
+)
+
+type Operation string
+
+const (
+	Alloc         Operation = "alloc"
+	Free          Operation = "free"
+	RegisterQuota Operation = "register_quota"
+	UpdateQuota   Operation = "update_quota"
+	DeleteQuota   Operation = "delete_quota"
+	Import        Operation = "import"
+	AllocBatch    Operation = "alloc_batch"
+	AbortBatch    Operation = "abort_batch"
+	ExpireLease   Operation = "expire_lease"
+	ResetPeriod   Operation = "reset_period"
+)
+
+const (
+	resultOK       = "ok"
+	resultRejected = "rejected"
+)
+
+// State is the state of a quota before or after a mutation. The strategy is only recorded by quota management.
+type State struct {
+	Allocated int64              `json:"allocated"`
+	Capacity  int64              `json:"capacity"`
+	Version   int64              `json:"version"`
+	Strategy  *dto.QuotaStrategy `json:"strategy,omitempty"`
+}
+
+// Entry is a mutation of a quota, along with who requested it. Index is the index of the raft log entry that applied
+// the mutation, and is only set by the raft backend. Before is not set if the quota did not exist, and After is only
+// set if the mutation was applied.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Index     uint64    `json:"index,omitempty"`
+	Operation Operation `json:"operation"`
+	Namespace string    `json:"namespace"`
+	Resource  string    `json:"resource"`
+	Caller    string    `json:"caller,omitempty"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	Holder    string    `json:"holder,omitempty"`
+	Tokens    int64     `json:"tokens,omitempty"`
+	LeaseID   string    `json:"lease_id,omitempty"`
+	Before    *State    `json:"before,omitempty"`
+	After     *State    `json:"after,omitempty"`
+	Result    string    `json:"result"`
+}
+
+// NewEntry returns an entry of a mutation requested with ctx, which carries the identity of the caller and the trace.
+func NewEntry(ctx context.Context, now time.Time, op Operation, namespace, resource string) Entry {
+	return Entry{
+		Time:      now,
+		Operation: op,
+		Namespace: namespace,
+		Resource:  resource,
+		Caller:    caller.FromContext(ctx),
+		TraceID:   TraceID(ctx),
+	}
+}
+
+// SetResult sets the result of the entry to the error of the mutation, if any, or to whether it was applied. The state
+// after a mutation that was not applied is dropped.
+func (e *Entry) SetResult(ok bool, err error) {
+	if !ok || err != nil {
+		e.After = nil
+	}
+
+	switch {
+	case err != nil:
+		e.Result = err.Error()
+	case !ok:
+		e.Result = resultRejected
+	default:
+		e.Result = resultOK
+	}
+}
+
+// TraceID returns the ID of the trace carried by ctx, or an empty string if there is none.
+func TraceID(ctx context.Context) string {
+	traceID := trace.SpanFromContext(ctx).SpanContext().TraceID()
+	if !traceID.IsValid() {
+		return ""
+	}
+
+	return traceID.String()
+}
+
+// Log records entries to a sink. Entries that cannot be written are logged instead, since the mutations they describe
+// have already been applied.
+type Log struct {
+	sink   Sink
+	logger log.Logger
+}
+
+func NewLog(sink Sink, logger log.Logger) *Log {
+	return &Log{
+		sink:   sink,
+		logger: logger,
+	}
+}
+
+// NewNopLog returns a log discarding all entries.
+func NewNopLog() *Log {
+	return NewLog(NopSink{}, log.NewNoopLogger())
+}
+
+func (l *Log) Record(e Entry) {
+	if err := l.sink.Write(e); err != nil {
+		l.logger.Warn("failed to write audit entry", "err", err, "operation", e.Operation, "namespace", e.Namespace, "resource", e.Resource)
+	}
+}
+
+func (l *Log) Close() error {
+	return l.sink.Close()
+}
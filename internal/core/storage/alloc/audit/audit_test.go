@@ -0,0 +1,54 @@
+package audit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntry_SetResult(t *testing.T) {
+	type args struct {
+		ok  bool
+		err error
+	}
+	tests := []struct {
+		name      string
+		args      args
+		want      string
+		wantAfter bool
+	}{
+		{
+			name:      "applied mutation keeps the state after it",
+			args:      args{ok: true},
+			want:      "ok",
+			wantAfter: true,
+		},
+		{
+			name:      "rejected mutation drops the state after it",
+			args:      args{ok: false},
+			want:      "rejected",
+			wantAfter: false,
+		},
+		{
+			name:      "failed mutation records the error",
+			args:      args{ok: true, err: errors.New("not found")},
+			want:      "not found",
+			wantAfter: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Given
+			e := Entry{Before: &State{Allocated: 1}, After: &State{Allocated: 2}}
+
+			// When
+			e.SetResult(tt.args.ok, tt.args.err)
+
+			// Then
+			assert.Equal(t, tt.want, e.Result)
+			assert.Equal(t, tt.wantAfter, e.After != nil)
+			assert.NotNil(t, e.Before)
+		})
+	}
+}
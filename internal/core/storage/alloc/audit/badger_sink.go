@@ -0,0 +1,110 @@
+package audit
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+
+	"github.com/Blinkuu/qms/pkg/log"
+	badgerlog "github.com/Blinkuu/qms/pkg/log/badger"
+)
+
+const (
+	entryKeyPrefix = "__audit__"
+	sequenceKey    = "__audit_sequence__"
+
+	sequenceBandwidth = 1000
+)
+
+// BadgerSink writes entries to a badger store as JSON. The entries are keyed by a sequence number encoded big-endian,
+// so that they are sorted in the order they were written.
+type BadgerSink struct {
+	db  *badger.DB
+	seq *badger.Sequence
+}
+
+func NewBadgerSink(dir string, logger log.Logger) (*BadgerSink, error) {
+	opts := badger.DefaultOptions(dir)
+	opts.Logger = badgerlog.NewLogger(logger)
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open badger: %w", err)
+	}
+
+	seq, err := db.GetSequence([]byte(sequenceKey), sequenceBandwidth)
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to get sequence: %w", err)
+	}
+
+	return &BadgerSink{
+		db:  db,
+		seq: seq,
+	}, nil
+}
+
+func (s *BadgerSink) Write(e Entry) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal entry: %w", err)
+	}
+
+	n, err := s.seq.Next()
+	if err != nil {
+		return fmt.Errorf("failed to get next sequence number: %w", err)
+	}
+
+	key := make([]byte, len(entryKeyPrefix)+8)
+	copy(key, entryKeyPrefix)
+	binary.BigEndian.PutUint64(key[len(entryKeyPrefix):], n)
+
+	err = s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, buf)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set entry: %w", err)
+	}
+
+	return nil
+}
+
+// Entries returns all entries written, in the order they were written.
+func (s *BadgerSink) Entries() ([]Entry, error) {
+	var entries []Entry
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(entryKeyPrefix)
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			var e Entry
+			err := iter.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &e)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to read entry: %w", err)
+			}
+
+			entries = append(entries, e)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (s *BadgerSink) Close() error {
+	if err := s.seq.Release(); err != nil {
+		_ = s.db.Close()
+		return fmt.Errorf("failed to release sequence: %w", err)
+	}
+
+	return s.db.Close()
+}
@@ -0,0 +1,79 @@
+package audit
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Blinkuu/qms/pkg/log"
+	"github.com/Blinkuu/qms/pkg/strutil"
+)
+
+const (
+	None   = "none"
+	File   = "file"
+	Stdout = "stdout"
+	Badger = "badger"
+)
+
+type Config struct {
+	Sink   string       `yaml:"sink"`
+	File   FileConfig   `yaml:"file"`
+	Badger BadgerConfig `yaml:"badger"`
+}
+
+func (c *Config) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix string) {
+	f.StringVar(&c.Sink, strutil.WithPrefixOrDefault(prefix, "sink"), None, "")
+
+	c.File.RegisterFlagsWithPrefix(f, strutil.WithPrefixOrDefault(prefix, File))
+	c.Badger.RegisterFlagsWithPrefix(f, strutil.WithPrefixOrDefault(prefix, Badger))
+}
+
+type FileConfig struct {
+	Path       string `yaml:"path"`
+	MaxSize    int64  `yaml:"max_size"`
+	MaxBackups int    `yaml:"max_backups"`
+}
+
+func (c *FileConfig) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix string) {
+	f.StringVar(&c.Path, strutil.WithPrefixOrDefault(prefix, "path"), "/tmp/qms/audit/audit.log", "")
+	f.Int64Var(&c.MaxSize, strutil.WithPrefixOrDefault(prefix, "max_size"), 100<<20, "")
+	f.IntVar(&c.MaxBackups, strutil.WithPrefixOrDefault(prefix, "max_backups"), 5, "")
+}
+
+type BadgerConfig struct {
+	Dir string `yaml:"dir"`
+}
+
+func (c *BadgerConfig) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix string) {
+	f.StringVar(&c.Dir, strutil.WithPrefixOrDefault(prefix, "dir"), "/tmp/qms/data/audit", "")
+}
+
+// NewLogFromConfig returns a log recording entries to the configured sink.
+func NewLogFromConfig(cfg Config, logger log.Logger) (*Log, error) {
+	var sink Sink
+	switch cfg.Sink {
+	case None:
+		sink = NopSink{}
+	case File:
+		s, err := NewFileSink(cfg.File.Path, cfg.File.MaxSize, cfg.File.MaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new file sink: %w", err)
+		}
+
+		sink = s
+	case Stdout:
+		sink = NewWriterSink(os.Stdout)
+	case Badger:
+		s, err := NewBadgerSink(cfg.Badger.Dir, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new badger sink: %w", err)
+		}
+
+		sink = s
+	default:
+		return nil, fmt.Errorf("%s audit sink is not supported", cfg.Sink)
+	}
+
+	return NewLog(sink, logger), nil
+}
@@ -0,0 +1,57 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSink_Write_RotatesFileAndDropsBackupsBeyondMaxBackups(t *testing.T) {
+	// Given
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s, err := NewFileSink(path, 1, 2)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, s.Close())
+	}()
+
+	// When
+	for _, resource := range []string{"a", "b", "c", "d"} {
+		err := s.Write(Entry{Time: time.Unix(0, 0).UTC(), Operation: Alloc, Namespace: "namespace", Resource: resource, Result: resultOK})
+		require.NoError(t, err)
+	}
+
+	// Then
+	assert.Equal(t, []string{"d"}, readResources(t, path))
+	assert.Equal(t, []string{"c"}, readResources(t, path+".1"))
+	assert.Equal(t, []string{"b"}, readResources(t, path+".2"))
+	assert.NoFileExists(t, path+".3")
+}
+
+func readResources(t *testing.T, path string) []string {
+	t.Helper()
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, file.Close())
+	}()
+
+	var resources []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e Entry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		resources = append(resources, e.Resource)
+	}
+
+	require.NoError(t, scanner.Err())
+
+	return resources
+}
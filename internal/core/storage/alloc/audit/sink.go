@@ -0,0 +1,58 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Sink writes the entries of the audit log somewhere durable. It is safe for concurrent use.
+type Sink interface {
+	Write(e Entry) error
+	Close() error
+}
+
+// NopSink discards all entries.
+type NopSink struct{}
+
+func (NopSink) Write(Entry) error {
+	return nil
+}
+
+func (NopSink) Close() error {
+	return nil
+}
+
+// WriterSink writes entries to a writer as JSON, one per line.
+type WriterSink struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{
+		w:  w,
+		mu: &sync.Mutex{},
+	}
+}
+
+func (s *WriterSink) Write(e Entry) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal entry: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.w.Write(append(buf, '\n')); err != nil {
+		return fmt.Errorf("failed to write entry: %w", err)
+	}
+
+	return nil
+}
+
+func (s *WriterSink) Close() error {
+	return nil
+}
@@ -0,0 +1,219 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// magic starts every backup, followed by its format version.
+var magic = []byte("QMSBACKUP\x01")
+
+// Writer writes a backup made of sections, each holding the keys of one database. A section starts with its ID, and
+// is followed by the length-prefixed keys and values, and a key of zero length, which badger does not allow.
+type Writer struct {
+	w       *bufio.Writer
+	started bool
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w: bufio.NewWriter(w),
+	}
+}
+
+// WriteSection writes a section holding all keys visible to txn, so the section is a consistent snapshot of the
+// database of txn.
+func (w *Writer) WriteSection(id uint64, txn *badger.Txn) error {
+	if err := w.startSection(id); err != nil {
+		return err
+	}
+
+	iter := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer iter.Close()
+
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		value, err := iter.Item().ValueCopy(nil)
+		if err != nil {
+			return fmt.Errorf("failed to copy value: %w", err)
+		}
+
+		if err := w.writeBytes(iter.Item().Key()); err != nil {
+			return fmt.Errorf("failed to write key: %w", err)
+		}
+
+		if err := w.writeBytes(value); err != nil {
+			return fmt.Errorf("failed to write value: %w", err)
+		}
+	}
+
+	if err := w.writeUvarint(0); err != nil {
+		return fmt.Errorf("failed to write end of section: %w", err)
+	}
+
+	return nil
+}
+
+// CopySection writes a section holding the keys of the current section of r, so that sections of backups written
+// elsewhere can be gathered into one.
+func (w *Writer) CopySection(id uint64, r *Reader) error {
+	if err := w.startSection(id); err != nil {
+		return err
+	}
+
+	for {
+		key, value, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read section: %w", err)
+		}
+
+		if err := w.writeBytes(key); err != nil {
+			return fmt.Errorf("failed to write key: %w", err)
+		}
+
+		if err := w.writeBytes(value); err != nil {
+			return fmt.Errorf("failed to write value: %w", err)
+		}
+	}
+
+	if err := w.writeUvarint(0); err != nil {
+		return fmt.Errorf("failed to write end of section: %w", err)
+	}
+
+	return nil
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// startSection writes the ID of a section, preceded by the magic if it is the first one.
+func (w *Writer) startSection(id uint64) error {
+	if !w.started {
+		if _, err := w.w.Write(magic); err != nil {
+			return fmt.Errorf("failed to write magic: %w", err)
+		}
+
+		w.started = true
+	}
+
+	if err := w.writeUvarint(id); err != nil {
+		return fmt.Errorf("failed to write section id: %w", err)
+	}
+
+	return nil
+}
+
+func (w *Writer) writeUvarint(v uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	_, err := w.w.Write(buf[:n])
+
+	return err
+}
+
+func (w *Writer) writeBytes(b []byte) error {
+	if err := w.writeUvarint(uint64(len(b))); err != nil {
+		return err
+	}
+
+	_, err := w.w.Write(b)
+
+	return err
+}
+
+// Reader reads a backup written by a Writer.
+type Reader struct {
+	r       *bufio.Reader
+	started bool
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r: bufio.NewReader(r),
+	}
+}
+
+// NextSection returns the ID of the next section, whose keys are then returned by Next. Returns io.EOF once there are
+// no more sections.
+func (r *Reader) NextSection() (uint64, error) {
+	if !r.started {
+		buf := make([]byte, len(magic))
+		if _, err := io.ReadFull(r.r, buf); err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, io.EOF
+			}
+
+			return 0, fmt.Errorf("failed to read magic: %w", err)
+		}
+
+		if !bytes.Equal(buf, magic) {
+			return 0, errors.New("not a backup")
+		}
+
+		r.started = true
+	}
+
+	id, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, io.EOF
+		}
+
+		return 0, fmt.Errorf("failed to read section id: %w", err)
+	}
+
+	return id, nil
+}
+
+// Next returns the next key and value of the current section. Returns io.EOF at the end of the section.
+func (r *Reader) Next() ([]byte, []byte, error) {
+	key, err := r.readBytes()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read key: %w", err)
+	}
+
+	if len(key) == 0 {
+		return nil, nil, io.EOF
+	}
+
+	value, err := r.readBytes()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read value: %w", err)
+	}
+
+	return key, value, nil
+}
+
+func (r *Reader) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	return b, nil
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, since a backup cannot end in the middle of a section.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
@@ -0,0 +1,127 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader_ReadsSectionsWrittenByWriter(t *testing.T) {
+	// Given
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, db.Close())
+	}()
+
+	err = db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set([]byte("a"), []byte("1")); err != nil {
+			return err
+		}
+
+		if err := txn.Set([]byte("b"), []byte("2")); err != nil {
+			return err
+		}
+
+		return txn.Set([]byte("c"), []byte("3"))
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(txn *badger.Txn) error { return txn.Delete([]byte("b")) }))
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, db.View(func(txn *badger.Txn) error { return w.WriteSection(1, txn) }))
+	require.NoError(t, db.View(func(txn *badger.Txn) error { return w.WriteSection(2, txn) }))
+	require.NoError(t, w.Flush())
+
+	// When
+	sections := make(map[uint64]map[string]string)
+	r := NewReader(&buf)
+	for {
+		id, err := r.NextSection()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		sections[id] = make(map[string]string)
+		for {
+			key, value, err := r.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+
+			sections[id][string(key)] = string(value)
+		}
+	}
+
+	// Then
+	want := map[string]string{"a": "1", "c": "3"}
+	assert.Equal(t, map[uint64]map[string]string{1: want, 2: want}, sections)
+}
+
+func TestReader_NextSection_ReturnsErrorWithoutMagic(t *testing.T) {
+	// Given
+	r := NewReader(bytes.NewReader([]byte("definitely not a backup")))
+
+	// When
+	_, err := r.NextSection()
+
+	// Then
+	assert.EqualError(t, err, "not a backup")
+}
+
+func TestWriter_CopySection_CopiesSectionOfAnotherBackup(t *testing.T) {
+	// Given
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, db.Close())
+	}()
+
+	require.NoError(t, db.Update(func(txn *badger.Txn) error { return txn.Set([]byte("a"), []byte("1")) }))
+
+	var src bytes.Buffer
+	sw := NewWriter(&src)
+	require.NoError(t, db.View(func(txn *badger.Txn) error { return sw.WriteSection(2, txn) }))
+	require.NoError(t, sw.Flush())
+
+	sr := NewReader(&src)
+	id, err := sr.NextSection()
+	require.NoError(t, err)
+
+	var dst bytes.Buffer
+	w := NewWriter(&dst)
+	require.NoError(t, db.View(func(txn *badger.Txn) error { return w.WriteSection(1, txn) }))
+
+	// When
+	err = w.CopySection(id, sr)
+
+	// Then
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+
+	r := NewReader(&dst)
+	for _, want := range []uint64{1, 2} {
+		id, err := r.NextSection()
+		require.NoError(t, err)
+		assert.Equal(t, want, id)
+
+		key, value, err := r.Next()
+		require.NoError(t, err)
+		assert.Equal(t, "a", string(key))
+		assert.Equal(t, "1", string(value))
+
+		_, _, err = r.Next()
+		assert.ErrorIs(t, err, io.EOF)
+	}
+
+	_, err = r.NextSection()
+	assert.ErrorIs(t, err, io.EOF)
+}
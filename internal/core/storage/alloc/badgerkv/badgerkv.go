@@ -0,0 +1,1295 @@
+// Package badgerkv holds the layout of alloc quotas in badger, shared by the local and the raft storages. The helpers
+// work within the transaction of their caller, which commits it.
+package badgerkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+
+	stor "github.com/Blinkuu/qms/internal/core/storage"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/audit"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/batch"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/export"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/history"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/watch"
+)
+
+// The keys of the records kept along with the item of a quota, which is stored under the key of the quota itself.
+const (
+	QuotaRefKeyPrefix = "__quota__"
+	HoldersKeyPrefix  = "__holders__"
+	ResultKeyPrefix   = "__result__"
+	LeaseKeyPrefix    = "__lease__"
+	PeriodKeyPrefix   = "__period__"
+	historyKeyPrefix  = "__history__"
+)
+
+// QuotaRef maps the key of an item back to its namespace-resource pair, so that quotas can be listed.
+type QuotaRef struct {
+	Namespace string `json:"namespace"`
+	Resource  string `json:"resource"`
+	Parent    string `json:"parent,omitempty"`
+
+	SoftLimit  int64   `json:"soft_limit,omitempty"`
+	Overcommit float64 `json:"overcommit,omitempty"`
+
+	Period   string `json:"period,omitempty"`
+	TimeZone string `json:"time_zone,omitempty"`
+}
+
+// Config returns the configuration of the quota referenced, with the capacity of its item.
+func (r QuotaRef) Config(capacity int64) quota.Config {
+	return quota.Config{Capacity: capacity, Parent: r.Parent, SoftLimit: r.SoftLimit, Overcommit: r.Overcommit, Period: r.Period, TimeZone: r.TimeZone}
+}
+
+// Ancestor is the key of an ancestor of a quota, along with the holder under which it accounts the tokens charged
+// through the quota.
+type Ancestor struct {
+	ID     string
+	Holder string
+}
+
+// Lease holds tokens allocated from a quota until it expires. ExpiresAt is in Unix nanoseconds.
+type Lease struct {
+	Namespace string `json:"namespace"`
+	Resource  string `json:"resource"`
+	Holder    string `json:"holder,omitempty"`
+	Tokens    int64  `json:"tokens"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// The operations whose results are remembered for their idempotency keys.
+const (
+	AllocOp = "alloc"
+	FreeOp  = "free"
+)
+
+// Result is the result of an alloc or free remembered for its idempotency key. ExpiresAt is in Unix nanoseconds.
+type Result struct {
+	RemainingTokens int64  `json:"remaining_tokens"`
+	CurrentVersion  int64  `json:"current_version"`
+	LeaseID         string `json:"lease_id,omitempty"`
+	OK              bool   `json:"ok"`
+	OverSoftLimit   bool   `json:"over_soft_limit,omitempty"`
+	ExpiresAt       int64  `json:"expires_at"`
+}
+
+// Item is the state of a quota.
+type Item struct {
+	Allocated int64
+	Capacity  int64
+	Version   int64
+}
+
+// historySample is the usage of a quota over a window of the history, stored under the start of the window.
+type historySample struct {
+	Allocated    int64
+	MaxAllocated int64
+	Capacity     int64
+}
+
+// AuditState returns the state of an item for the audit log.
+func AuditState(it Item) *audit.State {
+	return &audit.State{Allocated: it.Allocated, Capacity: it.Capacity, Version: it.Version}
+}
+
+// QuotaAuditState returns the state of an item for the audit log, along with the configuration of its quota. The
+// shrink policy is left out, since it only applies to the update carrying it.
+func QuotaAuditState(it Item, cfg quota.Config) *audit.State {
+	cfg.ShrinkPolicy = ""
+	strategy := cfg.DTO()
+	state := AuditState(it)
+	state.Strategy = &strategy
+
+	return state
+}
+
+// ValidateConfig checks the configuration of a quota on its own, without its parent.
+func ValidateConfig(cfg quota.Config) error {
+	if cfg.Capacity <= 0 {
+		return fmt.Errorf("capacity must be greater than 0: %w", stor.ErrInvalidConfig)
+	}
+
+	if cfg.SoftLimit < 0 {
+		return fmt.Errorf("soft limit must not be negative: %w", stor.ErrInvalidConfig)
+	}
+
+	if cfg.Overcommit != 0 && cfg.Overcommit < 1 {
+		return fmt.Errorf("overcommit must be at least 1: %w", stor.ErrInvalidConfig)
+	}
+
+	if !cfg.ShrinkPolicy.Valid() {
+		return fmt.Errorf("unknown Shrink policy %s: %w", cfg.ShrinkPolicy, stor.ErrInvalidConfig)
+	}
+
+	if _, err := cfg.PeriodStart(time.Time{}); err != nil {
+		return fmt.Errorf("invalid period: %s: %w", err, stor.ErrInvalidConfig)
+	}
+
+	return nil
+}
+
+// SetQuotaRef stores the reference of a quota along with the parts of its configuration not kept in its item.
+func SetQuotaRef(txn *badger.Txn, id, namespace, resource string, cfg quota.Config) error {
+	buf, err := json.Marshal(QuotaRef{Namespace: namespace, Resource: resource, Parent: cfg.Parent, SoftLimit: cfg.SoftLimit, Overcommit: cfg.Overcommit, Period: cfg.Period, TimeZone: cfg.TimeZone})
+	if err != nil {
+		return fmt.Errorf("failed to marshal quota ref: %w", err)
+	}
+
+	if err := txn.Set([]byte(QuotaRefKeyPrefix+id), buf); err != nil {
+		return fmt.Errorf("failed to set value: %w", err)
+	}
+
+	return nil
+}
+
+// GetQuotaRef returns the reference of a quota, and false if it has none.
+func GetQuotaRef(txn *badger.Txn, id string) (QuotaRef, bool, error) {
+	it, err := txn.Get([]byte(QuotaRefKeyPrefix + id))
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return QuotaRef{}, false, nil
+		}
+
+		return QuotaRef{}, false, fmt.Errorf("failed to get key: %w", err)
+	}
+
+	var ref QuotaRef
+	err = it.Value(func(val []byte) error {
+		return json.Unmarshal(val, &ref)
+	})
+	if err != nil {
+		return QuotaRef{}, false, fmt.Errorf("failed to read quota ref: %w", err)
+	}
+
+	return ref, true, nil
+}
+
+// GetConfig returns the configuration of a quota, combining its item with its reference.
+func GetConfig(txn *badger.Txn, id string, it Item) (quota.Config, error) {
+	ref, _, err := GetQuotaRef(txn, id)
+	if err != nil {
+		return quota.Config{}, fmt.Errorf("failed to get quota ref: %w", err)
+	}
+
+	return ref.Config(it.Capacity), nil
+}
+
+// GetAncestors returns the ancestors of a quota, starting with its parent.
+func GetAncestors(txn *badger.Txn, id string) ([]Ancestor, error) {
+	var ancestors []Ancestor
+	for {
+		ref, found, err := GetQuotaRef(txn, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if !found {
+			return ancestors, nil
+		}
+
+		namespace, resource, ok := quota.Config{Parent: ref.Parent}.ParentRef()
+		if !ok {
+			return ancestors, nil
+		}
+
+		id = strings.Join([]string{namespace, resource}, "_")
+		ancestors = append(ancestors, Ancestor{ID: id, Holder: quota.ChildHolder(ref.Namespace, ref.Resource)})
+	}
+}
+
+// FitAncestors reports whether tokens fit into all ancestors of a quota.
+func FitAncestors(txn *badger.Txn, ancestors []Ancestor, tokens int64) (bool, error) {
+	for _, a := range ancestors {
+		it, err := Get[Item](txn, a.ID)
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
+
+			return false, fmt.Errorf("failed to get: %w", err)
+		}
+
+		cfg, err := GetConfig(txn, a.ID, it)
+		if err != nil {
+			return false, fmt.Errorf("failed to get config: %w", err)
+		}
+
+		if it.Allocated+tokens > cfg.Limit() {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// ChargeAncestors charges tokens to all ancestors of a quota, or releases them if tokens is negative. Released tokens
+// never drop the allocated tokens of an ancestor below 0.
+func ChargeAncestors(txn *badger.Txn, ancestors []Ancestor, tokens int64) error {
+	for _, a := range ancestors {
+		it, err := Get[Item](txn, a.ID)
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
+
+			return fmt.Errorf("failed to get: %w", err)
+		}
+
+		it.Allocated += tokens
+		if it.Allocated < 0 {
+			it.Allocated = 0
+		}
+
+		it.Version += 1
+		if err := Set[Item](txn, a.ID, it); err != nil {
+			return fmt.Errorf("failed to set item: %w", err)
+		}
+
+		holders, err := GetHolders(txn, a.ID)
+		if err != nil {
+			return fmt.Errorf("failed to get holders: %w", err)
+		}
+
+		holders[a.Holder] += tokens
+		if err := SetHolders(txn, a.ID, holders); err != nil {
+			return fmt.Errorf("failed to set holders: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Shrink sets the capacity of a quota and bumps its version. The shrink policy of cfg decides what happens if the
+// allocated tokens exceed the new limit.
+func Shrink(txn *badger.Txn, id string, it Item, cfg quota.Config) error {
+	if cfg.Limit() < it.Allocated {
+		switch cfg.ShrinkPolicy {
+		case quota.ShrinkPolicyOverQuota:
+		case quota.ShrinkPolicyClamp:
+			dropped := it.Allocated - cfg.Limit()
+			holders, err := GetHolders(txn, id)
+			if err != nil {
+				return fmt.Errorf("failed to get holders: %w", err)
+			}
+
+			quota.DropExcess(holders, it.Allocated, dropped)
+			if err := SetHolders(txn, id, holders); err != nil {
+				return fmt.Errorf("failed to set holders: %w", err)
+			}
+
+			ancestors, err := GetAncestors(txn, id)
+			if err != nil {
+				return fmt.Errorf("failed to get ancestors: %w", err)
+			}
+
+			if err := ChargeAncestors(txn, ancestors, -dropped); err != nil {
+				return fmt.Errorf("failed to release ancestors: %w", err)
+			}
+
+			it.Allocated = cfg.Limit()
+		default:
+			return stor.ErrCapacityBelowAllocated
+		}
+	}
+
+	it.Capacity = cfg.Capacity
+	it.Version += 1
+	if err := Set[Item](txn, id, it); err != nil {
+		return fmt.Errorf("failed to set item: %w", err)
+	}
+
+	return nil
+}
+
+// Publish sends the state of the given quotas, and of their ancestors, to their watchers.
+func Publish(txn *badger.Txn, hub *watch.Hub, ids []string) error {
+	for _, id := range ids {
+		ancestors, err := GetAncestors(txn, id)
+		if err != nil {
+			return fmt.Errorf("failed to get ancestors: %w", err)
+		}
+
+		quotaIDs := []string{id}
+		for _, a := range ancestors {
+			quotaIDs = append(quotaIDs, a.ID)
+		}
+
+		for _, quotaID := range quotaIDs {
+			it, err := Get[Item](txn, quotaID)
+			if err != nil {
+				if errors.Is(err, badger.ErrKeyNotFound) {
+					continue
+				}
+
+				return fmt.Errorf("failed to get: %w", err)
+			}
+
+			ref, found, err := GetQuotaRef(txn, quotaID)
+			if err != nil {
+				return fmt.Errorf("failed to get quota ref: %w", err)
+			}
+
+			if !found {
+				continue
+			}
+
+			hub.Publish(ref.Namespace, ref.Resource, watch.Event{Allocated: it.Allocated, Capacity: it.Capacity, Version: it.Version})
+		}
+	}
+
+	return nil
+}
+
+// ValidateParent checks that the parent of a quota exists, and that it does not make the quota its own ancestor.
+func ValidateParent(txn *badger.Txn, id string, cfg quota.Config) error {
+	if cfg.Parent == "" {
+		return nil
+	}
+
+	namespace, resource, ok := cfg.ParentRef()
+	if !ok {
+		return fmt.Errorf("parent must be a namespace/resource pair: %w", stor.ErrInvalidConfig)
+	}
+
+	parentID := strings.Join([]string{namespace, resource}, "_")
+	if _, err := Get[Item](txn, parentID); err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return fmt.Errorf("parent %s does not exist: %w", cfg.Parent, stor.ErrInvalidConfig)
+		}
+
+		return fmt.Errorf("failed to get: %w", err)
+	}
+
+	parentRef, _, err := GetQuotaRef(txn, parentID)
+	if err != nil {
+		return fmt.Errorf("failed to get quota ref: %w", err)
+	}
+
+	// Resetting a parent would drop the tokens charged by its children.
+	if parentRef.Period != "" {
+		return fmt.Errorf("parent %s is periodic: %w", cfg.Parent, stor.ErrInvalidConfig)
+	}
+
+	ancestors, err := GetAncestors(txn, parentID)
+	if err != nil {
+		return fmt.Errorf("failed to get ancestors: %w", err)
+	}
+
+	if parentID == id {
+		return fmt.Errorf("quota cannot be its own ancestor: %w", stor.ErrInvalidConfig)
+	}
+
+	for _, a := range ancestors {
+		if a.ID == id {
+			return fmt.Errorf("quota cannot be its own ancestor: %w", stor.ErrInvalidConfig)
+		}
+	}
+
+	return nil
+}
+
+// HasChildren reports whether any quota has the given quota as its parent.
+func HasChildren(txn *badger.Txn, namespace, resource string) (bool, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(QuotaRefKeyPrefix)
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		var ref QuotaRef
+		err := iter.Item().Value(func(val []byte) error {
+			return json.Unmarshal(val, &ref)
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to read quota ref: %w", err)
+		}
+
+		if ref.Parent == namespace+"/"+resource {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// ListQuotaRefs returns the references of all quotas.
+func ListQuotaRefs(txn *badger.Txn) ([]QuotaRef, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(QuotaRefKeyPrefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var refs []QuotaRef
+	for it.Rewind(); it.Valid(); it.Next() {
+		var ref QuotaRef
+		err := it.Item().Value(func(val []byte) error {
+			return json.Unmarshal(val, &ref)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read quota ref: %w", err)
+		}
+
+		refs = append(refs, ref)
+	}
+
+	return refs, nil
+}
+
+// GetHolders returns the tokens allocated by each holder of an item.
+func GetHolders(txn *badger.Txn, id string) (map[string]int64, error) {
+	holders := make(map[string]int64)
+	it, err := txn.Get([]byte(HoldersKeyPrefix + id))
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return holders, nil
+		}
+
+		return nil, fmt.Errorf("failed to get key: %w", err)
+	}
+
+	err = it.Value(func(val []byte) error {
+		return json.Unmarshal(val, &holders)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read holders: %w", err)
+	}
+
+	return holders, nil
+}
+
+// SetHolders stores the tokens allocated by each holder of an item, dropping holders without tokens.
+func SetHolders(txn *badger.Txn, id string, holders map[string]int64) error {
+	for holder, tokens := range holders {
+		if tokens <= 0 {
+			delete(holders, holder)
+		}
+	}
+
+	if len(holders) == 0 {
+		return txn.Delete([]byte(HoldersKeyPrefix + id))
+	}
+
+	buf, err := json.Marshal(holders)
+	if err != nil {
+		return fmt.Errorf("failed to marshal holders: %w", err)
+	}
+
+	if err := txn.Set([]byte(HoldersKeyPrefix+id), buf); err != nil {
+		return fmt.Errorf("failed to set value: %w", err)
+	}
+
+	return nil
+}
+
+// Freeable returns the tokens of an item that the holder can free. Without a holder only unowned tokens can be freed.
+// Tokens held by the leases of the holder are left out, since they are freed through their lease or once it expires.
+func Freeable(txn *badger.Txn, id string, it Item, holders map[string]int64, holder string) (int64, error) {
+	freeable := holders[holder]
+	if holder == "" {
+		freeable = it.Allocated
+		for _, tokens := range holders {
+			freeable -= tokens
+		}
+	}
+
+	leases, err := ListLeases(txn)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list leases: %w", err)
+	}
+
+	for _, l := range leases {
+		if l.Holder == holder && strings.Join([]string{l.Namespace, l.Resource}, "_") == id {
+			freeable -= l.Tokens
+		}
+	}
+
+	return freeable, nil
+}
+
+// AllocBatch checks the items of a batch against their quotas and their ancestors and, if all of them fit, allocates
+// their tokens in txn. Nothing is written when it returns false. The states of the quotas before and after the batch
+// are set on the entries of the items, given in the same order.
+func AllocBatch(txn *badger.Txn, items []batch.Item, entries []audit.Entry) ([]batch.Result, bool, error) {
+	its := make(map[string]Item, len(items))
+	cfgs := make(map[string]quota.Config, len(items))
+	ancestors := make([][]Ancestor, 0, len(items))
+	pending := make(map[string]int64, len(items))
+	for i, bi := range items {
+		id := strings.Join([]string{bi.Namespace, bi.Resource}, "_")
+		if _, found := its[id]; !found {
+			it, err := Get[Item](txn, id)
+			if err != nil {
+				switch {
+				case errors.Is(err, badger.ErrKeyNotFound):
+					return nil, false, stor.ErrNotFound
+				default:
+				}
+
+				return nil, false, fmt.Errorf("failed to get: %w", err)
+			}
+
+			cfg, err := GetConfig(txn, id, it)
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to get config: %w", err)
+			}
+
+			its[id] = it
+			cfgs[id] = cfg
+		}
+
+		entries[i].Before = AuditState(its[id])
+		if bi.Version != 0 && its[id].Version != bi.Version {
+			return nil, false, stor.ErrInvalidVersion
+		}
+
+		pending[id] += bi.Tokens
+
+		itemAncestors, err := GetAncestors(txn, id)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to get ancestors: %w", err)
+		}
+
+		ancestors = append(ancestors, itemAncestors)
+		for _, a := range itemAncestors {
+			pending[a.ID] += bi.Tokens
+		}
+	}
+
+	results := make([]batch.Result, 0, len(items))
+	ok := true
+	for i, bi := range items {
+		id := strings.Join([]string{bi.Namespace, bi.Resource}, "_")
+		it := its[id]
+		if it.Allocated+pending[id] > cfgs[id].Limit() {
+			ok = false
+		}
+
+		for _, a := range ancestors[i] {
+			fits, err := FitAncestors(txn, []Ancestor{a}, pending[a.ID])
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to fit ancestors: %w", err)
+			}
+
+			if !fits {
+				ok = false
+			}
+		}
+
+		results = append(results, batch.Result{RemainingTokens: cfgs[id].Limit() - it.Allocated, CurrentVersion: it.Version})
+	}
+
+	if !ok {
+		return results, false, nil
+	}
+
+	for i, bi := range items {
+		id := strings.Join([]string{bi.Namespace, bi.Resource}, "_")
+		it := its[id]
+		it.Allocated += bi.Tokens
+		it.Version += 1
+		its[id] = it
+		if err := Set[Item](txn, id, it); err != nil {
+			return nil, false, fmt.Errorf("failed to set item: %w", err)
+		}
+
+		if bi.Holder != "" {
+			holders, err := GetHolders(txn, id)
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to get holders: %w", err)
+			}
+
+			holders[bi.Holder] += bi.Tokens
+			if err := SetHolders(txn, id, holders); err != nil {
+				return nil, false, fmt.Errorf("failed to set holders: %w", err)
+			}
+		}
+
+		if err := ChargeAncestors(txn, ancestors[i], bi.Tokens); err != nil {
+			return nil, false, fmt.Errorf("failed to charge ancestors: %w", err)
+		}
+
+		results[i] = batch.Result{RemainingTokens: cfgs[id].Limit() - it.Allocated, CurrentVersion: it.Version}
+	}
+
+	for i, bi := range items {
+		entries[i].After = AuditState(its[strings.Join([]string{bi.Namespace, bi.Resource}, "_")])
+	}
+
+	return results, true, nil
+}
+
+// GetResult returns the result remembered for an idempotency key, unless it expired at now, given in Unix nanoseconds.
+func GetResult(txn *badger.Txn, key string, now int64) (Result, bool, error) {
+	it, err := txn.Get([]byte(key))
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return Result{}, false, nil
+		}
+
+		return Result{}, false, fmt.Errorf("failed to get key: %w", err)
+	}
+
+	var r Result
+	err = it.Value(func(val []byte) error {
+		return json.Unmarshal(val, &r)
+	})
+	if err != nil {
+		return Result{}, false, fmt.Errorf("failed to read result: %w", err)
+	}
+
+	if r.ExpiresAt <= now {
+		return Result{}, false, nil
+	}
+
+	return r, true, nil
+}
+
+// ForgetResults deletes the results of idempotency keys that expired at now, given in Unix nanoseconds.
+func ForgetResults(txn *badger.Txn, now int64) (int, error) {
+	keys, err := expiredResultKeys(txn, now)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return 0, fmt.Errorf("failed to delete result: %w", err)
+		}
+	}
+
+	return len(keys), nil
+}
+
+// DueResults returns the number of results of idempotency keys that expired at now, given in Unix nanoseconds, without
+// deleting them.
+func DueResults(txn *badger.Txn, now int64) (int, error) {
+	keys, err := expiredResultKeys(txn, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(keys), nil
+}
+
+func expiredResultKeys(txn *badger.Txn, now int64) ([][]byte, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(ResultKeyPrefix)
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+
+	var keys [][]byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		var r Result
+		err := iter.Item().Value(func(val []byte) error {
+			return json.Unmarshal(val, &r)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read result: %w", err)
+		}
+
+		if r.ExpiresAt <= now {
+			keys = append(keys, iter.Item().KeyCopy(nil))
+		}
+	}
+
+	return keys, nil
+}
+
+// SetJSON stores value under key as JSON.
+func SetJSON(txn *badger.Txn, key string, value any) error {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+
+	if err := txn.Set([]byte(key), buf); err != nil {
+		return fmt.Errorf("failed to set value: %w", err)
+	}
+
+	return nil
+}
+
+// GetLease returns a lease by its ID, failing with badger.ErrKeyNotFound if it does not exist.
+func GetLease(txn *badger.Txn, leaseID string) (Lease, error) {
+	it, err := txn.Get([]byte(LeaseKeyPrefix + leaseID))
+	if err != nil {
+		return Lease{}, fmt.Errorf("failed to get key: %w", err)
+	}
+
+	var l Lease
+	err = it.Value(func(val []byte) error {
+		return json.Unmarshal(val, &l)
+	})
+	if err != nil {
+		return Lease{}, fmt.Errorf("failed to read lease: %w", err)
+	}
+
+	return l, nil
+}
+
+// SetLease stores a lease under its ID.
+func SetLease(txn *badger.Txn, leaseID string, l Lease) error {
+	buf, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lease: %w", err)
+	}
+
+	if err := txn.Set([]byte(LeaseKeyPrefix+leaseID), buf); err != nil {
+		return fmt.Errorf("failed to set value: %w", err)
+	}
+
+	return nil
+}
+
+// ListLeases returns all leases by their keys.
+func ListLeases(txn *badger.Txn) (map[string]Lease, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(LeaseKeyPrefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	leases := make(map[string]Lease)
+	for it.Rewind(); it.Valid(); it.Next() {
+		var l Lease
+		err := it.Item().Value(func(val []byte) error {
+			return json.Unmarshal(val, &l)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read lease: %w", err)
+		}
+
+		leases[string(it.Item().KeyCopy(nil))] = l
+	}
+
+	return leases, nil
+}
+
+// DueLeases returns the number of leases that expired at now, given in Unix nanoseconds, without expiring them.
+func DueLeases(txn *badger.Txn, now int64) (int, error) {
+	leases, err := ListLeases(txn)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list leases: %w", err)
+	}
+
+	due := 0
+	for _, l := range leases {
+		if l.ExpiresAt <= now {
+			due++
+		}
+	}
+
+	return due, nil
+}
+
+// ExpireLeases frees the tokens of the leases that expired at now, given in Unix nanoseconds, and returns the number of
+// leases expired along with an audit entry for each of them that freed tokens. The entries are left for the caller to
+// stamp. Leases of deleted quotas are removed without freeing anything.
+func ExpireLeases(txn *badger.Txn, now int64) (int, []audit.Entry, error) {
+	leases, err := ListLeases(txn)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to list leases: %w", err)
+	}
+
+	expired := 0
+	var entries []audit.Entry
+	for key, l := range leases {
+		if l.ExpiresAt > now {
+			continue
+		}
+
+		id := strings.Join([]string{l.Namespace, l.Resource}, "_")
+		it, err := Get[Item](txn, id)
+		switch {
+		case err == nil:
+			e := audit.Entry{Operation: audit.ExpireLease, Namespace: l.Namespace, Resource: l.Resource, Holder: l.Holder, Tokens: l.Tokens, LeaseID: strings.TrimPrefix(key, LeaseKeyPrefix), Before: AuditState(it)}
+			it.Allocated -= l.Tokens
+			if it.Allocated < 0 {
+				it.Allocated = 0
+			}
+
+			it.Version += 1
+			if err := Set[Item](txn, id, it); err != nil {
+				return 0, nil, fmt.Errorf("failed to set item: %w", err)
+			}
+
+			if l.Holder != "" {
+				holders, err := GetHolders(txn, id)
+				if err != nil {
+					return 0, nil, fmt.Errorf("failed to get holders: %w", err)
+				}
+
+				holders[l.Holder] -= l.Tokens
+				if err := SetHolders(txn, id, holders); err != nil {
+					return 0, nil, fmt.Errorf("failed to set holders: %w", err)
+				}
+			}
+
+			ancestors, err := GetAncestors(txn, id)
+			if err != nil {
+				return 0, nil, fmt.Errorf("failed to get ancestors: %w", err)
+			}
+
+			if err := ChargeAncestors(txn, ancestors, -l.Tokens); err != nil {
+				return 0, nil, fmt.Errorf("failed to release ancestors: %w", err)
+			}
+
+			e.After = AuditState(it)
+			e.SetResult(true, nil)
+			entries = append(entries, e)
+		case errors.Is(err, badger.ErrKeyNotFound):
+		default:
+			return 0, nil, fmt.Errorf("failed to get: %w", err)
+		}
+
+		if err := txn.Delete([]byte(key)); err != nil {
+			return 0, nil, fmt.Errorf("failed to delete lease: %w", err)
+		}
+
+		expired++
+	}
+
+	return expired, entries, nil
+}
+
+// SetPeriod starts the current period of a quota, or stops tracking its periods if it is not periodic. Period starts are
+// stored in Unix nanoseconds.
+func SetPeriod(txn *badger.Txn, id string, cfg quota.Config, now time.Time) error {
+	if !cfg.Periodic() {
+		if err := txn.Delete([]byte(PeriodKeyPrefix + id)); err != nil {
+			return fmt.Errorf("failed to delete period: %w", err)
+		}
+
+		return nil
+	}
+
+	start, err := cfg.PeriodStart(now)
+	if err != nil {
+		return fmt.Errorf("failed to get period start: %w", err)
+	}
+
+	return Set[int64](txn, PeriodKeyPrefix+id, start.UnixNano())
+}
+
+// EndedPeriods returns the periodic quotas whose period has ended by now, keyed by the keys of their items, along with
+// the starts of their current periods.
+func EndedPeriods(txn *badger.Txn, now time.Time) (map[string]time.Time, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(PeriodKeyPrefix)
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+
+	ended := make(map[string]time.Time)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		var start int64
+		err := iter.Item().Value(func(val []byte) error {
+			return binary.Read(bytes.NewReader(val), binary.BigEndian, &start)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read period: %w", err)
+		}
+
+		id := strings.TrimPrefix(string(iter.Item().KeyCopy(nil)), PeriodKeyPrefix)
+		ref, found, err := GetQuotaRef(txn, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get quota ref: %w", err)
+		}
+
+		if !found {
+			continue
+		}
+
+		current, err := ref.Config(0).PeriodStart(now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get period start: %w", err)
+		}
+
+		if current.UnixNano() > start {
+			ended[id] = current
+		}
+	}
+
+	return ended, nil
+}
+
+// ResetPeriods frees all tokens of the periodic quotas whose period has ended by now, releasing them from their
+// ancestors, and drops their leases. Returns an audit entry for each quota reset, left for the caller to stamp.
+func ResetPeriods(txn *badger.Txn, now time.Time) ([]audit.Entry, error) {
+	ended, err := EndedPeriods(txn, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ended periods: %w", err)
+	}
+
+	var entries []audit.Entry
+	for id, current := range ended {
+		ref, _, err := GetQuotaRef(txn, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get quota ref: %w", err)
+		}
+
+		it, err := Get[Item](txn, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get: %w", err)
+		}
+
+		ancestors, err := GetAncestors(txn, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get ancestors: %w", err)
+		}
+
+		if err := ChargeAncestors(txn, ancestors, -it.Allocated); err != nil {
+			return nil, fmt.Errorf("failed to release ancestors: %w", err)
+		}
+
+		e := audit.Entry{Operation: audit.ResetPeriod, Namespace: ref.Namespace, Resource: ref.Resource, Tokens: it.Allocated, Before: AuditState(it)}
+		it.Allocated = 0
+		it.Version += 1
+		if err := Set[Item](txn, id, it); err != nil {
+			return nil, fmt.Errorf("failed to set item: %w", err)
+		}
+
+		if err := txn.Delete([]byte(HoldersKeyPrefix + id)); err != nil {
+			return nil, fmt.Errorf("failed to delete holders: %w", err)
+		}
+
+		if err := DeleteLeases(txn, ref.Namespace, ref.Resource); err != nil {
+			return nil, fmt.Errorf("failed to delete leases: %w", err)
+		}
+
+		if err := Set[int64](txn, PeriodKeyPrefix+id, current.UnixNano()); err != nil {
+			return nil, fmt.Errorf("failed to set period: %w", err)
+		}
+
+		e.After = AuditState(it)
+		e.SetResult(true, nil)
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// historyKey returns the key of the window of the history of a quota starting at start. The start is encoded
+// big-endian, so that the windows of a quota are sorted by time.
+func historyKey(id string, start time.Time) string {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(start.UnixNano()))
+
+	return historyKeyPrefix + id + "/" + string(buf[:])
+}
+
+// RecordHistory samples the allocated tokens of all quotas into the windows of resolution containing now. A window
+// keeps the last sample along with the highest allocation sampled. Windows that start more than retention before now
+// are dropped as new ones begin.
+func RecordHistory(txn *badger.Txn, now time.Time, resolution, retention time.Duration) (int, error) {
+	refs, err := ListQuotaRefs(txn)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list quota refs: %w", err)
+	}
+
+	start := now.Truncate(resolution)
+	recorded := 0
+	for _, ref := range refs {
+		id := strings.Join([]string{ref.Namespace, ref.Resource}, "_")
+		it, err := Get[Item](txn, id)
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
+
+			return 0, fmt.Errorf("failed to get: %w", err)
+		}
+
+		key := historyKey(id, start)
+		sample := historySample{Allocated: it.Allocated, MaxAllocated: it.Allocated, Capacity: it.Capacity}
+		previous, err := Get[historySample](txn, key)
+		switch {
+		case err == nil:
+			if previous.MaxAllocated > sample.MaxAllocated {
+				sample.MaxAllocated = previous.MaxAllocated
+			}
+		case errors.Is(err, badger.ErrKeyNotFound):
+			if err := ForgetHistory(txn, id, now.Add(-retention)); err != nil {
+				return 0, fmt.Errorf("failed to forget history: %w", err)
+			}
+		default:
+			return 0, fmt.Errorf("failed to get history sample: %w", err)
+		}
+
+		if err := Set[historySample](txn, key, sample); err != nil {
+			return 0, fmt.Errorf("failed to set history sample: %w", err)
+		}
+
+		recorded++
+	}
+
+	return recorded, nil
+}
+
+// GetHistory returns the windows of the history of a quota starting between from and to.
+func GetHistory(txn *badger.Txn, id string, from, to time.Time) ([]history.Sample, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(historyKeyPrefix + id + "/")
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+
+	var samples []history.Sample
+	for iter.Seek([]byte(historyKey(id, from))); iter.Valid(); iter.Next() {
+		start := time.Unix(0, int64(binary.BigEndian.Uint64(iter.Item().Key()[len(opts.Prefix):])))
+		if start.After(to) {
+			break
+		}
+
+		var sample historySample
+		err := iter.Item().Value(func(val []byte) error {
+			return binary.Read(bytes.NewReader(val), binary.BigEndian, &sample)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read history sample: %w", err)
+		}
+
+		samples = append(samples, history.Sample{
+			Time:         start,
+			Allocated:    sample.Allocated,
+			MaxAllocated: sample.MaxAllocated,
+			Capacity:     sample.Capacity,
+		})
+	}
+
+	return samples, nil
+}
+
+// ForgetHistory deletes the windows of the history of a quota starting before the given time, or all of them if it is
+// zero.
+func ForgetHistory(txn *badger.Txn, id string, before time.Time) error {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(historyKeyPrefix + id + "/")
+	opts.PrefetchValues = false
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+
+	var keys [][]byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		start := time.Unix(0, int64(binary.BigEndian.Uint64(iter.Item().Key()[len(opts.Prefix):])))
+		if !before.IsZero() && !start.Before(before) {
+			break
+		}
+
+		keys = append(keys, iter.Item().KeyCopy(nil))
+	}
+
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return fmt.Errorf("failed to delete history sample: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ExportItems returns the state of all quotas, along with their leases.
+func ExportItems(txn *badger.Txn) ([]export.Item, error) {
+	refs, err := ListQuotaRefs(txn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list quota refs: %w", err)
+	}
+
+	leases, err := ListLeases(txn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list leases: %w", err)
+	}
+
+	exportedLeases := make(map[string][]export.Lease)
+	for key, l := range leases {
+		id := strings.Join([]string{l.Namespace, l.Resource}, "_")
+		exportedLeases[id] = append(exportedLeases[id], export.Lease{
+			ID:        strings.TrimPrefix(key, LeaseKeyPrefix),
+			Holder:    l.Holder,
+			Tokens:    l.Tokens,
+			ExpiresAt: time.Unix(0, l.ExpiresAt).UTC(),
+		})
+	}
+
+	items := make([]export.Item, 0, len(refs))
+	for _, ref := range refs {
+		id := strings.Join([]string{ref.Namespace, ref.Resource}, "_")
+		it, err := Get[Item](txn, id)
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
+
+			return nil, fmt.Errorf("failed to get: %w", err)
+		}
+
+		holders, err := GetHolders(txn, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get holders: %w", err)
+		}
+
+		sort.Slice(exportedLeases[id], func(i, j int) bool { return exportedLeases[id][i].ID < exportedLeases[id][j].ID })
+		items = append(items, export.Item{
+			Namespace: ref.Namespace,
+			Resource:  ref.Resource,
+			Strategy:  ref.Config(it.Capacity),
+			Allocated: it.Allocated,
+			Version:   it.Version,
+			Holders:   holders,
+			Leases:    exportedLeases[id],
+		})
+	}
+
+	return items, nil
+}
+
+// ImportItem writes the state of an exported quota as it is, overwriting the quota and its leases if it exists. Returns
+// the state of the quota before the import, if it existed, and after.
+func ImportItem(txn *badger.Txn, exported export.Item, now time.Time) (*audit.State, *audit.State, error) {
+	cfg := exported.Strategy
+	if err := ValidateConfig(cfg); err != nil {
+		return nil, nil, err
+	}
+
+	if err := exported.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	id := strings.Join([]string{exported.Namespace, exported.Resource}, "_")
+
+	var before *audit.State
+	current, err := Get[Item](txn, id)
+	switch {
+	case err == nil:
+		ref, _, err := GetQuotaRef(txn, id)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get quota ref: %w", err)
+		}
+
+		before = QuotaAuditState(current, ref.Config(current.Capacity))
+
+		// The tokens charged by the quota to its current parent would be left behind.
+		if cfg.Parent != ref.Parent {
+			return before, nil, fmt.Errorf("parent cannot be changed by an import: %w", stor.ErrInvalidConfig)
+		}
+	case errors.Is(err, badger.ErrKeyNotFound):
+	default:
+		return nil, nil, fmt.Errorf("failed to get: %w", err)
+	}
+
+	if cfg.Periodic() {
+		children, err := HasChildren(txn, exported.Namespace, exported.Resource)
+		if err != nil {
+			return before, nil, fmt.Errorf("failed to check children: %w", err)
+		}
+
+		if children {
+			return before, nil, fmt.Errorf("quota with child quotas cannot be periodic: %w", stor.ErrInvalidConfig)
+		}
+	}
+
+	if err := ValidateParent(txn, id, cfg); err != nil {
+		return before, nil, err
+	}
+
+	it := Item{Allocated: exported.Allocated, Capacity: cfg.Capacity, Version: exported.Version}
+	if err := Set[Item](txn, id, it); err != nil {
+		return before, nil, fmt.Errorf("failed to set item: %w", err)
+	}
+
+	if err := SetQuotaRef(txn, id, exported.Namespace, exported.Resource, cfg); err != nil {
+		return before, nil, fmt.Errorf("failed to set quota ref: %w", err)
+	}
+
+	holders := make(map[string]int64, len(exported.Holders))
+	for holder, tokens := range exported.Holders {
+		holders[holder] = tokens
+	}
+
+	if err := SetHolders(txn, id, holders); err != nil {
+		return before, nil, fmt.Errorf("failed to set holders: %w", err)
+	}
+
+	if err := SetPeriod(txn, id, cfg, now); err != nil {
+		return before, nil, fmt.Errorf("failed to set period: %w", err)
+	}
+
+	if err := DeleteLeases(txn, exported.Namespace, exported.Resource); err != nil {
+		return before, nil, err
+	}
+
+	for _, l := range exported.Leases {
+		err := SetLease(txn, l.ID, Lease{Namespace: exported.Namespace, Resource: exported.Resource, Holder: l.Holder, Tokens: l.Tokens, ExpiresAt: l.ExpiresAt.UnixNano()})
+		if err != nil {
+			return before, nil, fmt.Errorf("failed to set lease: %w", err)
+		}
+	}
+
+	return before, QuotaAuditState(it, cfg), nil
+}
+
+// DeleteLeases deletes all leases of a quota.
+func DeleteLeases(txn *badger.Txn, namespace, resource string) error {
+	leases, err := ListLeases(txn)
+	if err != nil {
+		return fmt.Errorf("failed to list leases: %w", err)
+	}
+
+	for key, l := range leases {
+		if l.Namespace != namespace || l.Resource != resource {
+			continue
+		}
+
+		if err := txn.Delete([]byte(key)); err != nil {
+			return fmt.Errorf("failed to delete lease: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Get returns the value stored under key in big-endian binary form, failing with badger.ErrKeyNotFound if there is none.
+func Get[T any](txn *badger.Txn, key string) (T, error) {
+	item, err := txn.Get([]byte(key))
+	if err != nil {
+		var zero T
+		return zero, fmt.Errorf("failed to get key: %w", err)
+	}
+
+	var result T
+	err = item.Value(func(val []byte) error {
+		err := binary.Read(bytes.NewReader(val), binary.BigEndian, &result)
+		if err != nil {
+			return fmt.Errorf("failed to read bytes: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		var zero T
+		return zero, fmt.Errorf("failed to read item value: %w", err)
+	}
+
+	return result, nil
+}
+
+// Set stores value under key in big-endian binary form.
+func Set[T any](txn *badger.Txn, key string, value T) error {
+	buf := bytes.NewBuffer(nil)
+	if err := binary.Write(buf, binary.BigEndian, value); err != nil {
+		return fmt.Errorf("failed to write to buffer: %w", err)
+	}
+
+	if err := txn.Set([]byte(key), buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to set value: %w", err)
+	}
+
+	return nil
+}
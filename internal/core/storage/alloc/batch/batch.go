@@ -0,0 +1,54 @@
+package batch
+
+import (
+	"github.com/Blinkuu/qms/pkg/dto"
+)
+
+// Item is a single allocation of an atomic batch.
+type Item struct {
+	Namespace string
+	Resource  string
+	Holder    string
+	Tokens    int64
+	Version   int64
+}
+
+// Result is the state of the quota of an Item once the batch has been attempted.
+type Result struct {
+	RemainingTokens int64
+	CurrentVersion  int64
+}
+
+func NewItemFromDTO(item dto.AllocBatchItem) Item {
+	return Item{
+		Namespace: item.Namespace,
+		Resource:  item.Resource,
+		Holder:    item.Holder,
+		Tokens:    item.Tokens,
+		Version:   item.Version,
+	}
+}
+
+func (i Item) DTO() dto.AllocBatchItem {
+	return dto.AllocBatchItem{
+		Namespace: i.Namespace,
+		Resource:  i.Resource,
+		Holder:    i.Holder,
+		Tokens:    i.Tokens,
+		Version:   i.Version,
+	}
+}
+
+func NewResultFromDTO(result dto.AllocBatchItemResult) Result {
+	return Result{
+		RemainingTokens: result.RemainingTokens,
+		CurrentVersion:  result.CurrentVersion,
+	}
+}
+
+func (r Result) DTO() dto.AllocBatchItemResult {
+	return dto.AllocBatchItemResult{
+		RemainingTokens: r.RemainingTokens,
+		CurrentVersion:  r.CurrentVersion,
+	}
+}
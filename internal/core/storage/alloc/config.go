@@ -2,6 +2,7 @@ package alloc
 
 import (
 	"flag"
+	"time"
 
 	"github.com/Blinkuu/qms/internal/core/storage/alloc/local"
 	"github.com/Blinkuu/qms/internal/core/storage/alloc/raft"
@@ -15,13 +16,15 @@ const (
 )
 
 type Config struct {
-	Backend string       `yaml:"backend"`
-	Local   local.Config `yaml:"local"`
-	Raft    raft.Config  `yaml:"raft"`
+	Backend           string        `yaml:"backend"`
+	IdempotencyWindow time.Duration `yaml:"idempotency_window"`
+	Local             local.Config  `yaml:"local"`
+	Raft              raft.Config   `yaml:"raft"`
 }
 
 func (c *Config) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix string) {
 	f.StringVar(&c.Backend, strutil.WithPrefixOrDefault(prefix, "backend"), Memory, "")
+	f.DurationVar(&c.IdempotencyWindow, strutil.WithPrefixOrDefault(prefix, "idempotency_window"), 5*time.Minute, "")
 
 	c.Local.RegisterFlagsWithPrefix(f, strutil.WithPrefixOrDefault(prefix, Local))
 	c.Raft.RegisterFlagsWithPrefix(f, strutil.WithPrefixOrDefault(prefix, Raft))
@@ -0,0 +1,242 @@
+package export
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Blinkuu/qms/internal/core/storage"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+	"github.com/Blinkuu/qms/pkg/dto"
+)
+
+// Lease holds tokens of an exported quota until it expires.
+type Lease struct {
+	ID        string
+	Holder    string
+	Tokens    int64
+	ExpiresAt time.Time
+}
+
+// Item is the state of a quota, as exported from a storage. The allocated tokens of a quota include those charged to it
+// by its child quotas, under their child holders, so items are imported as they are, without charging their ancestors.
+type Item struct {
+	Namespace string
+	Resource  string
+	Strategy  quota.Config
+	Allocated int64
+	Version   int64
+	Holders   map[string]int64
+	Leases    []Lease
+}
+
+func NewItemFromDTO(q dto.ExportedQuota) Item {
+	leases := make([]Lease, 0, len(q.Leases))
+	for _, l := range q.Leases {
+		leases = append(leases, Lease{ID: l.ID, Holder: l.Holder, Tokens: l.Tokens, ExpiresAt: l.ExpiresAt})
+	}
+
+	return Item{
+		Namespace: q.Namespace,
+		Resource:  q.Resource,
+		Strategy: quota.Config{
+			Capacity:   q.Capacity,
+			Parent:     q.Parent,
+			SoftLimit:  q.SoftLimit,
+			Overcommit: q.Overcommit,
+			Period:     q.Period,
+			TimeZone:   q.TimeZone,
+		},
+		Allocated: q.Allocated,
+		Version:   q.Version,
+		Holders:   q.Holders,
+		Leases:    leases,
+	}
+}
+
+func (i Item) DTO() dto.ExportedQuota {
+	leases := make([]dto.ExportedLease, 0, len(i.Leases))
+	for _, l := range i.Leases {
+		leases = append(leases, dto.ExportedLease{ID: l.ID, Holder: l.Holder, Tokens: l.Tokens, ExpiresAt: l.ExpiresAt})
+	}
+
+	return dto.ExportedQuota{
+		Namespace:  i.Namespace,
+		Resource:   i.Resource,
+		Capacity:   i.Strategy.Capacity,
+		Parent:     i.Strategy.Parent,
+		SoftLimit:  i.Strategy.SoftLimit,
+		Overcommit: i.Strategy.Overcommit,
+		Period:     i.Strategy.Period,
+		TimeZone:   i.Strategy.TimeZone,
+		Allocated:  i.Allocated,
+		Version:    i.Version,
+		Holders:    i.Holders,
+		Leases:     leases,
+	}
+}
+
+// Validate checks that the state of an item is consistent. Its configuration is validated by the storage importing it.
+func (i Item) Validate() error {
+	if i.Allocated < 0 {
+		return fmt.Errorf("allocated tokens of %s/%s must not be negative: %w", i.Namespace, i.Resource, storage.ErrInvalidConfig)
+	}
+
+	var owned int64
+	for holder, tokens := range i.Holders {
+		if tokens <= 0 {
+			return fmt.Errorf("tokens of holder %s of %s/%s must be greater than 0: %w", holder, i.Namespace, i.Resource, storage.ErrInvalidConfig)
+		}
+
+		owned += tokens
+	}
+
+	if owned > i.Allocated {
+		return fmt.Errorf("holders of %s/%s own more than the allocated tokens: %w", i.Namespace, i.Resource, storage.ErrInvalidConfig)
+	}
+
+	for _, l := range i.Leases {
+		if l.ID == "" || l.Tokens <= 0 {
+			return fmt.Errorf("leases of %s/%s must have an ID and tokens: %w", i.Namespace, i.Resource, storage.ErrInvalidConfig)
+		}
+	}
+
+	return nil
+}
+
+// Sort orders items so that every quota comes after its parent, if the parent is among them, and otherwise by namespace
+// and resource. Imported in this order, the parent of every quota exists by the time it is written.
+func Sort(items []Item) {
+	depths := make(map[string]int, len(items))
+	parents := make(map[string]string, len(items))
+	for _, it := range items {
+		parents[it.Namespace+"/"+it.Resource] = it.Strategy.Parent
+	}
+
+	for _, it := range items {
+		ref := it.Namespace + "/" + it.Resource
+		depth := 0
+		// A cycle cannot be imported anyway, but is bounded so that sorting terminates.
+		for parent := parents[ref]; parent != "" && depth < len(items); parent = parents[parent] {
+			if _, found := parents[parent]; !found {
+				break
+			}
+
+			depth++
+		}
+
+		depths[ref] = depth
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		refI, refJ := items[i].Namespace+"/"+items[i].Resource, items[j].Namespace+"/"+items[j].Resource
+		if depths[refI] != depths[refJ] {
+			return depths[refI] < depths[refJ]
+		}
+
+		if items[i].Namespace != items[j].Namespace {
+			return items[i].Namespace < items[j].Namespace
+		}
+
+		return items[i].Resource < items[j].Resource
+	})
+}
+
+// Change is what importing an item changes in a storage. Fields lists the changed fields of a quota that already
+// exists, as name: old -> new.
+type Change struct {
+	Namespace string
+	Resource  string
+	Added     bool
+	Fields    []string
+}
+
+func (c Change) String() string {
+	if c.Added {
+		return fmt.Sprintf("+ %s/%s", c.Namespace, c.Resource)
+	}
+
+	return fmt.Sprintf("~ %s/%s %s", c.Namespace, c.Resource, strings.Join(c.Fields, ", "))
+}
+
+// Diff returns the changes that importing items makes to a storage holding current, in the order of items. Items equal
+// to the current ones are left out, and so are the current ones that are not imported, since importing keeps them.
+func Diff(current, items []Item) []Change {
+	byRef := make(map[string]Item, len(current))
+	for _, it := range current {
+		byRef[it.Namespace+"/"+it.Resource] = it
+	}
+
+	var changes []Change
+	for _, it := range items {
+		old, found := byRef[it.Namespace+"/"+it.Resource]
+		if !found {
+			changes = append(changes, Change{Namespace: it.Namespace, Resource: it.Resource, Added: true})
+			continue
+		}
+
+		fields := diffFields(old, it)
+		if len(fields) == 0 {
+			continue
+		}
+
+		changes = append(changes, Change{Namespace: it.Namespace, Resource: it.Resource, Fields: fields})
+	}
+
+	return changes
+}
+
+func diffFields(old, new Item) []string {
+	var fields []string
+	field := func(name string, old, new any) {
+		if !reflect.DeepEqual(old, new) {
+			fields = append(fields, fmt.Sprintf("%s: %v -> %v", name, old, new))
+		}
+	}
+
+	field("capacity", old.Strategy.Capacity, new.Strategy.Capacity)
+	field("parent", old.Strategy.Parent, new.Strategy.Parent)
+	field("soft_limit", old.Strategy.SoftLimit, new.Strategy.SoftLimit)
+	field("overcommit", old.Strategy.Overcommit, new.Strategy.Overcommit)
+	field("period", old.Strategy.Period, new.Strategy.Period)
+	field("time_zone", old.Strategy.TimeZone, new.Strategy.TimeZone)
+	field("allocated", old.Allocated, new.Allocated)
+	field("version", old.Version, new.Version)
+	field("holders", holdersOrNil(old.Holders), holdersOrNil(new.Holders))
+	if !leasesEqual(old.Leases, new.Leases) {
+		fields = append(fields, fmt.Sprintf("leases: %d -> %d", len(old.Leases), len(new.Leases)))
+	}
+
+	return fields
+}
+
+// holdersOrNil treats no holders the same, whether decoded as an empty or a nil map.
+func holdersOrNil(holders map[string]int64) map[string]int64 {
+	if len(holders) == 0 {
+		return nil
+	}
+
+	return holders
+}
+
+func leasesEqual(a, b []Lease) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	byID := make(map[string]Lease, len(a))
+	for _, l := range a {
+		byID[l.ID] = l
+	}
+
+	for _, l := range b {
+		other, found := byID[l.ID]
+		if !found || other.Holder != l.Holder || other.Tokens != l.Tokens || !other.ExpiresAt.Equal(l.ExpiresAt) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,124 @@
+package export
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+)
+
+func TestDiff(t *testing.T) {
+	expiresAt := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	current := Item{
+		Namespace: "namespace",
+		Resource:  "resource",
+		Strategy:  quota.Config{Capacity: 10},
+		Allocated: 4,
+		Version:   2,
+		Holders:   map[string]int64{"holder": 4},
+		Leases:    []Lease{{ID: "lease", Holder: "holder", Tokens: 4, ExpiresAt: expiresAt}},
+	}
+
+	changed := current
+	changed.Strategy = quota.Config{Capacity: 12, SoftLimit: 8}
+	changed.Allocated = 6
+	changed.Version = 3
+	changed.Holders = map[string]int64{"holder": 6}
+	changed.Leases = nil
+
+	withoutHolders := current
+	withoutHolders.Holders = map[string]int64{}
+	withoutHolders.Leases = []Lease{{ID: "lease", Holder: "holder", Tokens: 4, ExpiresAt: expiresAt.In(time.FixedZone("CET", 3600))}}
+
+	added := Item{Namespace: "namespace", Resource: "other", Strategy: quota.Config{Capacity: 1}, Version: 1}
+
+	tests := []struct {
+		name    string
+		current []Item
+		items   []Item
+		want    []Change
+	}{
+		{
+			name:    "unchanged items are left out",
+			current: []Item{current},
+			items:   []Item{current},
+			want:    nil,
+		},
+		{
+			name:    "missing items are added",
+			current: []Item{current},
+			items:   []Item{added},
+			want:    []Change{{Namespace: "namespace", Resource: "other", Added: true}},
+		},
+		{
+			name:    "changed fields are listed",
+			current: []Item{current},
+			items:   []Item{changed},
+			want: []Change{{
+				Namespace: "namespace",
+				Resource:  "resource",
+				Fields: []string{
+					"capacity: 10 -> 12",
+					"soft_limit: 0 -> 8",
+					"allocated: 4 -> 6",
+					"version: 2 -> 3",
+					"holders: map[holder:4] -> map[holder:6]",
+					"leases: 1 -> 0",
+				},
+			}},
+		},
+		{
+			name:    "empty holders and leases expiring at the same instant are equal",
+			current: []Item{{Namespace: "namespace", Resource: "resource", Strategy: quota.Config{Capacity: 10}, Allocated: 4, Version: 2, Leases: current.Leases}},
+			items:   []Item{withoutHolders},
+			want:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// When
+			changes := Diff(tt.current, tt.items)
+
+			// Then
+			assert.Equal(t, tt.want, changes)
+		})
+	}
+}
+
+func TestChange_String(t *testing.T) {
+	// Given
+	added := Change{Namespace: "namespace", Resource: "resource", Added: true}
+	changed := Change{Namespace: "namespace", Resource: "resource", Fields: []string{"capacity: 10 -> 12", "version: 2 -> 3"}}
+
+	// When
+	addedStr, changedStr := added.String(), changed.String()
+
+	// Then
+	assert.Equal(t, "+ namespace/resource", addedStr)
+	assert.Equal(t, "~ namespace/resource capacity: 10 -> 12, version: 2 -> 3", changedStr)
+}
+
+func TestSort_OrdersParentsBeforeChildren(t *testing.T) {
+	// Given
+	items := []Item{
+		{Namespace: "user", Resource: "cpu", Strategy: quota.Config{Parent: "team/cpu"}},
+		{Namespace: "b", Resource: "cpu", Strategy: quota.Config{Parent: "missing/cpu"}},
+		{Namespace: "team", Resource: "cpu", Strategy: quota.Config{Parent: "org/cpu"}},
+		{Namespace: "org", Resource: "cpu"},
+		{Namespace: "a", Resource: "cpu"},
+	}
+
+	// When
+	Sort(items)
+
+	// Then
+	var refs []string
+	for _, it := range items {
+		refs = append(refs, it.Namespace+"/"+it.Resource)
+	}
+
+	assert.Equal(t, []string{"a/cpu", "b/cpu", "org/cpu", "team/cpu", "user/cpu"}, refs)
+}
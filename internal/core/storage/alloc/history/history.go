@@ -0,0 +1,68 @@
+package history
+
+import (
+	"time"
+
+	"github.com/Blinkuu/qms/pkg/dto"
+)
+
+// Sample is the usage of a quota over a window starting at Time. Allocated is the last value sampled in the window,
+// and MaxAllocated is the highest one.
+type Sample struct {
+	Time         time.Time
+	Allocated    int64
+	MaxAllocated int64
+	Capacity     int64
+}
+
+func NewSampleFromDTO(s dto.HistorySample) Sample {
+	return Sample{
+		Time:         s.Time,
+		Allocated:    s.Allocated,
+		MaxAllocated: s.MaxAllocated,
+		Capacity:     s.Capacity,
+	}
+}
+
+func (s Sample) DTO() dto.HistorySample {
+	return dto.HistorySample{
+		Time:         s.Time,
+		Allocated:    s.Allocated,
+		MaxAllocated: s.MaxAllocated,
+		Capacity:     s.Capacity,
+	}
+}
+
+// Merge folds a later sample of the same window into s.
+func (s Sample) Merge(later Sample) Sample {
+	if later.MaxAllocated < s.MaxAllocated {
+		later.MaxAllocated = s.MaxAllocated
+	}
+
+	later.Time = s.Time
+
+	return later
+}
+
+// Downsample merges samples, sorted by time, into windows of step aligned to the Unix epoch. The samples are returned
+// unchanged if step is not positive.
+func Downsample(samples []Sample, step time.Duration) []Sample {
+	if step <= 0 {
+		return samples
+	}
+
+	var downsampled []Sample
+	for _, sample := range samples {
+		start := sample.Time.Truncate(step)
+		last := len(downsampled) - 1
+		if last >= 0 && downsampled[last].Time.Equal(start) {
+			downsampled[last] = downsampled[last].Merge(sample)
+			continue
+		}
+
+		sample.Time = start
+		downsampled = append(downsampled, sample)
+	}
+
+	return downsampled
+}
@@ -0,0 +1,61 @@
+package history
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownsample(t *testing.T) {
+	start := time.Date(2022, time.December, 1, 12, 0, 0, 0, time.UTC)
+
+	type args struct {
+		samples []Sample
+		step    time.Duration
+	}
+	tests := []struct {
+		name string
+		args args
+		want []Sample
+	}{
+		{
+			name: "step of zero keeps the samples",
+			args: args{
+				samples: []Sample{
+					{Time: start, Allocated: 1, MaxAllocated: 2, Capacity: 10},
+					{Time: start.Add(time.Minute), Allocated: 3, MaxAllocated: 3, Capacity: 10},
+				},
+				step: 0,
+			},
+			want: []Sample{
+				{Time: start, Allocated: 1, MaxAllocated: 2, Capacity: 10},
+				{Time: start.Add(time.Minute), Allocated: 3, MaxAllocated: 3, Capacity: 10},
+			},
+		},
+		{
+			name: "samples of a window keep the last allocated and the highest max allocated",
+			args: args{
+				samples: []Sample{
+					{Time: start.Add(time.Minute), Allocated: 4, MaxAllocated: 7, Capacity: 10},
+					{Time: start.Add(2 * time.Minute), Allocated: 2, MaxAllocated: 5, Capacity: 20},
+					{Time: start.Add(5 * time.Minute), Allocated: 9, MaxAllocated: 9, Capacity: 20},
+				},
+				step: 5 * time.Minute,
+			},
+			want: []Sample{
+				{Time: start, Allocated: 2, MaxAllocated: 7, Capacity: 20},
+				{Time: start.Add(5 * time.Minute), Allocated: 9, MaxAllocated: 9, Capacity: 20},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// When
+			got := Downsample(tt.args.samples, tt.args.step)
+
+			// Then
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -2,14 +2,19 @@ package local
 
 import (
 	"flag"
+	"time"
 
 	"github.com/Blinkuu/qms/pkg/strutil"
 )
 
 type Config struct {
-	Dir string `yaml:"dir"`
+	Dir               string        `yaml:"dir"`
+	HistoryResolution time.Duration `yaml:"history_resolution"`
+	HistoryRetention  time.Duration `yaml:"history_retention"`
 }
 
 func (c *Config) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix string) {
 	f.StringVar(&c.Dir, strutil.WithPrefixOrDefault(prefix, "dir"), "/tmp/qms/data/local", "")
+	f.DurationVar(&c.HistoryResolution, strutil.WithPrefixOrDefault(prefix, "history_resolution"), time.Minute, "")
+	f.DurationVar(&c.HistoryRetention, strutil.WithPrefixOrDefault(prefix, "history_retention"), 7*24*time.Hour, "")
 }
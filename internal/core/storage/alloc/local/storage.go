@@ -1,33 +1,45 @@
 package local
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"strings"
+	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/dgraph-io/badger/v3"
+	"github.com/google/uuid"
 
 	"github.com/Blinkuu/qms/internal/core/storage"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/audit"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/backup"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/badgerkv"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/batch"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/export"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/history"
 	"github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/watch"
 	"github.com/Blinkuu/qms/pkg/log"
 	badgerlog "github.com/Blinkuu/qms/pkg/log/badger"
 )
 
-type item struct {
-	Allocated int64
-	Capacity  int64
-	Version   int64
-}
+// backupSectionID is the ID of the only section of a backup of the store. The sections of raft backups are numbered
+// after their shards, which start at 1.
+const backupSectionID = 0
 
 type Storage struct {
-	cfg Config
-	db  *badger.DB
+	cfg               Config
+	clock             clock.Clock
+	idempotencyWindow time.Duration
+	logger            log.Logger
+	db                *badger.DB
+	hub               *watch.Hub
+	audit             *audit.Log
 }
 
-func NewStorage(cfg Config, logger log.Logger) (*Storage, error) {
+func NewStorage(cfg Config, clock clock.Clock, idempotencyWindow time.Duration, logger log.Logger, auditLog *audit.Log) (*Storage, error) {
 	opts := badger.DefaultOptions(cfg.Dir)
 	opts.Logger = badgerlog.NewLogger(logger)
 	db, err := badger.Open(opts)
@@ -36,8 +48,13 @@ func NewStorage(cfg Config, logger log.Logger) (*Storage, error) {
 	}
 
 	return &Storage{
-		cfg: cfg,
-		db:  db,
+		cfg:               cfg,
+		clock:             clock,
+		idempotencyWindow: idempotencyWindow,
+		logger:            logger,
+		db:                db,
+		hub:               watch.NewHub(),
+		audit:             auditLog,
 	}, nil
 }
 
@@ -51,7 +68,7 @@ func (s *Storage) View(_ context.Context, namespace, resource string) (int64, in
 	txn := s.db.NewTransaction(true)
 	defer txn.Discard()
 
-	it, err := get[item](txn, id)
+	it, err := badgerkv.Get[badgerkv.Item](txn, id)
 	if err != nil {
 		switch {
 		case errors.Is(err, badger.ErrKeyNotFound):
@@ -65,9 +82,53 @@ func (s *Storage) View(_ context.Context, namespace, resource string) (int64, in
 	return it.Allocated, it.Capacity, it.Version, nil
 }
 
-func (s *Storage) Alloc(_ context.Context, namespace, resource string, tokens, version int64) (int64, int64, bool, error) {
+// ViewHolders returns the state of a quota along with the tokens allocated by each holder.
+func (s *Storage) ViewHolders(_ context.Context, namespace, resource string) (int64, int64, int64, map[string]int64, error) {
 	if s.db.IsClosed() {
-		return 0, 0, false, errors.New("badger db is closed")
+		return 0, 0, 0, nil, errors.New("badger db is closed")
+	}
+
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	it, err := badgerkv.Get[badgerkv.Item](txn, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+			return 0, 0, 0, nil, storage.ErrNotFound
+		default:
+		}
+
+		return 0, 0, 0, nil, fmt.Errorf("failed to get: %w", err)
+	}
+
+	holders, err := badgerkv.GetHolders(txn, id)
+	if err != nil {
+		return 0, 0, 0, nil, fmt.Errorf("failed to get holders: %w", err)
+	}
+
+	return it.Allocated, it.Capacity, it.Version, holders, nil
+}
+
+// Alloc allocates tokens from a quota on behalf of the holder, if any. With a positive ttl the tokens are leased, and
+// they are freed automatically unless the returned lease is renewed before it expires.
+func (s *Storage) Alloc(ctx context.Context, namespace, resource, holder string, tokens, version int64, ttl time.Duration, idempotencyKey string) (int64, int64, string, bool, bool, error) {
+	e := audit.NewEntry(ctx, s.clock.Now(), audit.Alloc, namespace, resource)
+	e.Holder, e.Tokens = holder, tokens
+
+	remainingTokens, currentVersion, leaseID, ok, overSoftLimit, err := s.alloc(&e, namespace, resource, holder, tokens, version, ttl, idempotencyKey)
+	e.LeaseID = leaseID
+	e.SetResult(ok, err)
+	s.audit.Record(e)
+
+	return remainingTokens, currentVersion, leaseID, ok, overSoftLimit, err
+}
+
+func (s *Storage) alloc(e *audit.Entry, namespace, resource, holder string, tokens, version int64, ttl time.Duration, idempotencyKey string) (int64, int64, string, bool, bool, error) {
+	if s.db.IsClosed() {
+		return 0, 0, "", false, false, errors.New("badger db is closed")
 	}
 
 	id := strings.Join([]string{namespace, resource}, "_")
@@ -75,40 +136,173 @@ func (s *Storage) Alloc(_ context.Context, namespace, resource string, tokens, v
 	txn := s.db.NewTransaction(true)
 	defer txn.Discard()
 
-	it, err := get[item](txn, id)
+	it, err := badgerkv.Get[badgerkv.Item](txn, id)
 	if err != nil {
 		switch {
 		case errors.Is(err, badger.ErrKeyNotFound):
-			return 0, 0, false, storage.ErrNotFound
+			return 0, 0, "", false, false, storage.ErrNotFound
 		default:
 		}
 
-		return 0, 0, false, fmt.Errorf("failed to get: %w", err)
+		return 0, 0, "", false, false, fmt.Errorf("failed to get: %w", err)
+	}
+
+	e.Before = badgerkv.AuditState(it)
+
+	var resultKey string
+	if idempotencyKey != "" {
+		resultKey = badgerkv.ResultKeyPrefix + strings.Join([]string{badgerkv.AllocOp, id, idempotencyKey}, "_")
+		r, found, err := badgerkv.GetResult(txn, resultKey, s.clock.Now().UnixNano())
+		if err != nil {
+			return 0, 0, "", false, false, fmt.Errorf("failed to get result: %w", err)
+		}
+
+		if found {
+			return r.RemainingTokens, r.CurrentVersion, r.LeaseID, r.OK, r.OverSoftLimit, nil
+		}
 	}
 
 	if version != 0 && it.Version != version {
-		return 0, 0, false, storage.ErrInvalidVersion
+		return 0, 0, "", false, false, storage.ErrInvalidVersion
+	}
+
+	cfg, err := badgerkv.GetConfig(txn, id, it)
+	if err != nil {
+		return 0, 0, "", false, false, fmt.Errorf("failed to get config: %w", err)
 	}
 
 	newAllocated := it.Allocated + tokens
-	if newAllocated > it.Capacity {
-		return it.Capacity - it.Allocated, it.Version, false, nil
+	if newAllocated > cfg.Limit() {
+		return cfg.Limit() - it.Allocated, it.Version, "", false, false, nil
+	}
+
+	ancestors, err := badgerkv.GetAncestors(txn, id)
+	if err != nil {
+		return 0, 0, "", false, false, fmt.Errorf("failed to get ancestors: %w", err)
+	}
+
+	fits, err := badgerkv.FitAncestors(txn, ancestors, tokens)
+	if err != nil {
+		return 0, 0, "", false, false, fmt.Errorf("failed to fit ancestors: %w", err)
+	}
+
+	if !fits {
+		return cfg.Limit() - it.Allocated, it.Version, "", false, false, nil
 	}
 
 	it.Allocated = newAllocated
 	it.Version += 1
-	if err := set[item](txn, id, it); err != nil {
-		return 0, 0, false, fmt.Errorf("failed to set item: %w", err)
+	if err := badgerkv.Set[badgerkv.Item](txn, id, it); err != nil {
+		return 0, 0, "", false, false, fmt.Errorf("failed to set item: %w", err)
+	}
+
+	if err := badgerkv.ChargeAncestors(txn, ancestors, tokens); err != nil {
+		return 0, 0, "", false, false, fmt.Errorf("failed to charge ancestors: %w", err)
+	}
+
+	if holder != "" {
+		holders, err := badgerkv.GetHolders(txn, id)
+		if err != nil {
+			return 0, 0, "", false, false, fmt.Errorf("failed to get holders: %w", err)
+		}
+
+		holders[holder] += tokens
+		if err := badgerkv.SetHolders(txn, id, holders); err != nil {
+			return 0, 0, "", false, false, fmt.Errorf("failed to set holders: %w", err)
+		}
+	}
+
+	var leaseID string
+	if ttl > 0 {
+		leaseID = uuid.NewString()
+		l := badgerkv.Lease{Namespace: namespace, Resource: resource, Holder: holder, Tokens: tokens, ExpiresAt: s.clock.Now().Add(ttl).UnixNano()}
+		if err := badgerkv.SetLease(txn, leaseID, l); err != nil {
+			return 0, 0, "", false, false, fmt.Errorf("failed to set lease: %w", err)
+		}
+	}
+
+	if resultKey != "" {
+		r := badgerkv.Result{RemainingTokens: cfg.Limit() - it.Allocated, CurrentVersion: it.Version, LeaseID: leaseID, OK: true, OverSoftLimit: cfg.OverSoftLimit(it.Allocated), ExpiresAt: s.clock.Now().Add(s.idempotencyWindow).UnixNano()}
+		if err := badgerkv.SetJSON(txn, resultKey, r); err != nil {
+			return 0, 0, "", false, false, fmt.Errorf("failed to set result: %w", err)
+		}
 	}
 
 	if err := txn.Commit(); err != nil {
-		return 0, 0, false, fmt.Errorf("failed to commit transaction: %w", err)
+		return 0, 0, "", false, false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	e.After = badgerkv.AuditState(it)
+	s.publish(id)
+
+	return cfg.Limit() - it.Allocated, it.Version, leaseID, true, cfg.OverSoftLimit(it.Allocated), nil
+}
+
+// AllocBatch allocates tokens from several quotas all-or-nothing, within a single transaction. Returns false, and
+// allocates nothing, if any of the quotas lacks tokens.
+func (s *Storage) AllocBatch(ctx context.Context, items []batch.Item) ([]batch.Result, bool, error) {
+	entries := make([]audit.Entry, 0, len(items))
+	for _, item := range items {
+		e := audit.NewEntry(ctx, s.clock.Now(), audit.AllocBatch, item.Namespace, item.Resource)
+		e.Holder, e.Tokens = item.Holder, item.Tokens
+		entries = append(entries, e)
+	}
+
+	results, ok, err := s.allocBatch(entries, items)
+	for _, e := range entries {
+		e.SetResult(ok, err)
+		s.audit.Record(e)
+	}
+
+	return results, ok, err
+}
+
+func (s *Storage) allocBatch(entries []audit.Entry, items []batch.Item) ([]batch.Result, bool, error) {
+	if s.db.IsClosed() {
+		return nil, false, errors.New("badger db is closed")
 	}
 
-	return it.Capacity - it.Allocated, it.Version, true, nil
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	results, ok, err := badgerkv.AllocBatch(txn, items, entries)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !ok {
+		return results, false, nil
+	}
+
+	if err := txn.Commit(); err != nil {
+		return nil, false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	ids := make([]string, 0, len(items))
+	for _, bi := range items {
+		ids = append(ids, strings.Join([]string{bi.Namespace, bi.Resource}, "_"))
+	}
+
+	s.publish(ids...)
+
+	return results, true, nil
+}
+
+// Free frees tokens of a quota allocated by the holder, or unowned tokens without a holder. With a lease ID the tokens
+// of the lease are freed instead, and the lease is removed. Returns false if the holder does not own enough tokens, or
+// if the lease is unknown or belongs to another holder.
+func (s *Storage) Free(ctx context.Context, namespace, resource, holder string, tokens, version int64, leaseID, idempotencyKey string) (int64, int64, bool, error) {
+	e := audit.NewEntry(ctx, s.clock.Now(), audit.Free, namespace, resource)
+	e.Holder, e.Tokens, e.LeaseID = holder, tokens, leaseID
+
+	remainingTokens, currentVersion, ok, err := s.free(&e, namespace, resource, holder, tokens, version, leaseID, idempotencyKey)
+	e.SetResult(ok, err)
+	s.audit.Record(e)
+
+	return remainingTokens, currentVersion, ok, err
 }
 
-func (s *Storage) Free(_ context.Context, namespace, resource string, tokens, version int64) (int64, int64, bool, error) {
+func (s *Storage) free(e *audit.Entry, namespace, resource, holder string, tokens, version int64, leaseID, idempotencyKey string) (int64, int64, bool, error) {
 	if s.db.IsClosed() {
 		return 0, 0, false, errors.New("badger db is closed")
 	}
@@ -118,7 +312,7 @@ func (s *Storage) Free(_ context.Context, namespace, resource string, tokens, ve
 	txn := s.db.NewTransaction(true)
 	defer txn.Discard()
 
-	it, err := get[item](txn, id)
+	it, err := badgerkv.Get[badgerkv.Item](txn, id)
 	if err != nil {
 		switch {
 		case errors.Is(err, badger.ErrKeyNotFound):
@@ -129,29 +323,279 @@ func (s *Storage) Free(_ context.Context, namespace, resource string, tokens, ve
 		return 0, 0, false, fmt.Errorf("failed to get: %w", err)
 	}
 
+	e.Before = badgerkv.AuditState(it)
+
+	cfg, err := badgerkv.GetConfig(txn, id, it)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("failed to get config: %w", err)
+	}
+
+	var resultKey string
+	if idempotencyKey != "" {
+		resultKey = badgerkv.ResultKeyPrefix + strings.Join([]string{badgerkv.FreeOp, id, idempotencyKey}, "_")
+		r, found, err := badgerkv.GetResult(txn, resultKey, s.clock.Now().UnixNano())
+		if err != nil {
+			return 0, 0, false, fmt.Errorf("failed to get result: %w", err)
+		}
+
+		if found {
+			return r.RemainingTokens, r.CurrentVersion, r.OK, nil
+		}
+	}
+
 	if version != 0 && it.Version != version {
 		return 0, 0, false, storage.ErrInvalidVersion
 	}
 
-	newAllocated := it.Allocated - tokens
-	if newAllocated < 0 {
-		return it.Capacity - it.Allocated, it.Version, false, nil
+	if leaseID != "" {
+		l, err := badgerkv.GetLease(txn, leaseID)
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return cfg.Limit() - it.Allocated, it.Version, false, nil
+			}
+
+			return 0, 0, false, fmt.Errorf("failed to get lease: %w", err)
+		}
+
+		if l.Namespace != namespace || l.Resource != resource || l.Holder != holder {
+			return cfg.Limit() - it.Allocated, it.Version, false, nil
+		}
+
+		if err := txn.Delete([]byte(badgerkv.LeaseKeyPrefix + leaseID)); err != nil {
+			return 0, 0, false, fmt.Errorf("failed to delete lease: %w", err)
+		}
+
+		tokens = l.Tokens
+	}
+
+	holders, err := badgerkv.GetHolders(txn, id)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("failed to get holders: %w", err)
 	}
 
-	it.Allocated = newAllocated
+	freeable, err := badgerkv.Freeable(txn, id, it, holders, holder)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("failed to get freeable tokens: %w", err)
+	}
+
+	if tokens > freeable {
+		return cfg.Limit() - it.Allocated, it.Version, false, nil
+	}
+
+	it.Allocated -= tokens
 	it.Version += 1
-	if err := set[item](txn, id, it); err != nil {
+	if err := badgerkv.Set[badgerkv.Item](txn, id, it); err != nil {
 		return 0, 0, false, fmt.Errorf("failed to set item: %w", err)
 	}
 
+	ancestors, err := badgerkv.GetAncestors(txn, id)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("failed to get ancestors: %w", err)
+	}
+
+	if err := badgerkv.ChargeAncestors(txn, ancestors, -tokens); err != nil {
+		return 0, 0, false, fmt.Errorf("failed to release ancestors: %w", err)
+	}
+
+	if holder != "" {
+		holders[holder] -= tokens
+		if err := badgerkv.SetHolders(txn, id, holders); err != nil {
+			return 0, 0, false, fmt.Errorf("failed to set holders: %w", err)
+		}
+	}
+
+	if resultKey != "" {
+		r := badgerkv.Result{RemainingTokens: cfg.Limit() - it.Allocated, CurrentVersion: it.Version, OK: true, ExpiresAt: s.clock.Now().Add(s.idempotencyWindow).UnixNano()}
+		if err := badgerkv.SetJSON(txn, resultKey, r); err != nil {
+			return 0, 0, false, fmt.Errorf("failed to set result: %w", err)
+		}
+	}
+
 	if err := txn.Commit(); err != nil {
 		return 0, 0, false, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return it.Capacity - it.Allocated, it.Version, true, nil
+	e.After = badgerkv.AuditState(it)
+	s.publish(id)
+
+	return cfg.Limit() - it.Allocated, it.Version, true, nil
+}
+
+// Renew extends a lease to ttl from now. Returns false if the lease is unknown or has already expired.
+func (s *Storage) Renew(_ context.Context, namespace, resource, leaseID string, ttl time.Duration) (time.Time, bool, error) {
+	if s.db.IsClosed() {
+		return time.Time{}, false, errors.New("badger db is closed")
+	}
+
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	if _, err := badgerkv.Get[badgerkv.Item](txn, id); err != nil {
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+			return time.Time{}, false, storage.ErrNotFound
+		default:
+		}
+
+		return time.Time{}, false, fmt.Errorf("failed to get: %w", err)
+	}
+
+	l, err := badgerkv.GetLease(txn, leaseID)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return time.Time{}, false, nil
+		}
+
+		return time.Time{}, false, fmt.Errorf("failed to get lease: %w", err)
+	}
+
+	now := s.clock.Now()
+	if l.Namespace != namespace || l.Resource != resource || l.ExpiresAt <= now.UnixNano() {
+		return time.Time{}, false, nil
+	}
+
+	expiresAt := now.Add(ttl)
+	l.ExpiresAt = expiresAt.UnixNano()
+	if err := badgerkv.SetLease(txn, leaseID, l); err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to set lease: %w", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return expiresAt, true, nil
 }
 
-func (s *Storage) RegisterQuota(_ context.Context, namespace, resource string, cfg quota.Config) error {
+// ExpireLeases frees the tokens of all expired leases and forgets the results of idempotency keys past their window.
+func (s *Storage) ExpireLeases(_ context.Context) (int, error) {
+	if s.db.IsClosed() {
+		return 0, errors.New("badger db is closed")
+	}
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	now := s.clock.Now()
+	expired, entries, err := badgerkv.ExpireLeases(txn, now.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire leases: %w", err)
+	}
+
+	forgotten, err := badgerkv.ForgetResults(txn, now.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("failed to forget results: %w", err)
+	}
+
+	if expired == 0 && forgotten == 0 {
+		return 0, nil
+	}
+
+	if err := txn.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.record(now, entries)
+
+	return expired, nil
+}
+
+// ResetPeriods frees all tokens of the periodic quotas whose period has ended, and drops their leases. Returns the
+// number of quotas reset.
+func (s *Storage) ResetPeriods(_ context.Context) (int, error) {
+	if s.db.IsClosed() {
+		return 0, errors.New("badger db is closed")
+	}
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	now := s.clock.Now()
+	entries, err := badgerkv.ResetPeriods(txn, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reset periods: %w", err)
+	}
+
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	if err := txn.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.record(now, entries)
+
+	return len(entries), nil
+}
+
+// RecordHistory samples the allocated tokens of all quotas into the windows of the history, and drops the windows past
+// the retention. Returns the number of quotas sampled.
+func (s *Storage) RecordHistory(_ context.Context) (int, error) {
+	if s.db.IsClosed() {
+		return 0, errors.New("badger db is closed")
+	}
+
+	if s.cfg.HistoryResolution <= 0 || s.cfg.HistoryRetention <= 0 {
+		return 0, nil
+	}
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	recorded, err := badgerkv.RecordHistory(txn, s.clock.Now(), s.cfg.HistoryResolution, s.cfg.HistoryRetention)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record history: %w", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return recorded, nil
+}
+
+// History returns the history of a quota in the windows starting between from and to, downsampled to step.
+func (s *Storage) History(_ context.Context, namespace, resource string, from, to time.Time, step time.Duration) ([]history.Sample, error) {
+	if s.db.IsClosed() {
+		return nil, errors.New("badger db is closed")
+	}
+
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	if _, err := badgerkv.Get[badgerkv.Item](txn, id); err != nil {
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+			return nil, storage.ErrNotFound
+		default:
+		}
+
+		return nil, fmt.Errorf("failed to get: %w", err)
+	}
+
+	samples, err := badgerkv.GetHistory(txn, id, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history: %w", err)
+	}
+
+	return history.Downsample(samples, step), nil
+}
+
+func (s *Storage) RegisterQuota(ctx context.Context, namespace, resource string, cfg quota.Config) error {
+	e := audit.NewEntry(ctx, s.clock.Now(), audit.RegisterQuota, namespace, resource)
+	err := s.registerQuota(&e, namespace, resource, cfg)
+	e.SetResult(true, err)
+	s.audit.Record(e)
+
+	return err
+}
+
+func (s *Storage) registerQuota(e *audit.Entry, namespace, resource string, cfg quota.Config) error {
 	if s.db.IsClosed() {
 		return errors.New("badger db is closed")
 	}
@@ -161,59 +605,484 @@ func (s *Storage) RegisterQuota(_ context.Context, namespace, resource string, c
 	txn := s.db.NewTransaction(true)
 	defer txn.Discard()
 
-	_, err := get[item](txn, id)
-	if !errors.Is(err, badger.ErrKeyNotFound) {
-		return nil
+	_, err := badgerkv.Get[badgerkv.Item](txn, id)
+	switch {
+	case err == nil:
+		// The quota survived a restart. Its reference is written anyway, since older versions did not store it.
+		ref, _, err := badgerkv.GetQuotaRef(txn, id)
+		if err != nil {
+			return fmt.Errorf("failed to get quota ref: %w", err)
+		}
+
+		if err := badgerkv.SetQuotaRef(txn, id, namespace, resource, ref.Config(0)); err != nil {
+			return fmt.Errorf("failed to set quota ref: %w", err)
+		}
+
+		if err := txn.Commit(); err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+
+		return storage.ErrAlreadyExists
+	case errors.Is(err, badger.ErrKeyNotFound):
+	default:
+		return fmt.Errorf("failed to get: %w", err)
+	}
+
+	if err := badgerkv.ValidateConfig(cfg); err != nil {
+		return err
 	}
 
-	if err := set[item](txn, id, item{Allocated: 0, Capacity: cfg.Capacity, Version: 1}); err != nil {
+	if err := badgerkv.ValidateParent(txn, id, cfg); err != nil {
+		return err
+	}
+
+	it := badgerkv.Item{Allocated: 0, Capacity: cfg.Capacity, Version: 1}
+	if err := badgerkv.Set[badgerkv.Item](txn, id, it); err != nil {
 		return fmt.Errorf("failed to set item :%w", err)
 	}
 
+	if err := badgerkv.SetQuotaRef(txn, id, namespace, resource, cfg); err != nil {
+		return fmt.Errorf("failed to set quota ref: %w", err)
+	}
+
+	if err := badgerkv.SetPeriod(txn, id, cfg, s.clock.Now()); err != nil {
+		return fmt.Errorf("failed to set period: %w", err)
+	}
+
 	if err := txn.Commit(); err != nil {
 		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
+	e.After = badgerkv.QuotaAuditState(it, cfg)
+	s.publish(id)
+
 	return nil
 }
 
-func (s *Storage) Shutdown(_ context.Context) error {
-	return s.db.Close()
+// UpdateQuota changes the capacity of a quota, and its shrink policy decides what happens to the allocated tokens above
+// the new capacity. Nothing changes if neither the capacity nor the parent do.
+func (s *Storage) UpdateQuota(ctx context.Context, namespace, resource string, cfg quota.Config) error {
+	e := audit.NewEntry(ctx, s.clock.Now(), audit.UpdateQuota, namespace, resource)
+	err := s.updateQuota(&e, namespace, resource, cfg)
+	e.SetResult(true, err)
+	s.audit.Record(e)
+
+	return err
+}
+
+func (s *Storage) updateQuota(e *audit.Entry, namespace, resource string, cfg quota.Config) error {
+	if s.db.IsClosed() {
+		return errors.New("badger db is closed")
+	}
+
+	if err := badgerkv.ValidateConfig(cfg); err != nil {
+		return err
+	}
+
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	it, err := badgerkv.Get[badgerkv.Item](txn, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+			return storage.ErrNotFound
+		default:
+		}
+
+		return fmt.Errorf("failed to get: %w", err)
+	}
+
+	ref, _, err := badgerkv.GetQuotaRef(txn, id)
+	if err != nil {
+		return fmt.Errorf("failed to get quota ref: %w", err)
+	}
+
+	current := ref.Config(it.Capacity)
+	e.Before = badgerkv.QuotaAuditState(it, current)
+	if cfg.Capacity == current.Capacity && cfg.Parent == current.Parent && cfg.SoftLimit == current.SoftLimit && cfg.Overcommit == current.Overcommit && cfg.Period == current.Period && cfg.TimeZone == current.TimeZone {
+		e.After = e.Before
+		return nil
+	}
+
+	if cfg.Periodic() {
+		children, err := badgerkv.HasChildren(txn, namespace, resource)
+		if err != nil {
+			return fmt.Errorf("failed to check children: %w", err)
+		}
+
+		if children {
+			return fmt.Errorf("quota with child quotas cannot be periodic: %w", storage.ErrInvalidConfig)
+		}
+	}
+
+	if cfg.Parent != ref.Parent {
+		if it.Allocated > 0 {
+			return fmt.Errorf("parent cannot be changed with tokens allocated: %w", storage.ErrInvalidConfig)
+		}
+
+		if err := badgerkv.ValidateParent(txn, id, cfg); err != nil {
+			return err
+		}
+	}
+
+	if err := badgerkv.SetQuotaRef(txn, id, namespace, resource, cfg); err != nil {
+		return fmt.Errorf("failed to set quota ref: %w", err)
+	}
+
+	if err := badgerkv.Shrink(txn, id, it, cfg); err != nil {
+		return err
+	}
+
+	if cfg.Period != current.Period || cfg.TimeZone != current.TimeZone {
+		if err := badgerkv.SetPeriod(txn, id, cfg, s.clock.Now()); err != nil {
+			return fmt.Errorf("failed to set period: %w", err)
+		}
+	}
+
+	updated, err := badgerkv.Get[badgerkv.Item](txn, id)
+	if err != nil {
+		return fmt.Errorf("failed to get: %w", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	e.After = badgerkv.QuotaAuditState(updated, cfg)
+	s.publish(id)
+
+	return nil
+}
+
+func (s *Storage) DeleteQuota(ctx context.Context, namespace, resource string) error {
+	e := audit.NewEntry(ctx, s.clock.Now(), audit.DeleteQuota, namespace, resource)
+	err := s.deleteQuota(&e, namespace, resource)
+	e.SetResult(true, err)
+	s.audit.Record(e)
+
+	return err
+}
+
+func (s *Storage) deleteQuota(e *audit.Entry, namespace, resource string) error {
+	if s.db.IsClosed() {
+		return errors.New("badger db is closed")
+	}
+
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	it, err := badgerkv.Get[badgerkv.Item](txn, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+			return storage.ErrNotFound
+		default:
+		}
+
+		return fmt.Errorf("failed to get: %w", err)
+	}
+
+	ref, _, err := badgerkv.GetQuotaRef(txn, id)
+	if err != nil {
+		return fmt.Errorf("failed to get quota ref: %w", err)
+	}
+
+	e.Before = badgerkv.QuotaAuditState(it, ref.Config(it.Capacity))
+
+	children, err := badgerkv.HasChildren(txn, namespace, resource)
+	if err != nil {
+		return fmt.Errorf("failed to check children: %w", err)
+	}
+
+	if children {
+		return fmt.Errorf("quota has child quotas: %w", storage.ErrInvalidConfig)
+	}
+
+	ancestors, err := badgerkv.GetAncestors(txn, id)
+	if err != nil {
+		return fmt.Errorf("failed to get ancestors: %w", err)
+	}
+
+	if err := badgerkv.ChargeAncestors(txn, ancestors, -it.Allocated); err != nil {
+		return fmt.Errorf("failed to release ancestors: %w", err)
+	}
+
+	if err := txn.Delete([]byte(id)); err != nil {
+		return fmt.Errorf("failed to delete item: %w", err)
+	}
+
+	if err := txn.Delete([]byte(badgerkv.QuotaRefKeyPrefix + id)); err != nil {
+		return fmt.Errorf("failed to delete quota ref: %w", err)
+	}
+
+	if err := txn.Delete([]byte(badgerkv.HoldersKeyPrefix + id)); err != nil {
+		return fmt.Errorf("failed to delete holders: %w", err)
+	}
+
+	if err := txn.Delete([]byte(badgerkv.PeriodKeyPrefix + id)); err != nil {
+		return fmt.Errorf("failed to delete period: %w", err)
+	}
+
+	if err := badgerkv.ForgetHistory(txn, id, time.Time{}); err != nil {
+		return fmt.Errorf("failed to delete history: %w", err)
+	}
+
+	if err := badgerkv.DeleteLeases(txn, namespace, resource); err != nil {
+		return fmt.Errorf("failed to delete leases: %w", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.hub.Publish(namespace, resource, watch.Event{Deleted: true})
+	if len(ancestors) > 0 {
+		s.publish(ancestors[0].ID)
+	}
+
+	return nil
+}
+
+func (s *Storage) ListQuotas(_ context.Context) ([]quota.Quota, error) {
+	if s.db.IsClosed() {
+		return nil, errors.New("badger db is closed")
+	}
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	refs, err := badgerkv.ListQuotaRefs(txn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list quota refs: %w", err)
+	}
+
+	quotas := make([]quota.Quota, 0, len(refs))
+	for _, ref := range refs {
+		it, err := badgerkv.Get[badgerkv.Item](txn, strings.Join([]string{ref.Namespace, ref.Resource}, "_"))
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
+
+			return nil, fmt.Errorf("failed to get: %w", err)
+		}
+
+		quotas = append(quotas, quota.Quota{Namespace: ref.Namespace, Resource: ref.Resource, Strategy: ref.Config(it.Capacity)})
+	}
+
+	return quotas, nil
+}
+
+// Watch returns the changes of a quota, starting with its current state, until ctx is done.
+func (s *Storage) Watch(ctx context.Context, namespace, resource string) (<-chan watch.Event, error) {
+	if s.db.IsClosed() {
+		return nil, errors.New("badger db is closed")
+	}
+
+	sub := s.hub.Subscribe(namespace, resource)
+	allocated, capacity, version, err := s.View(ctx, namespace, resource)
+	if err != nil {
+		sub.Cancel()
+		return nil, err
+	}
+
+	sub.Offer(watch.Event{Allocated: allocated, Capacity: capacity, Version: version})
+
+	go func() {
+		<-ctx.Done()
+		sub.Cancel()
+	}()
+
+	return sub.Events(), nil
 }
 
-func get[T any](txn *badger.Txn, key string) (T, error) {
-	item, err := txn.Get([]byte(key))
+// Export returns the state of all quotas, along with their leases, ordered by export.Sort.
+func (s *Storage) Export(_ context.Context) ([]export.Item, error) {
+	if s.db.IsClosed() {
+		return nil, errors.New("badger db is closed")
+	}
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	items, err := badgerkv.ExportItems(txn)
 	if err != nil {
-		var zero T
-		return zero, fmt.Errorf("failed to get key: %w", err)
+		return nil, err
+	}
+
+	export.Sort(items)
+
+	return items, nil
+}
+
+// Import writes the state of exported quotas as it is, registering the missing ones and overwriting the others along
+// with their leases. Every item is imported in its own transaction and in order, so parents have to come before their
+// children, and an import stops at the first invalid item.
+func (s *Storage) Import(ctx context.Context, items []export.Item) error {
+	if s.db.IsClosed() {
+		return errors.New("badger db is closed")
 	}
 
-	var result T
-	err = item.Value(func(val []byte) error {
-		err := binary.Read(bytes.NewReader(val), binary.BigEndian, &result)
+	for _, it := range items {
+		e := audit.NewEntry(ctx, s.clock.Now(), audit.Import, it.Namespace, it.Resource)
+		err := s.importItem(&e, it)
+		e.SetResult(true, err)
+		s.audit.Record(e)
+
 		if err != nil {
-			return fmt.Errorf("failed to read bytes: %w", err)
+			return fmt.Errorf("failed to import %s/%s: %w", it.Namespace, it.Resource, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) importItem(e *audit.Entry, it export.Item) error {
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	before, after, err := badgerkv.ImportItem(txn, it, s.clock.Now())
+	e.Before = before
+	if err != nil {
+		return err
+	}
+
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	e.After = after
+	s.publish(strings.Join([]string{it.Namespace, it.Resource}, "_"))
+
+	return nil
+}
+
+// Backup writes a consistent snapshot of the store to w, as a backup with a single section.
+func (s *Storage) Backup(_ context.Context, w io.Writer) error {
+	if s.db.IsClosed() {
+		return errors.New("badger db is closed")
+	}
+
+	bw := backup.NewWriter(w)
+	err := s.db.View(func(txn *badger.Txn) error {
+		return bw.WriteSection(backupSectionID, txn)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write section: %w", err)
+	}
+
+	return bw.Flush()
+}
+
+// Restore loads a backup written by Backup into the store, which must not have any quotas.
+func (s *Storage) Restore(_ context.Context, r io.Reader) error {
+	if s.db.IsClosed() {
+		return errors.New("badger db is closed")
+	}
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		refs, err := badgerkv.ListQuotaRefs(txn)
+		if err != nil {
+			return fmt.Errorf("failed to list quota refs: %w", err)
+		}
+
+		if len(refs) > 0 {
+			return fmt.Errorf("store has quotas: %w", storage.ErrAlreadyExists)
 		}
 
 		return nil
 	})
 	if err != nil {
-		var zero T
-		return zero, fmt.Errorf("failed to read item value: %w", err)
+		return err
 	}
 
-	return result, nil
+	br := backup.NewReader(r)
+	for {
+		id, err := br.NextSection()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read section: %w", err)
+		}
+
+		if id != backupSectionID {
+			return fmt.Errorf("backup holds section %d of a raft storage: %w", id, storage.ErrInvalidConfig)
+		}
+
+		if err := s.restoreSection(br); err != nil {
+			return err
+		}
+	}
 }
 
-func set[T any](txn *badger.Txn, key string, value T) error {
-	buf := bytes.NewBuffer(nil)
-	if err := binary.Write(buf, binary.BigEndian, value); err != nil {
-		return fmt.Errorf("failed to write to buffer: %w", err)
+// restoreSection writes the keys of the current section of a backup, committing whenever a transaction grows too big.
+func (s *Storage) restoreSection(br *backup.Reader) error {
+	txn := s.db.NewTransaction(true)
+	defer func() {
+		txn.Discard()
+	}()
+
+	for {
+		key, value, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read key: %w", err)
+		}
+
+		err = txn.Set(key, value)
+		if errors.Is(err, badger.ErrTxnTooBig) {
+			if err := txn.Commit(); err != nil {
+				return fmt.Errorf("failed to commit transaction: %w", err)
+			}
+
+			txn = s.db.NewTransaction(true)
+			err = txn.Set(key, value)
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to set key: %w", err)
+		}
 	}
 
-	if err := txn.Set([]byte(key), buf.Bytes()); err != nil {
-		return fmt.Errorf("failed to set value: %w", err)
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	return nil
 }
+
+// publish sends the state of the given quotas, and of their ancestors, to their watchers.
+func (s *Storage) publish(ids ...string) {
+	err := s.db.View(func(txn *badger.Txn) error {
+		return badgerkv.Publish(txn, s.hub, ids)
+	})
+	if err != nil {
+		s.logger.Warn("failed to publish changes", "err", err)
+	}
+}
+
+// record records the entries of mutations the storage made on its own at now, and publishes the quotas they changed.
+func (s *Storage) record(now time.Time, entries []audit.Entry) {
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		e.Time = now
+		s.audit.Record(e)
+		ids = append(ids, strings.Join([]string{e.Namespace, e.Resource}, "_"))
+	}
+
+	s.publish(ids...)
+}
+
+func (s *Storage) Shutdown(_ context.Context) error {
+	return s.db.Close()
+}
@@ -0,0 +1,531 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Blinkuu/qms/internal/core/storage"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/audit"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/batch"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/export"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/history"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/memory"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/watch"
+	"github.com/Blinkuu/qms/pkg/caller"
+	"github.com/Blinkuu/qms/pkg/log"
+)
+
+func newTestStorage(t *testing.T, c clock.Clock) *Storage {
+	s, err := NewStorage(Config{Dir: t.TempDir()}, c, time.Minute, log.NewNoopLogger(), audit.NewNopLog())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+
+	return s
+}
+
+func TestStorage_ListQuotas_ReturnsRegisteredQuotas(t *testing.T) {
+	// Given
+	s := newTestStorage(t, clock.NewMock())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource_1", quota.Config{Capacity: 10}))
+	assert.ErrorIs(t, s.RegisterQuota(context.Background(), "namespace", "resource_1", quota.Config{Capacity: 20}), storage.ErrAlreadyExists)
+
+	// When
+	quotas, err := s.ListQuotas(context.Background())
+
+	// Then
+	assert.NoError(t, err)
+	assert.Equal(t, []quota.Quota{{Namespace: "namespace", Resource: "resource_1", Strategy: quota.Config{Capacity: 10}}}, quotas)
+}
+
+func TestStorage_UpdateQuota_ChangesCapacityAndBumpsVersion(t *testing.T) {
+	// Given
+	s := newTestStorage(t, clock.NewMock())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10}))
+	_, _, _, _, _, err := s.Alloc(context.Background(), "namespace", "resource", "", 4, 0, 0, "")
+	assert.NoError(t, err)
+
+	// When
+	belowErr := s.UpdateQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 3})
+	err = s.UpdateQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 4})
+
+	// Then
+	assert.ErrorIs(t, belowErr, storage.ErrCapacityBelowAllocated)
+	assert.NoError(t, err)
+	allocated, capacity, version, viewErr := s.View(context.Background(), "namespace", "resource")
+	assert.NoError(t, viewErr)
+	assert.EqualValues(t, 4, allocated)
+	assert.EqualValues(t, 4, capacity)
+	assert.EqualValues(t, 3, version)
+}
+
+func TestStorage_DeleteQuota_RemovesItemAndRef(t *testing.T) {
+	// Given
+	s := newTestStorage(t, clock.NewMock())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10}))
+
+	// When
+	err := s.DeleteQuota(context.Background(), "namespace", "resource")
+
+	// Then
+	assert.NoError(t, err)
+	_, _, _, viewErr := s.View(context.Background(), "namespace", "resource")
+	assert.ErrorIs(t, viewErr, storage.ErrNotFound)
+	quotas, listErr := s.ListQuotas(context.Background())
+	assert.NoError(t, listErr)
+	assert.Empty(t, quotas)
+	assert.ErrorIs(t, s.DeleteQuota(context.Background(), "namespace", "resource"), storage.ErrNotFound)
+}
+
+func TestStorage_ExpireLeases_FreesTokensOfExpiredLeases(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	s := newTestStorage(t, c)
+	require.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10}))
+	_, _, leaseID, ok, _, err := s.Alloc(context.Background(), "namespace", "resource", "", 4, 0, 10*time.Second, "")
+	require.NoError(t, err)
+	require.True(t, ok)
+	c.Add(5 * time.Second)
+	_, renewed, err := s.Renew(context.Background(), "namespace", "resource", leaseID, 10*time.Second)
+	require.NoError(t, err)
+	require.True(t, renewed)
+	c.Add(10 * time.Second)
+
+	// When
+	expired, err := s.ExpireLeases(context.Background())
+
+	// Then
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	allocated, _, version, viewErr := s.View(context.Background(), "namespace", "resource")
+	assert.NoError(t, viewErr)
+	assert.EqualValues(t, 0, allocated)
+	assert.EqualValues(t, 3, version)
+	_, _, ok, err = s.Free(context.Background(), "namespace", "resource", "", 0, 0, leaseID, "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestStorage_Free_KeepsLeasedTokensUntilTheLeaseExpires(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	s := newTestStorage(t, c)
+	require.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10}))
+	_, _, _, ok, _, err := s.Alloc(context.Background(), "namespace", "resource", "a", 10, 0, 10*time.Second, "")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// When
+	_, _, freed, err := s.Free(context.Background(), "namespace", "resource", "a", 10, 0, "", "")
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, freed)
+	c.Add(10 * time.Second)
+	expired, err := s.ExpireLeases(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	_, _, _, ok, _, err = s.Alloc(context.Background(), "namespace", "resource", "b", 10, 0, 0, "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	_, _, _, ok, _, err = s.Alloc(context.Background(), "namespace", "resource", "c", 10, 0, 0, "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	allocated, _, _, viewErr := s.View(context.Background(), "namespace", "resource")
+	assert.NoError(t, viewErr)
+	assert.EqualValues(t, 10, allocated)
+}
+
+func TestStorage_ViewHolders_TracksTokensPerHolder(t *testing.T) {
+	// Given
+	s := newTestStorage(t, clock.NewMock())
+	require.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10}))
+	_, _, _, _, _, err := s.Alloc(context.Background(), "namespace", "resource", "holder1", 4, 0, 0, "")
+	require.NoError(t, err)
+	_, _, leaseID, _, _, err := s.Alloc(context.Background(), "namespace", "resource", "holder2", 3, 0, time.Second, "")
+	require.NoError(t, err)
+
+	// When
+	_, _, ok1, err1 := s.Free(context.Background(), "namespace", "resource", "holder1", 5, 0, "", "")
+	_, _, ok2, err2 := s.Free(context.Background(), "namespace", "resource", "holder1", 0, 0, leaseID, "")
+	_, _, ok3, err3 := s.Free(context.Background(), "namespace", "resource", "holder1", 1, 0, "", "")
+
+	// Then
+	assert.NoError(t, err1)
+	assert.False(t, ok1)
+	assert.NoError(t, err2)
+	assert.False(t, ok2)
+	assert.NoError(t, err3)
+	assert.True(t, ok3)
+	allocated, _, _, holders, err := s.ViewHolders(context.Background(), "namespace", "resource")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 6, allocated)
+	assert.Equal(t, map[string]int64{"holder1": 3, "holder2": 3}, holders)
+}
+
+func TestStorage_Free_ReplaysResultOfIdempotencyKey(t *testing.T) {
+	// Given
+	s := newTestStorage(t, clock.NewMock())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10}))
+	_, _, _, _, _, err := s.Alloc(context.Background(), "namespace", "resource", "", 4, 0, 0, "alloc")
+	assert.NoError(t, err)
+	_, _, _, _, _, err = s.Alloc(context.Background(), "namespace", "resource", "", 4, 0, 0, "alloc")
+	assert.NoError(t, err)
+
+	// When
+	remainingTokens1, version1, ok1, err1 := s.Free(context.Background(), "namespace", "resource", "", 3, 0, "", "free")
+	remainingTokens2, version2, ok2, err2 := s.Free(context.Background(), "namespace", "resource", "", 3, 0, "", "free")
+
+	// Then
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.True(t, ok1)
+	assert.True(t, ok2)
+	assert.EqualValues(t, 9, remainingTokens1)
+	assert.Equal(t, remainingTokens1, remainingTokens2)
+	assert.Equal(t, version1, version2)
+	allocated, _, _, viewErr := s.View(context.Background(), "namespace", "resource")
+	assert.NoError(t, viewErr)
+	assert.EqualValues(t, 1, allocated)
+}
+
+func TestStorage_AllocBatch_AllocatesAllItemsTogether(t *testing.T) {
+	// Given
+	s := newTestStorage(t, clock.NewMock())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "namespace", "cpu", quota.Config{Capacity: 10}))
+	assert.NoError(t, s.RegisterQuota(context.Background(), "namespace", "memory", quota.Config{Capacity: 5}))
+	items := []batch.Item{
+		{Namespace: "namespace", Resource: "cpu", Holder: "vm", Tokens: 4},
+		{Namespace: "namespace", Resource: "memory", Holder: "vm", Tokens: 5},
+	}
+
+	// When
+	results1, ok1, err1 := s.AllocBatch(context.Background(), items)
+	results2, ok2, err2 := s.AllocBatch(context.Background(), items)
+
+	// Then
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.True(t, ok1)
+	assert.False(t, ok2)
+	assert.Equal(t, []batch.Result{{RemainingTokens: 6, CurrentVersion: 2}, {RemainingTokens: 0, CurrentVersion: 2}}, results1)
+	assert.Equal(t, results1, results2)
+	_, _, _, holders, viewErr := s.ViewHolders(context.Background(), "namespace", "memory")
+	assert.NoError(t, viewErr)
+	assert.Equal(t, map[string]int64{"vm": 5}, holders)
+}
+
+func TestStorage_Alloc_ChargesAncestorsUntilFreed(t *testing.T) {
+	// Given
+	s := newTestStorage(t, clock.NewMock())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "org", "cpu", quota.Config{Capacity: 5}))
+	assert.NoError(t, s.RegisterQuota(context.Background(), "team", "cpu", quota.Config{Capacity: 8, Parent: "org/cpu"}))
+
+	// When
+	_, _, _, ok1, _, err1 := s.Alloc(context.Background(), "team", "cpu", "", 5, 0, 0, "")
+	_, _, _, ok2, _, err2 := s.Alloc(context.Background(), "team", "cpu", "", 1, 0, 0, "")
+	_, _, freed, freeErr := s.Free(context.Background(), "team", "cpu", "", 5, 0, "", "")
+
+	// Then
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.NoError(t, freeErr)
+	assert.True(t, ok1)
+	assert.False(t, ok2)
+	assert.True(t, freed)
+	allocated, _, _, viewErr := s.View(context.Background(), "org", "cpu")
+	assert.NoError(t, viewErr)
+	assert.EqualValues(t, 0, allocated)
+}
+
+func TestStorage_RegisterQuota_ReturnsErrInvalidConfigWithInvalidParent(t *testing.T) {
+	// Given
+	s := newTestStorage(t, clock.NewMock())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "org", "cpu", quota.Config{Capacity: 10}))
+	assert.NoError(t, s.RegisterQuota(context.Background(), "team", "cpu", quota.Config{Capacity: 8, Parent: "org/cpu"}))
+
+	// When
+	unknownErr := s.RegisterQuota(context.Background(), "user", "cpu", quota.Config{Capacity: 1, Parent: "nobody/cpu"})
+	cycleErr := s.UpdateQuota(context.Background(), "org", "cpu", quota.Config{Capacity: 10, Parent: "team/cpu"})
+	deleteErr := s.DeleteQuota(context.Background(), "org", "cpu")
+
+	// Then
+	assert.ErrorIs(t, unknownErr, storage.ErrInvalidConfig)
+	assert.ErrorIs(t, cycleErr, storage.ErrInvalidConfig)
+	assert.ErrorIs(t, deleteErr, storage.ErrInvalidConfig)
+}
+
+func TestStorage_UpdateQuota_ClampReleasesAncestors(t *testing.T) {
+	// Given
+	s := newTestStorage(t, clock.NewMock())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "org", "cpu", quota.Config{Capacity: 10}))
+	assert.NoError(t, s.RegisterQuota(context.Background(), "team", "cpu", quota.Config{Capacity: 8, Parent: "org/cpu"}))
+	_, _, _, _, _, err := s.Alloc(context.Background(), "team", "cpu", "holder", 6, 0, 0, "")
+	assert.NoError(t, err)
+
+	// When
+	err = s.UpdateQuota(context.Background(), "team", "cpu", quota.Config{Capacity: 4, Parent: "org/cpu", ShrinkPolicy: quota.ShrinkPolicyClamp})
+
+	// Then
+	assert.NoError(t, err)
+	allocated, capacity, _, holders, viewErr := s.ViewHolders(context.Background(), "team", "cpu")
+	assert.NoError(t, viewErr)
+	assert.EqualValues(t, 4, allocated)
+	assert.EqualValues(t, 4, capacity)
+	assert.Equal(t, map[string]int64{"holder": 4}, holders)
+	parentAllocated, _, _, parentViewErr := s.View(context.Background(), "org", "cpu")
+	assert.NoError(t, parentViewErr)
+	assert.EqualValues(t, 4, parentAllocated)
+}
+
+func TestStorage_Alloc_FlagsAllocsOverSoftLimitUpToOvercommittedCapacity(t *testing.T) {
+	// Given
+	s := newTestStorage(t, clock.NewMock())
+	cfg := quota.Config{Capacity: 10, SoftLimit: 8, Overcommit: 1.5}
+	assert.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource", cfg))
+
+	// When
+	remainingTokens1, _, _, ok1, overSoftLimit1, err1 := s.Alloc(context.Background(), "namespace", "resource", "", 9, 0, 0, "")
+	_, _, _, ok2, _, err2 := s.Alloc(context.Background(), "namespace", "resource", "", 7, 0, 0, "")
+
+	// Then
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.True(t, ok1)
+	assert.True(t, overSoftLimit1)
+	assert.EqualValues(t, 6, remainingTokens1)
+	assert.False(t, ok2)
+	quotas, listErr := s.ListQuotas(context.Background())
+	assert.NoError(t, listErr)
+	assert.Equal(t, []quota.Quota{{Namespace: "namespace", Resource: "resource", Strategy: cfg}}, quotas)
+}
+
+func TestStorage_Watch_SendsDeletedEventAndClosesOnCancel(t *testing.T) {
+	// Given
+	s := newTestStorage(t, clock.NewMock())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10}))
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// When
+	events, err := s.Watch(ctx, "namespace", "resource")
+	require.NoError(t, err)
+	initial := <-events
+	deleteErr := s.DeleteQuota(context.Background(), "namespace", "resource")
+	deleted := <-events
+	cancel()
+	_, open := <-events
+
+	// Then
+	assert.NoError(t, deleteErr)
+	assert.Equal(t, watch.Event{Allocated: 0, Capacity: 10, Version: 1}, initial)
+	assert.Equal(t, watch.Event{Deleted: true}, deleted)
+	assert.False(t, open)
+}
+
+func TestStorage_ResetPeriods_FreesTokensAndReleasesAncestors(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	c.Set(time.Date(2022, time.November, 20, 23, 0, 0, 0, time.UTC))
+	s := newTestStorage(t, c)
+	assert.NoError(t, s.RegisterQuota(context.Background(), "org", "builds", quota.Config{Capacity: 10}))
+	assert.NoError(t, s.RegisterQuota(context.Background(), "team", "builds", quota.Config{Capacity: 8, Parent: "org/builds", Period: "week"}))
+	_, _, leaseID, _, _, err := s.Alloc(context.Background(), "team", "builds", "ci", 6, 0, time.Hour, "")
+	require.NoError(t, err)
+
+	// When
+	c.Add(2 * time.Hour)
+	reset, resetErr := s.ResetPeriods(context.Background())
+
+	// Then
+	assert.NoError(t, resetErr)
+	assert.Equal(t, 1, reset)
+	allocated, _, _, holders, viewErr := s.ViewHolders(context.Background(), "team", "builds")
+	assert.NoError(t, viewErr)
+	assert.EqualValues(t, 0, allocated)
+	assert.Empty(t, holders)
+	parentAllocated, _, _, parentErr := s.View(context.Background(), "org", "builds")
+	assert.NoError(t, parentErr)
+	assert.EqualValues(t, 0, parentAllocated)
+	_, ok, renewErr := s.Renew(context.Background(), "team", "builds", leaseID, time.Hour)
+	assert.NoError(t, renewErr)
+	assert.False(t, ok)
+}
+
+func TestStorage_History_ReturnsDownsampledWindowsWithinRetention(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	start := time.Unix(0, 0).Add(1000 * time.Hour)
+	c.Set(start)
+	s, err := NewStorage(Config{Dir: t.TempDir(), HistoryResolution: time.Minute, HistoryRetention: time.Hour}, c, time.Minute, log.NewNoopLogger(), audit.NewNopLog())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+	assert.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10}))
+
+	record := func(tokens int64) {
+		if tokens > 0 {
+			_, _, _, _, _, err := s.Alloc(context.Background(), "namespace", "resource", "", tokens, 0, 0, "")
+			require.NoError(t, err)
+		} else {
+			_, _, _, err := s.Free(context.Background(), "namespace", "resource", "", -tokens, 0, "", "")
+			require.NoError(t, err)
+		}
+
+		recorded, err := s.RecordHistory(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 1, recorded)
+	}
+
+	// When
+	record(6)
+	c.Add(30 * time.Second)
+	record(-4)
+	c.Add(time.Minute)
+	record(1)
+	samples, samplesErr := s.History(context.Background(), "namespace", "resource", start, c.Now(), 0)
+	downsampled, downsampledErr := s.History(context.Background(), "namespace", "resource", start, c.Now(), time.Hour)
+	c.Add(time.Hour)
+	record(1)
+	retained, retainedErr := s.History(context.Background(), "namespace", "resource", start, c.Now(), 0)
+
+	// Then
+	assert.NoError(t, samplesErr)
+	assert.Equal(t, []history.Sample{
+		{Time: start, Allocated: 2, MaxAllocated: 6, Capacity: 10},
+		{Time: start.Add(time.Minute), Allocated: 3, MaxAllocated: 3, Capacity: 10},
+	}, samples)
+	assert.NoError(t, downsampledErr)
+	assert.Equal(t, []history.Sample{
+		{Time: start, Allocated: 3, MaxAllocated: 6, Capacity: 10},
+	}, downsampled)
+	assert.NoError(t, retainedErr)
+	assert.Equal(t, []history.Sample{
+		{Time: start.Add(61 * time.Minute), Allocated: 4, MaxAllocated: 4, Capacity: 10},
+	}, retained)
+}
+
+func TestStorage_UpdateQuota_RecordsAuditEntryWithStrategies(t *testing.T) {
+	// Given
+	var buf bytes.Buffer
+	s, err := NewStorage(Config{Dir: t.TempDir()}, clock.NewMock(), time.Minute, log.NewNoopLogger(), audit.NewLog(audit.NewWriterSink(&buf), log.NewNoopLogger()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+	require.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10}))
+	buf.Reset()
+
+	// When
+	err = s.UpdateQuota(caller.NewContext(context.Background(), "admin"), "namespace", "resource", quota.Config{Capacity: 20, ShrinkPolicy: quota.ShrinkPolicyReject})
+
+	// Then
+	require.NoError(t, err)
+	var e audit.Entry
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &e))
+	assert.Equal(t, audit.UpdateQuota, e.Operation)
+	assert.Equal(t, "admin", e.Caller)
+	require.NotNil(t, e.Before)
+	require.NotNil(t, e.After)
+	assert.EqualValues(t, 10, e.Before.Strategy.Capacity)
+	assert.EqualValues(t, 20, e.After.Strategy.Capacity)
+	assert.Empty(t, e.After.Strategy.ShrinkPolicy)
+	assert.Equal(t, "ok", e.Result)
+}
+
+func TestStorage_ResetPeriods_RecordsAuditEntry(t *testing.T) {
+	// Given
+	var buf bytes.Buffer
+	c := clock.NewMock()
+	c.Set(time.Date(2022, time.Month(1), 11, 0, 0, 0, 0, time.UTC))
+	s, err := NewStorage(Config{Dir: t.TempDir()}, c, time.Minute, log.NewNoopLogger(), audit.NewLog(audit.NewWriterSink(&buf), log.NewNoopLogger()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+	require.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10, Period: "day"}))
+	_, _, _, ok, _, err := s.Alloc(context.Background(), "namespace", "resource", "holder", 4, 0, 0, "")
+	require.NoError(t, err)
+	require.True(t, ok)
+	buf.Reset()
+	c.Add(24 * time.Hour)
+
+	// When
+	reset, err := s.ResetPeriods(context.Background())
+
+	// Then
+	require.NoError(t, err)
+	assert.Equal(t, 1, reset)
+	var e audit.Entry
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &e))
+	assert.Equal(t, audit.ResetPeriod, e.Operation)
+	assert.Equal(t, c.Now(), e.Time.UTC())
+	assert.EqualValues(t, 4, e.Tokens)
+	assert.Equal(t, &audit.State{Allocated: 4, Capacity: 10, Version: 2}, e.Before)
+	assert.Equal(t, &audit.State{Allocated: 0, Capacity: 10, Version: 3}, e.After)
+	assert.Equal(t, "ok", e.Result)
+}
+
+func TestStorage_Restore_LoadsBackupIntoEmptyStore(t *testing.T) {
+	// Given
+	source := newTestStorage(t, clock.NewMock())
+	require.NoError(t, source.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10}))
+	_, _, _, ok, _, err := source.Alloc(context.Background(), "namespace", "resource", "holder", 4, 0, 0, "")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	var buf bytes.Buffer
+	require.NoError(t, source.Backup(context.Background(), &buf))
+
+	s := newTestStorage(t, clock.NewMock())
+
+	// When
+	err = s.Restore(context.Background(), bytes.NewReader(buf.Bytes()))
+
+	// Then
+	require.NoError(t, err)
+	allocated, capacity, version, holders, err := s.ViewHolders(context.Background(), "namespace", "resource")
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, allocated)
+	assert.EqualValues(t, 10, capacity)
+	assert.EqualValues(t, 2, version)
+	assert.Equal(t, map[string]int64{"holder": 4}, holders)
+	assert.ErrorIs(t, s.Restore(context.Background(), bytes.NewReader(buf.Bytes())), storage.ErrAlreadyExists)
+}
+
+func TestStorage_Import_PreservesStateExportedFromMemoryStorage(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	source := memory.NewStorage(c, time.Minute, audit.NewNopLog())
+	require.NoError(t, source.RegisterQuota(context.Background(), "org", "cpu", quota.Config{Capacity: 10, SoftLimit: 8}))
+	require.NoError(t, source.RegisterQuota(context.Background(), "team", "cpu", quota.Config{Capacity: 6, Parent: "org/cpu", Period: "day"}))
+	_, _, _, ok, _, err := source.Alloc(context.Background(), "team", "cpu", "holder", 4, 0, time.Minute, "")
+	require.NoError(t, err)
+	require.True(t, ok)
+	_, _, _, ok, _, err = source.Alloc(context.Background(), "org", "cpu", "", 1, 0, 0, "")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	items, err := source.Export(context.Background())
+	require.NoError(t, err)
+
+	s := newTestStorage(t, c)
+	require.NoError(t, s.RegisterQuota(context.Background(), "org", "cpu", quota.Config{Capacity: 1}))
+
+	// When
+	err = s.Import(context.Background(), items)
+
+	// Then
+	require.NoError(t, err)
+	imported, err := s.Export(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, items, imported)
+	assert.Empty(t, export.Diff(imported, items))
+	allocated, capacity, version, holders, err := s.ViewHolders(context.Background(), "org", "cpu")
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, allocated)
+	assert.EqualValues(t, 10, capacity)
+	assert.EqualValues(t, 3, version)
+	assert.Equal(t, map[string]int64{quota.ChildHolder("team", "cpu"): 4}, holders)
+}
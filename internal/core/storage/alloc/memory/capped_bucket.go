@@ -4,13 +4,20 @@ import (
 	"sync"
 
 	"github.com/Blinkuu/qms/internal/core/storage"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
 )
 
+// CappedBucket counts the tokens allocated from a capacity. Tokens allocated with a holder are also counted per holder,
+// and the rest of the allocated tokens are unowned. An overcommit factor raises the number of tokens that can be
+// allocated above the capacity, and allocations above the soft limit succeed but are flagged.
 type CappedBucket struct {
-	allocated int64
-	capacity  int64
-	version   int64
-	mu        *sync.Mutex
+	allocated  int64
+	capacity   int64
+	softLimit  int64
+	overcommit float64
+	version    int64
+	holders    map[string]int64
+	mu         *sync.Mutex
 }
 
 func NewCappedBucket(capacity, version int64) *CappedBucket {
@@ -22,10 +29,32 @@ func NewCappedBucket(capacity, version int64) *CappedBucket {
 		allocated: 0,
 		capacity:  capacity,
 		version:   version,
+		holders:   make(map[string]int64),
 		mu:        &sync.Mutex{},
 	}
 }
 
+// NewCappedBucketFromConfig creates a bucket with the capacity and limits of a quota.
+func NewCappedBucketFromConfig(cfg quota.Config, version int64) *CappedBucket {
+	c := NewCappedBucket(cfg.Capacity, version)
+	c.softLimit = cfg.SoftLimit
+	c.overcommit = cfg.Overcommit
+
+	return c
+}
+
+// NewCappedBucketFromState creates a bucket with the capacity and limits of a quota, and with the allocated tokens of
+// an exported one.
+func NewCappedBucketFromState(cfg quota.Config, allocated, version int64, holders map[string]int64) *CappedBucket {
+	c := NewCappedBucketFromConfig(cfg, version)
+	c.allocated = allocated
+	for holder, tokens := range holders {
+		c.holders[holder] = tokens
+	}
+
+	return c
+}
+
 func (c *CappedBucket) View() (int64, int64, int64) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -33,25 +62,63 @@ func (c *CappedBucket) View() (int64, int64, int64) {
 	return c.allocated, c.capacity, c.version
 }
 
-func (c *CappedBucket) Alloc(tokens, version int64) (int64, int64, bool, error) {
+// Holders returns the tokens allocated by each holder, along with the state of the bucket.
+func (c *CappedBucket) Holders() (int64, int64, int64, map[string]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	holders := make(map[string]int64, len(c.holders))
+	for holder, tokens := range c.holders {
+		holders[holder] = tokens
+	}
+
+	return c.allocated, c.capacity, c.version, holders
+}
+
+// Remaining returns the number of tokens that can still be allocated, along with the version of the bucket.
+func (c *CappedBucket) Remaining() (int64, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.remainingTokensLocked(), c.version
+}
+
+// Fits reports whether tokens can be allocated from the bucket.
+func (c *CappedBucket) Fits(tokens int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return tokens <= c.remainingTokensLocked()
+}
+
+// Alloc allocates tokens on behalf of the holder, if any. The second returned bool reports whether the allocated tokens
+// exceed the soft limit of the bucket after a successful allocation.
+func (c *CappedBucket) Alloc(holder string, tokens, version int64) (int64, int64, bool, bool, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	if version != 0 && c.version != version {
-		return 0, 0, false, storage.ErrInvalidVersion
+		return 0, 0, false, false, storage.ErrInvalidVersion
 	}
 
-	if c.allocated+tokens > c.capacity {
-		return c.remainingTokensLocked(), c.version, false, nil
+	if tokens > c.remainingTokensLocked() {
+		return c.remainingTokensLocked(), c.version, false, false, nil
 	}
 
 	c.allocated += tokens
 	c.version += 1
+	if holder != "" {
+		c.holders[holder] += tokens
+	}
 
-	return c.remainingTokensLocked(), c.version, true, nil
+	overSoftLimit := c.softLimit > 0 && c.allocated > c.softLimit
+
+	return c.remainingTokensLocked(), c.version, true, overSoftLimit, nil
 }
 
-func (c *CappedBucket) Free(tokens, version int64) (int64, int64, bool, error) {
+// Free frees tokens allocated by the holder. Without a holder only unowned tokens can be freed. Leased is how many of
+// those tokens are held by leases, which are kept until their lease is freed or expires.
+func (c *CappedBucket) Free(holder string, tokens, leased, version int64) (int64, int64, bool, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -59,16 +126,96 @@ func (c *CappedBucket) Free(tokens, version int64) (int64, int64, bool, error) {
 		return 0, 0, false, storage.ErrInvalidVersion
 	}
 
-	if c.allocated-tokens < 0 {
+	if tokens > c.freeableLocked(holder)-leased {
 		return c.remainingTokensLocked(), c.version, false, nil
 	}
 
 	c.allocated -= tokens
 	c.version += 1
+	c.releaseLocked(holder, tokens)
 
 	return c.remainingTokensLocked(), c.version, true, nil
 }
 
+// Expire frees tokens of an expired lease. Unlike Free it never fails, so that leases are reclaimed even if the
+// counts drifted.
+func (c *CappedBucket) Expire(holder string, tokens int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.allocated -= tokens
+	if c.allocated < 0 {
+		c.allocated = 0
+	}
+
+	c.version += 1
+	c.releaseLocked(holder, tokens)
+}
+
+// SetConfig changes the capacity and limits of the bucket and bumps its version. The shrink policy of cfg decides what
+// happens if the allocated tokens exceed the new limit. Returns the number of tokens dropped by quota.ShrinkPolicyClamp.
+func (c *CappedBucket) SetConfig(cfg quota.Config) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var dropped int64
+	if limit := cfg.Limit(); limit < c.allocated {
+		switch cfg.ShrinkPolicy {
+		case quota.ShrinkPolicyOverQuota:
+		case quota.ShrinkPolicyClamp:
+			dropped = c.allocated - limit
+			quota.DropExcess(c.holders, c.allocated, dropped)
+			c.allocated = limit
+		default:
+			return 0, storage.ErrCapacityBelowAllocated
+		}
+	}
+
+	c.capacity = cfg.Capacity
+	c.softLimit = cfg.SoftLimit
+	c.overcommit = cfg.Overcommit
+	c.version += 1
+
+	return dropped, nil
+}
+
+// Reset frees all allocated tokens and bumps the version. Returns the number of tokens freed.
+func (c *CappedBucket) Reset() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	freed := c.allocated
+	c.allocated = 0
+	c.holders = make(map[string]int64)
+	c.version += 1
+
+	return freed
+}
+
+func (c *CappedBucket) freeableLocked(holder string) int64 {
+	if holder != "" {
+		return c.holders[holder]
+	}
+
+	unowned := c.allocated
+	for _, tokens := range c.holders {
+		unowned -= tokens
+	}
+
+	return unowned
+}
+
+func (c *CappedBucket) releaseLocked(holder string, tokens int64) {
+	if holder == "" {
+		return
+	}
+
+	c.holders[holder] -= tokens
+	if c.holders[holder] <= 0 {
+		delete(c.holders, holder)
+	}
+}
+
 func (c *CappedBucket) remainingTokensLocked() int64 {
-	return c.capacity - c.allocated
+	return quota.Limit(c.capacity, c.overcommit) - c.allocated
 }
@@ -0,0 +1,83 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+)
+
+func TestCappedBucket_Free_RejectsFreeExceedingHolderTokens(t *testing.T) {
+	// Given
+	b := NewCappedBucket(10, 1)
+	_, _, _, _, _ = b.Alloc("holder1", 4, 0)
+	_, _, _, _, _ = b.Alloc("holder2", 3, 0)
+
+	// When
+	_, _, ok1, err1 := b.Free("holder1", 5, 0, 0)
+	_, _, ok2, err2 := b.Free("holder1", 4, 0, 0)
+
+	// Then
+	assert.NoError(t, err1)
+	assert.False(t, ok1)
+	assert.NoError(t, err2)
+	assert.True(t, ok2)
+	allocated, _, _, holders := b.Holders()
+	assert.EqualValues(t, 3, allocated)
+	assert.Equal(t, map[string]int64{"holder2": 3}, holders)
+}
+
+func TestCappedBucket_Free_WithoutHolderFreesOnlyUnownedTokens(t *testing.T) {
+	// Given
+	b := NewCappedBucket(10, 1)
+	_, _, _, _, _ = b.Alloc("", 2, 0)
+	_, _, _, _, _ = b.Alloc("holder", 4, 0)
+
+	// When
+	_, _, ok1, err1 := b.Free("", 3, 0, 0)
+	_, _, ok2, err2 := b.Free("", 2, 0, 0)
+
+	// Then
+	assert.NoError(t, err1)
+	assert.False(t, ok1)
+	assert.NoError(t, err2)
+	assert.True(t, ok2)
+}
+
+func TestCappedBucket_SetCapacity_ClampDropsUnownedTokensFirst(t *testing.T) {
+	// Given
+	b := NewCappedBucket(10, 1)
+	_, _, _, _, _ = b.Alloc("", 2, 0)
+	_, _, _, _, _ = b.Alloc("holder2", 3, 0)
+	_, _, _, _, _ = b.Alloc("holder1", 4, 0)
+
+	// When
+	dropped, err := b.SetConfig(quota.Config{Capacity: 5, ShrinkPolicy: quota.ShrinkPolicyClamp})
+
+	// Then
+	assert.NoError(t, err)
+	assert.EqualValues(t, 4, dropped)
+	allocated, capacity, version, holders := b.Holders()
+	assert.EqualValues(t, 5, allocated)
+	assert.EqualValues(t, 5, capacity)
+	assert.EqualValues(t, 5, version)
+	assert.Equal(t, map[string]int64{"holder2": 3, "holder1": 2}, holders)
+}
+
+func TestCappedBucket_SetCapacity_OverQuotaBlocksAllocs(t *testing.T) {
+	// Given
+	b := NewCappedBucket(10, 1)
+	_, _, _, _, _ = b.Alloc("", 6, 0)
+
+	// When
+	dropped, err := b.SetConfig(quota.Config{Capacity: 4, ShrinkPolicy: quota.ShrinkPolicyOverQuota})
+	remainingTokens, _, ok, _, allocErr := b.Alloc("", 1, 0)
+
+	// Then
+	assert.NoError(t, err)
+	assert.NoError(t, allocErr)
+	assert.EqualValues(t, 0, dropped)
+	assert.False(t, ok)
+	assert.EqualValues(t, -2, remainingTokens)
+}
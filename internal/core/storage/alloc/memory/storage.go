@@ -2,30 +2,85 @@ package memory
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"io"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/google/uuid"
 
 	"github.com/Blinkuu/qms/internal/core/storage"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/audit"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/batch"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/export"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/history"
 	"github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/watch"
+)
+
+const (
+	allocOp = "alloc"
+	freeOp  = "free"
 )
 
+// result is the result of an alloc or free remembered for its idempotency key.
+type result struct {
+	remainingTokens int64
+	currentVersion  int64
+	leaseID         string
+	ok              bool
+	overSoftLimit   bool
+	expiresAt       time.Time
+}
+
+type lease struct {
+	id        string
+	holder    string
+	tokens    int64
+	expiresAt time.Time
+}
+
 type Storage struct {
-	buckets   map[string]*CappedBucket
-	bucketsMu *sync.RWMutex
+	clock             clock.Clock
+	idempotencyWindow time.Duration
+	buckets           map[string]*CappedBucket
+	quotas            map[string]quota.Quota
+	periods           map[string]time.Time
+	bucketsMu         *sync.RWMutex
+	leases            map[string]lease
+	leasesMu          *sync.Mutex
+	results           map[string]result
+	resultsMu         *sync.Mutex
+	hub               *watch.Hub
+	audit             *audit.Log
 }
 
-func NewStorage() *Storage {
+func NewStorage(clock clock.Clock, idempotencyWindow time.Duration, auditLog *audit.Log) *Storage {
 	return &Storage{
-		buckets:   make(map[string]*CappedBucket),
-		bucketsMu: &sync.RWMutex{},
+		clock:             clock,
+		idempotencyWindow: idempotencyWindow,
+		buckets:           make(map[string]*CappedBucket),
+		quotas:            make(map[string]quota.Quota),
+		periods:           make(map[string]time.Time),
+		bucketsMu:         &sync.RWMutex{},
+		leases:            make(map[string]lease),
+		leasesMu:          &sync.Mutex{},
+		results:           make(map[string]result),
+		resultsMu:         &sync.Mutex{},
+		hub:               watch.NewHub(),
+		audit:             auditLog,
 	}
 }
 
 func (s *Storage) View(_ context.Context, namespace, resource string) (int64, int64, int64, error) {
 	id := strings.Join([]string{namespace, resource}, "_")
 
+	s.bucketsMu.RLock()
+	defer s.bucketsMu.RUnlock()
+
 	bucket, found := s.buckets[id]
 	if !found {
 		return 0, 0, 0, storage.ErrNotFound
@@ -36,7 +91,8 @@ func (s *Storage) View(_ context.Context, namespace, resource string) (int64, in
 	return allocated, capacity, version, nil
 }
 
-func (s *Storage) Alloc(_ context.Context, namespace, resource string, tokens, version int64) (int64, int64, bool, error) {
+// ViewHolders returns the state of a quota along with the tokens allocated by each holder.
+func (s *Storage) ViewHolders(_ context.Context, namespace, resource string) (int64, int64, int64, map[string]int64, error) {
 	id := strings.Join([]string{namespace, resource}, "_")
 
 	s.bucketsMu.RLock()
@@ -44,47 +100,705 @@ func (s *Storage) Alloc(_ context.Context, namespace, resource string, tokens, v
 
 	bucket, found := s.buckets[id]
 	if !found {
-		return 0, 0, false, storage.ErrNotFound
+		return 0, 0, 0, nil, storage.ErrNotFound
+	}
+
+	allocated, capacity, version, holders := bucket.Holders()
+
+	return allocated, capacity, version, holders, nil
+}
+
+// Alloc allocates tokens from a quota on behalf of the holder, if any. With a positive ttl the tokens are leased, and
+// they are freed automatically unless the returned lease is renewed before it expires. With an idempotency key a
+// successful result is remembered, and a repeated call within the idempotency window returns it without allocating
+// again. Allocations that leave the quota over its soft limit succeed, and are flagged.
+func (s *Storage) Alloc(ctx context.Context, namespace, resource, holder string, tokens, version int64, ttl time.Duration, idempotencyKey string) (int64, int64, string, bool, bool, error) {
+	e := audit.NewEntry(ctx, s.clock.Now(), audit.Alloc, namespace, resource)
+	e.Holder, e.Tokens = holder, tokens
+
+	remainingTokens, currentVersion, leaseID, ok, overSoftLimit, err := s.allocIdempotently(&e, namespace, resource, holder, tokens, version, ttl, idempotencyKey)
+	e.LeaseID = leaseID
+	e.SetResult(ok, err)
+	s.audit.Record(e)
+
+	return remainingTokens, currentVersion, leaseID, ok, overSoftLimit, err
+}
+
+func (s *Storage) allocIdempotently(e *audit.Entry, namespace, resource, holder string, tokens, version int64, ttl time.Duration, idempotencyKey string) (int64, int64, string, bool, bool, error) {
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	unlock := s.lockBuckets(id)
+	defer unlock()
+
+	bucket, found := s.buckets[id]
+	if !found {
+		return 0, 0, "", false, false, storage.ErrNotFound
+	}
+
+	e.Before = auditState(bucket)
+	defer func() { e.After = auditState(bucket) }()
+
+	if idempotencyKey == "" {
+		return s.alloc(bucket, id, holder, tokens, version, ttl)
 	}
 
-	remainingTokens, currentVersion, ok, err := bucket.Alloc(tokens, version)
+	s.resultsMu.Lock()
+	defer s.resultsMu.Unlock()
+
+	key := strings.Join([]string{allocOp, id, idempotencyKey}, "_")
+	if r, found := s.resultLocked(key); found {
+		return r.remainingTokens, r.currentVersion, r.leaseID, r.ok, r.overSoftLimit, nil
+	}
+
+	remainingTokens, currentVersion, leaseID, ok, overSoftLimit, err := s.alloc(bucket, id, holder, tokens, version, ttl)
 	if err != nil {
-		return 0, 0, false, fmt.Errorf("failed to alloc: %w", err)
+		return 0, 0, "", false, false, err
 	}
 
-	return remainingTokens, currentVersion, ok, nil
+	if ok {
+		s.results[key] = result{remainingTokens: remainingTokens, currentVersion: currentVersion, leaseID: leaseID, ok: ok, overSoftLimit: overSoftLimit, expiresAt: s.clock.Now().Add(s.idempotencyWindow)}
+	}
+
+	return remainingTokens, currentVersion, leaseID, ok, overSoftLimit, nil
+}
+
+func (s *Storage) alloc(bucket *CappedBucket, id, holder string, tokens, version int64, ttl time.Duration) (int64, int64, string, bool, bool, error) {
+	ancestors := s.ancestorsLocked(id)
+	for _, a := range ancestors {
+		if a.bucket.Fits(tokens) {
+			continue
+		}
+
+		remainingTokens, currentVersion := bucket.Remaining()
+		if version != 0 && currentVersion != version {
+			return 0, 0, "", false, false, fmt.Errorf("failed to alloc: %w", storage.ErrInvalidVersion)
+		}
+
+		return remainingTokens, currentVersion, "", false, false, nil
+	}
+
+	remainingTokens, currentVersion, ok, overSoftLimit, err := bucket.Alloc(holder, tokens, version)
+	if err != nil {
+		return 0, 0, "", false, false, fmt.Errorf("failed to alloc: %w", err)
+	}
+
+	if ok {
+		s.chargeLocked(ancestors, tokens)
+		s.publishLocked(id)
+	}
+
+	if !ok || ttl <= 0 {
+		return remainingTokens, currentVersion, "", ok, overSoftLimit, nil
+	}
+
+	leaseID := uuid.NewString()
+
+	s.leasesMu.Lock()
+	defer s.leasesMu.Unlock()
+
+	s.leases[leaseID] = lease{id: id, holder: holder, tokens: tokens, expiresAt: s.clock.Now().Add(ttl)}
+
+	return remainingTokens, currentVersion, leaseID, true, overSoftLimit, nil
+}
+
+// AllocBatch allocates tokens from several quotas all-or-nothing. The buckets are locked exclusively, so the batch is
+// checked and applied without other allocations in between. Returns false, and allocates nothing, if any of the
+// quotas, or any of their ancestors, lacks tokens.
+func (s *Storage) AllocBatch(ctx context.Context, items []batch.Item) ([]batch.Result, bool, error) {
+	entries := make([]audit.Entry, 0, len(items))
+	for _, item := range items {
+		e := audit.NewEntry(ctx, s.clock.Now(), audit.AllocBatch, item.Namespace, item.Resource)
+		e.Holder, e.Tokens = item.Holder, item.Tokens
+		entries = append(entries, e)
+	}
+
+	results, ok, err := s.allocBatch(entries, items)
+	for _, e := range entries {
+		e.SetResult(ok, err)
+		s.audit.Record(e)
+	}
+
+	return results, ok, err
+}
+
+func (s *Storage) allocBatch(entries []audit.Entry, items []batch.Item) ([]batch.Result, bool, error) {
+	s.bucketsMu.Lock()
+	defer s.bucketsMu.Unlock()
+
+	buckets := make([]*CappedBucket, 0, len(items))
+	ancestors := make([][]ancestor, 0, len(items))
+	pending := make(map[*CappedBucket]int64, len(items))
+	for _, item := range items {
+		id := strings.Join([]string{item.Namespace, item.Resource}, "_")
+		bucket, found := s.buckets[id]
+		if !found {
+			return nil, false, storage.ErrNotFound
+		}
+
+		buckets = append(buckets, bucket)
+		entries[len(buckets)-1].Before = auditState(bucket)
+		ancestors = append(ancestors, s.ancestorsLocked(id))
+		pending[bucket] += item.Tokens
+		for _, a := range ancestors[len(ancestors)-1] {
+			pending[a.bucket] += item.Tokens
+		}
+	}
+
+	results := make([]batch.Result, 0, len(items))
+	ok := true
+	for i, item := range items {
+		remainingTokens, version := buckets[i].Remaining()
+		if item.Version != 0 && version != item.Version {
+			return nil, false, storage.ErrInvalidVersion
+		}
+
+		if !buckets[i].Fits(pending[buckets[i]]) {
+			ok = false
+		}
+
+		for _, a := range ancestors[i] {
+			if !a.bucket.Fits(pending[a.bucket]) {
+				ok = false
+			}
+		}
+
+		results = append(results, batch.Result{RemainingTokens: remainingTokens, CurrentVersion: version})
+	}
+
+	if !ok {
+		return results, false, nil
+	}
+
+	for i, item := range items {
+		remainingTokens, currentVersion, _, _, err := buckets[i].Alloc(item.Holder, item.Tokens, 0)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to alloc: %w", err)
+		}
+
+		s.chargeLocked(ancestors[i], item.Tokens)
+		s.publishLocked(strings.Join([]string{item.Namespace, item.Resource}, "_"))
+		results[i] = batch.Result{RemainingTokens: remainingTokens, CurrentVersion: currentVersion}
+	}
+
+	for i, bucket := range buckets {
+		entries[i].After = auditState(bucket)
+	}
+
+	return results, true, nil
+}
+
+// Free frees tokens of a quota allocated by the holder, or unowned tokens without a holder. With a lease ID the tokens
+// of the lease are freed instead, and the lease is removed. Returns false if the holder does not own enough tokens, or
+// if the lease is unknown or belongs to another holder. Idempotency keys work as in Alloc.
+func (s *Storage) Free(ctx context.Context, namespace, resource, holder string, tokens, version int64, leaseID, idempotencyKey string) (int64, int64, bool, error) {
+	e := audit.NewEntry(ctx, s.clock.Now(), audit.Free, namespace, resource)
+	e.Holder, e.Tokens, e.LeaseID = holder, tokens, leaseID
+
+	remainingTokens, currentVersion, ok, err := s.freeIdempotently(&e, namespace, resource, holder, tokens, version, leaseID, idempotencyKey)
+	e.SetResult(ok, err)
+	s.audit.Record(e)
+
+	return remainingTokens, currentVersion, ok, err
 }
 
-func (s *Storage) Free(_ context.Context, namespace, resource string, tokens, version int64) (int64, int64, bool, error) {
+func (s *Storage) freeIdempotently(e *audit.Entry, namespace, resource, holder string, tokens, version int64, leaseID, idempotencyKey string) (int64, int64, bool, error) {
 	id := strings.Join([]string{namespace, resource}, "_")
 
-	s.bucketsMu.RLock()
-	defer s.bucketsMu.RUnlock()
+	unlock := s.lockBuckets(id)
+	defer unlock()
 
 	bucket, found := s.buckets[id]
 	if !found {
 		return 0, 0, false, storage.ErrNotFound
 	}
 
-	remainingTokens, currentVersion, ok, err := bucket.Free(tokens, version)
+	e.Before = auditState(bucket)
+	defer func() { e.After = auditState(bucket) }()
+
+	if idempotencyKey == "" {
+		return s.free(bucket, id, holder, tokens, version, leaseID)
+	}
+
+	s.resultsMu.Lock()
+	defer s.resultsMu.Unlock()
+
+	key := strings.Join([]string{freeOp, id, idempotencyKey}, "_")
+	if r, found := s.resultLocked(key); found {
+		return r.remainingTokens, r.currentVersion, r.ok, nil
+	}
+
+	remainingTokens, currentVersion, ok, err := s.free(bucket, id, holder, tokens, version, leaseID)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	if ok {
+		s.results[key] = result{remainingTokens: remainingTokens, currentVersion: currentVersion, ok: ok, expiresAt: s.clock.Now().Add(s.idempotencyWindow)}
+	}
+
+	return remainingTokens, currentVersion, ok, nil
+}
+
+func (s *Storage) free(bucket *CappedBucket, id, holder string, tokens, version int64, leaseID string) (int64, int64, bool, error) {
+	s.leasesMu.Lock()
+	defer s.leasesMu.Unlock()
+
+	if leaseID == "" {
+		remainingTokens, currentVersion, ok, err := bucket.Free(holder, tokens, s.leasedLocked(id, holder), version)
+		if err != nil {
+			return 0, 0, false, fmt.Errorf("failed to free: %w", err)
+		}
+
+		if ok {
+			releaseLocked(s.ancestorsLocked(id), tokens)
+			s.publishLocked(id)
+		}
+
+		return remainingTokens, currentVersion, ok, nil
+	}
+
+	l, found := s.leases[leaseID]
+	if !found || l.id != id || l.holder != holder {
+		remainingTokens, currentVersion := bucket.Remaining()
+		return remainingTokens, currentVersion, false, nil
+	}
+
+	remainingTokens, currentVersion, ok, err := bucket.Free(holder, l.tokens, 0, version)
 	if err != nil {
 		return 0, 0, false, fmt.Errorf("failed to free: %w", err)
 	}
 
+	if ok {
+		releaseLocked(s.ancestorsLocked(id), l.tokens)
+		delete(s.leases, leaseID)
+		s.publishLocked(id)
+	}
+
 	return remainingTokens, currentVersion, ok, nil
 }
 
-func (s *Storage) RegisterQuota(_ context.Context, namespace, resource string, cfg quota.Config) error {
+// leasedLocked returns the tokens of a quota held by the leases of the holder.
+func (s *Storage) leasedLocked(id, holder string) int64 {
+	var leased int64
+	for _, l := range s.leases {
+		if l.id == id && l.holder == holder {
+			leased += l.tokens
+		}
+	}
+
+	return leased
+}
+
+func (s *Storage) forgetExpiredResults() {
+	s.resultsMu.Lock()
+	defer s.resultsMu.Unlock()
+
+	now := s.clock.Now()
+	for key, r := range s.results {
+		if !r.expiresAt.After(now) {
+			delete(s.results, key)
+		}
+	}
+}
+
+func (s *Storage) resultLocked(key string) (result, bool) {
+	r, found := s.results[key]
+	if !found || !r.expiresAt.After(s.clock.Now()) {
+		return result{}, false
+	}
+
+	return r, true
+}
+
+// Renew extends a lease to ttl from now. Returns false if the lease is unknown or has already expired.
+func (s *Storage) Renew(_ context.Context, namespace, resource, leaseID string, ttl time.Duration) (time.Time, bool, error) {
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	s.bucketsMu.RLock()
+	defer s.bucketsMu.RUnlock()
+
+	if _, found := s.buckets[id]; !found {
+		return time.Time{}, false, storage.ErrNotFound
+	}
+
+	s.leasesMu.Lock()
+	defer s.leasesMu.Unlock()
+
+	now := s.clock.Now()
+	l, found := s.leases[leaseID]
+	if !found || l.id != id || !l.expiresAt.After(now) {
+		return time.Time{}, false, nil
+	}
+
+	l.expiresAt = now.Add(ttl)
+	s.leases[leaseID] = l
+
+	return l.expiresAt, true, nil
+}
+
+// ExpireLeases frees the tokens of all expired leases. It also forgets the results of idempotency keys past their
+// window.
+func (s *Storage) ExpireLeases(_ context.Context) (int, error) {
+	s.forgetExpiredResults()
+
+	s.bucketsMu.Lock()
+	defer s.bucketsMu.Unlock()
+
+	s.leasesMu.Lock()
+	defer s.leasesMu.Unlock()
+
+	now := s.clock.Now()
+	expired := 0
+	for leaseID, l := range s.leases {
+		if l.expiresAt.After(now) {
+			continue
+		}
+
+		if bucket, found := s.buckets[l.id]; found {
+			q := s.quotas[l.id]
+			e := audit.Entry{Time: now, Operation: audit.ExpireLease, Namespace: q.Namespace, Resource: q.Resource}
+			e.Holder, e.Tokens, e.LeaseID, e.Before = l.holder, l.tokens, leaseID, auditState(bucket)
+			bucket.Expire(l.holder, l.tokens)
+			releaseLocked(s.ancestorsLocked(l.id), l.tokens)
+			s.publishLocked(l.id)
+			e.After = auditState(bucket)
+			e.SetResult(true, nil)
+			s.audit.Record(e)
+		}
+
+		delete(s.leases, leaseID)
+		expired++
+	}
+
+	return expired, nil
+}
+
+// ResetPeriods frees all tokens of the periodic quotas whose period has ended, and drops their leases. Returns the
+// number of quotas reset.
+func (s *Storage) ResetPeriods(_ context.Context) (int, error) {
+	s.bucketsMu.Lock()
+	defer s.bucketsMu.Unlock()
+
+	s.leasesMu.Lock()
+	defer s.leasesMu.Unlock()
+
+	now := s.clock.Now()
+	reset := 0
+	for id, start := range s.periods {
+		current, err := s.quotas[id].Strategy.PeriodStart(now)
+		if err != nil {
+			return reset, fmt.Errorf("failed to get period start: %w", err)
+		}
+
+		if !current.After(start) {
+			continue
+		}
+
+		q := s.quotas[id]
+		e := audit.Entry{Time: now, Operation: audit.ResetPeriod, Namespace: q.Namespace, Resource: q.Resource}
+		e.Before = auditState(s.buckets[id])
+		freed := s.buckets[id].Reset()
+		e.Tokens = freed
+		releaseLocked(s.ancestorsLocked(id), freed)
+		s.periods[id] = current
+		for leaseID, l := range s.leases {
+			if l.id == id {
+				delete(s.leases, leaseID)
+			}
+		}
+
+		s.publishLocked(id)
+		e.After = auditState(s.buckets[id])
+		e.SetResult(true, nil)
+		s.audit.Record(e)
+		reset++
+	}
+
+	return reset, nil
+}
+
+// RecordHistory does nothing, as the history of quotas is only kept by the persistent backends.
+func (s *Storage) RecordHistory(_ context.Context) (int, error) {
+	return 0, nil
+}
+
+func (s *Storage) History(_ context.Context, _, _ string, _, _ time.Time, _ time.Duration) ([]history.Sample, error) {
+	return nil, storage.ErrNotSupported
+}
+
+func (s *Storage) Backup(_ context.Context, _ io.Writer) error {
+	return storage.ErrNotSupported
+}
+
+func (s *Storage) Restore(_ context.Context, _ io.Reader) error {
+	return storage.ErrNotSupported
+}
+
+func (s *Storage) RegisterQuota(ctx context.Context, namespace, resource string, cfg quota.Config) error {
+	e := audit.NewEntry(ctx, s.clock.Now(), audit.RegisterQuota, namespace, resource)
+	err := s.registerQuota(&e, namespace, resource, cfg)
+	e.SetResult(true, err)
+	s.audit.Record(e)
+
+	return err
+}
+
+func (s *Storage) registerQuota(e *audit.Entry, namespace, resource string, cfg quota.Config) error {
 	s.bucketsMu.Lock()
 	defer s.bucketsMu.Unlock()
 
 	id := strings.Join([]string{namespace, resource}, "_")
 	_, found := s.buckets[id]
 	if found {
-		return errors.New("only a single strategy for a namespace-resource pair can be registered")
+		return fmt.Errorf("only a single strategy for a namespace-resource pair can be registered: %w", storage.ErrAlreadyExists)
+	}
+
+	if err := validateConfig(cfg); err != nil {
+		return err
+	}
+
+	if err := s.validateParentLocked(id, cfg); err != nil {
+		return err
+	}
+
+	s.buckets[id] = NewCappedBucketFromConfig(cfg, 1)
+	s.quotas[id] = quota.Quota{Namespace: namespace, Resource: resource, Strategy: storedConfig(cfg)}
+	s.setPeriodLocked(id, cfg)
+	s.publishLocked(id)
+	e.After = quotaAuditState(s.buckets[id], storedConfig(cfg))
+
+	return nil
+}
+
+// UpdateQuota changes the capacity and limits of a quota, and its shrink policy decides what happens to the allocated
+// tokens above the new limit. Nothing changes if the stored configuration does not. The parent of a quota can only be changed
+// while it has no tokens allocated, since they are charged to its ancestors.
+func (s *Storage) UpdateQuota(ctx context.Context, namespace, resource string, cfg quota.Config) error {
+	e := audit.NewEntry(ctx, s.clock.Now(), audit.UpdateQuota, namespace, resource)
+	err := s.updateQuota(&e, namespace, resource, cfg)
+	e.SetResult(true, err)
+	s.audit.Record(e)
+
+	return err
+}
+
+func (s *Storage) updateQuota(e *audit.Entry, namespace, resource string, cfg quota.Config) error {
+	if err := validateConfig(cfg); err != nil {
+		return err
 	}
 
-	s.buckets[id] = NewCappedBucket(cfg.Capacity, 1)
+	s.bucketsMu.Lock()
+	defer s.bucketsMu.Unlock()
+
+	id := strings.Join([]string{namespace, resource}, "_")
+	bucket, found := s.buckets[id]
+	if !found {
+		return storage.ErrNotFound
+	}
+
+	e.Before = quotaAuditState(bucket, s.quotas[id].Strategy)
+	defer func() { e.After = quotaAuditState(bucket, s.quotas[id].Strategy) }()
+
+	if cfg.Parent != s.quotas[id].Strategy.Parent {
+		if allocated, _, _ := bucket.View(); allocated > 0 {
+			return fmt.Errorf("parent cannot be changed with tokens allocated: %w", storage.ErrInvalidConfig)
+		}
+
+		if err := s.validateParentLocked(id, cfg); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Periodic() && s.hasChildrenLocked(namespace, resource) {
+		return fmt.Errorf("quota with child quotas cannot be periodic: %w", storage.ErrInvalidConfig)
+	}
+
+	if storedConfig(cfg) == s.quotas[id].Strategy {
+		return nil
+	}
+
+	dropped, err := bucket.SetConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to set config: %w", err)
+	}
+
+	releaseLocked(s.ancestorsLocked(id), dropped)
+
+	previous := s.quotas[id].Strategy
+	s.quotas[id] = quota.Quota{Namespace: namespace, Resource: resource, Strategy: storedConfig(cfg)}
+	if cfg.Period != previous.Period || cfg.TimeZone != previous.TimeZone {
+		s.setPeriodLocked(id, cfg)
+	}
+
+	s.publishLocked(id)
+
+	return nil
+}
+
+func (s *Storage) DeleteQuota(ctx context.Context, namespace, resource string) error {
+	e := audit.NewEntry(ctx, s.clock.Now(), audit.DeleteQuota, namespace, resource)
+	err := s.deleteQuota(&e, namespace, resource)
+	e.SetResult(true, err)
+	s.audit.Record(e)
+
+	return err
+}
+
+func (s *Storage) deleteQuota(e *audit.Entry, namespace, resource string) error {
+	s.bucketsMu.Lock()
+	defer s.bucketsMu.Unlock()
+
+	id := strings.Join([]string{namespace, resource}, "_")
+	bucket, found := s.buckets[id]
+	if !found {
+		return storage.ErrNotFound
+	}
+
+	e.Before = quotaAuditState(bucket, s.quotas[id].Strategy)
+
+	if s.hasChildrenLocked(namespace, resource) {
+		return fmt.Errorf("quota has child quotas: %w", storage.ErrInvalidConfig)
+	}
+
+	allocated, _, _ := bucket.View()
+	releaseLocked(s.ancestorsLocked(id), allocated)
+
+	parentNamespace, parentResource, hasParent := s.quotas[id].Strategy.ParentRef()
+	delete(s.buckets, id)
+	delete(s.quotas, id)
+	delete(s.periods, id)
+
+	s.hub.Publish(namespace, resource, watch.Event{Deleted: true})
+	if hasParent {
+		s.publishLocked(strings.Join([]string{parentNamespace, parentResource}, "_"))
+	}
+
+	s.leasesMu.Lock()
+	defer s.leasesMu.Unlock()
+
+	for leaseID, l := range s.leases {
+		if l.id == id {
+			delete(s.leases, leaseID)
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) ListQuotas(_ context.Context) ([]quota.Quota, error) {
+	s.bucketsMu.RLock()
+	defer s.bucketsMu.RUnlock()
+
+	quotas := make([]quota.Quota, 0, len(s.quotas))
+	for _, q := range s.quotas {
+		quotas = append(quotas, q)
+	}
+
+	return quotas, nil
+}
+
+// Export returns the state of all quotas, along with their leases, ordered by export.Sort.
+func (s *Storage) Export(_ context.Context) ([]export.Item, error) {
+	s.bucketsMu.RLock()
+	defer s.bucketsMu.RUnlock()
+
+	s.leasesMu.Lock()
+	defer s.leasesMu.Unlock()
+
+	leases := make(map[string][]export.Lease)
+	for leaseID, l := range s.leases {
+		leases[l.id] = append(leases[l.id], export.Lease{ID: leaseID, Holder: l.holder, Tokens: l.tokens, ExpiresAt: l.expiresAt.UTC()})
+	}
+
+	items := make([]export.Item, 0, len(s.quotas))
+	for id, q := range s.quotas {
+		allocated, capacity, version, holders := s.buckets[id].Holders()
+		q.Strategy.Capacity = capacity
+		sort.Slice(leases[id], func(i, j int) bool { return leases[id][i].ID < leases[id][j].ID })
+		items = append(items, export.Item{
+			Namespace: q.Namespace,
+			Resource:  q.Resource,
+			Strategy:  q.Strategy,
+			Allocated: allocated,
+			Version:   version,
+			Holders:   holders,
+			Leases:    leases[id],
+		})
+	}
+
+	export.Sort(items)
+
+	return items, nil
+}
+
+// Import writes the state of exported quotas as it is, registering the missing ones and overwriting the others along
+// with their leases. Items are imported in order, so parents have to come before their children, and an import stops
+// at the first invalid item.
+func (s *Storage) Import(ctx context.Context, items []export.Item) error {
+	s.bucketsMu.Lock()
+	defer s.bucketsMu.Unlock()
+
+	s.leasesMu.Lock()
+	defer s.leasesMu.Unlock()
+
+	for _, it := range items {
+		e := audit.NewEntry(ctx, s.clock.Now(), audit.Import, it.Namespace, it.Resource)
+		err := s.importLocked(&e, it)
+		e.SetResult(true, err)
+		s.audit.Record(e)
+
+		if err != nil {
+			return fmt.Errorf("failed to import %s/%s: %w", it.Namespace, it.Resource, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) importLocked(e *audit.Entry, it export.Item) error {
+	cfg := storedConfig(it.Strategy)
+	if err := validateConfig(cfg); err != nil {
+		return err
+	}
+
+	if err := it.Validate(); err != nil {
+		return err
+	}
+
+	id := strings.Join([]string{it.Namespace, it.Resource}, "_")
+	if bucket, found := s.buckets[id]; found {
+		e.Before = quotaAuditState(bucket, s.quotas[id].Strategy)
+
+		// The tokens charged by the quota to its current parent would be left behind.
+		if cfg.Parent != s.quotas[id].Strategy.Parent {
+			return fmt.Errorf("parent cannot be changed by an import: %w", storage.ErrInvalidConfig)
+		}
+	}
+
+	if cfg.Periodic() && s.hasChildrenLocked(it.Namespace, it.Resource) {
+		return fmt.Errorf("quota with child quotas cannot be periodic: %w", storage.ErrInvalidConfig)
+	}
+
+	if err := s.validateParentLocked(id, cfg); err != nil {
+		return err
+	}
+
+	s.buckets[id] = NewCappedBucketFromState(cfg, it.Allocated, it.Version, it.Holders)
+	s.quotas[id] = quota.Quota{Namespace: it.Namespace, Resource: it.Resource, Strategy: cfg}
+	s.setPeriodLocked(id, cfg)
+
+	for leaseID, l := range s.leases {
+		if l.id == id {
+			delete(s.leases, leaseID)
+		}
+	}
+
+	for _, l := range it.Leases {
+		s.leases[l.ID] = lease{id: id, holder: l.Holder, tokens: l.Tokens, expiresAt: l.ExpiresAt}
+	}
+
+	s.publishLocked(id)
+	e.After = quotaAuditState(s.buckets[id], cfg)
 
 	return nil
 }
@@ -92,3 +806,210 @@ func (s *Storage) RegisterQuota(_ context.Context, namespace, resource string, c
 func (s *Storage) Shutdown(_ context.Context) error {
 	return nil
 }
+
+// ancestor is a bucket of an ancestor of a quota, along with the holder under which it accounts the tokens charged
+// through the quota.
+type ancestor struct {
+	bucket *CappedBucket
+	holder string
+}
+
+// lockBuckets locks the buckets for an operation on a quota, and returns the function unlocking them. Quotas with a
+// parent charge their ancestors, so they are checked and charged with the buckets locked exclusively.
+func (s *Storage) lockBuckets(id string) func() {
+	s.bucketsMu.RLock()
+	if _, _, ok := s.quotas[id].Strategy.ParentRef(); !ok {
+		return s.bucketsMu.RUnlock
+	}
+
+	s.bucketsMu.RUnlock()
+	s.bucketsMu.Lock()
+
+	return s.bucketsMu.Unlock
+}
+
+// Watch returns the changes of a quota, starting with its current state, until ctx is done.
+func (s *Storage) Watch(ctx context.Context, namespace, resource string) (<-chan watch.Event, error) {
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	s.bucketsMu.RLock()
+	defer s.bucketsMu.RUnlock()
+
+	bucket, found := s.buckets[id]
+	if !found {
+		return nil, storage.ErrNotFound
+	}
+
+	sub := s.hub.Subscribe(namespace, resource)
+	allocated, capacity, version := bucket.View()
+	sub.Offer(watch.Event{Allocated: allocated, Capacity: capacity, Version: version})
+
+	go func() {
+		<-ctx.Done()
+		sub.Cancel()
+	}()
+
+	return sub.Events(), nil
+}
+
+// publishLocked sends the state of a quota, and of its ancestors, to their watchers.
+func (s *Storage) publishLocked(id string) {
+	for {
+		q, found := s.quotas[id]
+		if !found {
+			return
+		}
+
+		allocated, capacity, version := s.buckets[id].View()
+		s.hub.Publish(q.Namespace, q.Resource, watch.Event{Allocated: allocated, Capacity: capacity, Version: version})
+
+		namespace, resource, ok := q.Strategy.ParentRef()
+		if !ok {
+			return
+		}
+
+		id = strings.Join([]string{namespace, resource}, "_")
+	}
+}
+
+// ancestorsLocked returns the ancestors of a quota, starting with its parent.
+func (s *Storage) ancestorsLocked(id string) []ancestor {
+	var ancestors []ancestor
+	for q := s.quotas[id]; ; {
+		namespace, resource, ok := q.Strategy.ParentRef()
+		if !ok {
+			return ancestors
+		}
+
+		parentID := strings.Join([]string{namespace, resource}, "_")
+		bucket, found := s.buckets[parentID]
+		if !found {
+			return ancestors
+		}
+
+		ancestors = append(ancestors, ancestor{bucket: bucket, holder: quota.ChildHolder(q.Namespace, q.Resource)})
+		q = s.quotas[parentID]
+	}
+}
+
+// chargeLocked charges tokens to the ancestors of a quota. The ancestors have to be checked to fit the tokens first.
+func (s *Storage) chargeLocked(ancestors []ancestor, tokens int64) {
+	for _, a := range ancestors {
+		if _, _, ok, _, err := a.bucket.Alloc(a.holder, tokens, 0); !ok || err != nil {
+			panic("ancestor charged beyond its capacity")
+		}
+	}
+}
+
+// releaseLocked releases tokens charged to the ancestors of a quota.
+func releaseLocked(ancestors []ancestor, tokens int64) {
+	for _, a := range ancestors {
+		a.bucket.Expire(a.holder, tokens)
+	}
+}
+
+// setPeriodLocked starts the current period of a quota, or stops tracking its periods if it is not periodic.
+func (s *Storage) setPeriodLocked(id string, cfg quota.Config) {
+	if !cfg.Periodic() {
+		delete(s.periods, id)
+		return
+	}
+
+	// The configuration is validated, so the period start cannot fail.
+	start, _ := cfg.PeriodStart(s.clock.Now())
+	s.periods[id] = start
+}
+
+// hasChildrenLocked reports whether any quota has the given one as its parent.
+func (s *Storage) hasChildrenLocked(namespace, resource string) bool {
+	for _, q := range s.quotas {
+		if q.Strategy.Parent == namespace+"/"+resource {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateParentLocked checks that the parent of a quota exists, and that it does not make the quota its own ancestor.
+func (s *Storage) validateParentLocked(id string, cfg quota.Config) error {
+	if cfg.Parent == "" {
+		return nil
+	}
+
+	namespace, resource, ok := cfg.ParentRef()
+	if !ok {
+		return fmt.Errorf("parent must be a namespace/resource pair: %w", storage.ErrInvalidConfig)
+	}
+
+	for parentID := strings.Join([]string{namespace, resource}, "_"); ; {
+		if parentID == id {
+			return fmt.Errorf("quota cannot be its own ancestor: %w", storage.ErrInvalidConfig)
+		}
+
+		q, found := s.quotas[parentID]
+		if !found {
+			return fmt.Errorf("parent %s/%s does not exist: %w", namespace, resource, storage.ErrInvalidConfig)
+		}
+
+		// Resetting a parent would drop the tokens charged by its children.
+		if q.Strategy.Periodic() {
+			return fmt.Errorf("parent %s/%s is periodic: %w", namespace, resource, storage.ErrInvalidConfig)
+		}
+
+		ancestorNamespace, ancestorResource, ok := q.Strategy.ParentRef()
+		if !ok {
+			return nil
+		}
+
+		namespace, resource = ancestorNamespace, ancestorResource
+		parentID = strings.Join([]string{namespace, resource}, "_")
+	}
+}
+
+// auditState returns the state of a bucket for the audit log.
+func auditState(bucket *CappedBucket) *audit.State {
+	allocated, capacity, version := bucket.View()
+
+	return &audit.State{Allocated: allocated, Capacity: capacity, Version: version}
+}
+
+// quotaAuditState returns the state of a bucket for the audit log, along with the configuration of its quota.
+func quotaAuditState(bucket *CappedBucket, cfg quota.Config) *audit.State {
+	state := auditState(bucket)
+	strategy := cfg.DTO()
+	state.Strategy = &strategy
+
+	return state
+}
+
+// storedConfig returns cfg without the shrink policy, which only applies to the update carrying it.
+func storedConfig(cfg quota.Config) quota.Config {
+	cfg.ShrinkPolicy = ""
+
+	return cfg
+}
+
+func validateConfig(cfg quota.Config) error {
+	if cfg.Capacity <= 0 {
+		return fmt.Errorf("capacity must be greater than 0: %w", storage.ErrInvalidConfig)
+	}
+
+	if cfg.SoftLimit < 0 {
+		return fmt.Errorf("soft limit must not be negative: %w", storage.ErrInvalidConfig)
+	}
+
+	if cfg.Overcommit != 0 && cfg.Overcommit < 1 {
+		return fmt.Errorf("overcommit must be at least 1: %w", storage.ErrInvalidConfig)
+	}
+
+	if !cfg.ShrinkPolicy.Valid() {
+		return fmt.Errorf("unknown shrink policy %s: %w", cfg.ShrinkPolicy, storage.ErrInvalidConfig)
+	}
+
+	if _, err := cfg.PeriodStart(time.Time{}); err != nil {
+		return fmt.Errorf("invalid period: %s: %w", err, storage.ErrInvalidConfig)
+	}
+
+	return nil
+}
@@ -0,0 +1,527 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Blinkuu/qms/internal/core/storage"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/audit"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/batch"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/export"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/watch"
+	"github.com/Blinkuu/qms/pkg/caller"
+	"github.com/Blinkuu/qms/pkg/log"
+)
+
+func TestStorage_UpdateQuota_KeepsAllocatedTokensAndBumpsVersion(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), time.Minute, audit.NewNopLog())
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10})
+	assert.NoError(t, err)
+	_, _, _, ok, _, err := s.Alloc(context.Background(), "namespace", "resource", "", 4, 0, 0, "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// When
+	err = s.UpdateQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 5})
+
+	// Then
+	assert.NoError(t, err)
+	allocated, capacity, version, viewErr := s.View(context.Background(), "namespace", "resource")
+	assert.NoError(t, viewErr)
+	assert.EqualValues(t, 4, allocated)
+	assert.EqualValues(t, 5, capacity)
+	assert.EqualValues(t, 3, version)
+}
+
+func TestStorage_UpdateQuota_ReturnsErrCapacityBelowAllocated(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), time.Minute, audit.NewNopLog())
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10})
+	assert.NoError(t, err)
+	_, _, _, _, _, err = s.Alloc(context.Background(), "namespace", "resource", "", 4, 0, 0, "")
+	assert.NoError(t, err)
+
+	// When
+	err = s.UpdateQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 3})
+
+	// Then
+	assert.ErrorIs(t, err, storage.ErrCapacityBelowAllocated)
+	_, capacity, _, viewErr := s.View(context.Background(), "namespace", "resource")
+	assert.NoError(t, viewErr)
+	assert.EqualValues(t, 10, capacity)
+}
+
+func TestStorage_RegisterQuota_ReturnsErrAlreadyExistsWithRegisteredQuota(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), time.Minute, audit.NewNopLog())
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10})
+	assert.NoError(t, err)
+
+	// When
+	err = s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10})
+
+	// Then
+	assert.ErrorIs(t, err, storage.ErrAlreadyExists)
+}
+
+func TestStorage_DeleteQuota_RemovesQuotaFromList(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), time.Minute, audit.NewNopLog())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource1", quota.Config{Capacity: 10}))
+	assert.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource2", quota.Config{Capacity: 20}))
+
+	// When
+	err := s.DeleteQuota(context.Background(), "namespace", "resource1")
+
+	// Then
+	assert.NoError(t, err)
+	quotas, listErr := s.ListQuotas(context.Background())
+	assert.NoError(t, listErr)
+	assert.Equal(t, []quota.Quota{{Namespace: "namespace", Resource: "resource2", Strategy: quota.Config{Capacity: 20}}}, quotas)
+	_, _, _, viewErr := s.View(context.Background(), "namespace", "resource1")
+	assert.ErrorIs(t, viewErr, storage.ErrNotFound)
+}
+
+func TestStorage_ExpireLeases_FreesTokensOfExpiredLeases(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	s := NewStorage(c, time.Minute, audit.NewNopLog())
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10})
+	assert.NoError(t, err)
+	_, _, leaseID, ok, _, err := s.Alloc(context.Background(), "namespace", "resource", "", 4, 0, 10*time.Second, "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NotEmpty(t, leaseID)
+	_, _, _, _, _, err = s.Alloc(context.Background(), "namespace", "resource", "", 2, 0, 20*time.Second, "")
+	assert.NoError(t, err)
+	c.Add(10 * time.Second)
+
+	// When
+	expired, err := s.ExpireLeases(context.Background())
+
+	// Then
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	allocated, _, version, viewErr := s.View(context.Background(), "namespace", "resource")
+	assert.NoError(t, viewErr)
+	assert.EqualValues(t, 2, allocated)
+	assert.EqualValues(t, 4, version)
+}
+
+func TestStorage_Renew_ExtendsLease(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	s := NewStorage(c, time.Minute, audit.NewNopLog())
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10})
+	assert.NoError(t, err)
+	_, _, leaseID, _, _, err := s.Alloc(context.Background(), "namespace", "resource", "", 4, 0, 10*time.Second, "")
+	assert.NoError(t, err)
+	c.Add(5 * time.Second)
+
+	// When
+	expiresAt, ok, err := s.Renew(context.Background(), "namespace", "resource", leaseID, 10*time.Second)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, c.Now().Add(10*time.Second), expiresAt)
+	c.Add(9 * time.Second)
+	expired, expireErr := s.ExpireLeases(context.Background())
+	assert.NoError(t, expireErr)
+	assert.Zero(t, expired)
+}
+
+func TestStorage_Renew_ReturnsFalseWithExpiredLease(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	s := NewStorage(c, time.Minute, audit.NewNopLog())
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10})
+	assert.NoError(t, err)
+	_, _, leaseID, _, _, err := s.Alloc(context.Background(), "namespace", "resource", "", 4, 0, 10*time.Second, "")
+	assert.NoError(t, err)
+	c.Add(10 * time.Second)
+
+	// When
+	_, ok, err := s.Renew(context.Background(), "namespace", "resource", leaseID, 10*time.Second)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestStorage_Free_FreesTokensOfLease(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), time.Minute, audit.NewNopLog())
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10})
+	assert.NoError(t, err)
+	_, _, leaseID, _, _, err := s.Alloc(context.Background(), "namespace", "resource", "", 4, 0, 10*time.Second, "")
+	assert.NoError(t, err)
+
+	// When
+	remainingTokens, _, ok1, err1 := s.Free(context.Background(), "namespace", "resource", "", 0, 0, leaseID, "")
+	_, _, ok2, err2 := s.Free(context.Background(), "namespace", "resource", "", 0, 0, leaseID, "")
+
+	// Then
+	assert.NoError(t, err1)
+	assert.True(t, ok1)
+	assert.EqualValues(t, 10, remainingTokens)
+	assert.NoError(t, err2)
+	assert.False(t, ok2)
+}
+
+func TestStorage_Free_KeepsLeasedTokensUntilTheLeaseExpires(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	s := NewStorage(c, time.Minute, audit.NewNopLog())
+	require.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10}))
+	_, _, _, ok, _, err := s.Alloc(context.Background(), "namespace", "resource", "a", 10, 0, 10*time.Second, "")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// When
+	_, _, freed, err := s.Free(context.Background(), "namespace", "resource", "a", 10, 0, "", "")
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, freed)
+	c.Add(10 * time.Second)
+	expired, err := s.ExpireLeases(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	_, _, _, ok, _, err = s.Alloc(context.Background(), "namespace", "resource", "b", 10, 0, 0, "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	_, _, _, ok, _, err = s.Alloc(context.Background(), "namespace", "resource", "c", 10, 0, 0, "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	allocated, _, _, viewErr := s.View(context.Background(), "namespace", "resource")
+	assert.NoError(t, viewErr)
+	assert.EqualValues(t, 10, allocated)
+}
+
+func TestStorage_Alloc_ReplaysResultOfIdempotencyKey(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	s := NewStorage(c, time.Minute, audit.NewNopLog())
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10})
+	assert.NoError(t, err)
+	remainingTokens1, version1, leaseID1, ok1, _, err1 := s.Alloc(context.Background(), "namespace", "resource", "", 4, 0, 10*time.Second, "key")
+
+	// When
+	remainingTokens2, version2, leaseID2, ok2, _, err2 := s.Alloc(context.Background(), "namespace", "resource", "", 4, 0, 10*time.Second, "key")
+	c.Add(time.Minute)
+	_, err3 := s.ExpireLeases(context.Background())
+	remainingTokens4, _, leaseID4, ok4, _, err4 := s.Alloc(context.Background(), "namespace", "resource", "", 4, 0, 10*time.Second, "key")
+
+	// Then
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.NoError(t, err3)
+	assert.NoError(t, err4)
+	assert.True(t, ok1)
+	assert.True(t, ok2)
+	assert.True(t, ok4)
+	assert.EqualValues(t, 6, remainingTokens1)
+	assert.Equal(t, remainingTokens1, remainingTokens2)
+	assert.Equal(t, version1, version2)
+	assert.Equal(t, leaseID1, leaseID2)
+	assert.EqualValues(t, 6, remainingTokens4)
+	assert.NotEqual(t, leaseID1, leaseID4)
+}
+
+func TestStorage_AllocBatch_AllocatesNothingIfAnyQuotaLacksTokens(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), time.Minute, audit.NewNopLog())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "namespace", "cpu", quota.Config{Capacity: 10}))
+	assert.NoError(t, s.RegisterQuota(context.Background(), "namespace", "memory", quota.Config{Capacity: 5}))
+	items := []batch.Item{
+		{Namespace: "namespace", Resource: "cpu", Tokens: 4},
+		{Namespace: "namespace", Resource: "memory", Tokens: 6},
+	}
+
+	// When
+	results, ok, err := s.AllocBatch(context.Background(), items)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, []batch.Result{{RemainingTokens: 10, CurrentVersion: 1}, {RemainingTokens: 5, CurrentVersion: 1}}, results)
+	allocated, _, _, viewErr := s.View(context.Background(), "namespace", "cpu")
+	assert.NoError(t, viewErr)
+	assert.EqualValues(t, 0, allocated)
+}
+
+func TestStorage_AllocBatch_ReturnsErrNotFoundWithUnknownQuota(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), time.Minute, audit.NewNopLog())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "namespace", "cpu", quota.Config{Capacity: 10}))
+	items := []batch.Item{
+		{Namespace: "namespace", Resource: "cpu", Tokens: 4},
+		{Namespace: "namespace", Resource: "disk", Tokens: 1},
+	}
+
+	// When
+	_, _, err := s.AllocBatch(context.Background(), items)
+
+	// Then
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	allocated, _, _, viewErr := s.View(context.Background(), "namespace", "cpu")
+	assert.NoError(t, viewErr)
+	assert.EqualValues(t, 0, allocated)
+}
+
+func TestStorage_Alloc_ChargesAncestorsAndFailsIfAnyIsFull(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), time.Minute, audit.NewNopLog())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "org", "cpu", quota.Config{Capacity: 10}))
+	assert.NoError(t, s.RegisterQuota(context.Background(), "team", "cpu", quota.Config{Capacity: 8, Parent: "org/cpu"}))
+	assert.NoError(t, s.RegisterQuota(context.Background(), "user", "cpu", quota.Config{Capacity: 8, Parent: "team/cpu"}))
+	_, _, _, _, _, err := s.Alloc(context.Background(), "team", "cpu", "", 2, 0, 0, "")
+	assert.NoError(t, err)
+
+	// When
+	_, _, _, ok1, _, err1 := s.Alloc(context.Background(), "user", "cpu", "", 6, 0, 0, "")
+	_, _, _, ok2, _, err2 := s.Alloc(context.Background(), "user", "cpu", "", 1, 0, 0, "")
+
+	// Then
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.True(t, ok1)
+	assert.False(t, ok2)
+	allocated, _, _, holders, viewErr := s.ViewHolders(context.Background(), "org", "cpu")
+	assert.NoError(t, viewErr)
+	assert.EqualValues(t, 8, allocated)
+	assert.Equal(t, map[string]int64{quota.ChildHolder("team", "cpu"): 8}, holders)
+}
+
+func TestStorage_Free_ReleasesAncestors(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), time.Minute, audit.NewNopLog())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "org", "cpu", quota.Config{Capacity: 10}))
+	assert.NoError(t, s.RegisterQuota(context.Background(), "team", "cpu", quota.Config{Capacity: 8, Parent: "org/cpu"}))
+	_, _, _, _, _, err := s.Alloc(context.Background(), "team", "cpu", "", 5, 0, 0, "")
+	assert.NoError(t, err)
+
+	// When
+	_, _, ok, err := s.Free(context.Background(), "team", "cpu", "", 3, 0, "", "")
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	allocated, _, _, viewErr := s.View(context.Background(), "org", "cpu")
+	assert.NoError(t, viewErr)
+	assert.EqualValues(t, 2, allocated)
+}
+
+func TestStorage_Alloc_FlagsAllocsOverSoftLimitUpToOvercommittedCapacity(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), time.Minute, audit.NewNopLog())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10, SoftLimit: 8, Overcommit: 1.5}))
+
+	// When
+	_, _, _, ok1, overSoftLimit1, err1 := s.Alloc(context.Background(), "namespace", "resource", "", 8, 0, 0, "")
+	remainingTokens2, _, _, ok2, overSoftLimit2, err2 := s.Alloc(context.Background(), "namespace", "resource", "", 7, 0, 0, "")
+	remainingTokens3, _, _, ok3, overSoftLimit3, err3 := s.Alloc(context.Background(), "namespace", "resource", "", 1, 0, 0, "")
+
+	// Then
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.NoError(t, err3)
+	assert.True(t, ok1)
+	assert.False(t, overSoftLimit1)
+	assert.True(t, ok2)
+	assert.True(t, overSoftLimit2)
+	assert.EqualValues(t, 0, remainingTokens2)
+	assert.False(t, ok3)
+	assert.False(t, overSoftLimit3)
+	assert.EqualValues(t, 0, remainingTokens3)
+}
+
+func TestStorage_Watch_StartsWithCurrentStateAndFollowsChildAllocs(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), time.Minute, audit.NewNopLog())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "org", "cpu", quota.Config{Capacity: 10}))
+	assert.NoError(t, s.RegisterQuota(context.Background(), "team", "cpu", quota.Config{Capacity: 8, Parent: "org/cpu"}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// When
+	events, err := s.Watch(ctx, "org", "cpu")
+	assert.NoError(t, err)
+	initial := <-events
+	_, _, _, _, _, allocErr := s.Alloc(context.Background(), "team", "cpu", "", 3, 0, 0, "")
+	changed := <-events
+
+	// Then
+	assert.NoError(t, allocErr)
+	assert.Equal(t, watch.Event{Allocated: 0, Capacity: 10, Version: 1}, initial)
+	assert.Equal(t, watch.Event{Allocated: 3, Capacity: 10, Version: 2}, changed)
+}
+
+func TestStorage_Watch_ReturnsErrNotFoundWithUnknownQuota(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), time.Minute, audit.NewNopLog())
+
+	// When
+	_, err := s.Watch(context.Background(), "namespace", "resource")
+
+	// Then
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestStorage_ResetPeriods_FreesTokensAtCalendarBoundaryInTimeZone(t *testing.T) {
+	// Given
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	require.NoError(t, err)
+	c := clock.NewMock()
+	c.Set(time.Date(2022, time.November, 30, 23, 0, 0, 0, warsaw))
+	s := NewStorage(c, time.Minute, audit.NewNopLog())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10, Period: "month", TimeZone: "Europe/Warsaw"}))
+	_, _, _, _, _, err = s.Alloc(context.Background(), "namespace", "resource", "", 10, 0, 0, "")
+	assert.NoError(t, err)
+
+	// When
+	c.Add(30 * time.Minute)
+	resetBefore, errBefore := s.ResetPeriods(context.Background())
+	c.Add(30 * time.Minute)
+	resetAfter, errAfter := s.ResetPeriods(context.Background())
+
+	// Then
+	assert.NoError(t, errBefore)
+	assert.Equal(t, 0, resetBefore)
+	assert.NoError(t, errAfter)
+	assert.Equal(t, 1, resetAfter)
+	allocated, _, version, viewErr := s.View(context.Background(), "namespace", "resource")
+	assert.NoError(t, viewErr)
+	assert.EqualValues(t, 0, allocated)
+	assert.EqualValues(t, 3, version)
+}
+
+func TestStorage_RegisterQuota_ReturnsErrInvalidConfigWithPeriodicParent(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), time.Minute, audit.NewNopLog())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "org", "builds", quota.Config{Capacity: 10, Period: "month"}))
+
+	// When
+	err := s.RegisterQuota(context.Background(), "team", "builds", quota.Config{Capacity: 5, Parent: "org/builds"})
+
+	// Then
+	assert.ErrorIs(t, err, storage.ErrInvalidConfig)
+}
+
+func TestStorage_Alloc_RecordsAuditEntryWithCallerAndStates(t *testing.T) {
+	// Given
+	var buf bytes.Buffer
+	s := NewStorage(clock.NewMock(), time.Minute, audit.NewLog(audit.NewWriterSink(&buf), log.NewNoopLogger()))
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10})
+	require.NoError(t, err)
+	buf.Reset()
+
+	// When
+	_, _, _, ok, _, err := s.Alloc(caller.NewContext(context.Background(), "service"), "namespace", "resource", "holder", 4, 0, 0, "")
+
+	// Then
+	require.NoError(t, err)
+	require.True(t, ok)
+	var e audit.Entry
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &e))
+	assert.Equal(t, audit.Alloc, e.Operation)
+	assert.Equal(t, "service", e.Caller)
+	assert.Equal(t, "holder", e.Holder)
+	assert.EqualValues(t, 4, e.Tokens)
+	assert.Equal(t, &audit.State{Allocated: 0, Capacity: 10, Version: 1}, e.Before)
+	assert.Equal(t, &audit.State{Allocated: 4, Capacity: 10, Version: 2}, e.After)
+	assert.Equal(t, "ok", e.Result)
+}
+
+func TestStorage_AllocBatch_RecordsAuditEntryPerItem(t *testing.T) {
+	// Given
+	var buf bytes.Buffer
+	s := NewStorage(clock.NewMock(), time.Minute, audit.NewLog(audit.NewWriterSink(&buf), log.NewNoopLogger()))
+	require.NoError(t, s.RegisterQuota(context.Background(), "namespace", "first", quota.Config{Capacity: 10}))
+	require.NoError(t, s.RegisterQuota(context.Background(), "namespace", "second", quota.Config{Capacity: 10}))
+	buf.Reset()
+
+	// When
+	_, ok, err := s.AllocBatch(caller.NewContext(context.Background(), "service"), []batch.Item{
+		{Namespace: "namespace", Resource: "first", Holder: "holder", Tokens: 4},
+		{Namespace: "namespace", Resource: "second", Holder: "holder", Tokens: 6},
+	})
+
+	// Then
+	require.NoError(t, err)
+	require.True(t, ok)
+	dec := json.NewDecoder(&buf)
+	for _, want := range []struct {
+		resource string
+		tokens   int64
+	}{{"first", 4}, {"second", 6}} {
+		var e audit.Entry
+		require.NoError(t, dec.Decode(&e))
+		assert.Equal(t, audit.AllocBatch, e.Operation)
+		assert.Equal(t, want.resource, e.Resource)
+		assert.Equal(t, "service", e.Caller)
+		assert.Equal(t, want.tokens, e.Tokens)
+		assert.Equal(t, &audit.State{Allocated: 0, Capacity: 10, Version: 1}, e.Before)
+		assert.Equal(t, &audit.State{Allocated: want.tokens, Capacity: 10, Version: 2}, e.After)
+		assert.Equal(t, "ok", e.Result)
+	}
+}
+
+func TestStorage_ExpireLeases_RecordsAuditEntry(t *testing.T) {
+	// Given
+	var buf bytes.Buffer
+	c := clock.NewMock()
+	s := NewStorage(c, time.Minute, audit.NewLog(audit.NewWriterSink(&buf), log.NewNoopLogger()))
+	require.NoError(t, s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Capacity: 10}))
+	_, _, leaseID, ok, _, err := s.Alloc(context.Background(), "namespace", "resource", "holder", 4, 0, time.Second, "")
+	require.NoError(t, err)
+	require.True(t, ok)
+	buf.Reset()
+	c.Add(time.Second)
+
+	// When
+	expired, err := s.ExpireLeases(context.Background())
+
+	// Then
+	require.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	var e audit.Entry
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &e))
+	assert.Equal(t, audit.ExpireLease, e.Operation)
+	assert.Empty(t, e.Caller)
+	assert.Equal(t, "holder", e.Holder)
+	assert.EqualValues(t, 4, e.Tokens)
+	assert.Equal(t, leaseID, e.LeaseID)
+	assert.Equal(t, &audit.State{Allocated: 4, Capacity: 10, Version: 2}, e.Before)
+	assert.Equal(t, "ok", e.Result)
+	require.NotNil(t, e.After)
+	assert.Zero(t, e.After.Allocated)
+}
+
+func TestStorage_Import_ReturnsErrInvalidConfigWithChangedParent(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), time.Minute, audit.NewNopLog())
+	assert.NoError(t, s.RegisterQuota(context.Background(), "org", "cpu", quota.Config{Capacity: 10}))
+	assert.NoError(t, s.RegisterQuota(context.Background(), "team", "cpu", quota.Config{Capacity: 8}))
+	items := []export.Item{{Namespace: "team", Resource: "cpu", Strategy: quota.Config{Capacity: 8, Parent: "org/cpu"}, Allocated: 2, Version: 3}}
+
+	// When
+	err := s.Import(context.Background(), items)
+
+	// Then
+	assert.ErrorIs(t, err, storage.ErrInvalidConfig)
+	allocated, _, version, viewErr := s.View(context.Background(), "team", "cpu")
+	assert.NoError(t, viewErr)
+	assert.EqualValues(t, 0, allocated)
+	assert.EqualValues(t, 1, version)
+}
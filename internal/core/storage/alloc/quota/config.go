@@ -1,5 +1,201 @@
 package quota
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	// The time zone database is embedded, so that all replicas compute the same period boundaries.
+	_ "time/tzdata"
+
+	"github.com/Blinkuu/qms/pkg/dto"
+	"github.com/Blinkuu/qms/pkg/timeunit"
+)
+
+// childHolderPrefix prefixes the holders under which a quota accounts the tokens charged to it by its child quotas.
+const childHolderPrefix = "quota:"
+
+// ShrinkPolicy decides what happens when the capacity of a quota is updated below its allocated tokens.
+type ShrinkPolicy string
+
+const (
+	// ShrinkPolicyReject rejects the update. It is the default.
+	ShrinkPolicyReject ShrinkPolicy = "reject"
+
+	// ShrinkPolicyOverQuota keeps the allocated tokens, leaving the quota over its capacity. Allocations fail until
+	// enough tokens are freed.
+	ShrinkPolicyOverQuota ShrinkPolicy = "over_quota"
+
+	// ShrinkPolicyClamp drops the allocated tokens above the capacity, first the unowned ones and then those of the
+	// holders in order of their names.
+	ShrinkPolicyClamp ShrinkPolicy = "clamp"
+)
+
 type Config struct {
 	Capacity int64 `yaml:"capacity"`
+
+	// Parent references the parent quota as namespace/resource. Allocations from a quota with a parent also charge the
+	// parent, and in turn all of its ancestors.
+	Parent string `yaml:"parent"`
+
+	// SoftLimit is the number of allocated tokens above which allocations still succeed, but are flagged as over the
+	// soft limit. Zero disables it.
+	SoftLimit int64 `yaml:"soft_limit"`
+
+	// Overcommit multiplies the capacity for resources that are rarely used in full, so that more tokens than the
+	// capacity can be allocated. Zero disables it, like 1.
+	Overcommit float64 `yaml:"overcommit"`
+
+	// ShrinkPolicy applies when the capacity of a registered quota is updated below its allocated tokens. It is not
+	// stored along with the quota.
+	ShrinkPolicy ShrinkPolicy `yaml:"shrink_policy"`
+
+	// Period is the calendar unit (day, week, month, ...) at the start of which the allocated tokens are reset. Empty
+	// disables the resets.
+	Period string `yaml:"period"`
+
+	// TimeZone is the IANA time zone in which the period boundaries fall. Empty stands for UTC.
+	TimeZone string `yaml:"time_zone"`
+}
+
+// Quota is a quota registered for a namespace-resource pair.
+type Quota struct {
+	Namespace string `yaml:"namespace"`
+	Resource  string `yaml:"resource"`
+	Strategy  Config `yaml:"strategy"`
+}
+
+func NewConfigFromDTO(strategy dto.QuotaStrategy) Config {
+	return Config{
+		Capacity:     strategy.Capacity,
+		Parent:       strategy.Parent,
+		SoftLimit:    strategy.SoftLimit,
+		Overcommit:   strategy.Overcommit,
+		ShrinkPolicy: ShrinkPolicy(strategy.ShrinkPolicy),
+		Period:       strategy.Period,
+		TimeZone:     strategy.TimeZone,
+	}
+}
+
+func (c Config) DTO() dto.QuotaStrategy {
+	return dto.QuotaStrategy{
+		Capacity:     c.Capacity,
+		Parent:       c.Parent,
+		SoftLimit:    c.SoftLimit,
+		Overcommit:   c.Overcommit,
+		ShrinkPolicy: string(c.ShrinkPolicy),
+		Period:       c.Period,
+		TimeZone:     c.TimeZone,
+	}
+}
+
+// ParentRef returns the namespace and resource of the parent quota. Returns false if the quota has no parent, or if the
+// reference is malformed.
+func (c Config) ParentRef() (string, string, bool) {
+	namespace, resource, found := strings.Cut(c.Parent, "/")
+	if !found || namespace == "" || resource == "" {
+		return "", "", false
+	}
+
+	return namespace, resource, true
+}
+
+// Limit returns the number of tokens that can be allocated from the quota, which is its capacity multiplied by its
+// overcommit factor.
+func (c Config) Limit() int64 {
+	return Limit(c.Capacity, c.Overcommit)
+}
+
+// OverSoftLimit reports whether the allocated tokens exceed the soft limit of the quota, if any.
+func (c Config) OverSoftLimit(allocated int64) bool {
+	return c.SoftLimit > 0 && allocated > c.SoftLimit
+}
+
+// Periodic reports whether the allocated tokens of the quota are reset periodically.
+func (c Config) Periodic() bool {
+	return c.Period != ""
+}
+
+// PeriodStart returns the start of the period containing t. Returns the zero time if the quota is not periodic.
+func (c Config) PeriodStart(t time.Time) (time.Time, error) {
+	if !c.Periodic() {
+		return time.Time{}, nil
+	}
+
+	// The local time zone differs between instances.
+	if c.TimeZone == "Local" {
+		return time.Time{}, fmt.Errorf("time zone %s is not supported", c.TimeZone)
+	}
+
+	loc, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to load time zone: %w", err)
+	}
+
+	start, err := timeunit.Truncate(t.In(loc), c.Period)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to truncate: %w", err)
+	}
+
+	return start, nil
+}
+
+// Limit returns the number of tokens that can be allocated from a capacity with an overcommit factor.
+func Limit(capacity int64, overcommit float64) int64 {
+	if overcommit <= 1 {
+		return capacity
+	}
+
+	return int64(float64(capacity) * overcommit)
+}
+
+// ChildHolder returns the holder under which a parent quota accounts the tokens charged to it by a child quota.
+func ChildHolder(namespace, resource string) string {
+	return childHolderPrefix + namespace + "/" + resource
+}
+
+// Valid reports whether the policy is known. An empty policy is valid and stands for ShrinkPolicyReject.
+func (p ShrinkPolicy) Valid() bool {
+	switch p {
+	case "", ShrinkPolicyReject, ShrinkPolicyOverQuota, ShrinkPolicyClamp:
+		return true
+	default:
+		return false
+	}
+}
+
+// DropExcess drops excess allocated tokens the way ShrinkPolicyClamp does, first from the unowned tokens and then from
+// the holders in order of their names. Holders left without tokens are removed.
+func DropExcess(holders map[string]int64, allocated, excess int64) {
+	unowned := allocated
+	for _, tokens := range holders {
+		unowned -= tokens
+	}
+
+	if unowned > 0 {
+		excess -= unowned
+	}
+
+	names := make([]string, 0, len(holders))
+	for holder := range holders {
+		names = append(names, holder)
+	}
+
+	sort.Strings(names)
+	for _, holder := range names {
+		if excess <= 0 {
+			return
+		}
+
+		dropped := holders[holder]
+		if dropped > excess {
+			dropped = excess
+		}
+
+		holders[holder] -= dropped
+		excess -= dropped
+		if holders[holder] <= 0 {
+			delete(holders, holder)
+		}
+	}
 }
@@ -0,0 +1,69 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+type AbortBatchCommand struct {
+	BatchID           string
+	Coordinator       bool
+	DecisionExpiresAt int64
+	Now               int64
+	SMResult          statemachine.Result
+}
+
+type AbortBatchCommandResult struct {
+	Committed bool
+	Err       string
+}
+
+// NewAbortBatchCommand returns a command aborting a prepared cross-shard batch. Proposed to the coordinator shard, it
+// records the decision to abort until decisionExpiresAt, given in Unix nanoseconds, unless the batch has already been
+// committed, which is then reported back instead. Now, also in Unix nanoseconds, is only recorded in the audit log
+// along with the tokens freed.
+func NewAbortBatchCommand(batchID string, coordinator bool, decisionExpiresAt, now int64) *AbortBatchCommand {
+	return &AbortBatchCommand{
+		BatchID:           batchID,
+		Coordinator:       coordinator,
+		DecisionExpiresAt: decisionExpiresAt,
+		Now:               now,
+		SMResult:          statemachine.Result{},
+	}
+}
+
+func (c *AbortBatchCommand) Type() CommandType {
+	return AbortBatch
+}
+
+func (c *AbortBatchCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, session *client.Session) (any, error) {
+	result, err := syncWrite[AbortBatchCommandResult](ctx, nh, shardID, session, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync write: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *AbortBatchCommand) LocalInvoke(storage *storage, entryIdx uint64) error {
+	committed, err := storage.abortBatch(c.BatchID, c.Coordinator, c.DecisionExpiresAt, c.Now, entryIdx)
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(AbortBatchCommandResult{Committed: committed, Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *AbortBatchCommand) Result() statemachine.Result {
+	return c.SMResult
+}
@@ -0,0 +1,80 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/audit"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/batch"
+)
+
+type AllocBatchCommand struct {
+	Items []batch.Item
+	Now   int64
+
+	Caller  string
+	TraceID string
+
+	SMResult statemachine.Result
+}
+
+type AllocBatchCommandResult struct {
+	Results []batch.Result
+	OK      bool
+	Err     string
+}
+
+// NewAllocBatchCommand returns a command allocating the items of a batch all-or-nothing. All items have to belong to
+// the shard the command is proposed to. Now, in Unix nanoseconds, the caller and the trace ID are only recorded in the
+// audit log.
+func NewAllocBatchCommand(items []batch.Item, now int64, caller, traceID string) *AllocBatchCommand {
+	return &AllocBatchCommand{
+		Items:    items,
+		Now:      now,
+		Caller:   caller,
+		TraceID:  traceID,
+		SMResult: statemachine.Result{},
+	}
+}
+
+func (c *AllocBatchCommand) Type() CommandType {
+	return AllocBatch
+}
+
+func (c *AllocBatchCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, session *client.Session) (any, error) {
+	result, err := syncWrite[AllocBatchCommandResult](ctx, nh, shardID, session, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync write: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *AllocBatchCommand) LocalInvoke(storage *storage, entryIdx uint64) error {
+	entries := newBatchAuditEntries(audit.AllocBatch, c.Items, c.Caller, c.TraceID, c.Now, entryIdx)
+	results, ok, err := storage.allocBatch(entries, c.Items, entryIdx)
+	for _, e := range entries {
+		e.SetResult(ok, err)
+		storage.audit.Record(e)
+	}
+
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(AllocBatchCommandResult{Results: results, OK: ok, Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *AllocBatchCommand) Result() statemachine.Result {
+	return c.SMResult
+}
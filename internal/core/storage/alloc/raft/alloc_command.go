@@ -4,33 +4,59 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/lni/dragonboat/v4"
 	"github.com/lni/dragonboat/v4/client"
 	"github.com/lni/dragonboat/v4/statemachine"
+
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/audit"
 )
 
 type AllocCommand struct {
 	Namespace string
 	Resource  string
+	Holder    string
 	Tokens    int64
 	Version   int64
-	SMResult  statemachine.Result
+	LeaseID   string
+	ExpiresAt int64
+
+	IdempotencyKey  string
+	Now             int64
+	ResultExpiresAt int64
+
+	Caller  string
+	TraceID string
+
+	SMResult statemachine.Result
 }
 
 type AllocCommandResult struct {
 	RemainingTokens int64
 	CurrentVersion  int64
+	LeaseID         string
 	OK              bool
+	OverSoftLimit   bool
 	Err             string
 }
 
-func NewAllocCommand(namespace, resource string, tokens, version int64) *AllocCommand {
+// NewAllocCommand returns a command allocating tokens. With a non-empty lease ID the tokens are leased until expiresAt.
+// With an idempotency key the result is remembered until resultExpiresAt, and it is replayed if the key is seen again
+// before then, as judged by now. All times are in Unix nanoseconds. The caller and the trace ID are only recorded in the
+// audit log.
+func NewAllocCommand(namespace, resource, holder string, tokens, version int64, leaseID string, expiresAt int64, idempotencyKey string, now, resultExpiresAt int64, caller, traceID string) *AllocCommand {
 	return &AllocCommand{
-		Namespace: namespace,
-		Resource:  resource,
-		Tokens:    tokens,
-		Version:   version,
-		SMResult:  statemachine.Result{},
+		Namespace:       namespace,
+		Resource:        resource,
+		Holder:          holder,
+		Tokens:          tokens,
+		Version:         version,
+		LeaseID:         leaseID,
+		ExpiresAt:       expiresAt,
+		IdempotencyKey:  idempotencyKey,
+		Now:             now,
+		ResultExpiresAt: resultExpiresAt,
+		Caller:          caller,
+		TraceID:         traceID,
+		SMResult:        statemachine.Result{},
 	}
 }
 
@@ -38,8 +64,8 @@ func (c *AllocCommand) Type() CommandType {
 	return Alloc
 }
 
-func (c *AllocCommand) RaftInvoke(ctx context.Context, nh *dragonboat.NodeHost, _ uint64, session *client.Session) (any, error) {
-	result, err := syncWrite[AllocCommandResult](ctx, nh, session, c)
+func (c *AllocCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, session *client.Session) (any, error) {
+	result, err := syncWrite[AllocCommandResult](ctx, nh, shardID, session, c)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sync write: %w", err)
 	}
@@ -48,13 +74,19 @@ func (c *AllocCommand) RaftInvoke(ctx context.Context, nh *dragonboat.NodeHost,
 }
 
 func (c *AllocCommand) LocalInvoke(storage *storage, entryIdx uint64) error {
-	remainingTokens, currentVersion, ok, err := storage.alloc(c.Namespace, c.Resource, c.Tokens, c.Version, entryIdx)
+	e := newAuditEntry(audit.Alloc, c.Namespace, c.Resource, c.Caller, c.TraceID, c.Now, entryIdx)
+	e.Holder, e.Tokens, e.LeaseID = c.Holder, c.Tokens, c.LeaseID
+
+	remainingTokens, currentVersion, leaseID, ok, overSoftLimit, err := storage.alloc(&e, c.Namespace, c.Resource, c.Holder, c.Tokens, c.Version, c.LeaseID, c.ExpiresAt, c.IdempotencyKey, c.Now, c.ResultExpiresAt, entryIdx)
+	e.SetResult(ok, err)
+	storage.audit.Record(e)
+
 	var errStr string
 	if err != nil {
 		errStr = err.Error()
 	}
 
-	data := EncodeCommandResult(AllocCommandResult{RemainingTokens: remainingTokens, CurrentVersion: currentVersion, OK: ok, Err: errStr})
+	data := EncodeCommandResult(AllocCommandResult{RemainingTokens: remainingTokens, CurrentVersion: currentVersion, LeaseID: leaseID, OK: ok, OverSoftLimit: overSoftLimit, Err: errStr})
 	c.SMResult = statemachine.Result{
 		Value: 1,
 		Data:  data,
@@ -0,0 +1,59 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+// AppliedIndexCommand returns the index of the last raft log entry applied by the state machine. Since it is a
+// linearizable read, the local state machine has applied every entry committed before it once it returns.
+type AppliedIndexCommand struct {
+	SMResult statemachine.Result
+}
+
+type AppliedIndexCommandResult struct {
+	AppliedIndex uint64
+	Err          string
+}
+
+func NewAppliedIndexCommand() *AppliedIndexCommand {
+	return &AppliedIndexCommand{
+		SMResult: statemachine.Result{},
+	}
+}
+
+func (c *AppliedIndexCommand) Type() CommandType {
+	return AppliedIndex
+}
+
+func (c *AppliedIndexCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, _ *client.Session) (any, error) {
+	result, err := syncRead[AppliedIndexCommandResult](ctx, nh, shardID, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync read: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *AppliedIndexCommand) LocalInvoke(storage *storage, _ uint64) error {
+	appliedIndex, err := storage.lastAppliedIndex()
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(AppliedIndexCommandResult{AppliedIndex: appliedIndex, Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *AppliedIndexCommand) Result() statemachine.Result {
+	return c.SMResult
+}
@@ -0,0 +1,70 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/backup"
+)
+
+// BackupCommand returns a backup of a shard holding it as its only section. It lets a replica not hosting the shard
+// back it up through a peer.
+type BackupCommand struct {
+	ShardID  uint64
+	SMResult statemachine.Result
+}
+
+type BackupCommandResult struct {
+	Backup []byte
+	Err    string
+}
+
+func NewBackupCommand(shardID uint64) *BackupCommand {
+	return &BackupCommand{
+		ShardID:  shardID,
+		SMResult: statemachine.Result{},
+	}
+}
+
+func (c *BackupCommand) Type() CommandType {
+	return Backup
+}
+
+func (c *BackupCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, _ *client.Session) (any, error) {
+	result, err := syncRead[BackupCommandResult](ctx, nh, shardID, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync read: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *BackupCommand) LocalInvoke(storage *storage, _ uint64) error {
+	var buf bytes.Buffer
+	bw := backup.NewWriter(&buf)
+	err := storage.backup(bw, c.ShardID)
+	if err == nil {
+		err = bw.Flush()
+	}
+
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(BackupCommandResult{Backup: buf.Bytes(), Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *BackupCommand) Result() statemachine.Result {
+	return c.SMResult
+}
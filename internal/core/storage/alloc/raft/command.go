@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 
 	"github.com/lni/dragonboat/v4"
@@ -14,15 +15,36 @@ import (
 type CommandType byte
 
 const (
-	View          CommandType = 1
-	Alloc         CommandType = 2
-	Free          CommandType = 3
-	RegisterQuota CommandType = 4
+	View           CommandType = 1
+	Alloc          CommandType = 2
+	Free           CommandType = 3
+	RegisterQuota  CommandType = 4
+	UpdateQuota    CommandType = 5
+	DeleteQuota    CommandType = 6
+	ListQuotas     CommandType = 7
+	Renew          CommandType = 8
+	ExpireLeases   CommandType = 9
+	ViewHolders    CommandType = 10
+	AllocBatch     CommandType = 11
+	PrepareBatch   CommandType = 12
+	CommitBatch    CommandType = 13
+	AbortBatch     CommandType = 14
+	ExpiredBatches CommandType = 15
+	DuePeriods     CommandType = 16
+	ResetPeriods   CommandType = 17
+	RecordHistory  CommandType = 18
+	History        CommandType = 19
+	Restore        CommandType = 20
+	AppliedIndex   CommandType = 21
+	Export         CommandType = 22
+	Import         CommandType = 23
+	Backup         CommandType = 24
+	DueExpiries    CommandType = 25
 )
 
 type Command interface {
 	Type() CommandType
-	RaftInvoke(ctx context.Context, nh *dragonboat.NodeHost, shardID uint64, session *client.Session) (result any, err error)
+	RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, session *client.Session) (result any, err error)
 	LocalInvoke(storage *storage, entryIdx uint64) error
 	Result() statemachine.Result
 }
@@ -70,6 +92,153 @@ func DecodeCommand(data []byte) (Command, error) {
 			panic(fmt.Errorf("failed to decode free command: %w", err))
 		}
 
+		return cmd, nil
+	case UpdateQuota:
+		cmd := &UpdateQuotaCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode update quota command: %w", err))
+		}
+
+		return cmd, nil
+	case DeleteQuota:
+		cmd := &DeleteQuotaCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode delete quota command: %w", err))
+		}
+
+		return cmd, nil
+	case ListQuotas:
+		cmd := &ListQuotasCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode list quotas command: %w", err))
+		}
+
+		return cmd, nil
+	case Renew:
+		cmd := &RenewCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode renew command: %w", err))
+		}
+
+		return cmd, nil
+	case ExpireLeases:
+		cmd := &ExpireLeasesCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode expire leases command: %w", err))
+		}
+
+		return cmd, nil
+	case ViewHolders:
+		cmd := &ViewHoldersCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode view holders command: %w", err))
+		}
+
+		return cmd, nil
+	case AllocBatch:
+		cmd := &AllocBatchCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode alloc batch command: %w", err))
+		}
+
+		return cmd, nil
+	case PrepareBatch:
+		cmd := &PrepareBatchCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode prepare batch command: %w", err))
+		}
+
+		return cmd, nil
+	case CommitBatch:
+		cmd := &CommitBatchCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode commit batch command: %w", err))
+		}
+
+		return cmd, nil
+	case AbortBatch:
+		cmd := &AbortBatchCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode abort batch command: %w", err))
+		}
+
+		return cmd, nil
+	case ExpiredBatches:
+		cmd := &ExpiredBatchesCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode expired batches command: %w", err))
+		}
+
+		return cmd, nil
+	case DuePeriods:
+		cmd := &DuePeriodsCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode due periods command: %w", err))
+		}
+
+		return cmd, nil
+	case ResetPeriods:
+		cmd := &ResetPeriodsCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode reset periods command: %w", err))
+		}
+
+		return cmd, nil
+	case RecordHistory:
+		cmd := &RecordHistoryCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode record history command: %w", err))
+		}
+
+		return cmd, nil
+	case History:
+		cmd := &HistoryCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode history command: %w", err))
+		}
+
+		return cmd, nil
+	case Restore:
+		cmd := &RestoreCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode restore command: %w", err))
+		}
+
+		return cmd, nil
+	case AppliedIndex:
+		cmd := &AppliedIndexCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode applied index command: %w", err))
+		}
+
+		return cmd, nil
+	case Export:
+		cmd := &ExportCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode export command: %w", err))
+		}
+
+		return cmd, nil
+	case Import:
+		cmd := &ImportCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode import command: %w", err))
+		}
+
+		return cmd, nil
+	case Backup:
+		cmd := &BackupCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode backup command: %w", err))
+		}
+
+		return cmd, nil
+	case DueExpiries:
+		cmd := &DueExpiriesCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode due expiries command: %w", err))
+		}
+
 		return cmd, nil
 	default:
 		return nil, fmt.Errorf("unknown command: type=%b", CommandType(data[0]))
@@ -85,18 +254,31 @@ func EncodeCommandResult(v any) []byte {
 	return buf.Bytes()
 }
 
+// DecodeCommandResult decodes the result of a command applied by the state machine, which panics if it is malformed.
 func DecodeCommandResult[T any](data []byte) T {
-	var result T
-	buf := bytes.NewBuffer(data)
-	if err := gob.NewDecoder(buf).Decode(&result); err != nil {
+	result, err := decodeCommandResult[T](data)
+	if err != nil {
 		panic(fmt.Errorf("failed to encode command SMResult: %w", err))
 	}
 
 	return result
 }
 
+func decodeCommandResult[T any](data []byte) (T, error) {
+	var result T
+	err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&result)
+
+	return result, err
+}
+
 // TODO: Implement optimistic concurrency control (versioning)
-func syncWrite[T any](ctx context.Context, nh *dragonboat.NodeHost, session *client.Session, cmd Command) (T, error) {
+// syncWrite proposes a command to a shard and waits until it is applied. Sessions are only created for the shards
+// hosted by the node host, so without one the command is forwarded to a peer hosting the shard.
+func syncWrite[T any](ctx context.Context, nh *NodeHost, shardID uint64, session *client.Session, cmd Command) (T, error) {
+	if session == nil {
+		return forward[T](ctx, nh, shardID, cmd)
+	}
+
 	result, err := nh.SyncPropose(ctx, session, EncodeCommand(cmd))
 	if err != nil {
 		var zero T
@@ -106,8 +288,19 @@ func syncWrite[T any](ctx context.Context, nh *dragonboat.NodeHost, session *cli
 	return DecodeCommandResult[T](result.Data), nil
 }
 
-func syncRead[T any](ctx context.Context, nh *dragonboat.NodeHost, shardID uint64, cmd Command) (T, error) {
+// syncRead reads the state of a shard linearizably, forwarding the command to a peer if the shard is not hosted by the
+// node host.
+func syncRead[T any](ctx context.Context, nh *NodeHost, shardID uint64, cmd Command) (T, error) {
+	if !nh.HostsShard(shardID) {
+		return forward[T](ctx, nh, shardID, cmd)
+	}
+
 	result, err := nh.SyncRead(ctx, shardID, EncodeCommand(cmd))
+	if errors.Is(err, dragonboat.ErrShardNotFound) {
+		var zero T
+		return zero, fmt.Errorf("failed to sync read shardID=%d: %w", shardID, ErrShardNotHosted)
+	}
+
 	if err != nil {
 		var zero T
 		return zero, fmt.Errorf("failed to sync read: %w", err)
@@ -115,3 +308,21 @@ func syncRead[T any](ctx context.Context, nh *dragonboat.NodeHost, shardID uint6
 
 	return DecodeCommandResult[T](result.([]byte)), nil
 }
+
+// forward invokes a command on a peer hosting the shard. Unlike the results of the raft log, the response of a peer may
+// hold anything, so a result failing to decode is reported instead of panicking.
+func forward[T any](ctx context.Context, nh *NodeHost, shardID uint64, cmd Command) (T, error) {
+	data, err := nh.forward(ctx, shardID, EncodeCommand(cmd))
+	if err != nil {
+		var zero T
+		return zero, fmt.Errorf("failed to forward: %w", err)
+	}
+
+	result, err := decodeCommandResult[T](data)
+	if err != nil {
+		var zero T
+		return zero, fmt.Errorf("failed to decode forwarded command result: %w", err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,66 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+type CommitBatchCommand struct {
+	BatchID           string
+	Coordinator       bool
+	DecisionExpiresAt int64
+	SMResult          statemachine.Result
+}
+
+type CommitBatchCommandResult struct {
+	Committed bool
+	Err       string
+}
+
+// NewCommitBatchCommand returns a command committing a prepared cross-shard batch. Proposed to the coordinator shard,
+// it records the decision to commit until decisionExpiresAt, given in Unix nanoseconds, and fails to commit if the
+// batch has already been aborted.
+func NewCommitBatchCommand(batchID string, coordinator bool, decisionExpiresAt int64) *CommitBatchCommand {
+	return &CommitBatchCommand{
+		BatchID:           batchID,
+		Coordinator:       coordinator,
+		DecisionExpiresAt: decisionExpiresAt,
+		SMResult:          statemachine.Result{},
+	}
+}
+
+func (c *CommitBatchCommand) Type() CommandType {
+	return CommitBatch
+}
+
+func (c *CommitBatchCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, session *client.Session) (any, error) {
+	result, err := syncWrite[CommitBatchCommandResult](ctx, nh, shardID, session, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync write: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *CommitBatchCommand) LocalInvoke(storage *storage, entryIdx uint64) error {
+	committed, err := storage.commitBatch(c.BatchID, c.Coordinator, c.DecisionExpiresAt, entryIdx)
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(CommitBatchCommandResult{Committed: committed, Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *CommitBatchCommand) Result() statemachine.Result {
+	return c.SMResult
+}
@@ -2,20 +2,24 @@ package raft
 
 import (
 	"flag"
+	"time"
 
 	"github.com/Blinkuu/qms/pkg/strutil"
 )
 
 type Config struct {
-	BindAddress             string `yaml:"bind_address"`
-	BindPort                int    `yaml:"bind_port"`
-	BindAddressFromHostname bool   `yaml:"bind_address_from_hostname"`
-	DeploymentID            uint64 `yaml:"deployment_id"`
-	ReplicaID               uint64 `yaml:"replica_id"`
-	ReplicaIDOverride       string `yaml:"replica_id_override"`
-	ShardID                 uint64 `yaml:"shard_id"`
-	Shards                  uint64 `yaml:"shards"`
-	Dir                     string `yaml:"dir"`
+	BindAddress             string        `yaml:"bind_address"`
+	BindPort                int           `yaml:"bind_port"`
+	BindAddressFromHostname bool          `yaml:"bind_address_from_hostname"`
+	DeploymentID            uint64        `yaml:"deployment_id"`
+	ReplicaID               uint64        `yaml:"replica_id"`
+	ReplicaIDOverride       string        `yaml:"replica_id_override"`
+	ShardID                 uint64        `yaml:"shard_id"`
+	Shards                  uint64        `yaml:"shards"`
+	ReplicationFactor       uint64        `yaml:"replication_factor"`
+	Dir                     string        `yaml:"dir"`
+	HistoryResolution       time.Duration `yaml:"history_resolution"`
+	HistoryRetention        time.Duration `yaml:"history_retention"`
 }
 
 func (c *Config) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix string) {
@@ -27,5 +31,8 @@ func (c *Config) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix string) {
 	f.StringVar(&c.ReplicaIDOverride, strutil.WithPrefixOrDefault(prefix, "replica_id_override"), "", "")
 	f.Uint64Var(&c.ShardID, strutil.WithPrefixOrDefault(prefix, "shard_id"), 1, "")
 	f.Uint64Var(&c.Shards, strutil.WithPrefixOrDefault(prefix, "shards"), 1, "")
+	f.Uint64Var(&c.ReplicationFactor, strutil.WithPrefixOrDefault(prefix, "replication_factor"), 0, "")
 	f.StringVar(&c.Dir, strutil.WithPrefixOrDefault(prefix, "dir"), "/tmp/qms/data/raft", "")
+	f.DurationVar(&c.HistoryResolution, strutil.WithPrefixOrDefault(prefix, "history_resolution"), time.Minute, "")
+	f.DurationVar(&c.HistoryRetention, strutil.WithPrefixOrDefault(prefix, "history_retention"), 7*24*time.Hour, "")
 }
@@ -0,0 +1,74 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/audit"
+)
+
+type DeleteQuotaCommand struct {
+	Namespace string
+	Resource  string
+	Now       int64
+	Caller    string
+	TraceID   string
+	SMResult  statemachine.Result
+}
+
+type DeleteQuotaCommandResult struct {
+	Err string
+}
+
+// NewDeleteQuotaCommand returns a command deleting a quota. Now, given in Unix nanoseconds, the caller and the trace ID
+// are only recorded in the audit log.
+func NewDeleteQuotaCommand(namespace, resource string, now int64, caller, traceID string) *DeleteQuotaCommand {
+	return &DeleteQuotaCommand{
+		Namespace: namespace,
+		Resource:  resource,
+		Now:       now,
+		Caller:    caller,
+		TraceID:   traceID,
+		SMResult:  statemachine.Result{},
+	}
+}
+
+func (c *DeleteQuotaCommand) Type() CommandType {
+	return DeleteQuota
+}
+
+func (c *DeleteQuotaCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, session *client.Session) (any, error) {
+	result, err := syncWrite[DeleteQuotaCommandResult](ctx, nh, shardID, session, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync write: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *DeleteQuotaCommand) LocalInvoke(storage *storage, entryIdx uint64) error {
+	e := newAuditEntry(audit.DeleteQuota, c.Namespace, c.Resource, c.Caller, c.TraceID, c.Now, entryIdx)
+	err := storage.deleteQuota(&e, c.Namespace, c.Resource, entryIdx)
+	e.SetResult(true, err)
+	storage.audit.Record(e)
+
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(DeleteQuotaCommandResult{Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *DeleteQuotaCommand) Result() statemachine.Result {
+	return c.SMResult
+}
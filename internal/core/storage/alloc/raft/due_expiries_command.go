@@ -0,0 +1,61 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+type DueExpiriesCommand struct {
+	Now      int64
+	SMResult statemachine.Result
+}
+
+type DueExpiriesCommandResult struct {
+	Due int
+	Err string
+}
+
+// NewDueExpiriesCommand returns a command counting the leases, results of idempotency keys and batch decisions that
+// expired at now, given in Unix nanoseconds. It is read before an ExpireLeasesCommand is proposed.
+func NewDueExpiriesCommand(now int64) *DueExpiriesCommand {
+	return &DueExpiriesCommand{
+		Now:      now,
+		SMResult: statemachine.Result{},
+	}
+}
+
+func (c *DueExpiriesCommand) Type() CommandType {
+	return DueExpiries
+}
+
+func (c *DueExpiriesCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, _ *client.Session) (any, error) {
+	result, err := syncRead[DueExpiriesCommandResult](ctx, nh, shardID, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync read: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *DueExpiriesCommand) LocalInvoke(storage *storage, _ uint64) error {
+	due, err := storage.dueExpiries(c.Now)
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(DueExpiriesCommandResult{Due: due, Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *DueExpiriesCommand) Result() statemachine.Result {
+	return c.SMResult
+}
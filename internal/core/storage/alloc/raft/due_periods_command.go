@@ -0,0 +1,61 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+type DuePeriodsCommand struct {
+	Now      int64
+	SMResult statemachine.Result
+}
+
+type DuePeriodsCommandResult struct {
+	Due int
+	Err string
+}
+
+// NewDuePeriodsCommand returns a command counting the periodic quotas whose period has ended by now, given in Unix
+// nanoseconds.
+func NewDuePeriodsCommand(now int64) *DuePeriodsCommand {
+	return &DuePeriodsCommand{
+		Now:      now,
+		SMResult: statemachine.Result{},
+	}
+}
+
+func (c *DuePeriodsCommand) Type() CommandType {
+	return DuePeriods
+}
+
+func (c *DuePeriodsCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, _ *client.Session) (any, error) {
+	result, err := syncRead[DuePeriodsCommandResult](ctx, nh, shardID, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync read: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *DuePeriodsCommand) LocalInvoke(storage *storage, _ uint64) error {
+	due, err := storage.duePeriods(c.Now)
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(DuePeriodsCommandResult{Due: due, Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *DuePeriodsCommand) Result() statemachine.Result {
+	return c.SMResult
+}
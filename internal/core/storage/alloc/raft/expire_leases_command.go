@@ -0,0 +1,60 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+type ExpireLeasesCommand struct {
+	Now      int64
+	SMResult statemachine.Result
+}
+
+type ExpireLeasesCommandResult struct {
+	Expired int
+	Err     string
+}
+
+// NewExpireLeasesCommand returns a command freeing the tokens of all leases expired at now, given in Unix nanoseconds.
+func NewExpireLeasesCommand(now int64) *ExpireLeasesCommand {
+	return &ExpireLeasesCommand{
+		Now:      now,
+		SMResult: statemachine.Result{},
+	}
+}
+
+func (c *ExpireLeasesCommand) Type() CommandType {
+	return ExpireLeases
+}
+
+func (c *ExpireLeasesCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, session *client.Session) (any, error) {
+	result, err := syncWrite[ExpireLeasesCommandResult](ctx, nh, shardID, session, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync write: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *ExpireLeasesCommand) LocalInvoke(storage *storage, entryIdx uint64) error {
+	expired, err := storage.expireLeases(c.Now, entryIdx)
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(ExpireLeasesCommandResult{Expired: expired, Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *ExpireLeasesCommand) Result() statemachine.Result {
+	return c.SMResult
+}
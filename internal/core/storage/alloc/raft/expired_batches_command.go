@@ -0,0 +1,67 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+type ExpiredBatchesCommand struct {
+	Now      int64
+	SMResult statemachine.Result
+}
+
+type ExpiredBatchesCommandResult struct {
+	// Coordinators maps the IDs of the expired batches to their coordinator shards.
+	Coordinators map[string]uint64
+	Err          string
+}
+
+// NewExpiredBatchesCommand returns a command listing the prepared cross-shard batches not resolved by now, given in
+// Unix nanoseconds.
+func NewExpiredBatchesCommand(now int64) *ExpiredBatchesCommand {
+	return &ExpiredBatchesCommand{
+		Now:      now,
+		SMResult: statemachine.Result{},
+	}
+}
+
+func (c *ExpiredBatchesCommand) Type() CommandType {
+	return ExpiredBatches
+}
+
+func (c *ExpiredBatchesCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, _ *client.Session) (any, error) {
+	result, err := syncRead[ExpiredBatchesCommandResult](ctx, nh, shardID, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync read: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *ExpiredBatchesCommand) LocalInvoke(storage *storage, _ uint64) error {
+	batches, err := storage.expiredBatches(c.Now)
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	coordinators := make(map[string]uint64, len(batches))
+	for batchID, pb := range batches {
+		coordinators[batchID] = pb.Coordinator
+	}
+
+	data := EncodeCommandResult(ExpiredBatchesCommandResult{Coordinators: coordinators, Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *ExpiredBatchesCommand) Result() statemachine.Result {
+	return c.SMResult
+}
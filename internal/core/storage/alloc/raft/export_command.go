@@ -0,0 +1,59 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/export"
+)
+
+type ExportCommand struct {
+	SMResult statemachine.Result
+}
+
+type ExportCommandResult struct {
+	Items []export.Item
+	Err   string
+}
+
+func NewExportCommand() *ExportCommand {
+	return &ExportCommand{
+		SMResult: statemachine.Result{},
+	}
+}
+
+func (c *ExportCommand) Type() CommandType {
+	return Export
+}
+
+func (c *ExportCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, _ *client.Session) (any, error) {
+	result, err := syncRead[ExportCommandResult](ctx, nh, shardID, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync read: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *ExportCommand) LocalInvoke(storage *storage, _ uint64) error {
+	items, err := storage.exportQuotas()
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(ExportCommandResult{Items: items, Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *ExportCommand) Result() statemachine.Result {
+	return c.SMResult
+}
@@ -4,17 +4,28 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/lni/dragonboat/v4"
 	"github.com/lni/dragonboat/v4/client"
 	"github.com/lni/dragonboat/v4/statemachine"
+
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/audit"
 )
 
 type FreeCommand struct {
 	Namespace string
 	Resource  string
+	Holder    string
 	Tokens    int64
 	Version   int64
-	SMResult  statemachine.Result
+	LeaseID   string
+
+	IdempotencyKey  string
+	Now             int64
+	ResultExpiresAt int64
+
+	Caller  string
+	TraceID string
+
+	SMResult statemachine.Result
 }
 
 type FreeCommandResult struct {
@@ -24,13 +35,22 @@ type FreeCommandResult struct {
 	Err             string
 }
 
-func NewFreeCommand(namespace, resource string, tokens, version int64) *FreeCommand {
+// NewFreeCommand returns a command freeing tokens. Idempotency keys, the caller and the trace ID work as in
+// NewAllocCommand.
+func NewFreeCommand(namespace, resource, holder string, tokens, version int64, leaseID, idempotencyKey string, now, resultExpiresAt int64, caller, traceID string) *FreeCommand {
 	return &FreeCommand{
-		Namespace: namespace,
-		Resource:  resource,
-		Tokens:    tokens,
-		Version:   version,
-		SMResult:  statemachine.Result{},
+		Namespace:       namespace,
+		Resource:        resource,
+		Holder:          holder,
+		Tokens:          tokens,
+		Version:         version,
+		LeaseID:         leaseID,
+		IdempotencyKey:  idempotencyKey,
+		Now:             now,
+		ResultExpiresAt: resultExpiresAt,
+		Caller:          caller,
+		TraceID:         traceID,
+		SMResult:        statemachine.Result{},
 	}
 }
 
@@ -38,8 +58,8 @@ func (c *FreeCommand) Type() CommandType {
 	return Free
 }
 
-func (c *FreeCommand) RaftInvoke(ctx context.Context, nh *dragonboat.NodeHost, _ uint64, session *client.Session) (any, error) {
-	result, err := syncWrite[FreeCommandResult](ctx, nh, session, c)
+func (c *FreeCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, session *client.Session) (any, error) {
+	result, err := syncWrite[FreeCommandResult](ctx, nh, shardID, session, c)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sync write: %w", err)
 	}
@@ -48,7 +68,13 @@ func (c *FreeCommand) RaftInvoke(ctx context.Context, nh *dragonboat.NodeHost, _
 }
 
 func (c *FreeCommand) LocalInvoke(storage *storage, entryIdx uint64) error {
-	remainingTokens, currentVersion, ok, err := storage.free(c.Namespace, c.Resource, c.Tokens, c.Version, entryIdx)
+	e := newAuditEntry(audit.Free, c.Namespace, c.Resource, c.Caller, c.TraceID, c.Now, entryIdx)
+	e.Holder, e.Tokens, e.LeaseID = c.Holder, c.Tokens, c.LeaseID
+
+	remainingTokens, currentVersion, ok, err := storage.free(&e, c.Namespace, c.Resource, c.Holder, c.Tokens, c.Version, c.LeaseID, c.IdempotencyKey, c.Now, c.ResultExpiresAt, entryIdx)
+	e.SetResult(ok, err)
+	storage.audit.Record(e)
+
 	var errStr string
 	if err != nil {
 		errStr = err.Error()
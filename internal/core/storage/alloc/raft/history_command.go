@@ -0,0 +1,69 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/history"
+)
+
+type HistoryCommand struct {
+	Namespace string
+	Resource  string
+	From      int64
+	To        int64
+	SMResult  statemachine.Result
+}
+
+type HistoryCommandResult struct {
+	Samples []history.Sample
+	Err     string
+}
+
+// NewHistoryCommand returns a command reading the windows of the history of a quota starting between from and to,
+// given in Unix nanoseconds.
+func NewHistoryCommand(namespace, resource string, from, to int64) *HistoryCommand {
+	return &HistoryCommand{
+		Namespace: namespace,
+		Resource:  resource,
+		From:      from,
+		To:        to,
+		SMResult:  statemachine.Result{},
+	}
+}
+
+func (c *HistoryCommand) Type() CommandType {
+	return History
+}
+
+func (c *HistoryCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, _ *client.Session) (any, error) {
+	result, err := syncRead[HistoryCommandResult](ctx, nh, shardID, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync read: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *HistoryCommand) LocalInvoke(storage *storage, _ uint64) error {
+	samples, err := storage.history(c.Namespace, c.Resource, c.From, c.To)
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(HistoryCommandResult{Samples: samples, Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *HistoryCommand) Result() statemachine.Result {
+	return c.SMResult
+}
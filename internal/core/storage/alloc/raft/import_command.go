@@ -0,0 +1,69 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/export"
+)
+
+// ImportCommand writes the state of exported quotas of a shard. Now, given in Unix nanoseconds, starts the current
+// period of periodic quotas. The caller and the trace ID are only recorded in the audit log.
+type ImportCommand struct {
+	Items   []export.Item
+	Now     int64
+	Caller  string
+	TraceID string
+
+	SMResult statemachine.Result
+}
+
+type ImportCommandResult struct {
+	Err string
+}
+
+func NewImportCommand(items []export.Item, now int64, caller, traceID string) *ImportCommand {
+	return &ImportCommand{
+		Items:    items,
+		Now:      now,
+		Caller:   caller,
+		TraceID:  traceID,
+		SMResult: statemachine.Result{},
+	}
+}
+
+func (c *ImportCommand) Type() CommandType {
+	return Import
+}
+
+func (c *ImportCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, session *client.Session) (any, error) {
+	result, err := syncWrite[ImportCommandResult](ctx, nh, shardID, session, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync write: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *ImportCommand) LocalInvoke(storage *storage, entryIdx uint64) error {
+	err := storage.importQuotas(c.Items, c.Caller, c.TraceID, c.Now, entryIdx)
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(ImportCommandResult{Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *ImportCommand) Result() statemachine.Result {
+	return c.SMResult
+}
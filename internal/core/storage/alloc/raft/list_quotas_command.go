@@ -0,0 +1,59 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+)
+
+type ListQuotasCommand struct {
+	SMResult statemachine.Result
+}
+
+type ListQuotasCommandResult struct {
+	Quotas []quota.Quota
+	Err    string
+}
+
+func NewListQuotasCommand() *ListQuotasCommand {
+	return &ListQuotasCommand{
+		SMResult: statemachine.Result{},
+	}
+}
+
+func (c *ListQuotasCommand) Type() CommandType {
+	return ListQuotas
+}
+
+func (c *ListQuotasCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, _ *client.Session) (any, error) {
+	result, err := syncRead[ListQuotasCommandResult](ctx, nh, shardID, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync read: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *ListQuotasCommand) LocalInvoke(storage *storage, _ uint64) error {
+	quotas, err := storage.listQuotas()
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(ListQuotasCommandResult{Quotas: quotas, Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *ListQuotasCommand) Result() statemachine.Result {
+	return c.SMResult
+}
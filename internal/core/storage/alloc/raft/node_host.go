@@ -0,0 +1,463 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lni/dragonboat/v4"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+
+	"github.com/Blinkuu/qms/internal/core/ports"
+	"github.com/Blinkuu/qms/pkg/dto"
+	"github.com/Blinkuu/qms/pkg/log"
+)
+
+// ErrShardNotHosted is returned for commands of a shard that is not placed on the replica of the node host.
+var ErrShardNotHosted = errors.New("shard is not hosted by this replica")
+
+// NodeHost is a dragonboat node host that either joined the raft cluster of its memberlist peers or bootstrapped a new
+// one. It is shared by the storages replicated with raft, which start their own state machines on it. Only the shards
+// placed on its replica by ReplicaShardIDs are hosted by it, and the commands of the other shards are forwarded to the
+// peers hosting them.
+type NodeHost struct {
+	*dragonboat.NodeHost
+	cfg          Config
+	logger       log.Logger
+	memberlist   ports.MemberlistService
+	cli          *http.Client
+	path         string
+	raftAddr     string
+	bootstrapped map[uint64]bool
+	joined       map[uint64]bool
+	dataDir      string
+}
+
+// NewNodeHost creates a node host for the replica described by cfg. Peers serve the raft endpoints under path on their
+// HTTP server: they are asked to add the replica to the shards placed on it through path/join, to remove a replica
+// through path/exit, and to invoke the commands of the shards they host through path/invoke. A shard no peer hosts is
+// bootstrapped by its seed replica, the one with the lowest ID it is placed on.
+func NewNodeHost(cfg Config, logger log.Logger, memberlist ports.MemberlistService, path string) (*NodeHost, error) {
+	if cfg.ReplicaIDOverride != "" {
+		replicaID, err := strconv.ParseUint(trimBeforeSubstr(cfg.ReplicaIDOverride, "-"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse replica_id_override: %w", err)
+		}
+
+		cfg.ReplicaID = replicaID + 1
+	}
+
+	if cfg.BindAddressFromHostname {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get hostname: %w", err)
+		}
+
+		cfg.BindAddress = fmt.Sprintf("%s.%s.default.svc.cluster.local", hostname, trimAfterSubstr(hostname, "-"))
+	}
+
+	raftAddr := net.JoinHostPort(cfg.BindAddress, strconv.Itoa(cfg.BindPort))
+	shardIDs := ReplicaShardIDs(cfg.ReplicaID, cfg.Shards, cfg.ReplicationFactor)
+	added, members, err := join(context.Background(), logger, memberlist, path+"/join", cfg.ReplicaID, raftAddr, shardIDs)
+
+	joined := make(map[uint64]bool, len(added))
+	covered := make(map[uint64]bool, len(added)+len(members))
+	for _, shardID := range added {
+		joined[shardID] = true
+		covered[shardID] = true
+	}
+
+	for _, shardID := range members {
+		covered[shardID] = true
+	}
+
+	bootstrapped := make(map[uint64]bool)
+	for _, shardID := range shardIDs {
+		if covered[shardID] {
+			continue
+		}
+
+		if seedReplicaID(shardID, cfg.Shards, cfg.ReplicationFactor) != cfg.ReplicaID {
+			if raftAndDataDirsExist(cfg.Dir, cfg.ReplicaID) {
+				continue
+			}
+
+			return nil, fmt.Errorf("failed to join raft cluster for shardID=%d: %w", shardID, err)
+		}
+
+		logger.Info("bootstrapping new raft shard", "replicaID", cfg.ReplicaID, "shardID", shardID)
+		bootstrapped[shardID] = true
+	}
+
+	// raftDir: dir/raft_node_nodeId
+	// dataDir: dir/data_node_nodeId
+	raftDir, dataDir, err := createRaftAndDataDirs(cfg.Dir, cfg.ReplicaID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create raft and data dirs: %w", err)
+	}
+
+	nodeHostCfg := newNodeHostConfig(cfg.DeploymentID, raftDir, raftAddr)
+	nh, err := dragonboat.NewNodeHost(nodeHostCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new node host: %w", err)
+	}
+
+	return &NodeHost{
+		NodeHost:     nh,
+		cfg:          cfg,
+		logger:       logger,
+		memberlist:   memberlist,
+		cli:          &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)},
+		path:         path,
+		raftAddr:     raftAddr,
+		bootstrapped: bootstrapped,
+		joined:       joined,
+		dataDir:      dataDir,
+	}, nil
+}
+
+// Config returns the configuration with the replica ID and bind address resolved.
+func (h *NodeHost) Config() Config {
+	return h.cfg
+}
+
+// InitialMembers returns the initial members of a shard started on the node host, or nil unless the node host
+// bootstrapped the shard.
+func (h *NodeHost) InitialMembers(shardID uint64) map[uint64]string {
+	if !h.bootstrapped[shardID] {
+		return nil
+	}
+
+	return map[uint64]string{h.cfg.ReplicaID: h.raftAddr}
+}
+
+// Joined returns true if the replica was added to an existing shard and has not been part of it before.
+func (h *NodeHost) Joined(shardID uint64) bool {
+	return h.joined[shardID]
+}
+
+// DataDir returns the directory in which state machines keep their data.
+func (h *NodeHost) DataDir() string {
+	return h.dataDir
+}
+
+// ShardIDs returns the IDs of all shards of the cluster.
+func (h *NodeHost) ShardIDs() []uint64 {
+	shardIDs := make([]uint64, 0, h.cfg.Shards)
+	for shardID := uint64(1); shardID <= h.cfg.Shards; shardID++ {
+		shardIDs = append(shardIDs, shardID)
+	}
+
+	return shardIDs
+}
+
+// LocalShardIDs returns the IDs of the shards hosted by the node host.
+func (h *NodeHost) LocalShardIDs() []uint64 {
+	return ReplicaShardIDs(h.cfg.ReplicaID, h.cfg.Shards, h.cfg.ReplicationFactor)
+}
+
+// HostsShard returns true if the node host hosts a replica of the shard.
+func (h *NodeHost) HostsShard(shardID uint64) bool {
+	return hostsShard(h.cfg.ReplicaID, shardID, h.cfg.Shards, h.cfg.ReplicationFactor)
+}
+
+// ShardIDFromString returns the ID of the shard that owns a key.
+func (h *NodeHost) ShardIDFromString(key string) uint64 {
+	return ShardIDFromString(key, h.cfg.Shards)
+}
+
+// AddReplica adds a replica to the shards placed on it that the node host hosts. It returns the shards the replica was
+// added to and those it was already a member of.
+func (h *NodeHost) AddReplica(ctx context.Context, replicaID uint64, raftAddr string) ([]uint64, []uint64, error) {
+	var added, members []uint64
+	for _, shardID := range ReplicaShardIDs(replicaID, h.cfg.Shards, h.cfg.ReplicationFactor) {
+		if !h.HostsShard(shardID) {
+			continue
+		}
+
+		ms, err := h.SyncGetShardMembership(ctx, shardID)
+		if err != nil {
+			h.logger.Info("failed to get shard membership", "raftAddr", raftAddr, "replicaID", replicaID, "shardID", shardID, "err", err)
+			return added, members, fmt.Errorf("failed to get shard membership for replicaID=%d and shardID=%d: %w", replicaID, shardID, err)
+		}
+
+		if addr, found := ms.Nodes[replicaID]; found && addr == raftAddr {
+			h.logger.Info("replica is already part of the raft shard", "replicaID", replicaID, "raftAddr", raftAddr, "shardID", shardID)
+			members = append(members, shardID)
+			continue
+		}
+
+		err = h.SyncRequestAddReplica(ctx, shardID, replicaID, raftAddr, ms.ConfigChangeID)
+		if err != nil {
+			h.logger.Info("failed to request add replica", "raftAddr", raftAddr, "replicaID", replicaID, "shardID", shardID, "err", err)
+			return added, members, fmt.Errorf("failed to request add replica for replicaID=%d and shardID=%d: %w", replicaID, shardID, err)
+		}
+
+		added = append(added, shardID)
+	}
+
+	return added, members, nil
+}
+
+// RemoveReplica removes a replica from the shards placed on it. The shards hosted by the node host are changed here, and
+// the others are left to the peers hosting them. With shardIDs the replica is only removed from those, all of which
+// have to be hosted by the node host, so that peers do not pass the request on again.
+func (h *NodeHost) RemoveReplica(ctx context.Context, replicaID uint64, shardIDs []uint64) error {
+	local := len(shardIDs) > 0
+	if !local {
+		shardIDs = ReplicaShardIDs(replicaID, h.cfg.Shards, h.cfg.ReplicationFactor)
+	}
+
+	var remaining []uint64
+	for _, shardID := range shardIDs {
+		if !h.HostsShard(shardID) {
+			if local {
+				return fmt.Errorf("failed to remove replicaID=%d from shardID=%d: %w", replicaID, shardID, ErrShardNotHosted)
+			}
+
+			remaining = append(remaining, shardID)
+			continue
+		}
+
+		ms, err := h.SyncGetShardMembership(ctx, shardID)
+		if err != nil {
+			return fmt.Errorf("failed to get shard membership for replicaID=%d and shardID=%d: %w", replicaID, shardID, err)
+		}
+
+		if _, found := ms.Nodes[replicaID]; !found {
+			h.logger.Info("replica is not part of the raft shard", "replicaID", replicaID, "shardID", shardID)
+			continue
+		}
+
+		err = h.SyncRequestDeleteReplica(ctx, shardID, replicaID, ms.ConfigChangeID)
+		if err != nil {
+			return fmt.Errorf("failed to request delete replica for replicaID=%d and shardID=%d: %w", replicaID, shardID, err)
+		}
+	}
+
+	if len(remaining) == 0 {
+		return nil
+	}
+
+	return h.exit(ctx, replicaID, remaining)
+}
+
+// exit asks the peers hosting the shards to remove a replica from them.
+func (h *NodeHost) exit(ctx context.Context, replicaID uint64, shardIDs []uint64) error {
+	members, err := h.memberlist.Members(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get members: %w", err)
+	}
+
+	remaining := shardIDs
+	for _, member := range members {
+		var hosted, rest []uint64
+		for _, shardID := range remaining {
+			if member.Meta.HostsShard(shardID) {
+				hosted = append(hosted, shardID)
+			} else {
+				rest = append(rest, shardID)
+			}
+		}
+
+		if len(hosted) == 0 {
+			continue
+		}
+
+		body, err := json.Marshal(dto.ExitRequestBody{ReplicaID: replicaID, ShardIDs: hosted})
+		if err != nil {
+			return fmt.Errorf("failed to encode exit request body: %w", err)
+		}
+
+		addr := net.JoinHostPort(member.Host, strconv.Itoa(member.HTTPPort))
+		if _, err := h.post(ctx, addr, "/exit", body); err != nil {
+			h.logger.Warn("failed to remove replica through peer", "addr", addr, "replicaID", replicaID, "shardIDs", hosted, "err", err)
+			continue
+		}
+
+		remaining = rest
+		if len(remaining) == 0 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("failed to remove replicaID=%d from shardIDs=%v: no peer hosting them removed it", replicaID, remaining)
+}
+
+// forward invokes an encoded command of a shard not hosted by the node host on a peer hosting it, and returns the
+// encoded result. The peers are tried in a random order until one of them answers.
+func (h *NodeHost) forward(ctx context.Context, shardID uint64, cmd []byte) ([]byte, error) {
+	members, err := h.memberlist.Members(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get members: %w", err)
+	}
+
+	var addrs []string
+	for _, member := range members {
+		if member.Meta.HostsShard(shardID) {
+			addrs = append(addrs, net.JoinHostPort(member.Host, strconv.Itoa(member.HTTPPort)))
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no peer hosts shardID=%d: %w", shardID, ErrShardNotHosted)
+	}
+
+	rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+
+	for _, addr := range addrs {
+		result, err := h.post(ctx, addr, "/invoke?shard_id="+strconv.FormatUint(shardID, 10), cmd)
+		if errors.Is(err, errPeerUnavailable) {
+			h.logger.Warn("failed to forward command to peer", "addr", addr, "shardID", shardID, "err", err)
+			continue
+		}
+
+		return result, err
+	}
+
+	return nil, fmt.Errorf("failed to forward command of shardID=%d: %w", shardID, errPeerUnavailable)
+}
+
+// errPeerUnavailable is returned by post if the peer could not be reached, in which case another peer can be tried.
+var errPeerUnavailable = errors.New("peer is unavailable")
+
+// post sends a request to a raft endpoint of a peer, and returns the body of its response.
+func (h *NodeHost) post(ctx context.Context, addr, endpoint string, body []byte) ([]byte, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://%s%s%s", addr, h.path, endpoint), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new request with context: %w", err)
+	}
+
+	res, err := h.cli.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, errPeerUnavailable)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer %s responded with status %d: %s", addr, res.StatusCode, strings.TrimSpace(string(resBody)))
+	}
+
+	return resBody, nil
+}
+
+func (h *NodeHost) AwaitHealthy(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if h.AllShardsHealthy() {
+			return nil
+		}
+	}
+}
+
+func (h *NodeHost) AllShardsHealthy() bool {
+	for _, shardID := range h.LocalShardIDs() {
+		if !h.ShardHealthy(shardID) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (h *NodeHost) ShardHealthy(shardID uint64) bool {
+	_, _, valid, err := h.GetLeaderID(shardID)
+	if err != nil {
+		return false
+	}
+
+	return valid
+}
+
+// IsShardLeader returns true if the replica of this node host leads the shard.
+func (h *NodeHost) IsShardLeader(shardID uint64) bool {
+	leaderID, _, valid, err := h.GetLeaderID(shardID)
+	if err != nil {
+		return false
+	}
+
+	if !valid {
+		return false
+	}
+
+	if leaderID != h.cfg.ReplicaID {
+		return false
+	}
+
+	return true
+}
+
+// Shutdown stops the replicas of all shards hosted by the node host, and closes it. Returns the first error, once all
+// replicas have been asked to stop.
+func (h *NodeHost) Shutdown() error {
+	var firstErr error
+	for _, shardID := range h.LocalShardIDs() {
+		if err := h.StopReplica(shardID, h.cfg.ReplicaID); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to stop replica of shardID=%d: %w", shardID, err)
+		}
+	}
+	h.Close()
+
+	return firstErr
+}
+
+// ShardIDFromString returns the ID of the shard that owns a key, out of shards.
+func ShardIDFromString(key string, shards uint64) uint64 {
+	return uint64(crc32.ChecksumIEEE([]byte(key))%uint32(shards)) + 1
+}
+
+// ReplicaShardIDs returns the IDs of the shards placed on a replica. Without a replication factor, or with one covering
+// all shards, every replica hosts every shard. Otherwise replica r hosts shard r and the replicationFactor-1 shards
+// before it, wrapping around, so that with as many replicas as shards every shard is placed on replicationFactor
+// replicas. Replicas beyond the number of shards host the same shards as replica r-shards.
+func ReplicaShardIDs(replicaID, shards, replicationFactor uint64) []uint64 {
+	var shardIDs []uint64
+	for shardID := uint64(1); shardID <= shards; shardID++ {
+		if hostsShard(replicaID, shardID, shards, replicationFactor) {
+			shardIDs = append(shardIDs, shardID)
+		}
+	}
+
+	return shardIDs
+}
+
+func hostsShard(replicaID, shardID, shards, replicationFactor uint64) bool {
+	if replicationFactor == 0 || replicationFactor >= shards {
+		return shardID >= 1 && shardID <= shards
+	}
+
+	// The distance from the shard forward to the replica, both counted from 0, wrapping around.
+	return (replicaID-1+shards-(shardID-1))%shards < replicationFactor
+}
+
+// seedReplicaID returns the lowest ID of the replicas a shard is placed on, which bootstraps the shard. Replicas start
+// in the order of their IDs, so the seed is started before the others of the shard join it.
+func seedReplicaID(shardID, shards, replicationFactor uint64) uint64 {
+	if replicationFactor == 0 || replicationFactor >= shards || shardID+replicationFactor-1 > shards {
+		return 1
+	}
+
+	return shardID
+}
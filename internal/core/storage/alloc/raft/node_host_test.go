@@ -0,0 +1,177 @@
+package raft
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Blinkuu/qms/internal/core/domain"
+	"github.com/Blinkuu/qms/internal/core/ports"
+	"github.com/Blinkuu/qms/pkg/log"
+)
+
+func TestReplicaShardIDs(t *testing.T) {
+	tests := []struct {
+		name              string
+		replicaID         uint64
+		shards            uint64
+		replicationFactor uint64
+		want              []uint64
+	}{
+		{
+			name:              "every shard without a replication factor",
+			replicaID:         2,
+			shards:            3,
+			replicationFactor: 0,
+			want:              []uint64{1, 2, 3},
+		},
+		{
+			name:              "every shard with a replication factor covering all shards",
+			replicaID:         2,
+			shards:            3,
+			replicationFactor: 3,
+			want:              []uint64{1, 2, 3},
+		},
+		{
+			name:              "own shard and the ones before it",
+			replicaID:         3,
+			shards:            5,
+			replicationFactor: 3,
+			want:              []uint64{1, 2, 3},
+		},
+		{
+			name:              "wrapping around",
+			replicaID:         1,
+			shards:            5,
+			replicationFactor: 3,
+			want:              []uint64{1, 4, 5},
+		},
+		{
+			name:              "beyond the number of shards",
+			replicaID:         6,
+			shards:            5,
+			replicationFactor: 3,
+			want:              []uint64{1, 4, 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// When
+			shardIDs := ReplicaShardIDs(tt.replicaID, tt.shards, tt.replicationFactor)
+
+			// Then
+			assert.Equal(t, tt.want, shardIDs)
+		})
+	}
+}
+
+func TestSeedReplicaID_IsLowestReplicaOfShard(t *testing.T) {
+	// Given
+	const shards, replicationFactor = 5, 3
+	replicas := make(map[uint64][]uint64)
+	for replicaID := uint64(1); replicaID <= shards; replicaID++ {
+		for _, shardID := range ReplicaShardIDs(replicaID, shards, replicationFactor) {
+			replicas[shardID] = append(replicas[shardID], replicaID)
+		}
+	}
+
+	for shardID := uint64(1); shardID <= shards; shardID++ {
+		// When
+		seed := seedReplicaID(shardID, shards, replicationFactor)
+
+		// Then
+		assert.Len(t, replicas[shardID], replicationFactor)
+		assert.Equal(t, replicas[shardID][0], seed)
+	}
+}
+
+type fakeMemberlist struct {
+	ports.MemberlistService
+	members []domain.Instance
+}
+
+func (m *fakeMemberlist) Members(_ context.Context) ([]domain.Instance, error) {
+	return m.members, nil
+}
+
+// newPeerNodeHost returns a node host hosting no shard, whose only peer hosts shard 1 and answers with handler.
+func newPeerNodeHost(t *testing.T, handler http.HandlerFunc) *NodeHost {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	require.NoError(t, err)
+	httpPort, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	peer := domain.NewInstance("alloc", "peer", host, httpPort, 0, domain.InstanceMeta{Shards: 2, ShardIDs: []uint64{1}})
+
+	return &NodeHost{
+		logger:     log.NewNoopLogger(),
+		memberlist: &fakeMemberlist{members: []domain.Instance{peer}},
+		cli:        srv.Client(),
+		path:       "/api/v1/internal/raft",
+	}
+}
+
+func TestForward_DecodesResultOfPeer(t *testing.T) {
+	// Given
+	nh := newPeerNodeHost(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/internal/raft/invoke", r.URL.Path)
+		assert.Equal(t, "1", r.URL.Query().Get("shard_id"))
+		_, _ = w.Write(EncodeCommandResult(ViewCommandResult{Allocated: 3}))
+	})
+
+	// When
+	result, err := forward[ViewCommandResult](context.Background(), nh, 1, NewViewCommand("namespace", "resource"))
+
+	// Then
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, result.Allocated)
+}
+
+func TestForward_ReturnsErrorForMalformedResultOfPeer(t *testing.T) {
+	// Given
+	nh := newPeerNodeHost(t, func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("<html>bad gateway</html>"))
+	})
+
+	// When
+	_, err := forward[ViewCommandResult](context.Background(), nh, 1, NewViewCommand("namespace", "resource"))
+
+	// Then
+	assert.ErrorContains(t, err, "failed to decode forwarded command result")
+}
+
+func TestForward_ReturnsErrorOfPeer(t *testing.T) {
+	// Given
+	nh := newPeerNodeHost(t, func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "shard is not hosted by this replica", http.StatusInternalServerError)
+	})
+
+	// When
+	_, err := forward[ViewCommandResult](context.Background(), nh, 1, NewViewCommand("namespace", "resource"))
+
+	// Then
+	assert.ErrorContains(t, err, "shard is not hosted by this replica")
+}
+
+func TestForward_ReturnsErrShardNotHostedWithoutPeerHostingShard(t *testing.T) {
+	// Given
+	nh := newPeerNodeHost(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// When
+	_, err := forward[ViewCommandResult](context.Background(), nh, 2, NewViewCommand("namespace", "resource"))
+
+	// Then
+	assert.ErrorIs(t, err, ErrShardNotHosted)
+}
@@ -0,0 +1,87 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/audit"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/batch"
+)
+
+type PrepareBatchCommand struct {
+	BatchID     string
+	Coordinator uint64
+	Items       []batch.Item
+	ExpiresAt   int64
+	Now         int64
+
+	Caller  string
+	TraceID string
+
+	SMResult statemachine.Result
+}
+
+type PrepareBatchCommandResult struct {
+	Results []batch.Result
+	OK      bool
+	Err     string
+}
+
+// NewPrepareBatchCommand returns a command preparing the items of a cross-shard batch held by a shard. The outcome of
+// the batch is decided by the coordinator shard, and the prepared tokens are resolved by the leader of the shard if
+// the batch is neither committed nor aborted by expiresAt. Times are in Unix nanoseconds. Now, the caller and the trace
+// ID are only recorded in the audit log.
+func NewPrepareBatchCommand(batchID string, coordinator uint64, items []batch.Item, expiresAt, now int64, caller, traceID string) *PrepareBatchCommand {
+	return &PrepareBatchCommand{
+		BatchID:     batchID,
+		Coordinator: coordinator,
+		Items:       items,
+		ExpiresAt:   expiresAt,
+		Now:         now,
+		Caller:      caller,
+		TraceID:     traceID,
+		SMResult:    statemachine.Result{},
+	}
+}
+
+func (c *PrepareBatchCommand) Type() CommandType {
+	return PrepareBatch
+}
+
+func (c *PrepareBatchCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, session *client.Session) (any, error) {
+	result, err := syncWrite[PrepareBatchCommandResult](ctx, nh, shardID, session, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync write: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *PrepareBatchCommand) LocalInvoke(storage *storage, entryIdx uint64) error {
+	entries := newBatchAuditEntries(audit.AllocBatch, c.Items, c.Caller, c.TraceID, c.Now, entryIdx)
+	results, ok, err := storage.prepareBatch(entries, c.BatchID, c.Coordinator, c.Items, c.ExpiresAt, entryIdx)
+	for _, e := range entries {
+		e.SetResult(ok, err)
+		storage.audit.Record(e)
+	}
+
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(PrepareBatchCommandResult{Results: results, OK: ok, Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *PrepareBatchCommand) Result() statemachine.Result {
+	return c.SMResult
+}
@@ -0,0 +1,65 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+type RecordHistoryCommand struct {
+	Now        int64
+	Resolution int64
+	Retention  int64
+	SMResult   statemachine.Result
+}
+
+type RecordHistoryCommandResult struct {
+	Recorded int
+	Err      string
+}
+
+// NewRecordHistoryCommand returns a command sampling the allocated tokens of all quotas at now into the windows of
+// the history. All arguments are in nanoseconds.
+func NewRecordHistoryCommand(now, resolution, retention int64) *RecordHistoryCommand {
+	return &RecordHistoryCommand{
+		Now:        now,
+		Resolution: resolution,
+		Retention:  retention,
+		SMResult:   statemachine.Result{},
+	}
+}
+
+func (c *RecordHistoryCommand) Type() CommandType {
+	return RecordHistory
+}
+
+func (c *RecordHistoryCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, session *client.Session) (any, error) {
+	result, err := syncWrite[RecordHistoryCommandResult](ctx, nh, shardID, session, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync write: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *RecordHistoryCommand) LocalInvoke(storage *storage, entryIdx uint64) error {
+	recorded, err := storage.recordHistory(c.Now, c.Resolution, c.Retention, entryIdx)
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(RecordHistoryCommandResult{Recorded: recorded, Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *RecordHistoryCommand) Result() statemachine.Result {
+	return c.SMResult
+}
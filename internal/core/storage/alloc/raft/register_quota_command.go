@@ -4,10 +4,10 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/lni/dragonboat/v4"
 	"github.com/lni/dragonboat/v4/client"
 	"github.com/lni/dragonboat/v4/statemachine"
 
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/audit"
 	"github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
 )
 
@@ -15,16 +15,26 @@ type RegisterQuotaCommand struct {
 	Namespace string
 	Resource  string
 	Cfg       quota.Config
+	Now       int64
+	Caller    string
+	TraceID   string
 	SMResult  statemachine.Result
 }
 
-type RegisterQuotaCommandResult struct{}
+type RegisterQuotaCommandResult struct {
+	Err string
+}
 
-func NewRegisterQuotaCommand(namespace, resource string, cfg quota.Config) *RegisterQuotaCommand {
+// NewRegisterQuotaCommand returns a command registering a quota. Now, given in Unix nanoseconds, starts the current period of
+// periodic quotas. The caller and the trace ID are only recorded in the audit log.
+func NewRegisterQuotaCommand(namespace, resource string, cfg quota.Config, now int64, caller, traceID string) *RegisterQuotaCommand {
 	return &RegisterQuotaCommand{
 		Namespace: namespace,
 		Resource:  resource,
 		Cfg:       cfg,
+		Now:       now,
+		Caller:    caller,
+		TraceID:   traceID,
 		SMResult:  statemachine.Result{},
 	}
 }
@@ -33,8 +43,8 @@ func (c *RegisterQuotaCommand) Type() CommandType {
 	return RegisterQuota
 }
 
-func (c *RegisterQuotaCommand) RaftInvoke(ctx context.Context, nh *dragonboat.NodeHost, _ uint64, session *client.Session) (any, error) {
-	result, err := syncWrite[RegisterQuotaCommandResult](ctx, nh, session, c)
+func (c *RegisterQuotaCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, session *client.Session) (any, error) {
+	result, err := syncWrite[RegisterQuotaCommandResult](ctx, nh, shardID, session, c)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sync write: %w", err)
 	}
@@ -43,12 +53,17 @@ func (c *RegisterQuotaCommand) RaftInvoke(ctx context.Context, nh *dragonboat.No
 }
 
 func (c *RegisterQuotaCommand) LocalInvoke(storage *storage, entryIdx uint64) error {
-	err := storage.registerQuota(c.Namespace, c.Resource, c.Cfg, entryIdx)
+	e := newAuditEntry(audit.RegisterQuota, c.Namespace, c.Resource, c.Caller, c.TraceID, c.Now, entryIdx)
+	err := storage.registerQuota(&e, c.Namespace, c.Resource, c.Cfg, c.Now, entryIdx)
+	e.SetResult(true, err)
+	storage.audit.Record(e)
+
+	var errStr string
 	if err != nil {
-		return fmt.Errorf("failed to register quota: %w", err)
+		errStr = err.Error()
 	}
 
-	data := EncodeCommandResult(RegisterQuotaCommandResult{})
+	data := EncodeCommandResult(RegisterQuotaCommandResult{Err: errStr})
 	c.SMResult = statemachine.Result{
 		Value: 1,
 		Data:  data,
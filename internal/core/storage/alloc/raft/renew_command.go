@@ -0,0 +1,70 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+type RenewCommand struct {
+	Namespace string
+	Resource  string
+	LeaseID   string
+	Now       int64
+	ExpiresAt int64
+	SMResult  statemachine.Result
+}
+
+type RenewCommandResult struct {
+	ExpiresAt int64
+	OK        bool
+	Err       string
+}
+
+// NewRenewCommand returns a command extending a lease to expiresAt, unless it has expired at now. Both times are in
+// Unix nanoseconds.
+func NewRenewCommand(namespace, resource, leaseID string, now, expiresAt int64) *RenewCommand {
+	return &RenewCommand{
+		Namespace: namespace,
+		Resource:  resource,
+		LeaseID:   leaseID,
+		Now:       now,
+		ExpiresAt: expiresAt,
+		SMResult:  statemachine.Result{},
+	}
+}
+
+func (c *RenewCommand) Type() CommandType {
+	return Renew
+}
+
+func (c *RenewCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, session *client.Session) (any, error) {
+	result, err := syncWrite[RenewCommandResult](ctx, nh, shardID, session, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync write: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *RenewCommand) LocalInvoke(storage *storage, entryIdx uint64) error {
+	expiresAt, ok, err := storage.renew(c.Namespace, c.Resource, c.LeaseID, c.Now, c.ExpiresAt, entryIdx)
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(RenewCommandResult{ExpiresAt: expiresAt, OK: ok, Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *RenewCommand) Result() statemachine.Result {
+	return c.SMResult
+}
@@ -0,0 +1,61 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+type ResetPeriodsCommand struct {
+	Now      int64
+	SMResult statemachine.Result
+}
+
+type ResetPeriodsCommandResult struct {
+	Reset int
+	Err   string
+}
+
+// NewResetPeriodsCommand returns a command resetting the periodic quotas whose period has ended by now, given in Unix
+// nanoseconds.
+func NewResetPeriodsCommand(now int64) *ResetPeriodsCommand {
+	return &ResetPeriodsCommand{
+		Now:      now,
+		SMResult: statemachine.Result{},
+	}
+}
+
+func (c *ResetPeriodsCommand) Type() CommandType {
+	return ResetPeriods
+}
+
+func (c *ResetPeriodsCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, session *client.Session) (any, error) {
+	result, err := syncWrite[ResetPeriodsCommandResult](ctx, nh, shardID, session, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync write: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *ResetPeriodsCommand) LocalInvoke(storage *storage, entryIdx uint64) error {
+	reset, err := storage.resetPeriods(c.Now, entryIdx)
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(ResetPeriodsCommandResult{Reset: reset, Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *ResetPeriodsCommand) Result() statemachine.Result {
+	return c.SMResult
+}
@@ -0,0 +1,65 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+// RestoreCommand writes a chunk of the keys of a backup of a shard. The first chunk of a shard is only applied if the
+// shard has no quotas.
+type RestoreCommand struct {
+	Keys   [][]byte
+	Values [][]byte
+	First  bool
+
+	SMResult statemachine.Result
+}
+
+type RestoreCommandResult struct {
+	Err string
+}
+
+func NewRestoreCommand(keys, values [][]byte, first bool) *RestoreCommand {
+	return &RestoreCommand{
+		Keys:     keys,
+		Values:   values,
+		First:    first,
+		SMResult: statemachine.Result{},
+	}
+}
+
+func (c *RestoreCommand) Type() CommandType {
+	return Restore
+}
+
+func (c *RestoreCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, session *client.Session) (any, error) {
+	result, err := syncWrite[RestoreCommandResult](ctx, nh, shardID, session, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync write: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *RestoreCommand) LocalInvoke(storage *storage, entryIdx uint64) error {
+	err := storage.restore(c.Keys, c.Values, c.First, entryIdx)
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(RestoreCommandResult{Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *RestoreCommand) Result() statemachine.Result {
+	return c.SMResult
+}
@@ -27,6 +27,9 @@ func (m *stateMachine) Open(stopChan <-chan struct{}) (uint64, error) {
 }
 
 func (m *stateMachine) Update(entries []statemachine.Entry) ([]statemachine.Entry, error) {
+	// Watchers are notified of the changes of the applied entries, even if a later entry fails.
+	defer m.storage.publishChanges()
+
 	var result []statemachine.Entry
 	for _, e := range entries {
 		r, err := m.processEntry(e)
@@ -0,0 +1,309 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/statemachine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/audit"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/backup"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/batch"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/watch"
+	"github.com/Blinkuu/qms/pkg/log"
+)
+
+var startTime = time.Date(2022, time.Month(1), 11, 0, 0, 0, 0, time.UTC)
+
+type testStateMachine struct {
+	*stateMachine
+	index uint64
+}
+
+func newTestStateMachine(t *testing.T, auditLog *audit.Log) *testStateMachine {
+	st, err := newStorage(t.TempDir(), log.NewNoopLogger(), watch.NewHub(), auditLog)
+	require.NoError(t, err)
+	sm := newStateMachine(st)
+	t.Cleanup(func() { _ = sm.Close() })
+
+	return &testStateMachine{stateMachine: sm}
+}
+
+// update applies cmd as the next entry of the raft log.
+func update[T any](t *testing.T, sm *testStateMachine, cmd Command) T {
+	sm.index++
+	entries, err := sm.Update([]statemachine.Entry{{Index: sm.index, Cmd: EncodeCommand(cmd)}})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	return DecodeCommandResult[T](entries[0].Result.Data)
+}
+
+func lookup[T any](t *testing.T, sm *testStateMachine, cmd Command) T {
+	result, err := sm.Lookup(EncodeCommand(cmd))
+	require.NoError(t, err)
+
+	return DecodeCommandResult[T](result.([]byte))
+}
+
+func registerQuota(t *testing.T, sm *testStateMachine, namespace, resource string, cfg quota.Config) {
+	result := update[RegisterQuotaCommandResult](t, sm, NewRegisterQuotaCommand(namespace, resource, cfg, startTime.UnixNano(), "", ""))
+	require.Empty(t, result.Err)
+}
+
+func TestStateMachine_Update_KeepsLeasedTokensFromPlainFreeUntilTheLeaseExpires(t *testing.T) {
+	// Given
+	sm := newTestStateMachine(t, audit.NewNopLog())
+	now := startTime.UnixNano()
+	expiresAt := startTime.Add(10 * time.Second).UnixNano()
+	registerQuota(t, sm, "namespace", "resource", quota.Config{Capacity: 10})
+	allocResult := update[AllocCommandResult](t, sm, NewAllocCommand("namespace", "resource", "a", 10, 0, "lease", expiresAt, "", now, now, "", ""))
+	require.True(t, allocResult.OK)
+
+	// When
+	freeResult := update[FreeCommandResult](t, sm, NewFreeCommand("namespace", "resource", "a", 10, 0, "", "", now, now, "", ""))
+
+	// Then
+	assert.Empty(t, freeResult.Err)
+	assert.False(t, freeResult.OK)
+	expireResult := update[ExpireLeasesCommandResult](t, sm, NewExpireLeasesCommand(expiresAt))
+	assert.Equal(t, 1, expireResult.Expired)
+	allocResult = update[AllocCommandResult](t, sm, NewAllocCommand("namespace", "resource", "b", 10, 0, "", 0, "", expiresAt, expiresAt, "", ""))
+	assert.True(t, allocResult.OK)
+	allocResult = update[AllocCommandResult](t, sm, NewAllocCommand("namespace", "resource", "c", 10, 0, "", 0, "", expiresAt, expiresAt, "", ""))
+	assert.False(t, allocResult.OK)
+	viewResult := lookup[ViewCommandResult](t, sm, NewViewCommand("namespace", "resource"))
+	assert.EqualValues(t, 10, viewResult.Allocated)
+}
+
+func TestStateMachine_Update_RecordsFreedTokensOfAbortedBatchesWithTheEntryIndex(t *testing.T) {
+	// Given
+	var buf bytes.Buffer
+	sm := newTestStateMachine(t, audit.NewLog(audit.NewWriterSink(&buf), log.NewNoopLogger()))
+	now := startTime.UnixNano()
+	registerQuota(t, sm, "namespace", "resource", quota.Config{Capacity: 10})
+	items := []batch.Item{{Namespace: "namespace", Resource: "resource", Holder: "holder", Tokens: 4}}
+	prepareResult := update[PrepareBatchCommandResult](t, sm, NewPrepareBatchCommand("batch", 1, items, now, now, "service", ""))
+	require.True(t, prepareResult.OK)
+	buf.Reset()
+
+	// When
+	abortResult := update[AbortBatchCommandResult](t, sm, NewAbortBatchCommand("batch", false, now, now))
+
+	// Then
+	assert.Empty(t, abortResult.Err)
+	var e audit.Entry
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &e))
+	assert.Equal(t, audit.AbortBatch, e.Operation)
+	assert.Equal(t, sm.index, e.Index)
+	assert.Equal(t, "holder", e.Holder)
+	assert.EqualValues(t, 4, e.Tokens)
+	assert.Equal(t, &audit.State{Allocated: 4, Capacity: 10, Version: 2}, e.Before)
+	assert.Equal(t, &audit.State{Allocated: 0, Capacity: 10, Version: 3}, e.After)
+	assert.Equal(t, "ok", e.Result)
+}
+
+func TestStateMachine_Update_RecordsExpiredLeasesWithTheEntryIndex(t *testing.T) {
+	// Given
+	var buf bytes.Buffer
+	sm := newTestStateMachine(t, audit.NewLog(audit.NewWriterSink(&buf), log.NewNoopLogger()))
+	now := startTime.UnixNano()
+	expiresAt := startTime.Add(10 * time.Second).UnixNano()
+	registerQuota(t, sm, "namespace", "resource", quota.Config{Capacity: 10})
+	allocResult := update[AllocCommandResult](t, sm, NewAllocCommand("namespace", "resource", "holder", 4, 0, "lease", expiresAt, "", now, now, "", ""))
+	require.True(t, allocResult.OK)
+	buf.Reset()
+
+	// When
+	expireResult := update[ExpireLeasesCommandResult](t, sm, NewExpireLeasesCommand(expiresAt))
+
+	// Then
+	assert.Equal(t, 1, expireResult.Expired)
+	var e audit.Entry
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &e))
+	assert.Equal(t, audit.ExpireLease, e.Operation)
+	assert.Equal(t, sm.index, e.Index)
+	assert.True(t, time.Unix(0, expiresAt).Equal(e.Time))
+	assert.Equal(t, "lease", e.LeaseID)
+	assert.EqualValues(t, 4, e.Tokens)
+	assert.Equal(t, &audit.State{Allocated: 0, Capacity: 10, Version: 3}, e.After)
+	assert.Equal(t, "ok", e.Result)
+}
+
+func TestStateMachine_Update_FreesPreparedTokensOfExpiredBatchOnAbort(t *testing.T) {
+	// Given
+	sm := newTestStateMachine(t, audit.NewNopLog())
+	now := startTime.UnixNano()
+	expiresAt := startTime.Add(time.Second).UnixNano()
+	registerQuota(t, sm, "namespace", "resource", quota.Config{Capacity: 10})
+	items := []batch.Item{{Namespace: "namespace", Resource: "resource", Tokens: 10}}
+	prepareResult := update[PrepareBatchCommandResult](t, sm, NewPrepareBatchCommand("batch", 1, items, expiresAt, now, "", ""))
+	require.True(t, prepareResult.OK)
+	require.Empty(t, lookup[ExpiredBatchesCommandResult](t, sm, NewExpiredBatchesCommand(now)).Coordinators)
+
+	// When
+	expiredResult := lookup[ExpiredBatchesCommandResult](t, sm, NewExpiredBatchesCommand(expiresAt))
+	abortResult := update[AbortBatchCommandResult](t, sm, NewAbortBatchCommand("batch", false, expiresAt, expiresAt))
+
+	// Then
+	assert.Equal(t, map[string]uint64{"batch": 1}, expiredResult.Coordinators)
+	assert.Empty(t, abortResult.Err)
+	assert.False(t, abortResult.Committed)
+	viewResult := lookup[ViewCommandResult](t, sm, NewViewCommand("namespace", "resource"))
+	assert.EqualValues(t, 0, viewResult.Allocated)
+	assert.Empty(t, lookup[ExpiredBatchesCommandResult](t, sm, NewExpiredBatchesCommand(expiresAt)).Coordinators)
+}
+
+func TestStateMachine_Update_KeepsPreparedTokensOfBatchCommittedByTheCoordinator(t *testing.T) {
+	// Given
+	sm := newTestStateMachine(t, audit.NewNopLog())
+	now := startTime.UnixNano()
+	expiresAt := startTime.Add(time.Second).UnixNano()
+	registerQuota(t, sm, "namespace", "resource", quota.Config{Capacity: 10})
+	items := []batch.Item{{Namespace: "namespace", Resource: "resource", Tokens: 10}}
+	prepareResult := update[PrepareBatchCommandResult](t, sm, NewPrepareBatchCommand("batch", 1, items, expiresAt, now, "", ""))
+	require.True(t, prepareResult.OK)
+	commitResult := update[CommitBatchCommandResult](t, sm, NewCommitBatchCommand("batch", true, expiresAt))
+	require.True(t, commitResult.Committed)
+
+	// When
+	abortResult := update[AbortBatchCommandResult](t, sm, NewAbortBatchCommand("batch", true, expiresAt, expiresAt))
+
+	// Then
+	assert.Empty(t, abortResult.Err)
+	assert.True(t, abortResult.Committed)
+	viewResult := lookup[ViewCommandResult](t, sm, NewViewCommand("namespace", "resource"))
+	assert.EqualValues(t, 10, viewResult.Allocated)
+}
+
+func TestStateMachine_Update_RejectsCommitOfBatchAbortedByTheCoordinator(t *testing.T) {
+	// Given
+	sm := newTestStateMachine(t, audit.NewNopLog())
+	now := startTime.UnixNano()
+	expiresAt := startTime.Add(time.Second).UnixNano()
+	registerQuota(t, sm, "namespace", "resource", quota.Config{Capacity: 10})
+	items := []batch.Item{{Namespace: "namespace", Resource: "resource", Tokens: 10}}
+	prepareResult := update[PrepareBatchCommandResult](t, sm, NewPrepareBatchCommand("batch", 1, items, expiresAt, now, "", ""))
+	require.True(t, prepareResult.OK)
+	abortResult := update[AbortBatchCommandResult](t, sm, NewAbortBatchCommand("batch", true, expiresAt, now))
+	require.False(t, abortResult.Committed)
+
+	// When
+	commitResult := update[CommitBatchCommandResult](t, sm, NewCommitBatchCommand("batch", true, expiresAt))
+
+	// Then
+	assert.Empty(t, commitResult.Err)
+	assert.False(t, commitResult.Committed)
+	viewResult := lookup[ViewCommandResult](t, sm, NewViewCommand("namespace", "resource"))
+	assert.EqualValues(t, 0, viewResult.Allocated)
+}
+
+func TestStateMachine_Update_ExpiresOnlyLeasesPastTheirExpiry(t *testing.T) {
+	// Given
+	sm := newTestStateMachine(t, audit.NewNopLog())
+	now := startTime.UnixNano()
+	registerQuota(t, sm, "namespace", "resource", quota.Config{Capacity: 10})
+	allocResult := update[AllocCommandResult](t, sm, NewAllocCommand("namespace", "resource", "a", 4, 0, "short", startTime.Add(time.Second).UnixNano(), "", now, now, "", ""))
+	require.True(t, allocResult.OK)
+	allocResult = update[AllocCommandResult](t, sm, NewAllocCommand("namespace", "resource", "b", 6, 0, "long", startTime.Add(time.Minute).UnixNano(), "", now, now, "", ""))
+	require.True(t, allocResult.OK)
+
+	// When
+	expireResult := update[ExpireLeasesCommandResult](t, sm, NewExpireLeasesCommand(startTime.Add(time.Second).UnixNano()))
+
+	// Then
+	assert.Equal(t, 1, expireResult.Expired)
+	viewResult := lookup[ViewHoldersCommandResult](t, sm, NewViewHoldersCommand("namespace", "resource"))
+	assert.EqualValues(t, 6, viewResult.Allocated)
+	assert.Equal(t, map[string]int64{"b": 6}, viewResult.Holders)
+}
+
+func TestStateMachine_Lookup_BacksUpShardThatRestoresElsewhere(t *testing.T) {
+	// Given
+	sm := newTestStateMachine(t, audit.NewNopLog())
+	now := startTime.UnixNano()
+	registerQuota(t, sm, "namespace", "resource", quota.Config{Capacity: 10})
+	allocResult := update[AllocCommandResult](t, sm, NewAllocCommand("namespace", "resource", "a", 4, 0, "", 0, "", now, now, "", ""))
+	require.True(t, allocResult.OK)
+
+	// When
+	backupResult := lookup[BackupCommandResult](t, sm, NewBackupCommand(3))
+
+	// Then
+	require.Empty(t, backupResult.Err)
+	br := backup.NewReader(bytes.NewReader(backupResult.Backup))
+	shardID, err := br.NextSection()
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, shardID)
+
+	var keys, values [][]byte
+	for {
+		key, value, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		keys, values = append(keys, key), append(values, value)
+	}
+
+	restored := newTestStateMachine(t, audit.NewNopLog())
+	restoreResult := update[RestoreCommandResult](t, restored, NewRestoreCommand(keys, values, true))
+	require.Empty(t, restoreResult.Err)
+	viewResult := lookup[ViewCommandResult](t, restored, NewViewCommand("namespace", "resource"))
+	assert.EqualValues(t, 4, viewResult.Allocated)
+}
+
+func TestDecodeForwardedCommand_ReturnsErrorForMalformedCommand(t *testing.T) {
+	// Given
+	data := append([]byte{byte(View)}, []byte("definitely not gob")...)
+
+	// When
+	_, err := decodeForwardedCommand(data)
+
+	// Then
+	assert.Error(t, err)
+}
+
+func TestStateMachine_Lookup_CountsDueExpiriesOnlyOnceLeasesExpire(t *testing.T) {
+	// Given
+	sm := newTestStateMachine(t, audit.NewNopLog())
+	now := startTime.UnixNano()
+	expiresAt := startTime.Add(10 * time.Second).UnixNano()
+	registerQuota(t, sm, "namespace", "resource", quota.Config{Capacity: 10})
+	allocResult := update[AllocCommandResult](t, sm, NewAllocCommand("namespace", "resource", "a", 5, 0, "lease", expiresAt, "", now, now, "", ""))
+	require.True(t, allocResult.OK)
+
+	// When
+	before := lookup[DueExpiriesCommandResult](t, sm, NewDueExpiriesCommand(expiresAt-1))
+	due := lookup[DueExpiriesCommandResult](t, sm, NewDueExpiriesCommand(expiresAt))
+	expireResult := update[ExpireLeasesCommandResult](t, sm, NewExpireLeasesCommand(expiresAt))
+	after := lookup[DueExpiriesCommandResult](t, sm, NewDueExpiriesCommand(expiresAt))
+
+	// Then
+	assert.Empty(t, before.Err)
+	assert.Zero(t, before.Due)
+	assert.Equal(t, 1, due.Due)
+	assert.Equal(t, 1, expireResult.Expired)
+	assert.Zero(t, after.Due)
+}
+
+func TestShardErrors_WrapsFirstErrorAndKeepsTheOthers(t *testing.T) {
+	// Given
+	errs := []error{ErrShardNotHosted, errors.New("second")}
+
+	// When
+	err := shardErrors(errs)
+
+	// Then
+	assert.ErrorIs(t, err, ErrShardNotHosted)
+	assert.ErrorContains(t, err, "second")
+	assert.NoError(t, shardErrors(nil))
+}
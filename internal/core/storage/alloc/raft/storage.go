@@ -3,11 +3,9 @@ package raft
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"net"
 	"net/http"
@@ -18,9 +16,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/dgraph-io/badger/v3"
+	"github.com/google/uuid"
 	"github.com/grafana/dskit/backoff"
-	"github.com/lni/dragonboat/v4"
 	"github.com/lni/dragonboat/v4/client"
 	"github.com/lni/dragonboat/v4/config"
 	"github.com/lni/dragonboat/v4/statemachine"
@@ -29,7 +28,15 @@ import (
 	"github.com/Blinkuu/qms/internal/core/domain"
 	"github.com/Blinkuu/qms/internal/core/ports"
 	stor "github.com/Blinkuu/qms/internal/core/storage"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/audit"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/backup"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/badgerkv"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/batch"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/export"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/history"
 	"github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/watch"
+	"github.com/Blinkuu/qms/pkg/caller"
 	"github.com/Blinkuu/qms/pkg/dto"
 	"github.com/Blinkuu/qms/pkg/log"
 	badgerlog "github.com/Blinkuu/qms/pkg/log/badger"
@@ -37,86 +44,73 @@ import (
 
 const (
 	appliedEntryIndexKey string = "__applied_entry_index__"
+	batchKeyPrefix       string = "__batch__"
+	decisionKeyPrefix    string = "__decision__"
 )
 
-type Storage struct {
-	cfg        Config
-	logger     log.Logger
-	memberlist ports.MemberlistService
-	nh         *dragonboat.NodeHost
-	storages   map[uint64]*storage
-	sessions   map[uint64]*client.Session
-
-	shutdown     chan struct{}
-	shutdownOnce sync.Once
-}
-
-func NewStorage(cfg Config, logger log.Logger, memberlist ports.MemberlistService) (*Storage, error) {
-	if cfg.ReplicaIDOverride != "" {
-		replicaID, err := strconv.ParseUint(trimBeforeSubstr(cfg.ReplicaIDOverride, "-"), 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse replica_id_override: %w", err)
-		}
-
-		cfg.ReplicaID = replicaID + 1
-	}
+const (
+	// batchPrepareTimeout is how long the tokens of a cross-shard batch stay prepared before the batch is resolved by
+	// the leaders of the shards, in case its coordinator failed halfway.
+	batchPrepareTimeout = 10 * time.Second
 
-	if cfg.BindAddressFromHostname {
-		hostname, err := os.Hostname()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get hostname: %w", err)
-		}
+	// batchDecisionRetention is how long the coordinator shard remembers whether a cross-shard batch was committed.
+	batchDecisionRetention = time.Hour
 
-		cfg.BindAddress = fmt.Sprintf("%s.%s.default.svc.cluster.local", hostname, trimAfterSubstr(hostname, "-"))
-	}
+	// restoreChunkSize is roughly how many bytes of keys and values a restore command carries, so that a backup is
+	// replicated in raft log entries of a bounded size.
+	restoreChunkSize = 1 << 20
 
-	var initialMembers map[uint64]string
-	joined := false
-	raftAddr := net.JoinHostPort(cfg.BindAddress, strconv.Itoa(cfg.BindPort))
-	alreadyMember, err := join(context.Background(), logger, memberlist, cfg.ReplicaID, raftAddr)
-	if err == nil {
-		if !alreadyMember {
-			joined = true
-		}
-		goto createNodeHost
-	}
+	// importChunkSize is how many items an import command carries at most.
+	importChunkSize = 1000
+)
 
-	if cfg.ReplicaID != 1 {
-		if raftAndDataDirsExist(cfg.Dir, cfg.ReplicaID) {
-			goto createNodeHost
-		}
+// preparedBatch holds the items of a cross-shard batch prepared on a shard, until the batch is committed or aborted.
+// The coordinator shard decides the outcome of the batch. ExpiresAt is in Unix nanoseconds.
+type preparedBatch struct {
+	Coordinator uint64       `json:"coordinator"`
+	Items       []batch.Item `json:"items"`
+	ExpiresAt   int64        `json:"expires_at"`
+}
 
-		return nil, fmt.Errorf("failed to join raft cluster: %w", err)
-	}
+// decision is the outcome of a cross-shard batch recorded by its coordinator shard. ExpiresAt is in Unix nanoseconds.
+type decision struct {
+	Committed bool  `json:"committed"`
+	ExpiresAt int64 `json:"expires_at"`
+}
 
-	logger.Info("bootstrapping new raft cluster", "replicaID", cfg.ReplicaID)
-	initialMembers = map[uint64]string{
-		cfg.ReplicaID: raftAddr,
-	}
+type Storage struct {
+	cfg               Config
+	clock             clock.Clock
+	idempotencyWindow time.Duration
+	logger            log.Logger
+	memberlist        ports.MemberlistService
+	nh                *NodeHost
+	storages          map[uint64]*storage
+	sessions          map[uint64]*client.Session
+	hub               *watch.Hub
 
-createNodeHost:
-	// raftDir: dir/raft_node_nodeId
-	// dataDir: dir/data_node_nodeId
-	raftDir, dataDir, err := createRaftAndDataDirs(cfg.Dir, cfg.ReplicaID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create raft and data dirs: %w", err)
-	}
+	shutdownOnce sync.Once
+}
 
-	nodeHostCfg := newNodeHostConfig(cfg.DeploymentID, raftDir, raftAddr)
-	nh, err := dragonboat.NewNodeHost(nodeHostCfg)
+// NewStorage returns a storage replicating quotas with raft. Every replica records the mutations it applies to the audit
+// log, along with the index of the raft log entry applying them.
+func NewStorage(cfg Config, clock clock.Clock, idempotencyWindow time.Duration, logger log.Logger, memberlist ports.MemberlistService, auditLog *audit.Log) (*Storage, error) {
+	nh, err := NewNodeHost(cfg, logger, memberlist, "/api/v1/internal/raft")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new node host: %w", err)
+		return nil, fmt.Errorf("failed to create node host: %w", err)
 	}
 
 	var (
 		storages = make(map[uint64]*storage)
 		sessions = make(map[uint64]*client.Session)
+		hub      = watch.NewHub()
 	)
 
-	for shardID := uint64(1); shardID <= cfg.Shards; shardID++ {
-		shardDir := filepath.Join(dataDir, strconv.Itoa(int(shardID))) //clusterDataPath: base/data_node_nodeId/shardID
+	cfg = nh.Config()
+	for _, shardID := range nh.LocalShardIDs() {
+		shardDir := filepath.Join(nh.DataDir(), strconv.Itoa(int(shardID))) //clusterDataPath: base/data_node_nodeId/shardID
 
-		st, err := newStorage(shardDir, logger)
+		st, err := newStorage(shardDir, logger, hub, auditLog)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create new local storage: %w", err)
 		}
@@ -126,9 +120,9 @@ createNodeHost:
 			return nil, fmt.Errorf("failed to create new state machine for shardID=%d: %w", shardID, err)
 		}
 
-		raftCfg := newRaftConfig(cfg.ReplicaID, shardID)
-		logger.Infof("initialMembers=%+v", initialMembers)
-		err = nh.StartOnDiskReplica(initialMembers, joined, func(_ uint64, _ uint64) statemachine.IOnDiskStateMachine { return stateMachine }, raftCfg)
+		raftCfg := NewRaftConfig(cfg.ReplicaID, shardID)
+		logger.Infof("initialMembers=%+v", nh.InitialMembers(shardID))
+		err = nh.StartOnDiskReplica(nh.InitialMembers(shardID), nh.Joined(shardID), func(_ uint64, _ uint64) statemachine.IOnDiskStateMachine { return stateMachine }, raftCfg)
 		if err != nil {
 			return nil, fmt.Errorf("failed to start on disk replica for shardID=%d: %w", shardID, err)
 		}
@@ -137,39 +131,28 @@ createNodeHost:
 		sessions[shardID] = nh.GetNoOPSession(shardID)
 	}
 
+	// The proxy routes the requests of a quota to the replicas of its shard, which it learns of from the members.
+	if err := memberlist.UpdateMeta(domain.InstanceMeta{Shards: cfg.Shards, ShardIDs: nh.LocalShardIDs()}); err != nil {
+		return nil, fmt.Errorf("failed to update memberlist meta: %w", err)
+	}
+
 	return &Storage{
-		cfg:          cfg,
-		logger:       logger,
-		memberlist:   memberlist,
-		nh:           nh,
-		storages:     storages,
-		sessions:     sessions,
-		shutdown:     make(chan struct{}),
-		shutdownOnce: sync.Once{},
+		cfg:               cfg,
+		clock:             clock,
+		idempotencyWindow: idempotencyWindow,
+		logger:            logger,
+		memberlist:        memberlist,
+		nh:                nh,
+		storages:          storages,
+		sessions:          sessions,
+		hub:               hub,
+		shutdownOnce:      sync.Once{},
 	}, nil
 }
 
-func (s *Storage) Run(ctx context.Context) error {
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-s.shutdown:
-			return nil
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-ticker.C:
-			if !s.isLeader() {
-				continue
-			}
-		}
-	}
-}
-
 func (s *Storage) View(ctx context.Context, namespace, resource string) (int64, int64, int64, error) {
 	id := strings.Join([]string{namespace, resource}, "_")
-	shardID := shardIDFromString(id, s.cfg.Shards)
+	shardID := s.nh.ShardIDFromString(id)
 
 	viewCmd := NewViewCommand(namespace, resource)
 	result, err := viewCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
@@ -191,36 +174,292 @@ func (s *Storage) View(ctx context.Context, namespace, resource string) (int64,
 	return typedResult.Allocated, typedResult.Capacity, typedResult.Version, nil
 }
 
-func (s *Storage) Alloc(ctx context.Context, namespace, resource string, tokens, version int64) (int64, int64, bool, error) {
+// Watch returns the changes of a quota, starting with its current state, until ctx is done. The changes are published
+// by the state machine of this node as it applies them, so the watchers of a follower may trail the leader.
+func (s *Storage) Watch(ctx context.Context, namespace, resource string) (<-chan watch.Event, error) {
+	sub := s.hub.Subscribe(namespace, resource)
+	allocated, capacity, version, err := s.View(ctx, namespace, resource)
+	if err != nil {
+		sub.Cancel()
+		return nil, err
+	}
+
+	sub.Offer(watch.Event{Allocated: allocated, Capacity: capacity, Version: version})
+
+	go func() {
+		<-ctx.Done()
+		sub.Cancel()
+	}()
+
+	return sub.Events(), nil
+}
+
+// ViewHolders returns the state of a quota along with the tokens allocated by each holder.
+func (s *Storage) ViewHolders(ctx context.Context, namespace, resource string) (int64, int64, int64, map[string]int64, error) {
+	id := strings.Join([]string{namespace, resource}, "_")
+	shardID := s.nh.ShardIDFromString(id)
+
+	viewHoldersCmd := NewViewHoldersCommand(namespace, resource)
+	result, err := viewHoldersCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+	if err != nil {
+		return 0, 0, 0, nil, fmt.Errorf("failed to raft invoke: %w", err)
+	}
+
+	typedResult := result.(ViewHoldersCommandResult)
+	if typedResult.Err != "" {
+		switch {
+		case stor.IsErrNotFound(typedResult.Err):
+			return 0, 0, 0, nil, stor.ErrNotFound
+		default:
+			return 0, 0, 0, nil, errors.New(typedResult.Err)
+		}
+	}
+
+	return typedResult.Allocated, typedResult.Capacity, typedResult.Version, typedResult.Holders, nil
+}
+
+// Alloc allocates tokens from a quota on behalf of the holder, if any. With a positive ttl the tokens are leased. The
+// lease ID and its expiry are chosen here and replicated with the command, so that all replicas agree on them. The same
+// holds for the time deciding whether the result of an idempotency key is still remembered.
+func (s *Storage) Alloc(ctx context.Context, namespace, resource, holder string, tokens, version int64, ttl time.Duration, idempotencyKey string) (int64, int64, string, bool, bool, error) {
 	id := strings.Join([]string{namespace, resource}, "_")
-	shardID := shardIDFromString(id, s.cfg.Shards)
+	shardID := s.nh.ShardIDFromString(id)
 
-	allocCmd := NewAllocCommand(namespace, resource, tokens, version)
+	now := s.clock.Now()
+	var (
+		leaseID   string
+		expiresAt int64
+	)
+	if ttl > 0 {
+		leaseID = uuid.NewString()
+		expiresAt = now.Add(ttl).UnixNano()
+	}
+
+	allocCmd := NewAllocCommand(namespace, resource, holder, tokens, version, leaseID, expiresAt, idempotencyKey, now.UnixNano(), now.Add(s.idempotencyWindow).UnixNano(), caller.FromContext(ctx), audit.TraceID(ctx))
 	result, err := allocCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
 	if err != nil {
-		return 0, 0, false, fmt.Errorf("failed to raft invoke: %w", err)
+		return 0, 0, "", false, false, fmt.Errorf("failed to raft invoke: %w", err)
 	}
 
 	typedResult := result.(AllocCommandResult)
 	if typedResult.Err != "" {
 		switch {
 		case stor.IsErrNotFound(typedResult.Err):
-			return 0, 0, false, stor.ErrNotFound
+			return 0, 0, "", false, false, stor.ErrNotFound
 		case stor.IsErrInvalidVersion(typedResult.Err):
-			return 0, 0, false, stor.ErrInvalidVersion
+			return 0, 0, "", false, false, stor.ErrInvalidVersion
 		default:
-			return 0, 0, false, errors.New(typedResult.Err)
+			return 0, 0, "", false, false, errors.New(typedResult.Err)
 		}
 	}
 
-	return typedResult.RemainingTokens, typedResult.CurrentVersion, typedResult.OK, nil
+	return typedResult.RemainingTokens, typedResult.CurrentVersion, typedResult.LeaseID, typedResult.OK, typedResult.OverSoftLimit, nil
+}
+
+// AllocBatch allocates tokens from several quotas all-or-nothing. A batch within a single shard is allocated by a
+// single command. A batch spanning several shards is prepared on each of them and then committed, with the first shard
+// of the batch coordinating it: the batch is committed once the coordinator shard records so. If the coordinator fails
+// halfway, the leaders of the shards resolve the prepared tokens by the decision of the coordinator shard, aborting the
+// batch if it was not decided yet.
+func (s *Storage) AllocBatch(ctx context.Context, items []batch.Item) ([]batch.Result, bool, error) {
+	var shardIDs []uint64
+	indices := make(map[uint64][]int)
+	for i, item := range items {
+		shardID := s.nh.ShardIDFromString(strings.Join([]string{item.Namespace, item.Resource}, "_"))
+		if _, found := indices[shardID]; !found {
+			shardIDs = append(shardIDs, shardID)
+		}
+
+		indices[shardID] = append(indices[shardID], i)
+	}
+
+	if len(shardIDs) == 1 {
+		shardID := shardIDs[0]
+		allocBatchCmd := NewAllocBatchCommand(items, s.clock.Now().UnixNano(), caller.FromContext(ctx), audit.TraceID(ctx))
+		result, err := allocBatchCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to raft invoke: %w", err)
+		}
+
+		typedResult := result.(AllocBatchCommandResult)
+		if typedResult.Err != "" {
+			return nil, false, batchCommandError(typedResult.Err)
+		}
+
+		return typedResult.Results, typedResult.OK, nil
+	}
+
+	batchID := uuid.NewString()
+	coordinator := shardIDs[0]
+	now := s.clock.Now()
+	expiresAt := now.Add(batchPrepareTimeout).UnixNano()
+	decisionExpiresAt := now.Add(batchDecisionRetention).UnixNano()
+
+	results := make([]batch.Result, len(items))
+	prepared := make([]uint64, 0, len(shardIDs))
+	for _, shardID := range shardIDs {
+		shardItems := make([]batch.Item, 0, len(indices[shardID]))
+		for _, i := range indices[shardID] {
+			shardItems = append(shardItems, items[i])
+		}
+
+		prepareBatchCmd := NewPrepareBatchCommand(batchID, coordinator, shardItems, expiresAt, now.UnixNano(), caller.FromContext(ctx), audit.TraceID(ctx))
+		result, err := prepareBatchCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+		if err != nil {
+			s.abortBatch(ctx, batchID, coordinator, prepared, decisionExpiresAt)
+			return nil, false, fmt.Errorf("failed to raft invoke: %w", err)
+		}
+
+		typedResult := result.(PrepareBatchCommandResult)
+		if typedResult.Err != "" {
+			s.abortBatch(ctx, batchID, coordinator, prepared, decisionExpiresAt)
+			return nil, false, batchCommandError(typedResult.Err)
+		}
+
+		for j, i := range indices[shardID] {
+			results[i] = typedResult.Results[j]
+		}
+
+		if !typedResult.OK {
+			s.abortBatch(ctx, batchID, coordinator, prepared, decisionExpiresAt)
+			return results, false, nil
+		}
+
+		prepared = append(prepared, shardID)
+	}
+
+	commitBatchCmd := NewCommitBatchCommand(batchID, true, decisionExpiresAt)
+	result, err := commitBatchCmd.RaftInvoke(ctx, s.nh, coordinator, s.sessions[coordinator])
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to raft invoke: %w", err)
+	}
+
+	typedResult := result.(CommitBatchCommandResult)
+	if typedResult.Err != "" {
+		return nil, false, errors.New(typedResult.Err)
+	}
+
+	if !typedResult.Committed {
+		s.abortBatch(ctx, batchID, coordinator, prepared, decisionExpiresAt)
+		return results, false, nil
+	}
+
+	for _, shardID := range prepared[1:] {
+		if err := s.resolveBatch(ctx, shardID, batchID, true, decisionExpiresAt); err != nil {
+			s.logger.Warn("failed to commit batch, leaving it to the shard leader", "batchID", batchID, "shardID", shardID, "err", err)
+		}
+	}
+
+	return results, true, nil
+}
+
+// abortBatch aborts a cross-shard batch on the shards it was prepared on. Failures are left to the leaders of the
+// shards, which resolve the batch once it expires.
+func (s *Storage) abortBatch(ctx context.Context, batchID string, coordinator uint64, prepared []uint64, decisionExpiresAt int64) {
+	// The coordinator is aborted first, even if its part was not prepared, so that the decision is recorded.
+	if _, err := s.abortBatchOn(ctx, coordinator, batchID, true, decisionExpiresAt); err != nil {
+		s.logger.Warn("failed to abort batch, leaving it to the shard leader", "batchID", batchID, "shardID", coordinator, "err", err)
+	}
+
+	for _, shardID := range prepared {
+		if shardID == coordinator {
+			continue
+		}
+
+		if err := s.resolveBatch(ctx, shardID, batchID, false, decisionExpiresAt); err != nil {
+			s.logger.Warn("failed to abort batch, leaving it to the shard leader", "batchID", batchID, "shardID", shardID, "err", err)
+		}
+	}
+}
+
+// resolveBatch commits or aborts a cross-shard batch on a participant shard, or aborts it on its coordinator shard.
+func (s *Storage) resolveBatch(ctx context.Context, shardID uint64, batchID string, commit bool, decisionExpiresAt int64) error {
+	if commit {
+		commitBatchCmd := NewCommitBatchCommand(batchID, false, decisionExpiresAt)
+		result, err := commitBatchCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+		if err != nil {
+			return fmt.Errorf("failed to raft invoke: %w", err)
+		}
+
+		if errStr := result.(CommitBatchCommandResult).Err; errStr != "" {
+			return errors.New(errStr)
+		}
+
+		return nil
+	}
+
+	_, err := s.abortBatchOn(ctx, shardID, batchID, false, decisionExpiresAt)
+
+	return err
+}
+
+func (s *Storage) abortBatchOn(ctx context.Context, shardID uint64, batchID string, coordinator bool, decisionExpiresAt int64) (bool, error) {
+	abortBatchCmd := NewAbortBatchCommand(batchID, coordinator, decisionExpiresAt, s.clock.Now().UnixNano())
+	result, err := abortBatchCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+	if err != nil {
+		return false, fmt.Errorf("failed to raft invoke: %w", err)
+	}
+
+	typedResult := result.(AbortBatchCommandResult)
+	if typedResult.Err != "" {
+		return false, errors.New(typedResult.Err)
+	}
+
+	return typedResult.Committed, nil
+}
+
+// recoverBatches resolves the cross-shard batches prepared on a shard and not resolved in time, which happens if their
+// coordinator failed halfway. The coordinator shard is asked to abort each batch, which either records the decision to
+// abort or reports that the batch has already been committed, and the shard follows that decision.
+func (s *Storage) recoverBatches(ctx context.Context, shardID uint64) error {
+	now := s.clock.Now()
+	expiredBatchesCmd := NewExpiredBatchesCommand(now.UnixNano())
+	result, err := expiredBatchesCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+	if err != nil {
+		return fmt.Errorf("failed to raft invoke: %w", err)
+	}
+
+	typedResult := result.(ExpiredBatchesCommandResult)
+	if typedResult.Err != "" {
+		return errors.New(typedResult.Err)
+	}
+
+	decisionExpiresAt := now.Add(batchDecisionRetention).UnixNano()
+	for batchID, coordinator := range typedResult.Coordinators {
+		committed, err := s.abortBatchOn(ctx, coordinator, batchID, true, decisionExpiresAt)
+		if err != nil {
+			return fmt.Errorf("failed to abort batch on coordinator: %w", err)
+		}
+
+		if shardID == coordinator && !committed {
+			continue
+		}
+
+		if err := s.resolveBatch(ctx, shardID, batchID, committed, decisionExpiresAt); err != nil {
+			return fmt.Errorf("failed to resolve batch: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func batchCommandError(errStr string) error {
+	switch {
+	case stor.IsErrNotFound(errStr):
+		return stor.ErrNotFound
+	case stor.IsErrInvalidVersion(errStr):
+		return stor.ErrInvalidVersion
+	default:
+		return errors.New(errStr)
+	}
 }
 
-func (s *Storage) Free(ctx context.Context, namespace, resource string, tokens, version int64) (int64, int64, bool, error) {
+func (s *Storage) Free(ctx context.Context, namespace, resource, holder string, tokens, version int64, leaseID, idempotencyKey string) (int64, int64, bool, error) {
 	id := strings.Join([]string{namespace, resource}, "_")
-	shardID := shardIDFromString(id, s.cfg.Shards)
+	shardID := s.nh.ShardIDFromString(id)
 
-	freeCmd := NewFreeCommand(namespace, resource, tokens, version)
+	now := s.clock.Now()
+	freeCmd := NewFreeCommand(namespace, resource, holder, tokens, version, leaseID, idempotencyKey, now.UnixNano(), now.Add(s.idempotencyWindow).UnixNano(), caller.FromContext(ctx), audit.TraceID(ctx))
 	result, err := freeCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
 	if err != nil {
 		return 0, 0, false, fmt.Errorf("failed to raft invoke: %w", err)
@@ -241,298 +480,1805 @@ func (s *Storage) Free(ctx context.Context, namespace, resource string, tokens,
 	return typedResult.RemainingTokens, typedResult.CurrentVersion, typedResult.OK, nil
 }
 
+func (s *Storage) Renew(ctx context.Context, namespace, resource, leaseID string, ttl time.Duration) (time.Time, bool, error) {
+	id := strings.Join([]string{namespace, resource}, "_")
+	shardID := s.nh.ShardIDFromString(id)
+
+	now := s.clock.Now()
+	renewCmd := NewRenewCommand(namespace, resource, leaseID, now.UnixNano(), now.Add(ttl).UnixNano())
+	result, err := renewCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to raft invoke: %w", err)
+	}
+
+	typedResult := result.(RenewCommandResult)
+	if typedResult.Err != "" {
+		switch {
+		case stor.IsErrNotFound(typedResult.Err):
+			return time.Time{}, false, stor.ErrNotFound
+		}
+
+		return time.Time{}, false, errors.New(typedResult.Err)
+	}
+
+	if !typedResult.OK {
+		return time.Time{}, false, nil
+	}
+
+	return time.Unix(0, typedResult.ExpiresAt), true, nil
+}
+
+// ExpireLeases proposes the expiry of leases, and of results of idempotency keys, on the shards led by this replica.
+// The time of expiry is replicated with the command, so the wall clocks of other replicas never decide what expires.
+// An expiry is only proposed if anything is due, so that idle shards do not grow their logs. It also resolves the
+// cross-shard batches left prepared on these shards. A shard failing does not keep the others from expiring, and the
+// errors of all shards are returned together.
+func (s *Storage) ExpireLeases(ctx context.Context) (int, error) {
+	expired := 0
+	var errs []error
+	for _, shardID := range s.nh.ShardIDs() {
+		if !s.nh.IsShardLeader(shardID) {
+			continue
+		}
+
+		n, err := s.expireLeasesOn(ctx, shardID)
+		expired += n
+		if err != nil {
+			errs = append(errs, fmt.Errorf("shardID=%d: %w", shardID, err))
+			continue
+		}
+
+		if err := s.recoverBatches(ctx, shardID); err != nil {
+			errs = append(errs, fmt.Errorf("shardID=%d: failed to recover batches: %w", shardID, err))
+		}
+	}
+
+	return expired, shardErrors(errs)
+}
+
+// expireLeasesOn proposes the expiry of leases on a shard, if a read of the shard finds any expiry due.
+func (s *Storage) expireLeasesOn(ctx context.Context, shardID uint64) (int, error) {
+	now := s.clock.Now().UnixNano()
+	dueExpiriesCmd := NewDueExpiriesCommand(now)
+	result, err := dueExpiriesCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+	if err != nil {
+		return 0, fmt.Errorf("failed to raft invoke: %w", err)
+	}
+
+	dueResult := result.(DueExpiriesCommandResult)
+	if dueResult.Err != "" {
+		return 0, errors.New(dueResult.Err)
+	}
+
+	if dueResult.Due == 0 {
+		return 0, nil
+	}
+
+	expireLeasesCmd := NewExpireLeasesCommand(now)
+	result, err = expireLeasesCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+	if err != nil {
+		return 0, fmt.Errorf("failed to raft invoke: %w", err)
+	}
+
+	typedResult := result.(ExpireLeasesCommandResult)
+	if typedResult.Err != "" {
+		return 0, errors.New(typedResult.Err)
+	}
+
+	return typedResult.Expired, nil
+}
+
+// shardErrors combines the errors of several shards into one, which wraps the first of them.
+func shardErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+
+	msgs := make([]string, 0, len(errs)-1)
+	for _, err := range errs[1:] {
+		msgs = append(msgs, err.Error())
+	}
+
+	return fmt.Errorf("%w; %s", errs[0], strings.Join(msgs, "; "))
+}
+
+// ResetPeriods proposes the reset of the periodic quotas whose period has ended, on the shards led by this replica. Like
+// with ExpireLeases, the time is replicated with the command. A reset is only proposed if one is due, so that idle
+// shards do not grow their logs.
+func (s *Storage) ResetPeriods(ctx context.Context) (int, error) {
+	reset := 0
+	for _, shardID := range s.nh.ShardIDs() {
+		if !s.nh.IsShardLeader(shardID) {
+			continue
+		}
+
+		now := s.clock.Now().UnixNano()
+		duePeriodsCmd := NewDuePeriodsCommand(now)
+		result, err := duePeriodsCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+		if err != nil {
+			return reset, fmt.Errorf("failed to raft invoke: %w", err)
+		}
+
+		dueResult := result.(DuePeriodsCommandResult)
+		if dueResult.Err != "" {
+			return reset, errors.New(dueResult.Err)
+		}
+
+		if dueResult.Due == 0 {
+			continue
+		}
+
+		resetPeriodsCmd := NewResetPeriodsCommand(now)
+		result, err = resetPeriodsCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+		if err != nil {
+			return reset, fmt.Errorf("failed to raft invoke: %w", err)
+		}
+
+		resetResult := result.(ResetPeriodsCommandResult)
+		if resetResult.Err != "" {
+			return reset, errors.New(resetResult.Err)
+		}
+
+		reset += resetResult.Reset
+	}
+
+	return reset, nil
+}
+
+// RecordHistory proposes sampling the allocated tokens of all quotas into the history, on the shards led by this
+// replica. Like with ExpireLeases, the time is replicated with the command, and so are the resolution and retention of
+// the history, so that all replicas keep the same windows.
+func (s *Storage) RecordHistory(ctx context.Context) (int, error) {
+	if s.cfg.HistoryResolution <= 0 || s.cfg.HistoryRetention <= 0 {
+		return 0, nil
+	}
+
+	recorded := 0
+	for _, shardID := range s.nh.ShardIDs() {
+		if !s.nh.IsShardLeader(shardID) {
+			continue
+		}
+
+		recordHistoryCmd := NewRecordHistoryCommand(s.clock.Now().UnixNano(), int64(s.cfg.HistoryResolution), int64(s.cfg.HistoryRetention))
+		result, err := recordHistoryCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+		if err != nil {
+			return recorded, fmt.Errorf("failed to raft invoke: %w", err)
+		}
+
+		typedResult := result.(RecordHistoryCommandResult)
+		if typedResult.Err != "" {
+			return recorded, errors.New(typedResult.Err)
+		}
+
+		recorded += typedResult.Recorded
+	}
+
+	return recorded, nil
+}
+
+// History returns the history of a quota in the windows starting between from and to, downsampled to step.
+func (s *Storage) History(ctx context.Context, namespace, resource string, from, to time.Time, step time.Duration) ([]history.Sample, error) {
+	id := strings.Join([]string{namespace, resource}, "_")
+	shardID := s.nh.ShardIDFromString(id)
+
+	historyCmd := NewHistoryCommand(namespace, resource, from.UnixNano(), to.UnixNano())
+	result, err := historyCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+	if err != nil {
+		return nil, fmt.Errorf("failed to raft invoke: %w", err)
+	}
+
+	typedResult := result.(HistoryCommandResult)
+	if typedResult.Err != "" {
+		switch {
+		case stor.IsErrNotFound(typedResult.Err):
+			return nil, stor.ErrNotFound
+		default:
+			return nil, errors.New(typedResult.Err)
+		}
+	}
+
+	return history.Downsample(typedResult.Samples, step), nil
+}
+
+// HostsQuota reports whether the shard of a quota is hosted by this replica.
+func (s *Storage) HostsQuota(namespace, resource string) bool {
+	return s.nh.HostsShard(s.nh.ShardIDFromString(strings.Join([]string{namespace, resource}, "_")))
+}
+
 func (s *Storage) RegisterQuota(ctx context.Context, namespace, resource string, cfg quota.Config) error {
 	id := strings.Join([]string{namespace, resource}, "_")
-	shardID := shardIDFromString(id, s.cfg.Shards)
+	shardID := s.nh.ShardIDFromString(id)
+
+	if err := s.validateParentShard(shardID, cfg); err != nil {
+		return err
+	}
+
+	registerQuotaCmd := NewRegisterQuotaCommand(namespace, resource, cfg, s.clock.Now().UnixNano(), caller.FromContext(ctx), audit.TraceID(ctx))
+	result, err := registerQuotaCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+	if err != nil {
+		return fmt.Errorf("failed to raft invoke: %w", err)
+	}
+
+	return quotaCommandError(result.(RegisterQuotaCommandResult).Err)
+}
+
+func (s *Storage) UpdateQuota(ctx context.Context, namespace, resource string, cfg quota.Config) error {
+	id := strings.Join([]string{namespace, resource}, "_")
+	shardID := s.nh.ShardIDFromString(id)
+
+	if err := s.validateParentShard(shardID, cfg); err != nil {
+		return err
+	}
+
+	updateQuotaCmd := NewUpdateQuotaCommand(namespace, resource, cfg, s.clock.Now().UnixNano(), caller.FromContext(ctx), audit.TraceID(ctx))
+	result, err := updateQuotaCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+	if err != nil {
+		return fmt.Errorf("failed to raft invoke: %w", err)
+	}
+
+	return quotaCommandError(result.(UpdateQuotaCommandResult).Err)
+}
+
+// validateParentShard checks that the parent of a quota lives in the same shard as the quota, so that allocations
+// charging both are applied in a single state machine transaction.
+func (s *Storage) validateParentShard(shardID uint64, cfg quota.Config) error {
+	namespace, resource, ok := cfg.ParentRef()
+	if !ok {
+		return nil
+	}
+
+	parentID := strings.Join([]string{namespace, resource}, "_")
+	if s.nh.ShardIDFromString(parentID) != shardID {
+		return fmt.Errorf("parent %s lives in another shard: %w", cfg.Parent, stor.ErrInvalidConfig)
+	}
+
+	return nil
+}
+
+func (s *Storage) DeleteQuota(ctx context.Context, namespace, resource string) error {
+	id := strings.Join([]string{namespace, resource}, "_")
+	shardID := s.nh.ShardIDFromString(id)
+
+	deleteQuotaCmd := NewDeleteQuotaCommand(namespace, resource, s.clock.Now().UnixNano(), caller.FromContext(ctx), audit.TraceID(ctx))
+	result, err := deleteQuotaCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+	if err != nil {
+		return fmt.Errorf("failed to raft invoke: %w", err)
+	}
+
+	return quotaCommandError(result.(DeleteQuotaCommandResult).Err)
+}
+
+// ListQuotas returns the quotas of all shards.
+func (s *Storage) ListQuotas(ctx context.Context) ([]quota.Quota, error) {
+	var quotas []quota.Quota
+	for _, shardID := range s.nh.ShardIDs() {
+		listQuotasCmd := NewListQuotasCommand()
+		result, err := listQuotasCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+		if err != nil {
+			return nil, fmt.Errorf("failed to raft invoke: %w", err)
+		}
+
+		typedResult := result.(ListQuotasCommandResult)
+		if typedResult.Err != "" {
+			return nil, errors.New(typedResult.Err)
+		}
+
+		quotas = append(quotas, typedResult.Quotas...)
+	}
+
+	return quotas, nil
+}
+
+// quotaCommandError restores the error of a quota command applied by the state machine.
+func quotaCommandError(errStr string) error {
+	switch {
+	case errStr == "":
+		return nil
+	case stor.IsErrNotFound(errStr):
+		return stor.ErrNotFound
+	case stor.IsErrAlreadyExists(errStr):
+		return stor.ErrAlreadyExists
+	case stor.IsErrCapacityBelowAllocated(errStr):
+		return stor.ErrCapacityBelowAllocated
+	case stor.IsErrInvalidConfig(errStr):
+		return fmt.Errorf("%s: %w", errStr, stor.ErrInvalidConfig)
+	default:
+		return errors.New(errStr)
+	}
+}
+
+// Backup writes a backup of every shard to w, as a section per shard. A shard is backed up once this replica has
+// applied every entry committed before, so each section is a consistent and up-to-date snapshot of its shard. Shards
+// are not backed up at the same point in time, though. The sections of the shards not hosted by this replica are
+// backed up by a peer hosting them.
+func (s *Storage) Backup(ctx context.Context, w io.Writer) error {
+	bw := backup.NewWriter(w)
+	for _, shardID := range s.nh.ShardIDs() {
+		if !s.nh.HostsShard(shardID) {
+			if err := s.backupRemoteShard(ctx, bw, shardID); err != nil {
+				return fmt.Errorf("failed to backup shardID=%d: %w", shardID, err)
+			}
+
+			continue
+		}
+
+		appliedIndexCmd := NewAppliedIndexCommand()
+		result, err := appliedIndexCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+		if err != nil {
+			return fmt.Errorf("failed to raft invoke: %w", err)
+		}
+
+		typedResult := result.(AppliedIndexCommandResult)
+		if typedResult.Err != "" {
+			return errors.New(typedResult.Err)
+		}
+
+		if err := s.storages[shardID].backup(bw, shardID); err != nil {
+			return fmt.Errorf("failed to backup shardID=%d: %w", shardID, err)
+		}
+
+		s.logger.Info("backed up shard", "shardID", shardID, "appliedIndex", typedResult.AppliedIndex)
+	}
+
+	return bw.Flush()
+}
+
+// backupRemoteShard copies the backup of a shard made by a peer hosting it into bw.
+func (s *Storage) backupRemoteShard(ctx context.Context, bw *backup.Writer, shardID uint64) error {
+	backupCmd := NewBackupCommand(shardID)
+	result, err := backupCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+	if err != nil {
+		return fmt.Errorf("failed to raft invoke: %w", err)
+	}
+
+	typedResult := result.(BackupCommandResult)
+	if typedResult.Err != "" {
+		return errors.New(typedResult.Err)
+	}
+
+	br := backup.NewReader(bytes.NewReader(typedResult.Backup))
+	id, err := br.NextSection()
+	if err != nil {
+		return fmt.Errorf("failed to read section: %w", err)
+	}
+
+	if id != shardID {
+		return fmt.Errorf("peer backed up shardID=%d instead", id)
+	}
+
+	s.logger.Info("backed up shard through peer", "shardID", shardID)
+
+	return bw.CopySection(shardID, br)
+}
+
+// Restore replicates a backup written by Backup to the shards, which must not have any quotas. The keys of a shard are
+// proposed in chunks, so that every replica writes them as it applies the raft log. Since the shard of a quota follows
+// from its key, the cluster must have as many shards as the one backed up.
+func (s *Storage) Restore(ctx context.Context, r io.Reader) error {
+	quotas, err := s.ListQuotas(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list quotas: %w", err)
+	}
+
+	if len(quotas) > 0 {
+		return fmt.Errorf("storage has quotas: %w", stor.ErrAlreadyExists)
+	}
+
+	shardIDs := s.nh.ShardIDs()
+	br := backup.NewReader(r)
+	var restored int
+	for {
+		shardID, err := br.NextSection()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read section: %w", err)
+		}
+
+		if shardID == 0 || shardID > uint64(len(shardIDs)) {
+			return fmt.Errorf("backup holds shard %d, but there are %d shards: %w", shardID, len(shardIDs), stor.ErrInvalidConfig)
+		}
+
+		if err := s.restoreShard(ctx, shardID, br); err != nil {
+			return fmt.Errorf("failed to restore shardID=%d: %w", shardID, err)
+		}
+
+		restored++
+	}
+
+	if restored != len(shardIDs) {
+		return fmt.Errorf("backup holds %d shards, but there are %d: %w", restored, len(shardIDs), stor.ErrInvalidConfig)
+	}
+
+	return nil
+}
+
+// restoreShard proposes the keys of the current section of a backup in chunks of restoreChunkSize.
+func (s *Storage) restoreShard(ctx context.Context, shardID uint64, br *backup.Reader) error {
+	var (
+		keys, values [][]byte
+		size         int
+		first        = true
+	)
+	for {
+		key, value, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read key: %w", err)
+		}
+
+		keys, values = append(keys, key), append(values, value)
+		size += len(key) + len(value)
+		if size < restoreChunkSize {
+			continue
+		}
+
+		if err := s.proposeRestore(ctx, shardID, keys, values, first); err != nil {
+			return err
+		}
+
+		keys, values, size, first = nil, nil, 0, false
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	return s.proposeRestore(ctx, shardID, keys, values, first)
+}
+
+func (s *Storage) proposeRestore(ctx context.Context, shardID uint64, keys, values [][]byte, first bool) error {
+	restoreCmd := NewRestoreCommand(keys, values, first)
+	result, err := restoreCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+	if err != nil {
+		return fmt.Errorf("failed to raft invoke: %w", err)
+	}
+
+	return quotaCommandError(result.(RestoreCommandResult).Err)
+}
+
+// Export returns the state of all quotas of all shards, along with their leases, ordered by export.Sort.
+func (s *Storage) Export(ctx context.Context) ([]export.Item, error) {
+	var items []export.Item
+	for _, shardID := range s.nh.ShardIDs() {
+		exportCmd := NewExportCommand()
+		result, err := exportCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+		if err != nil {
+			return nil, fmt.Errorf("failed to raft invoke: %w", err)
+		}
+
+		typedResult := result.(ExportCommandResult)
+		if typedResult.Err != "" {
+			return nil, errors.New(typedResult.Err)
+		}
+
+		items = append(items, typedResult.Items...)
+	}
+
+	export.Sort(items)
+
+	return items, nil
+}
+
+// Import writes the state of exported quotas as it is, registering the missing ones and overwriting the others along
+// with their leases. The items of a shard are proposed in order and in chunks of importChunkSize, so parents have to
+// come before their children, and an import stops at the first invalid item.
+func (s *Storage) Import(ctx context.Context, items []export.Item) error {
+	shardItems := make(map[uint64][]export.Item)
+	for _, it := range items {
+		shardID := s.nh.ShardIDFromString(strings.Join([]string{it.Namespace, it.Resource}, "_"))
+		if err := s.validateParentShard(shardID, it.Strategy); err != nil {
+			return fmt.Errorf("failed to import %s/%s: %w", it.Namespace, it.Resource, err)
+		}
+
+		shardItems[shardID] = append(shardItems[shardID], it)
+	}
+
+	for _, shardID := range s.nh.ShardIDs() {
+		for chunk := shardItems[shardID]; len(chunk) > 0; {
+			n := len(chunk)
+			if n > importChunkSize {
+				n = importChunkSize
+			}
+
+			importCmd := NewImportCommand(chunk[:n], s.clock.Now().UnixNano(), caller.FromContext(ctx), audit.TraceID(ctx))
+			result, err := importCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+			if err != nil {
+				return fmt.Errorf("failed to raft invoke: %w", err)
+			}
+
+			if err := quotaCommandError(result.(ImportCommandResult).Err); err != nil {
+				return err
+			}
+
+			chunk = chunk[n:]
+		}
+	}
+
+	return nil
+}
+
+// InvokeShard invokes an encoded command on a shard hosted by this replica, and returns its encoded result. It serves
+// the commands forwarded by peers not hosting the shard.
+func (s *Storage) InvokeShard(ctx context.Context, shardID uint64, data []byte) ([]byte, error) {
+	if !s.nh.HostsShard(shardID) {
+		return nil, fmt.Errorf("failed to invoke command on shardID=%d: %w", shardID, ErrShardNotHosted)
+	}
+
+	cmd, err := decodeForwardedCommand(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode command: %w", err)
+	}
+
+	result, err := cmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+	if err != nil {
+		return nil, fmt.Errorf("failed to raft invoke: %w", err)
+	}
+
+	return EncodeCommandResult(result), nil
+}
+
+// decodeForwardedCommand decodes a command sent by a peer. Unlike the raft log, the request may hold anything, so a
+// command failing to decode is reported instead of panicking.
+func decodeForwardedCommand(data []byte) (cmd Command, err error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			cmd, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+
+	return DecodeCommand(data)
+}
+
+func (s *Storage) AddRaftReplica(ctx context.Context, replicaID uint64, raftAddr string) ([]uint64, []uint64, error) {
+	return s.nh.AddReplica(ctx, replicaID, raftAddr)
+}
+
+func (s *Storage) RemoveRaftReplica(ctx context.Context, replicaID uint64, shardIDs []uint64) error {
+	return s.nh.RemoveReplica(ctx, replicaID, shardIDs)
+}
+
+func (s *Storage) AwaitHealthy(ctx context.Context) error {
+	return s.nh.AwaitHealthy(ctx)
+}
+
+func (s *Storage) AllShardsHealthy() bool {
+	return s.nh.AllShardsHealthy()
+}
+
+func (s *Storage) ShardHealthy(shardID uint64) bool {
+	return s.nh.ShardHealthy(shardID)
+}
+
+func (s *Storage) Shutdown(_ context.Context) error {
+	var err error
+	s.shutdownOnce.Do(func() {
+		err = s.nh.Shutdown()
+	})
+
+	return err
+}
+
+// change is a quota changed by a command. Changes are published to the watchers of the quotas once the command is
+// applied.
+type change struct {
+	id        string
+	namespace string
+	resource  string
+	deleted   bool
+}
+
+type storage struct {
+	dir     string
+	db      *badger.DB
+	logger  log.Logger
+	hub     *watch.Hub
+	audit   *audit.Log
+	changes []change
+}
+
+func newStorage(dir string, logger log.Logger, hub *watch.Hub, auditLog *audit.Log) (*storage, error) {
+	opts := badger.DefaultOptions(dir)
+	opts.Logger = badgerlog.NewLogger(logger)
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open badger: %w", err)
+	}
+
+	return &storage{
+		dir:    dir,
+		db:     db,
+		logger: logger,
+		hub:    hub,
+		audit:  auditLog,
+	}, nil
+}
+
+func (s *storage) view(namespace, resource string) (int64, int64, int64, error) {
+	if s.db.IsClosed() {
+		return 0, 0, 0, errors.New("badger db is closed")
+	}
+
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	it, err := badgerkv.Get[badgerkv.Item](txn, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+			return 0, 0, 0, stor.ErrNotFound
+		default:
+		}
+
+		return 0, 0, 0, fmt.Errorf("failed to get: %w", err)
+	}
+
+	return it.Allocated, it.Capacity, it.Version, nil
+}
+
+func (s *storage) viewHolders(namespace, resource string) (int64, int64, int64, map[string]int64, error) {
+	if s.db.IsClosed() {
+		return 0, 0, 0, nil, errors.New("badger db is closed")
+	}
+
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	it, err := badgerkv.Get[badgerkv.Item](txn, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+			return 0, 0, 0, nil, stor.ErrNotFound
+		default:
+		}
+
+		return 0, 0, 0, nil, fmt.Errorf("failed to get: %w", err)
+	}
+
+	holders, err := badgerkv.GetHolders(txn, id)
+	if err != nil {
+		return 0, 0, 0, nil, fmt.Errorf("failed to get holders: %w", err)
+	}
+
+	return it.Allocated, it.Capacity, it.Version, holders, nil
+}
+
+func (s *storage) alloc(e *audit.Entry, namespace, resource, holder string, tokens, version int64, leaseID string, expiresAt int64, idempotencyKey string, now, resultExpiresAt int64, entryIdx uint64) (int64, int64, string, bool, bool, error) {
+	if s.db.IsClosed() {
+		return 0, 0, "", false, false, errors.New("badger db is closed")
+	}
+
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	it, err := badgerkv.Get[badgerkv.Item](txn, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+			return 0, 0, "", false, false, stor.ErrNotFound
+		default:
+		}
+
+		return 0, 0, "", false, false, fmt.Errorf("failed to get: %w", err)
+	}
+
+	e.Before = badgerkv.AuditState(it)
+
+	var resultKey string
+	if idempotencyKey != "" {
+		resultKey = badgerkv.ResultKeyPrefix + strings.Join([]string{badgerkv.AllocOp, id, idempotencyKey}, "_")
+		r, found, err := badgerkv.GetResult(txn, resultKey, now)
+		if err != nil {
+			return 0, 0, "", false, false, fmt.Errorf("failed to get result: %w", err)
+		}
+
+		if found {
+			return r.RemainingTokens, r.CurrentVersion, r.LeaseID, r.OK, r.OverSoftLimit, nil
+		}
+	}
+
+	if version != 0 && it.Version != version {
+		return 0, 0, "", false, false, stor.ErrInvalidVersion
+	}
+
+	cfg, err := badgerkv.GetConfig(txn, id, it)
+	if err != nil {
+		return 0, 0, "", false, false, fmt.Errorf("failed to get config: %w", err)
+	}
+
+	newAllocated := it.Allocated + tokens
+	if newAllocated > cfg.Limit() {
+		return cfg.Limit() - it.Allocated, it.Version, "", false, false, nil
+	}
+
+	ancestors, err := badgerkv.GetAncestors(txn, id)
+	if err != nil {
+		return 0, 0, "", false, false, fmt.Errorf("failed to get ancestors: %w", err)
+	}
+
+	fits, err := badgerkv.FitAncestors(txn, ancestors, tokens)
+	if err != nil {
+		return 0, 0, "", false, false, fmt.Errorf("failed to fit ancestors: %w", err)
+	}
+
+	if !fits {
+		return cfg.Limit() - it.Allocated, it.Version, "", false, false, nil
+	}
+
+	it.Allocated = newAllocated
+	it.Version += 1
+	if err := badgerkv.Set[badgerkv.Item](txn, id, it); err != nil {
+		return 0, 0, "", false, false, fmt.Errorf("failed to set item: %w", err)
+	}
+
+	if err := badgerkv.ChargeAncestors(txn, ancestors, tokens); err != nil {
+		return 0, 0, "", false, false, fmt.Errorf("failed to charge ancestors: %w", err)
+	}
+
+	if holder != "" {
+		holders, err := badgerkv.GetHolders(txn, id)
+		if err != nil {
+			return 0, 0, "", false, false, fmt.Errorf("failed to get holders: %w", err)
+		}
+
+		holders[holder] += tokens
+		if err := badgerkv.SetHolders(txn, id, holders); err != nil {
+			return 0, 0, "", false, false, fmt.Errorf("failed to set holders: %w", err)
+		}
+	}
+
+	if leaseID != "" {
+		l := badgerkv.Lease{Namespace: namespace, Resource: resource, Holder: holder, Tokens: tokens, ExpiresAt: expiresAt}
+		if err := badgerkv.SetLease(txn, leaseID, l); err != nil {
+			return 0, 0, "", false, false, fmt.Errorf("failed to set lease: %w", err)
+		}
+	}
+
+	if resultKey != "" {
+		r := badgerkv.Result{RemainingTokens: cfg.Limit() - it.Allocated, CurrentVersion: it.Version, LeaseID: leaseID, OK: true, OverSoftLimit: cfg.OverSoftLimit(it.Allocated), ExpiresAt: resultExpiresAt}
+		if err := badgerkv.SetJSON(txn, resultKey, r); err != nil {
+			return 0, 0, "", false, false, fmt.Errorf("failed to set result: %w", err)
+		}
+	}
+
+	if err := badgerkv.Set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
+		return 0, 0, "", false, false, fmt.Errorf("failed to set entry index: %w", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return 0, 0, "", false, false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	e.After = badgerkv.AuditState(it)
+	s.changes = append(s.changes, change{id: id})
+
+	return cfg.Limit() - it.Allocated, it.Version, leaseID, true, cfg.OverSoftLimit(it.Allocated), nil
+}
+
+func (s *storage) free(e *audit.Entry, namespace, resource, holder string, tokens, version int64, leaseID, idempotencyKey string, now, resultExpiresAt int64, entryIdx uint64) (int64, int64, bool, error) {
+	if s.db.IsClosed() {
+		return 0, 0, false, errors.New("badger db is closed")
+	}
+
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	it, err := badgerkv.Get[badgerkv.Item](txn, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+			return 0, 0, false, stor.ErrNotFound
+		default:
+		}
+
+		return 0, 0, false, fmt.Errorf("failed to get: %w", err)
+	}
+
+	e.Before = badgerkv.AuditState(it)
+
+	cfg, err := badgerkv.GetConfig(txn, id, it)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("failed to get config: %w", err)
+	}
+
+	var resultKey string
+	if idempotencyKey != "" {
+		resultKey = badgerkv.ResultKeyPrefix + strings.Join([]string{badgerkv.FreeOp, id, idempotencyKey}, "_")
+		r, found, err := badgerkv.GetResult(txn, resultKey, now)
+		if err != nil {
+			return 0, 0, false, fmt.Errorf("failed to get result: %w", err)
+		}
+
+		if found {
+			return r.RemainingTokens, r.CurrentVersion, r.OK, nil
+		}
+	}
+
+	if version != 0 && it.Version != version {
+		return 0, 0, false, stor.ErrInvalidVersion
+	}
+
+	if leaseID != "" {
+		l, err := badgerkv.GetLease(txn, leaseID)
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return cfg.Limit() - it.Allocated, it.Version, false, nil
+			}
+
+			return 0, 0, false, fmt.Errorf("failed to get lease: %w", err)
+		}
+
+		if l.Namespace != namespace || l.Resource != resource || l.Holder != holder {
+			return cfg.Limit() - it.Allocated, it.Version, false, nil
+		}
+
+		if err := txn.Delete([]byte(badgerkv.LeaseKeyPrefix + leaseID)); err != nil {
+			return 0, 0, false, fmt.Errorf("failed to delete lease: %w", err)
+		}
+
+		tokens = l.Tokens
+	}
+
+	holders, err := badgerkv.GetHolders(txn, id)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("failed to get holders: %w", err)
+	}
+
+	freeable, err := badgerkv.Freeable(txn, id, it, holders, holder)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("failed to get freeable tokens: %w", err)
+	}
+
+	if tokens > freeable {
+		return cfg.Limit() - it.Allocated, it.Version, false, nil
+	}
+
+	it.Allocated -= tokens
+	it.Version += 1
+	if err := badgerkv.Set[badgerkv.Item](txn, id, it); err != nil {
+		return 0, 0, false, fmt.Errorf("failed to set item: %w", err)
+	}
+
+	ancestors, err := badgerkv.GetAncestors(txn, id)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("failed to get ancestors: %w", err)
+	}
+
+	if err := badgerkv.ChargeAncestors(txn, ancestors, -tokens); err != nil {
+		return 0, 0, false, fmt.Errorf("failed to release ancestors: %w", err)
+	}
+
+	if holder != "" {
+		holders[holder] -= tokens
+		if err := badgerkv.SetHolders(txn, id, holders); err != nil {
+			return 0, 0, false, fmt.Errorf("failed to set holders: %w", err)
+		}
+	}
+
+	if resultKey != "" {
+		r := badgerkv.Result{RemainingTokens: cfg.Limit() - it.Allocated, CurrentVersion: it.Version, OK: true, ExpiresAt: resultExpiresAt}
+		if err := badgerkv.SetJSON(txn, resultKey, r); err != nil {
+			return 0, 0, false, fmt.Errorf("failed to set result: %w", err)
+		}
+	}
+
+	if err := badgerkv.Set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
+		return 0, 0, false, fmt.Errorf("failed to set entry index: %w", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return 0, 0, false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	e.After = badgerkv.AuditState(it)
+	s.changes = append(s.changes, change{id: id})
+
+	return cfg.Limit() - it.Allocated, it.Version, true, nil
+}
+
+// renew extends a lease to expiresAt. Returns false if the lease is unknown or has expired at now. Both times are in
+// Unix nanoseconds and come from the command, not from the clock of the replica.
+func (s *storage) renew(namespace, resource, leaseID string, now, expiresAt int64, entryIdx uint64) (int64, bool, error) {
+	if s.db.IsClosed() {
+		return 0, false, errors.New("badger db is closed")
+	}
+
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	if _, err := badgerkv.Get[badgerkv.Item](txn, id); err != nil {
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+			return 0, false, stor.ErrNotFound
+		default:
+		}
+
+		return 0, false, fmt.Errorf("failed to get: %w", err)
+	}
+
+	l, err := badgerkv.GetLease(txn, leaseID)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return 0, false, nil
+		}
+
+		return 0, false, fmt.Errorf("failed to get lease: %w", err)
+	}
+
+	if l.Namespace != namespace || l.Resource != resource || l.ExpiresAt <= now {
+		return 0, false, nil
+	}
+
+	l.ExpiresAt = expiresAt
+	if err := badgerkv.SetLease(txn, leaseID, l); err != nil {
+		return 0, false, fmt.Errorf("failed to set lease: %w", err)
+	}
+
+	if err := badgerkv.Set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
+		return 0, false, fmt.Errorf("failed to set entry index: %w", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return 0, false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return expiresAt, true, nil
+}
+
+// expireLeases frees the tokens of the leases that expired at now, given in Unix nanoseconds by the command. It also
+// forgets the results of idempotency keys past their window.
+func (s *storage) expireLeases(now int64, entryIdx uint64) (int, error) {
+	if s.db.IsClosed() {
+		return 0, errors.New("badger db is closed")
+	}
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	expired, entries, err := badgerkv.ExpireLeases(txn, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire leases: %w", err)
+	}
+
+	if _, err := badgerkv.ForgetResults(txn, now); err != nil {
+		return 0, fmt.Errorf("failed to forget results: %w", err)
+	}
+
+	if _, err := forgetDecisions(txn, now); err != nil {
+		return 0, fmt.Errorf("failed to forget decisions: %w", err)
+	}
+
+	if err := badgerkv.Set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
+		return 0, fmt.Errorf("failed to set entry index: %w", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.record(stampAuditEntries(entries, now, entryIdx))
+
+	return expired, nil
+}
+
+// dueExpiries returns the number of leases, results of idempotency keys and batch decisions that expired at now, given
+// in Unix nanoseconds, so that an expiry is only proposed if there is anything to expire.
+func (s *storage) dueExpiries(now int64) (int, error) {
+	if s.db.IsClosed() {
+		return 0, errors.New("badger db is closed")
+	}
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	leases, err := badgerkv.DueLeases(txn, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get due leases: %w", err)
+	}
+
+	results, err := badgerkv.DueResults(txn, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get due results: %w", err)
+	}
+
+	decisions, err := expiredDecisionKeys(txn, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get due decisions: %w", err)
+	}
+
+	return leases + results + len(decisions), nil
+}
+
+func (s *storage) allocBatch(entries []audit.Entry, items []batch.Item, entryIdx uint64) ([]batch.Result, bool, error) {
+	if s.db.IsClosed() {
+		return nil, false, errors.New("badger db is closed")
+	}
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	results, ok, err := badgerkv.AllocBatch(txn, items, entries)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !ok {
+		return results, false, nil
+	}
+
+	if err := badgerkv.Set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
+		return nil, false, fmt.Errorf("failed to set entry index: %w", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return nil, false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.changeItems(items)
+
+	return results, true, nil
+}
+
+// prepareBatch allocates the tokens of the items of a cross-shard batch held by this shard, and remembers them under
+// the batch ID until the batch is committed or aborted. Prepared batches not resolved by expiresAt, in Unix
+// nanoseconds, are resolved by the leader of the shard.
+func (s *storage) prepareBatch(entries []audit.Entry, batchID string, coordinator uint64, items []batch.Item, expiresAt int64, entryIdx uint64) ([]batch.Result, bool, error) {
+	if s.db.IsClosed() {
+		return nil, false, errors.New("badger db is closed")
+	}
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	results, ok, err := badgerkv.AllocBatch(txn, items, entries)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !ok {
+		return results, false, nil
+	}
+
+	pb := preparedBatch{Coordinator: coordinator, Items: items, ExpiresAt: expiresAt}
+	if err := badgerkv.SetJSON(txn, batchKeyPrefix+batchID, pb); err != nil {
+		return nil, false, fmt.Errorf("failed to set prepared batch: %w", err)
+	}
+
+	if err := badgerkv.Set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
+		return nil, false, fmt.Errorf("failed to set entry index: %w", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return nil, false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.changeItems(items)
+
+	return results, true, nil
+}
+
+// commitBatch keeps the tokens prepared for a batch. On the coordinator shard it also records the decision to commit,
+// and returns false if the batch has already been decided to abort.
+func (s *storage) commitBatch(batchID string, coordinator bool, decisionExpiresAt int64, entryIdx uint64) (bool, error) {
+	if s.db.IsClosed() {
+		return false, errors.New("badger db is closed")
+	}
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	if coordinator {
+		d, found, err := getDecision(txn, batchID)
+		if err != nil {
+			return false, fmt.Errorf("failed to get decision: %w", err)
+		}
+
+		if found && !d.Committed {
+			return false, nil
+		}
+
+		if err := badgerkv.SetJSON(txn, decisionKeyPrefix+batchID, decision{Committed: true, ExpiresAt: decisionExpiresAt}); err != nil {
+			return false, fmt.Errorf("failed to set decision: %w", err)
+		}
+	}
+
+	if err := txn.Delete([]byte(batchKeyPrefix + batchID)); err != nil {
+		return false, fmt.Errorf("failed to delete prepared batch: %w", err)
+	}
+
+	if err := badgerkv.Set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
+		return false, fmt.Errorf("failed to set entry index: %w", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return true, nil
+}
+
+// abortBatch frees the tokens prepared for a batch. On the coordinator shard it also records the decision to abort,
+// unless the batch has already been decided to commit, in which case nothing is freed and true is returned. The tokens
+// freed are recorded in the audit log at now, given in Unix nanoseconds.
+func (s *storage) abortBatch(batchID string, coordinator bool, decisionExpiresAt, now int64, entryIdx uint64) (bool, error) {
+	if s.db.IsClosed() {
+		return false, errors.New("badger db is closed")
+	}
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	if coordinator {
+		d, found, err := getDecision(txn, batchID)
+		if err != nil {
+			return false, fmt.Errorf("failed to get decision: %w", err)
+		}
+
+		if found && d.Committed {
+			return true, nil
+		}
+
+		if err := badgerkv.SetJSON(txn, decisionKeyPrefix+batchID, decision{Committed: false, ExpiresAt: decisionExpiresAt}); err != nil {
+			return false, fmt.Errorf("failed to set decision: %w", err)
+		}
+	}
+
+	pb, found, err := getPreparedBatch(txn, batchID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get prepared batch: %w", err)
+	}
+
+	var entries []audit.Entry
+	if found {
+		for _, bi := range pb.Items {
+			id := strings.Join([]string{bi.Namespace, bi.Resource}, "_")
+			it, err := badgerkv.Get[badgerkv.Item](txn, id)
+			switch {
+			case err == nil:
+				e := newAuditEntry(audit.AbortBatch, bi.Namespace, bi.Resource, "", "", now, entryIdx)
+				e.Holder, e.Tokens, e.Before = bi.Holder, bi.Tokens, badgerkv.AuditState(it)
+				it.Allocated -= bi.Tokens
+				if it.Allocated < 0 {
+					it.Allocated = 0
+				}
+
+				it.Version += 1
+				if err := badgerkv.Set[badgerkv.Item](txn, id, it); err != nil {
+					return false, fmt.Errorf("failed to set item: %w", err)
+				}
+
+				if bi.Holder != "" {
+					holders, err := badgerkv.GetHolders(txn, id)
+					if err != nil {
+						return false, fmt.Errorf("failed to get holders: %w", err)
+					}
+
+					holders[bi.Holder] -= bi.Tokens
+					if err := badgerkv.SetHolders(txn, id, holders); err != nil {
+						return false, fmt.Errorf("failed to set holders: %w", err)
+					}
+				}
+
+				ancestors, err := badgerkv.GetAncestors(txn, id)
+				if err != nil {
+					return false, fmt.Errorf("failed to get ancestors: %w", err)
+				}
+
+				if err := badgerkv.ChargeAncestors(txn, ancestors, -bi.Tokens); err != nil {
+					return false, fmt.Errorf("failed to release ancestors: %w", err)
+				}
+
+				e.After = badgerkv.AuditState(it)
+				e.SetResult(true, nil)
+				entries = append(entries, e)
+			case errors.Is(err, badger.ErrKeyNotFound):
+			default:
+				return false, fmt.Errorf("failed to get: %w", err)
+			}
+		}
+
+		if err := txn.Delete([]byte(batchKeyPrefix + batchID)); err != nil {
+			return false, fmt.Errorf("failed to delete prepared batch: %w", err)
+		}
+	}
+
+	if err := badgerkv.Set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
+		return false, fmt.Errorf("failed to set entry index: %w", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.record(entries)
+
+	return false, nil
+}
+
+// expiredBatches returns the prepared batches not resolved by now, given in Unix nanoseconds, keyed by their IDs.
+func (s *storage) expiredBatches(now int64) (map[string]preparedBatch, error) {
+	if s.db.IsClosed() {
+		return nil, errors.New("badger db is closed")
+	}
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(batchKeyPrefix)
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+
+	batches := make(map[string]preparedBatch)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		var pb preparedBatch
+		err := iter.Item().Value(func(val []byte) error {
+			return json.Unmarshal(val, &pb)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read prepared batch: %w", err)
+		}
+
+		if pb.ExpiresAt <= now {
+			batches[strings.TrimPrefix(string(iter.Item().KeyCopy(nil)), batchKeyPrefix)] = pb
+		}
+	}
+
+	return batches, nil
+}
+
+func (s *storage) registerQuota(e *audit.Entry, namespace, resource string, cfg quota.Config, now int64, entryIdx uint64) error {
+	if s.db.IsClosed() {
+		return errors.New("badger db is closed")
+	}
+
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	_, err := badgerkv.Get[badgerkv.Item](txn, id)
+	switch {
+	case err == nil:
+		// The reference is written anyway, since older versions did not store it.
+		ref, _, err := badgerkv.GetQuotaRef(txn, id)
+		if err != nil {
+			return fmt.Errorf("failed to get quota ref: %w", err)
+		}
+
+		if err := badgerkv.SetQuotaRef(txn, id, namespace, resource, ref.Config(0)); err != nil {
+			return fmt.Errorf("failed to set quota ref: %w", err)
+		}
+
+		if err := badgerkv.Set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
+			return fmt.Errorf("failed to set entry index: %w", err)
+		}
+
+		if err := txn.Commit(); err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+
+		return stor.ErrAlreadyExists
+	case errors.Is(err, badger.ErrKeyNotFound):
+	default:
+		return fmt.Errorf("failed to get: %w", err)
+	}
+
+	if cfg.Capacity <= 0 {
+		return fmt.Errorf("capacity must be greater than 0: %w", stor.ErrInvalidConfig)
+	}
+
+	if cfg.SoftLimit < 0 {
+		return fmt.Errorf("soft limit must not be negative: %w", stor.ErrInvalidConfig)
+	}
+
+	if cfg.Overcommit != 0 && cfg.Overcommit < 1 {
+		return fmt.Errorf("overcommit must be at least 1: %w", stor.ErrInvalidConfig)
+	}
+
+	if !cfg.ShrinkPolicy.Valid() {
+		return fmt.Errorf("unknown shrink policy %s: %w", cfg.ShrinkPolicy, stor.ErrInvalidConfig)
+	}
+
+	if _, err := cfg.PeriodStart(time.Time{}); err != nil {
+		return fmt.Errorf("invalid period: %s: %w", err, stor.ErrInvalidConfig)
+	}
+
+	if err := badgerkv.ValidateParent(txn, id, cfg); err != nil {
+		return err
+	}
+
+	it := badgerkv.Item{Allocated: 0, Capacity: cfg.Capacity, Version: 1}
+	if err := badgerkv.Set[badgerkv.Item](txn, id, it); err != nil {
+		return fmt.Errorf("failed to set item :%w", err)
+	}
+
+	if err := badgerkv.SetQuotaRef(txn, id, namespace, resource, cfg); err != nil {
+		return fmt.Errorf("failed to set quota ref: %w", err)
+	}
+
+	if err := badgerkv.SetPeriod(txn, id, cfg, time.Unix(0, now)); err != nil {
+		return fmt.Errorf("failed to set period: %w", err)
+	}
+
+	if err := badgerkv.Set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
+		return fmt.Errorf("failed to set entry index: %w", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	e.After = badgerkv.QuotaAuditState(it, cfg)
+	s.changes = append(s.changes, change{id: id})
+
+	return nil
+}
+
+func (s *storage) updateQuota(e *audit.Entry, namespace, resource string, cfg quota.Config, now int64, entryIdx uint64) error {
+	if s.db.IsClosed() {
+		return errors.New("badger db is closed")
+	}
+
+	if cfg.Capacity <= 0 {
+		return fmt.Errorf("capacity must be greater than 0: %w", stor.ErrInvalidConfig)
+	}
+
+	if cfg.SoftLimit < 0 {
+		return fmt.Errorf("soft limit must not be negative: %w", stor.ErrInvalidConfig)
+	}
+
+	if cfg.Overcommit != 0 && cfg.Overcommit < 1 {
+		return fmt.Errorf("overcommit must be at least 1: %w", stor.ErrInvalidConfig)
+	}
+
+	if !cfg.ShrinkPolicy.Valid() {
+		return fmt.Errorf("unknown shrink policy %s: %w", cfg.ShrinkPolicy, stor.ErrInvalidConfig)
+	}
+
+	if _, err := cfg.PeriodStart(time.Time{}); err != nil {
+		return fmt.Errorf("invalid period: %s: %w", err, stor.ErrInvalidConfig)
+	}
+
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	it, err := badgerkv.Get[badgerkv.Item](txn, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+			return stor.ErrNotFound
+		default:
+		}
+
+		return fmt.Errorf("failed to get: %w", err)
+	}
+
+	ref, _, err := badgerkv.GetQuotaRef(txn, id)
+	if err != nil {
+		return fmt.Errorf("failed to get quota ref: %w", err)
+	}
+
+	current := ref.Config(it.Capacity)
+	e.Before = badgerkv.QuotaAuditState(it, current)
+	if cfg.Capacity == current.Capacity && cfg.Parent == current.Parent && cfg.SoftLimit == current.SoftLimit && cfg.Overcommit == current.Overcommit && cfg.Period == current.Period && cfg.TimeZone == current.TimeZone {
+		e.After = e.Before
+		return nil
+	}
+
+	if cfg.Periodic() {
+		children, err := badgerkv.HasChildren(txn, namespace, resource)
+		if err != nil {
+			return fmt.Errorf("failed to check children: %w", err)
+		}
+
+		if children {
+			return fmt.Errorf("quota with child quotas cannot be periodic: %w", stor.ErrInvalidConfig)
+		}
+	}
+
+	if cfg.Parent != ref.Parent {
+		if it.Allocated > 0 {
+			return fmt.Errorf("parent cannot be changed with tokens allocated: %w", stor.ErrInvalidConfig)
+		}
+
+		if err := badgerkv.ValidateParent(txn, id, cfg); err != nil {
+			return err
+		}
+	}
+
+	if err := badgerkv.SetQuotaRef(txn, id, namespace, resource, cfg); err != nil {
+		return fmt.Errorf("failed to set quota ref: %w", err)
+	}
+
+	if err := badgerkv.Shrink(txn, id, it, cfg); err != nil {
+		return err
+	}
+
+	if cfg.Period != current.Period || cfg.TimeZone != current.TimeZone {
+		if err := badgerkv.SetPeriod(txn, id, cfg, time.Unix(0, now)); err != nil {
+			return fmt.Errorf("failed to set period: %w", err)
+		}
+	}
+
+	updated, err := badgerkv.Get[badgerkv.Item](txn, id)
+	if err != nil {
+		return fmt.Errorf("failed to get: %w", err)
+	}
+
+	if err := badgerkv.Set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
+		return fmt.Errorf("failed to set entry index: %w", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	e.After = badgerkv.QuotaAuditState(updated, cfg)
+	s.changes = append(s.changes, change{id: id})
+
+	return nil
+}
+
+func (s *storage) deleteQuota(e *audit.Entry, namespace, resource string, entryIdx uint64) error {
+	if s.db.IsClosed() {
+		return errors.New("badger db is closed")
+	}
+
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	it, err := badgerkv.Get[badgerkv.Item](txn, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+			return stor.ErrNotFound
+		default:
+		}
+
+		return fmt.Errorf("failed to get: %w", err)
+	}
 
-	registerQuotaCmd := NewRegisterQuotaCommand(namespace, resource, cfg)
-	_, err := registerQuotaCmd.RaftInvoke(ctx, s.nh, shardID, s.sessions[shardID])
+	ref, _, err := badgerkv.GetQuotaRef(txn, id)
 	if err != nil {
-		return fmt.Errorf("failed to raft invoke: %w", err)
+		return fmt.Errorf("failed to get quota ref: %w", err)
 	}
 
-	return nil
-}
+	e.Before = badgerkv.QuotaAuditState(it, ref.Config(it.Capacity))
 
-func (s *Storage) AddRaftReplica(ctx context.Context, replicaID uint64, raftAddr string) (bool, error) {
-	info := s.nh.GetNodeHostInfo(dragonboat.NodeHostInfoOption{SkipLogInfo: true})
+	children, err := badgerkv.HasChildren(txn, namespace, resource)
+	if err != nil {
+		return fmt.Errorf("failed to check children: %w", err)
+	}
 
-	if len(info.ShardInfoList) > 0 {
-		nodes := info.ShardInfoList[0].Nodes
-		for _, addr := range nodes {
-			if raftAddr == addr {
-				s.logger.Info("replica is already part of the raft cluster", "replicaID", replicaID, "raftAddr", raftAddr)
-				return true, nil
-			}
-		}
+	if children {
+		return fmt.Errorf("quota has child quotas: %w", stor.ErrInvalidConfig)
 	}
 
-	for shardID := uint64(1); shardID <= s.cfg.Shards; shardID++ {
-		ms, err := s.nh.SyncGetShardMembership(ctx, shardID)
-		if err != nil {
-			s.logger.Info("failed to get shard membership", "raftAddr", raftAddr, "replicaID", replicaID, "shardID", shardID, "err", err)
-			return false, fmt.Errorf("failed to get shard membership for replicaID=%d and shardID=%d: %w", replicaID, shardID, err)
-		}
+	ancestors, err := badgerkv.GetAncestors(txn, id)
+	if err != nil {
+		return fmt.Errorf("failed to get ancestors: %w", err)
+	}
 
-		err = s.nh.SyncRequestAddReplica(ctx, shardID, replicaID, raftAddr, ms.ConfigChangeID)
-		if err != nil {
-			s.logger.Info("failed to request add replica", "raftAddr", raftAddr, "replicaID", replicaID, "shardID", shardID, "err", err)
-			return false, fmt.Errorf("failed to request add replica for replicaID=%d and shardID=%d: %w", replicaID, shardID, err)
-		}
+	if err := badgerkv.ChargeAncestors(txn, ancestors, -it.Allocated); err != nil {
+		return fmt.Errorf("failed to release ancestors: %w", err)
 	}
 
-	return false, nil
-}
+	if err := txn.Delete([]byte(id)); err != nil {
+		return fmt.Errorf("failed to delete item: %w", err)
+	}
 
-func (s *Storage) RemoveRaftReplica(ctx context.Context, replicaID uint64) error {
-	// TODO: Handle already non-existent replica
+	if err := txn.Delete([]byte(badgerkv.QuotaRefKeyPrefix + id)); err != nil {
+		return fmt.Errorf("failed to delete quota ref: %w", err)
+	}
 
-	for shardID := uint64(1); shardID <= s.cfg.Shards; shardID++ {
-		ms, err := s.nh.SyncGetShardMembership(ctx, shardID)
-		if err != nil {
-			return fmt.Errorf("failed to get shard membership for replicaID=%d and shardID=%d: %w", replicaID, shardID, err)
-		}
+	if err := txn.Delete([]byte(badgerkv.HoldersKeyPrefix + id)); err != nil {
+		return fmt.Errorf("failed to delete holders: %w", err)
+	}
 
-		err = s.nh.SyncRequestDeleteReplica(ctx, shardID, replicaID, ms.ConfigChangeID)
-		if err != nil {
-			return fmt.Errorf("failed to request delete replica for replicaID=%d and shardID=%d: %w", replicaID, shardID, err)
-		}
+	if err := txn.Delete([]byte(badgerkv.PeriodKeyPrefix + id)); err != nil {
+		return fmt.Errorf("failed to delete period: %w", err)
 	}
 
-	return nil
-}
+	if err := badgerkv.ForgetHistory(txn, id, time.Time{}); err != nil {
+		return fmt.Errorf("failed to delete history: %w", err)
+	}
 
-func (s *Storage) AwaitHealthy(ctx context.Context) error {
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
+	leases, err := badgerkv.ListLeases(txn)
+	if err != nil {
+		return fmt.Errorf("failed to list leases: %w", err)
+	}
 
-		if s.AllShardsHealthy() {
-			return nil
+	for key, l := range leases {
+		if l.Namespace == namespace && l.Resource == resource {
+			if err := txn.Delete([]byte(key)); err != nil {
+				return fmt.Errorf("failed to delete lease: %w", err)
+			}
 		}
 	}
-}
 
-func (s *Storage) AllShardsHealthy() bool {
-	for shardID := uint64(1); shardID <= s.cfg.Shards; shardID++ {
-		if !s.ShardHealthy(shardID) {
-			return false
-		}
+	if err := badgerkv.Set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
+		return fmt.Errorf("failed to set entry index: %w", err)
 	}
 
-	return true
-}
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
 
-func (s *Storage) ShardHealthy(shardID uint64) bool {
-	_, _, valid, err := s.nh.GetLeaderID(shardID)
-	if err != nil {
-		return false
+	s.changes = append(s.changes, change{namespace: namespace, resource: resource, deleted: true})
+	if len(ancestors) > 0 {
+		s.changes = append(s.changes, change{id: ancestors[0].ID})
 	}
 
-	return valid
+	return nil
 }
 
-func (s *Storage) Shutdown(_ context.Context) error {
-	var err error
-	s.shutdownOnce.Do(func() {
-		close(s.shutdown)
-		err = s.nh.StopReplica(s.cfg.ShardID, s.cfg.ReplicaID)
-		s.nh.Close()
-	})
+// duePeriods returns the number of periodic quotas whose period has ended by now, given in Unix nanoseconds.
+func (s *storage) duePeriods(now int64) (int, error) {
+	if s.db.IsClosed() {
+		return 0, errors.New("badger db is closed")
+	}
 
-	return err
-}
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
 
-func (s *Storage) isLeader() bool {
-	leaderID, _, valid, err := s.nh.GetLeaderID(s.cfg.ShardID)
+	ended, err := badgerkv.EndedPeriods(txn, time.Unix(0, now))
 	if err != nil {
-		return false
+		return 0, fmt.Errorf("failed to get ended periods: %w", err)
 	}
 
-	if !valid {
-		return false
-	}
+	return len(ended), nil
+}
 
-	if leaderID != s.cfg.ReplicaID {
-		return false
+// resetPeriods frees all tokens of the periodic quotas whose period has ended by now, given in Unix nanoseconds,
+// releasing them from their ancestors, and drops their leases.
+func (s *storage) resetPeriods(now int64, entryIdx uint64) (int, error) {
+	if s.db.IsClosed() {
+		return 0, errors.New("badger db is closed")
 	}
 
-	return true
-}
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
 
-type item struct {
-	Allocated int64
-	Capacity  int64
-	Version   int64
-}
+	entries, err := badgerkv.ResetPeriods(txn, time.Unix(0, now))
+	if err != nil {
+		return 0, fmt.Errorf("failed to reset periods: %w", err)
+	}
 
-type storage struct {
-	dir string
-	db  *badger.DB
-}
+	if err := badgerkv.Set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
+		return 0, fmt.Errorf("failed to set entry index: %w", err)
+	}
 
-func newStorage(dir string, logger log.Logger) (*storage, error) {
-	opts := badger.DefaultOptions(dir)
-	opts.Logger = badgerlog.NewLogger(logger)
-	db, err := badger.Open(opts)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open badger: %w", err)
+	if err := txn.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return &storage{
-		dir: dir,
-		db:  db,
-	}, nil
+	s.record(stampAuditEntries(entries, now, entryIdx))
+
+	return len(entries), nil
 }
 
-func (s *storage) view(namespace, resource string) (int64, int64, int64, error) {
+// recordHistory samples the allocated tokens of all quotas into the windows of the history containing now. All
+// arguments are in nanoseconds.
+func (s *storage) recordHistory(now, resolution, retention int64, entryIdx uint64) (int, error) {
 	if s.db.IsClosed() {
-		return 0, 0, 0, errors.New("badger db is closed")
+		return 0, errors.New("badger db is closed")
 	}
 
-	id := strings.Join([]string{namespace, resource}, "_")
-
 	txn := s.db.NewTransaction(true)
 	defer txn.Discard()
 
-	it, err := get[item](txn, id)
+	recorded, err := badgerkv.RecordHistory(txn, time.Unix(0, now), time.Duration(resolution), time.Duration(retention))
 	if err != nil {
-		switch {
-		case errors.Is(err, badger.ErrKeyNotFound):
-			return 0, 0, 0, stor.ErrNotFound
-		default:
-		}
+		return 0, fmt.Errorf("failed to record history: %w", err)
+	}
 
-		return 0, 0, 0, fmt.Errorf("failed to get: %w", err)
+	if err := badgerkv.Set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
+		return 0, fmt.Errorf("failed to set entry index: %w", err)
 	}
 
-	return it.Allocated, it.Capacity, it.Version, nil
+	if err := txn.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return recorded, nil
 }
 
-func (s *storage) alloc(namespace, resource string, tokens, version int64, entryIdx uint64) (int64, int64, bool, error) {
+// history returns the windows of the history of a quota starting between from and to, given in Unix nanoseconds.
+func (s *storage) history(namespace, resource string, from, to int64) ([]history.Sample, error) {
 	if s.db.IsClosed() {
-		return 0, 0, false, errors.New("badger db is closed")
+		return nil, errors.New("badger db is closed")
 	}
 
 	id := strings.Join([]string{namespace, resource}, "_")
 
-	txn := s.db.NewTransaction(true)
+	txn := s.db.NewTransaction(false)
 	defer txn.Discard()
 
-	it, err := get[item](txn, id)
-	if err != nil {
+	if _, err := badgerkv.Get[badgerkv.Item](txn, id); err != nil {
 		switch {
 		case errors.Is(err, badger.ErrKeyNotFound):
-			return 0, 0, false, stor.ErrNotFound
+			return nil, stor.ErrNotFound
 		default:
 		}
 
-		return 0, 0, false, fmt.Errorf("failed to get: %w", err)
+		return nil, fmt.Errorf("failed to get: %w", err)
 	}
 
-	if version != 0 && it.Version != version {
-		return 0, 0, false, stor.ErrInvalidVersion
+	samples, err := badgerkv.GetHistory(txn, id, time.Unix(0, from), time.Unix(0, to))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history: %w", err)
 	}
 
-	newAllocated := it.Allocated + tokens
-	if newAllocated > it.Capacity {
-		return it.Capacity - it.Allocated, it.Version, false, nil
+	return samples, nil
+}
+
+// changeItems records the quotas of the batch items as changed.
+func (s *storage) changeItems(items []batch.Item) {
+	for _, bi := range items {
+		s.changes = append(s.changes, change{id: strings.Join([]string{bi.Namespace, bi.Resource}, "_")})
 	}
+}
 
-	it.Allocated = newAllocated
-	it.Version += 1
-	if err := set[item](txn, id, it); err != nil {
-		return 0, 0, false, fmt.Errorf("failed to set item: %w", err)
+// record records the entries of mutations applied without a caller in the audit log, and the quotas they changed.
+func (s *storage) record(entries []audit.Entry) {
+	for _, e := range entries {
+		s.audit.Record(e)
+		s.changes = append(s.changes, change{id: strings.Join([]string{e.Namespace, e.Resource}, "_")})
 	}
+}
 
-	if err := set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
-		return 0, 0, false, fmt.Errorf("failed to set entry index: %w", err)
+// publishChanges publishes the quotas changed by the applied commands, along with their ancestors, to their watchers.
+func (s *storage) publishChanges() {
+	changes := s.changes
+	s.changes = nil
+
+	var ids []string
+	for _, c := range changes {
+		if c.deleted {
+			s.hub.Publish(c.namespace, c.resource, watch.Event{Deleted: true})
+			continue
+		}
+
+		ids = append(ids, c.id)
 	}
 
-	if err := txn.Commit(); err != nil {
-		return 0, 0, false, fmt.Errorf("failed to commit transaction: %w", err)
+	if len(ids) == 0 {
+		return
 	}
 
-	return it.Capacity - it.Allocated, it.Version, true, nil
+	err := s.db.View(func(txn *badger.Txn) error {
+		return badgerkv.Publish(txn, s.hub, ids)
+	})
+	if err != nil {
+		s.logger.Warn("failed to publish changes", "err", err)
+	}
 }
 
-func (s *storage) free(namespace, resource string, tokens, version int64, entryIdx uint64) (int64, int64, bool, error) {
+func (s *storage) listQuotas() ([]quota.Quota, error) {
 	if s.db.IsClosed() {
-		return 0, 0, false, errors.New("badger db is closed")
+		return nil, errors.New("badger db is closed")
 	}
 
-	id := strings.Join([]string{namespace, resource}, "_")
-
-	txn := s.db.NewTransaction(true)
+	txn := s.db.NewTransaction(false)
 	defer txn.Discard()
 
-	it, err := get[item](txn, id)
-	if err != nil {
-		switch {
-		case errors.Is(err, badger.ErrKeyNotFound):
-			return 0, 0, false, stor.ErrNotFound
-		default:
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(badgerkv.QuotaRefKeyPrefix)
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+
+	var quotas []quota.Quota
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		var ref badgerkv.QuotaRef
+		err := iter.Item().Value(func(val []byte) error {
+			return json.Unmarshal(val, &ref)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read quota ref: %w", err)
 		}
 
-		return 0, 0, false, fmt.Errorf("failed to get: %w", err)
-	}
+		it, err := badgerkv.Get[badgerkv.Item](txn, strings.Join([]string{ref.Namespace, ref.Resource}, "_"))
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
 
-	if version != 0 && it.Version != version {
-		return 0, 0, false, stor.ErrInvalidVersion
-	}
+			return nil, fmt.Errorf("failed to get: %w", err)
+		}
 
-	newAllocated := it.Allocated - tokens
-	if newAllocated < 0 {
-		return it.Capacity - it.Allocated, it.Version, false, nil
+		quotas = append(quotas, quota.Quota{Namespace: ref.Namespace, Resource: ref.Resource, Strategy: ref.Config(it.Capacity)})
 	}
 
-	it.Allocated = newAllocated
-	it.Version += 1
-	if err := set[item](txn, id, it); err != nil {
-		return 0, 0, false, fmt.Errorf("failed to set item: %w", err)
-	}
+	return quotas, nil
+}
 
-	if err := set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
-		return 0, 0, false, fmt.Errorf("failed to set entry index: %w", err)
+// exportQuotas returns the state of all quotas of the shard, along with their leases.
+func (s *storage) exportQuotas() ([]export.Item, error) {
+	if s.db.IsClosed() {
+		return nil, errors.New("badger db is closed")
 	}
 
-	if err := txn.Commit(); err != nil {
-		return 0, 0, false, fmt.Errorf("failed to commit transaction: %w", err)
-	}
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
 
-	return it.Capacity - it.Allocated, it.Version, true, nil
+	return badgerkv.ExportItems(txn)
 }
 
-func (s *storage) registerQuota(namespace, resource string, cfg quota.Config, entryIdx uint64) error {
+// importQuotas imports items in order, each in its own transaction, and records every import in the audit log. The
+// entry index is set once all items are imported, so that an entry applied halfway is applied again after a restart,
+// which writes the same state.
+func (s *storage) importQuotas(items []export.Item, caller, traceID string, now int64, entryIdx uint64) error {
 	if s.db.IsClosed() {
 		return errors.New("badger db is closed")
 	}
 
-	id := strings.Join([]string{namespace, resource}, "_")
-
-	txn := s.db.NewTransaction(true)
-	defer txn.Discard()
+	var importErr error
+	for _, it := range items {
+		e := newAuditEntry(audit.Import, it.Namespace, it.Resource, caller, traceID, now, entryIdx)
+		err := s.importItem(&e, it, now)
+		e.SetResult(true, err)
+		s.audit.Record(e)
 
-	_, err := get[item](txn, id)
-	if !errors.Is(err, badger.ErrKeyNotFound) {
-		return nil
+		if err != nil {
+			importErr = fmt.Errorf("failed to import %s/%s: %w", it.Namespace, it.Resource, err)
+			break
+		}
 	}
 
-	if err := set[item](txn, id, item{Allocated: 0, Capacity: cfg.Capacity, Version: 1}); err != nil {
-		return fmt.Errorf("failed to set item :%w", err)
+	err := s.db.Update(func(txn *badger.Txn) error {
+		return badgerkv.Set[uint64](txn, appliedEntryIndexKey, entryIdx)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set entry index: %w", err)
 	}
 
-	if err := set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
-		return fmt.Errorf("failed to set entry index: %w", err)
+	return importErr
+}
+
+func (s *storage) importItem(e *audit.Entry, it export.Item, now int64) error {
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	before, after, err := badgerkv.ImportItem(txn, it, time.Unix(0, now))
+	e.Before = before
+	if err != nil {
+		return err
 	}
 
 	if err := txn.Commit(); err != nil {
 		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
+	e.After = after
+	s.changes = append(s.changes, change{id: strings.Join([]string{it.Namespace, it.Resource}, "_")})
+
 	return nil
 }
 
@@ -544,7 +2290,7 @@ func (s *storage) lastAppliedIndex() (uint64, error) {
 	txn := s.db.NewTransaction(false)
 	defer txn.Discard()
 
-	val, err := get[uint64](txn, appliedEntryIndexKey)
+	val, err := badgerkv.Get[uint64](txn, appliedEntryIndexKey)
 	if err != nil {
 		if errors.Is(err, badger.ErrKeyNotFound) {
 			return 0, nil
@@ -581,45 +2327,174 @@ func (s *storage) loadSnapshot(r io.Reader, stopChan <-chan struct{}) error {
 	return s.db.Load(r, 256)
 }
 
+// backup writes the keys of the shard to bw, as a section holding a consistent snapshot of the shard.
+func (s *storage) backup(bw *backup.Writer, shardID uint64) error {
+	if s.db.IsClosed() {
+		return errors.New("badger db is closed")
+	}
+
+	return s.db.View(func(txn *badger.Txn) error {
+		return bw.WriteSection(shardID, txn)
+	})
+}
+
+// restore writes a chunk of the keys of a backup. The first chunk is refused if the shard has quotas. The entry index
+// is written after the keys, since they hold the entry index of the shard backed up.
+func (s *storage) restore(keys, values [][]byte, first bool, entryIdx uint64) error {
+	if s.db.IsClosed() {
+		return errors.New("badger db is closed")
+	}
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	if first {
+		refs, err := badgerkv.ListQuotaRefs(txn)
+		if err != nil {
+			return fmt.Errorf("failed to list quota refs: %w", err)
+		}
+
+		if len(refs) > 0 {
+			return fmt.Errorf("shard has quotas: %w", stor.ErrAlreadyExists)
+		}
+	}
+
+	for i := range keys {
+		if err := txn.Set(keys[i], values[i]); err != nil {
+			return fmt.Errorf("failed to set key: %w", err)
+		}
+	}
+
+	if err := badgerkv.Set[uint64](txn, appliedEntryIndexKey, entryIdx); err != nil {
+		return fmt.Errorf("failed to set entry index: %w", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
 func (s *storage) close() error {
 	return s.db.Close()
 }
 
-func get[T any](txn *badger.Txn, key string) (T, error) {
-	item, err := txn.Get([]byte(key))
+// newAuditEntry returns an entry of a mutation applied by the raft log entry at entryIdx. Now is in Unix nanoseconds and
+// comes from the command, so that all replicas record the same entry.
+func newAuditEntry(op audit.Operation, namespace, resource, caller, traceID string, now int64, entryIdx uint64) audit.Entry {
+	return audit.Entry{
+		Time:      time.Unix(0, now),
+		Index:     entryIdx,
+		Operation: op,
+		Namespace: namespace,
+		Resource:  resource,
+		Caller:    caller,
+		TraceID:   traceID,
+	}
+}
+
+// newBatchAuditEntries returns an entry for each item of a batch.
+func newBatchAuditEntries(op audit.Operation, items []batch.Item, caller, traceID string, now int64, entryIdx uint64) []audit.Entry {
+	entries := make([]audit.Entry, 0, len(items))
+	for _, bi := range items {
+		e := newAuditEntry(op, bi.Namespace, bi.Resource, caller, traceID, now, entryIdx)
+		e.Holder, e.Tokens = bi.Holder, bi.Tokens
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+// stampAuditEntries sets the time and the index of the raft log entry on entries built by the shared badger layout.
+func stampAuditEntries(entries []audit.Entry, now int64, entryIdx uint64) []audit.Entry {
+	for i := range entries {
+		entries[i].Time, entries[i].Index = time.Unix(0, now), entryIdx
+	}
+
+	return entries
+}
+
+func getPreparedBatch(txn *badger.Txn, batchID string) (preparedBatch, bool, error) {
+	it, err := txn.Get([]byte(batchKeyPrefix + batchID))
 	if err != nil {
-		var zero T
-		return zero, fmt.Errorf("failed to get key: %w", err)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return preparedBatch{}, false, nil
+		}
+
+		return preparedBatch{}, false, fmt.Errorf("failed to get key: %w", err)
 	}
 
-	var result T
-	err = item.Value(func(val []byte) error {
-		err := binary.Read(bytes.NewReader(val), binary.BigEndian, &result)
-		if err != nil {
-			return fmt.Errorf("failed to read bytes: %w", err)
+	var pb preparedBatch
+	err = it.Value(func(val []byte) error {
+		return json.Unmarshal(val, &pb)
+	})
+	if err != nil {
+		return preparedBatch{}, false, fmt.Errorf("failed to read prepared batch: %w", err)
+	}
+
+	return pb, true, nil
+}
+
+func getDecision(txn *badger.Txn, batchID string) (decision, bool, error) {
+	it, err := txn.Get([]byte(decisionKeyPrefix + batchID))
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return decision{}, false, nil
 		}
 
-		return nil
+		return decision{}, false, fmt.Errorf("failed to get key: %w", err)
+	}
+
+	var d decision
+	err = it.Value(func(val []byte) error {
+		return json.Unmarshal(val, &d)
 	})
 	if err != nil {
-		var zero T
-		return zero, fmt.Errorf("failed to read item value: %w", err)
+		return decision{}, false, fmt.Errorf("failed to read decision: %w", err)
 	}
 
-	return result, nil
+	return d, true, nil
 }
 
-func set[T any](txn *badger.Txn, key string, value T) error {
-	buf := bytes.NewBuffer(nil)
-	if err := binary.Write(buf, binary.BigEndian, value); err != nil {
-		return fmt.Errorf("failed to write to buffer: %w", err)
+// forgetDecisions removes the decisions on batches past their retention at now, given in Unix nanoseconds.
+func forgetDecisions(txn *badger.Txn, now int64) (int, error) {
+	keys, err := expiredDecisionKeys(txn, now)
+	if err != nil {
+		return 0, err
 	}
 
-	if err := txn.Set([]byte(key), buf.Bytes()); err != nil {
-		return fmt.Errorf("failed to set value: %w", err)
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return 0, fmt.Errorf("failed to delete decision: %w", err)
+		}
 	}
 
-	return nil
+	return len(keys), nil
+}
+
+func expiredDecisionKeys(txn *badger.Txn, now int64) ([][]byte, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(decisionKeyPrefix)
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+
+	var keys [][]byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		var d decision
+		err := iter.Item().Value(func(val []byte) error {
+			return json.Unmarshal(val, &d)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read decision: %w", err)
+		}
+
+		if d.ExpiresAt <= now {
+			keys = append(keys, iter.Item().KeyCopy(nil))
+		}
+	}
+
+	return keys, nil
 }
 
 func trimBeforeSubstr(s string, substr string) string {
@@ -636,10 +2511,6 @@ func trimAfterSubstr(s string, substr string) string {
 	return s
 }
 
-func shardIDFromString(key string, shards uint64) uint64 {
-	return uint64(crc32.ChecksumIEEE([]byte(key))%uint32(shards)) + 1
-}
-
 func raftAndDataDirsExist(path string, replicaID uint64) bool {
 	raftPath := filepath.Join(path, fmt.Sprintf("raft_node_%d", replicaID))
 	dataPath := filepath.Join(path, fmt.Sprintf("data_node_%d", replicaID))
@@ -680,7 +2551,7 @@ func newNodeHostConfig(deploymentId uint64, raftDir, raftAddr string) config.Nod
 	}
 }
 
-func newRaftConfig(replicaID, shardID uint64) config.Config {
+func NewRaftConfig(replicaID, shardID uint64) config.Config {
 	return config.Config{
 		ReplicaID:               replicaID,
 		ShardID:                 shardID,
@@ -700,7 +2571,11 @@ func newRaftConfig(replicaID, shardID uint64) config.Config {
 	}
 }
 
-func join(ctx context.Context, logger log.Logger, memberlist ports.MemberlistService, replicaID uint64, raftAddr string) (bool, error) {
+// join asks memberlist peers to add the replica to the shards placed on it, until every shard of shardIDs is covered.
+// It returns the shards the replica was added to and those it was already a member of. Peers only add the replica to
+// the shards they host, so with a replication factor it may take several peers to cover all shards. If attempts run
+// out, the shards covered so far are returned along with an error.
+func join(ctx context.Context, logger log.Logger, memberlist ports.MemberlistService, joinPath string, replicaID uint64, raftAddr string, shardIDs []uint64) ([]uint64, []uint64, error) {
 	cli := &http.Client{
 		Transport: otelhttp.NewTransport(http.DefaultTransport),
 		Timeout:   1 * time.Second,
@@ -714,7 +2589,24 @@ func join(ctx context.Context, logger log.Logger, memberlist ports.MemberlistSer
 
 	hostname, err := os.Hostname()
 	if err != nil {
-		return false, fmt.Errorf("failed to get hostname: %w", err)
+		return nil, nil, fmt.Errorf("failed to get hostname: %w", err)
+	}
+
+	var added, memberOf []uint64
+	remaining := make(map[uint64]struct{}, len(shardIDs))
+	for _, shardID := range shardIDs {
+		remaining[shardID] = struct{}{}
+	}
+
+	cover := func(covered []uint64, ids []uint64) []uint64 {
+		for _, shardID := range ids {
+			if _, found := remaining[shardID]; found {
+				delete(remaining, shardID)
+				covered = append(covered, shardID)
+			}
+		}
+
+		return covered
 	}
 
 	bo := backoff.New(ctx, cfg)
@@ -743,16 +2635,16 @@ func join(ctx context.Context, logger log.Logger, memberlist ports.MemberlistSer
 
 		for _, member := range filteredMembers {
 			addr := net.JoinHostPort(member.Host, strconv.Itoa(member.HTTPPort))
-			url := fmt.Sprintf("http://%s/api/v1/internal/raft/join", addr)
+			url := fmt.Sprintf("http://%s%s", addr, joinPath)
 			body := dto.JoinRequestBody{ReplicaID: replicaID, RaftAddr: raftAddr}
 			var bodyBuffer bytes.Buffer
 			if err := json.NewEncoder(&bodyBuffer).Encode(body); err != nil {
-				return false, fmt.Errorf("failed to encode alloc request body: %w", err)
+				return added, memberOf, fmt.Errorf("failed to encode alloc request body: %w", err)
 			}
 
 			r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &bodyBuffer)
 			if err != nil {
-				return false, fmt.Errorf("failed to create new request with context: %w", err)
+				return added, memberOf, fmt.Errorf("failed to create new request with context: %w", err)
 			}
 
 			logger.Info("trying to join cluster", "addr", addr)
@@ -783,9 +2675,13 @@ func join(ctx context.Context, logger log.Logger, memberlist ports.MemberlistSer
 				continue
 			}
 
-			return resBody.Result.AlreadyMember, nil
+			added = cover(added, resBody.Result.AddedShardIDs)
+			memberOf = cover(memberOf, resBody.Result.MemberShardIDs)
+			if len(remaining) == 0 {
+				return added, memberOf, nil
+			}
 		}
 	}
 
-	return false, errors.New("all attempts failed")
+	return added, memberOf, errors.New("all attempts failed")
 }
@@ -0,0 +1,77 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/audit"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+)
+
+type UpdateQuotaCommand struct {
+	Namespace string
+	Resource  string
+	Cfg       quota.Config
+	Now       int64
+	Caller    string
+	TraceID   string
+	SMResult  statemachine.Result
+}
+
+type UpdateQuotaCommandResult struct {
+	Err string
+}
+
+// NewUpdateQuotaCommand returns a command updating a quota. Now, given in Unix nanoseconds, starts the current period of
+// periodic quotas. The caller and the trace ID are only recorded in the audit log.
+func NewUpdateQuotaCommand(namespace, resource string, cfg quota.Config, now int64, caller, traceID string) *UpdateQuotaCommand {
+	return &UpdateQuotaCommand{
+		Namespace: namespace,
+		Resource:  resource,
+		Cfg:       cfg,
+		Now:       now,
+		Caller:    caller,
+		TraceID:   traceID,
+		SMResult:  statemachine.Result{},
+	}
+}
+
+func (c *UpdateQuotaCommand) Type() CommandType {
+	return UpdateQuota
+}
+
+func (c *UpdateQuotaCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, session *client.Session) (any, error) {
+	result, err := syncWrite[UpdateQuotaCommandResult](ctx, nh, shardID, session, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync write: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *UpdateQuotaCommand) LocalInvoke(storage *storage, entryIdx uint64) error {
+	e := newAuditEntry(audit.UpdateQuota, c.Namespace, c.Resource, c.Caller, c.TraceID, c.Now, entryIdx)
+	err := storage.updateQuota(&e, c.Namespace, c.Resource, c.Cfg, c.Now, entryIdx)
+	e.SetResult(true, err)
+	storage.audit.Record(e)
+
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(UpdateQuotaCommandResult{Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *UpdateQuotaCommand) Result() statemachine.Result {
+	return c.SMResult
+}
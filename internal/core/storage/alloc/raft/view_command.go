@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/lni/dragonboat/v4"
 	"github.com/lni/dragonboat/v4/client"
 	"github.com/lni/dragonboat/v4/statemachine"
 )
@@ -34,7 +33,7 @@ func (c *ViewCommand) Type() CommandType {
 	return View
 }
 
-func (c *ViewCommand) RaftInvoke(ctx context.Context, nh *dragonboat.NodeHost, shardID uint64, _ *client.Session) (any, error) {
+func (c *ViewCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, _ *client.Session) (any, error) {
 	result, err := syncRead[ViewCommandResult](ctx, nh, shardID, c)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sync write: %w", err)
@@ -0,0 +1,64 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+type ViewHoldersCommand struct {
+	Namespace string
+	Resource  string
+	SMResult  statemachine.Result
+}
+
+type ViewHoldersCommandResult struct {
+	Allocated int64
+	Capacity  int64
+	Version   int64
+	Holders   map[string]int64
+	Err       string
+}
+
+func NewViewHoldersCommand(namespace, resource string) *ViewHoldersCommand {
+	return &ViewHoldersCommand{
+		Namespace: namespace,
+		Resource:  resource,
+		SMResult:  statemachine.Result{},
+	}
+}
+
+func (c *ViewHoldersCommand) Type() CommandType {
+	return ViewHolders
+}
+
+func (c *ViewHoldersCommand) RaftInvoke(ctx context.Context, nh *NodeHost, shardID uint64, _ *client.Session) (any, error) {
+	result, err := syncRead[ViewHoldersCommandResult](ctx, nh, shardID, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync read: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *ViewHoldersCommand) LocalInvoke(storage *storage, _ uint64) error {
+	allocated, capacity, version, holders, err := storage.viewHolders(c.Namespace, c.Resource)
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(ViewHoldersCommandResult{Allocated: allocated, Capacity: capacity, Version: version, Holders: holders, Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *ViewHoldersCommand) Result() statemachine.Result {
+	return c.SMResult
+}
@@ -2,14 +2,35 @@ package alloc
 
 import (
 	"context"
+	"io"
+	"time"
 
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/batch"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/export"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/history"
 	"github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/watch"
 )
 
 type Storage interface {
 	View(ctx context.Context, namespace, resource string) (allocated, capacity, version int64, err error)
-	Alloc(ctx context.Context, namespace, resource string, tokens, version int64) (remainingTokens, currentVersion int64, ok bool, err error)
-	Free(ctx context.Context, namespace, resource string, tokens, version int64) (remainingTokens, currentVersion int64, ok bool, err error)
+	ViewHolders(ctx context.Context, namespace, resource string) (allocated, capacity, version int64, holders map[string]int64, err error)
+	Alloc(ctx context.Context, namespace, resource, holder string, tokens, version int64, ttl time.Duration, idempotencyKey string) (remainingTokens, currentVersion int64, leaseID string, ok, overSoftLimit bool, err error)
+	AllocBatch(ctx context.Context, items []batch.Item) (results []batch.Result, ok bool, err error)
+	Free(ctx context.Context, namespace, resource, holder string, tokens, version int64, leaseID, idempotencyKey string) (remainingTokens, currentVersion int64, ok bool, err error)
+	Renew(ctx context.Context, namespace, resource, leaseID string, ttl time.Duration) (expiresAt time.Time, ok bool, err error)
+	ExpireLeases(ctx context.Context) (expired int, err error)
+	ResetPeriods(ctx context.Context) (reset int, err error)
+	RecordHistory(ctx context.Context) (recorded int, err error)
+	History(ctx context.Context, namespace, resource string, from, to time.Time, step time.Duration) (samples []history.Sample, err error)
+	Watch(ctx context.Context, namespace, resource string) (events <-chan watch.Event, err error)
 	RegisterQuota(ctx context.Context, namespace, resource string, cfg quota.Config) error
+	UpdateQuota(ctx context.Context, namespace, resource string, cfg quota.Config) error
+	DeleteQuota(ctx context.Context, namespace, resource string) error
+	ListQuotas(ctx context.Context) ([]quota.Quota, error)
+	Backup(ctx context.Context, w io.Writer) error
+	Restore(ctx context.Context, r io.Reader) error
+	Export(ctx context.Context) (items []export.Item, err error)
+	Import(ctx context.Context, items []export.Item) error
 	Shutdown(ctx context.Context) error
 }
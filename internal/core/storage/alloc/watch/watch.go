@@ -0,0 +1,140 @@
+package watch
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/Blinkuu/qms/pkg/dto"
+)
+
+// Event is the state of a quota after a change. Deleted events carry no state.
+type Event struct {
+	Allocated int64
+	Capacity  int64
+	Version   int64
+	Deleted   bool
+}
+
+func NewEventFromDTO(e dto.WatchEvent) Event {
+	return Event{
+		Allocated: e.Allocated,
+		Capacity:  e.Capacity,
+		Version:   e.Version,
+		Deleted:   e.Deleted,
+	}
+}
+
+func (e Event) DTO() dto.WatchEvent {
+	return dto.WatchEvent{
+		Allocated: e.Allocated,
+		Capacity:  e.Capacity,
+		Version:   e.Version,
+		Deleted:   e.Deleted,
+	}
+}
+
+// Hub fans out the changes of quotas to their subscriptions.
+type Hub struct {
+	subscriptions map[string]map[*Subscription]struct{}
+	mu            *sync.Mutex
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subscriptions: make(map[string]map[*Subscription]struct{}),
+		mu:            &sync.Mutex{},
+	}
+}
+
+// Subscribe returns a subscription to the changes of a quota. It has to be cancelled once no longer needed.
+func (h *Hub) Subscribe(namespace, resource string) *Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id := strings.Join([]string{namespace, resource}, "_")
+	s := &Subscription{
+		hub:    h,
+		id:     id,
+		events: make(chan Event, 1),
+		mu:     &sync.Mutex{},
+	}
+
+	if _, found := h.subscriptions[id]; !found {
+		h.subscriptions[id] = make(map[*Subscription]struct{})
+	}
+
+	h.subscriptions[id][s] = struct{}{}
+
+	return s
+}
+
+// Publish offers the event to all subscriptions of a quota.
+func (h *Hub) Publish(namespace, resource string, e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for s := range h.subscriptions[strings.Join([]string{namespace, resource}, "_")] {
+		s.Offer(e)
+	}
+}
+
+func (h *Hub) unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subscriptions[s.id], s)
+	if len(h.subscriptions[s.id]) == 0 {
+		delete(h.subscriptions, s.id)
+	}
+}
+
+// Subscription receives the changes of a quota. Only the latest undelivered event is kept, so slow receivers skip
+// intermediate states instead of blocking the writers, and events not newer than the ones already offered are dropped.
+type Subscription struct {
+	hub     *Hub
+	id      string
+	events  chan Event
+	version int64
+	closed  bool
+	mu      *sync.Mutex
+}
+
+// Events returns the channel of the subscription, which is closed once the subscription is cancelled.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Offer delivers the event, replacing the undelivered one, if any.
+func (s *Subscription) Offer(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || (!e.Deleted && e.Version <= s.version) {
+		return
+	}
+
+	// Versions start over once a quota is registered again.
+	s.version = e.Version
+	if e.Deleted {
+		s.version = 0
+	}
+
+	select {
+	case <-s.events:
+	default:
+	}
+
+	s.events <- e
+}
+
+func (s *Subscription) Cancel() {
+	s.hub.unsubscribe(s)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+}
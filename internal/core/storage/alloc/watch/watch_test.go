@@ -0,0 +1,38 @@
+package watch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscription_Offer_KeepsOnlyLatestNewerEvent(t *testing.T) {
+	// Given
+	h := NewHub()
+	sub := h.Subscribe("namespace", "resource")
+	defer sub.Cancel()
+
+	// When
+	h.Publish("namespace", "resource", Event{Allocated: 1, Capacity: 10, Version: 2})
+	h.Publish("namespace", "resource", Event{Allocated: 2, Capacity: 10, Version: 3})
+	h.Publish("namespace", "resource", Event{Allocated: 1, Capacity: 10, Version: 2})
+	h.Publish("namespace", "other", Event{Allocated: 5, Capacity: 10, Version: 9})
+
+	// Then
+	assert.Equal(t, Event{Allocated: 2, Capacity: 10, Version: 3}, <-sub.Events())
+	assert.Empty(t, sub.Events())
+}
+
+func TestSubscription_Cancel_ClosesEventsAndStopsDelivery(t *testing.T) {
+	// Given
+	h := NewHub()
+	sub := h.Subscribe("namespace", "resource")
+
+	// When
+	sub.Cancel()
+	h.Publish("namespace", "resource", Event{Allocated: 1, Capacity: 10, Version: 2})
+	_, open := <-sub.Events()
+
+	// Then
+	assert.False(t, open)
+}
@@ -6,8 +6,14 @@ import (
 )
 
 var (
-	ErrNotFound       = errors.New("not found")
-	ErrInvalidVersion = errors.New("invalid version")
+	ErrNotFound        = errors.New("not found")
+	ErrInvalidVersion  = errors.New("invalid version")
+	ErrNotSupported    = errors.New("not supported")
+	ErrAlreadyExists   = errors.New("already exists")
+	ErrInvalidConfig   = errors.New("invalid config")
+	ErrInvalidArgument = errors.New("invalid argument")
+
+	ErrCapacityBelowAllocated = errors.New("capacity below allocated tokens")
 )
 
 func IsErrNotFound(err string) bool {
@@ -17,3 +23,15 @@ func IsErrNotFound(err string) bool {
 func IsErrInvalidVersion(err string) bool {
 	return strings.Contains(err, ErrInvalidVersion.Error())
 }
+
+func IsErrAlreadyExists(err string) bool {
+	return strings.Contains(err, ErrAlreadyExists.Error())
+}
+
+func IsErrInvalidConfig(err string) bool {
+	return strings.Contains(err, ErrInvalidConfig.Error())
+}
+
+func IsErrCapacityBelowAllocated(err string) bool {
+	return strings.Contains(err, ErrCapacityBelowAllocated.Error())
+}
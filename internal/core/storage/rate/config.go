@@ -3,17 +3,26 @@ package rate
 import (
 	"flag"
 
+	"github.com/Blinkuu/qms/internal/core/storage/rate/raft"
+	"github.com/Blinkuu/qms/internal/core/storage/rate/replicated"
 	"github.com/Blinkuu/qms/pkg/strutil"
 )
 
 const (
-	Memory = "memory"
+	Memory     = "memory"
+	Replicated = "replicated"
+	Raft       = "raft"
 )
 
 type Config struct {
-	Backend string `yaml:"backend"`
+	Backend    string            `yaml:"backend"`
+	Replicated replicated.Config `yaml:"replicated"`
+	Raft       raft.Config       `yaml:"raft"`
 }
 
 func (c *Config) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix string) {
 	f.StringVar(&c.Backend, strutil.WithPrefixOrDefault(prefix, "backend"), Memory, "")
+
+	c.Replicated.RegisterFlagsWithPrefix(f, strutil.WithPrefixOrDefault(prefix, Replicated))
+	c.Raft.RegisterFlagsWithPrefix(f, strutil.WithPrefixOrDefault(prefix, Raft))
 }
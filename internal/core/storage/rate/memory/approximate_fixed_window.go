@@ -0,0 +1,183 @@
+package memory
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultApproximateSyncInterval = 1 * time.Second
+)
+
+type peerCount struct {
+	windowStart time.Time
+	count       int64
+	updatedAt   time.Time
+}
+
+// ApproximateFixedWindow enforces a fixed window limit shared by all rate replicas without coordinating on every
+// request. Every replica decides locally based on its own count and the last counts reported by its peers. Between two
+// syncs, a replica takes no more than its share of the capacity that was left at the previous sync, which bounds how
+// far the replicas can exceed the limit together.
+type ApproximateFixedWindow struct {
+	clock        clock.Clock
+	interval     time.Duration
+	capacity     int64
+	syncInterval time.Duration
+	windowStart  time.Time
+	count        int64
+	peers        map[string]peerCount
+	budgetStart  int64
+	budget       int64
+	lastSync     time.Time
+	overshoot    prometheus.Gauge
+	peerStateAge prometheus.Gauge
+	mu           *sync.Mutex
+}
+
+func NewApproximateFixedWindow(clock clock.Clock, interval time.Duration, capacity int64, syncInterval time.Duration, overshoot, peerStateAge prometheus.Gauge) *ApproximateFixedWindow {
+	if interval <= 0 {
+		panic("interval must be greater than 0")
+	}
+
+	if capacity <= 0 {
+		panic("capacity must be greater than 0")
+	}
+
+	if syncInterval <= 0 {
+		panic("sync interval must be greater than 0")
+	}
+
+	return &ApproximateFixedWindow{
+		clock:        clock,
+		interval:     interval,
+		capacity:     capacity,
+		syncInterval: syncInterval,
+		windowStart:  time.Time{},
+		count:        0,
+		peers:        make(map[string]peerCount),
+		budgetStart:  0,
+		budget:       capacity,
+		lastSync:     time.Time{},
+		overshoot:    overshoot,
+		peerStateAge: peerStateAge,
+		mu:           &sync.Mutex{},
+	}
+}
+
+// Allow returns true if the request fits both into the capacity left in the window, as far as this replica knows, and
+// into the share of this replica. If only the share is exhausted, it returns false and the time until the next sync.
+func (w *ApproximateFixedWindow) Allow(_ context.Context, tokens int64) (time.Duration, bool, error) {
+	now := w.clock.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.advanceLocked(now)
+
+	if tokens > w.capacity {
+		return 0, false, nil
+	}
+
+	if w.globalCountLocked()+tokens > w.capacity {
+		return w.windowStart.Add(w.interval).Sub(now), false, nil
+	}
+
+	if w.count-w.budgetStart+tokens > w.budget {
+		return w.syncInterval, false, nil
+	}
+
+	w.count += tokens
+
+	return 0, true, nil
+}
+
+// Report returns the count of this replica in the current window if a sync is due, and starts a new budget.
+func (w *ApproximateFixedWindow) Report() (time.Time, int64, bool) {
+	now := w.clock.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if now.Sub(w.lastSync) < w.syncInterval {
+		return time.Time{}, 0, false
+	}
+
+	w.lastSync = now
+	w.advanceLocked(now)
+	w.rebalanceLocked(now)
+
+	return w.windowStart, w.count, true
+}
+
+// Merge records the count reported by a peer and starts a new budget.
+func (w *ApproximateFixedWindow) Merge(peer string, windowStart time.Time, count int64) {
+	now := w.clock.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.peers[peer] = peerCount{windowStart: windowStart, count: count, updatedAt: now}
+	w.advanceLocked(now)
+	w.rebalanceLocked(now)
+}
+
+func (w *ApproximateFixedWindow) advanceLocked(now time.Time) {
+	windowEnd := w.windowStart.Add(w.interval)
+	if now.Before(windowEnd) {
+		return
+	}
+
+	w.windowStart = now.Truncate(w.interval)
+	w.count = 0
+	w.budgetStart = 0
+	w.budget = w.capacity
+}
+
+// rebalanceLocked splits the capacity left in the window evenly between this replica and its live peers.
+func (w *ApproximateFixedWindow) rebalanceLocked(now time.Time) {
+	var oldest time.Time
+	replicas := int64(1)
+	for peer, pc := range w.peers {
+		// Peers report on every sync, so a peer that missed a few of them is considered gone.
+		if now.Sub(pc.updatedAt) > 3*w.syncInterval {
+			delete(w.peers, peer)
+			continue
+		}
+
+		replicas++
+		if oldest.IsZero() || pc.updatedAt.Before(oldest) {
+			oldest = pc.updatedAt
+		}
+	}
+
+	global := w.globalCountLocked()
+	w.overshoot.Set(math.Max(float64(global-w.capacity), 0))
+	if !oldest.IsZero() {
+		w.peerStateAge.Set(now.Sub(oldest).Seconds())
+	}
+
+	remaining := w.capacity - global
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	w.budgetStart = w.count
+	w.budget = int64(math.Ceil(float64(remaining) / float64(replicas)))
+}
+
+func (w *ApproximateFixedWindow) globalCountLocked() int64 {
+	global := w.count
+	for _, pc := range w.peers {
+		if pc.windowStart.Equal(w.windowStart) {
+			global += pc.count
+		}
+	}
+
+	return global
+}
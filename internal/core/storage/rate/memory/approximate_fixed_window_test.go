@@ -0,0 +1,129 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestApproximateFixedWindow(c clock.Clock, interval time.Duration, capacity int64, syncInterval time.Duration) (*ApproximateFixedWindow, prometheus.Gauge, prometheus.Gauge) {
+	overshoot := prometheus.NewGauge(prometheus.GaugeOpts{Name: "overshoot_tokens"})
+	peerStateAge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "peer_state_age_seconds"})
+
+	return NewApproximateFixedWindow(c, interval, capacity, syncInterval, overshoot, peerStateAge), overshoot, peerStateAge
+}
+
+func TestNewApproximateFixedWindow_PanicsWithInvalidSyncInterval(t *testing.T) {
+	// When
+	panicFunc := func() { _, _, _ = newTestApproximateFixedWindow(clock.NewMock(), time.Second, 1, 0) }
+
+	// Then
+	assert.Panics(t, panicFunc)
+}
+
+func TestApproximateFixedWindow_Allow_AllowsWholeCapacityWithoutPeers(t *testing.T) {
+	// Given
+	cl := clock.NewMock()
+	w, _, _ := newTestApproximateFixedWindow(cl, 10*time.Second, 4, time.Second)
+
+	// When
+	_, ok1, err1 := w.Allow(context.Background(), 4)
+	wait, ok2, err2 := w.Allow(context.Background(), 1)
+
+	// Then
+	assert.NoError(t, err1)
+	assert.True(t, ok1)
+	assert.NoError(t, err2)
+	assert.False(t, ok2)
+	assert.Equal(t, 10*time.Second, wait)
+}
+
+func TestApproximateFixedWindow_Allow_LimitsReplicaToItsShareAfterMerge(t *testing.T) {
+	// Given
+	cl := clock.NewMock()
+	w, _, _ := newTestApproximateFixedWindow(cl, 10*time.Second, 10, time.Second)
+	w.Merge("peer", cl.Now(), 6)
+
+	// When
+	_, ok1, err1 := w.Allow(context.Background(), 2)
+	wait, ok2, err2 := w.Allow(context.Background(), 1)
+
+	// Then
+	assert.NoError(t, err1)
+	assert.True(t, ok1)
+	assert.NoError(t, err2)
+	assert.False(t, ok2)
+	assert.Equal(t, time.Second, wait)
+}
+
+func TestApproximateFixedWindow_Allow_IgnoresPeerCountsFromPreviousWindow(t *testing.T) {
+	// Given
+	cl := clock.NewMock()
+	w, _, _ := newTestApproximateFixedWindow(cl, 10*time.Second, 10, time.Second)
+	w.Merge("peer", cl.Now().Add(-10*time.Second), 10)
+
+	// When
+	_, ok, err := w.Allow(context.Background(), 5)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestApproximateFixedWindow_Report_ReportsOncePerSyncInterval(t *testing.T) {
+	// Given
+	cl := clock.NewMock()
+	w, _, _ := newTestApproximateFixedWindow(cl, 10*time.Second, 10, time.Second)
+	_, _, _ = w.Allow(context.Background(), 3)
+
+	// When
+	windowStart, count, ok1 := w.Report()
+	_, _, ok2 := w.Report()
+	cl.Add(time.Second)
+	_, _, ok3 := w.Report()
+
+	// Then
+	assert.True(t, ok1)
+	assert.Equal(t, cl.Now().Add(-time.Second), windowStart)
+	assert.EqualValues(t, 3, count)
+	assert.False(t, ok2)
+	assert.True(t, ok3)
+}
+
+func TestApproximateFixedWindow_Merge_SetsOvershootAndPeerStateAge(t *testing.T) {
+	// Given
+	cl := clock.NewMock()
+	w, overshoot, peerStateAge := newTestApproximateFixedWindow(cl, 10*time.Second, 10, time.Second)
+	_, _, _ = w.Allow(context.Background(), 8)
+	w.Merge("peer", cl.Now(), 5)
+	cl.Add(2 * time.Second)
+
+	// When
+	_, _, ok := w.Report()
+
+	// Then
+	assert.True(t, ok)
+	assert.EqualValues(t, 3, testutil.ToFloat64(overshoot))
+	assert.EqualValues(t, 2, testutil.ToFloat64(peerStateAge))
+}
+
+func TestApproximateFixedWindow_Merge_DropsPeersThatStoppedReporting(t *testing.T) {
+	// Given
+	cl := clock.NewMock()
+	w, _, _ := newTestApproximateFixedWindow(cl, 10*time.Second, 10, time.Second)
+	w.Merge("peer", cl.Now(), 0)
+	cl.Add(4 * time.Second)
+	_, _, _ = w.Report()
+
+	// When
+	_, ok, err := w.Allow(context.Background(), 10)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
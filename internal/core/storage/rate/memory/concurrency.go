@@ -0,0 +1,111 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/google/uuid"
+
+	"github.com/Blinkuu/qms/internal/core/storage"
+)
+
+const (
+	ConcurrencyAlgorithm = "concurrency"
+	defaultPermitTTL     = 1 * time.Minute
+)
+
+type permit struct {
+	tokens    int64
+	expiresAt time.Time
+}
+
+// ConcurrencyLimiter limits the number of tokens held at the same time. Acquired tokens are held by a permit until it
+// is released or until its TTL elapses, so that permits of crashed clients do not leak capacity.
+type ConcurrencyLimiter struct {
+	clock    clock.Clock
+	permits  map[string]permit
+	ttl      time.Duration
+	acquired int64
+	capacity int64
+	mu       *sync.Mutex
+}
+
+func NewConcurrencyLimiter(clock clock.Clock, ttl time.Duration, capacity int64) *ConcurrencyLimiter {
+	if ttl <= 0 {
+		panic("ttl must be greater than 0")
+	}
+
+	if capacity <= 0 {
+		panic("capacity must be greater than 0")
+	}
+
+	return &ConcurrencyLimiter{
+		clock:    clock,
+		permits:  make(map[string]permit),
+		ttl:      ttl,
+		acquired: 0,
+		capacity: capacity,
+		mu:       &sync.Mutex{},
+	}
+}
+
+// Acquire returns a permit ID and true if tokens are available. Returns false if the limit is reached. Fails with
+// storage.ErrInvalidArgument unless tokens is positive, since a negative permit would lower the tokens held and let
+// others exceed the limit.
+func (l *ConcurrencyLimiter) Acquire(_ context.Context, tokens int64) (string, bool, error) {
+	if tokens <= 0 {
+		return "", false, fmt.Errorf("tokens must be greater than 0: %w", storage.ErrInvalidArgument)
+	}
+
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.evictExpiredLocked(now)
+
+	if l.acquired+tokens > l.capacity {
+		return "", false, nil
+	}
+
+	permitID := uuid.NewString()
+	l.permits[permitID] = permit{tokens: tokens, expiresAt: now.Add(l.ttl)}
+	l.acquired += tokens
+
+	return permitID, true, nil
+}
+
+// Release returns true if the permit was held and its tokens were given back. Returns false if the permit is unknown
+// or has already expired.
+func (l *ConcurrencyLimiter) Release(_ context.Context, permitID string) (bool, error) {
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.evictExpiredLocked(now)
+
+	p, found := l.permits[permitID]
+	if !found {
+		return false, nil
+	}
+
+	delete(l.permits, permitID)
+	l.acquired -= p.tokens
+
+	return true, nil
+}
+
+func (l *ConcurrencyLimiter) evictExpiredLocked(now time.Time) {
+	for permitID, p := range l.permits {
+		if now.Before(p.expiresAt) {
+			continue
+		}
+
+		delete(l.permits, permitID)
+		l.acquired -= p.tokens
+	}
+}
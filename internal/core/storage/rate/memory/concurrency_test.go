@@ -0,0 +1,154 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Blinkuu/qms/internal/core/storage"
+)
+
+func TestNewConcurrencyLimiter_ReturnsNewConcurrencyLimiterWithCorrectArguments(t *testing.T) {
+	// When
+	got := NewConcurrencyLimiter(clock.NewMock(), 1, 1)
+
+	// Then
+	assert.NotNil(t, got)
+}
+
+func TestNewConcurrencyLimiter_PanicsWithInvalidTTL(t *testing.T) {
+	// When
+	panicFunc := func() { _ = NewConcurrencyLimiter(clock.NewMock(), 0, 1) }
+
+	// Then
+	assert.Panics(t, panicFunc)
+}
+
+func TestNewConcurrencyLimiter_PanicsWithInvalidCapacity(t *testing.T) {
+	// When
+	panicFunc := func() { _ = NewConcurrencyLimiter(clock.NewMock(), 1, 0) }
+
+	// Then
+	assert.Panics(t, panicFunc)
+}
+
+func TestConcurrencyLimiter_Acquire_ReturnsNoErrorNotOKAndEmptyPermitWithMoreTokensRequestedThanCapacity(t *testing.T) {
+	// Given
+	l := NewConcurrencyLimiter(clock.NewMock(), time.Minute, 4)
+
+	// When
+	permitID, ok, err := l.Acquire(context.Background(), 5)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Empty(t, permitID)
+}
+
+func TestConcurrencyLimiter_Acquire_ReturnsErrInvalidArgumentWithNoOrNegativeTokens(t *testing.T) {
+	for _, tokens := range []int64{0, -1} {
+		// Given
+		l := NewConcurrencyLimiter(clock.NewMock(), time.Minute, 2)
+
+		// When
+		permitID, ok, err := l.Acquire(context.Background(), tokens)
+		fullPermitID, fullOK, fullErr := l.Acquire(context.Background(), 2)
+		overPermitID, overOK, overErr := l.Acquire(context.Background(), 1)
+
+		// Then
+		assert.ErrorIs(t, err, storage.ErrInvalidArgument)
+		assert.False(t, ok)
+		assert.Empty(t, permitID)
+		assert.NoError(t, fullErr)
+		assert.True(t, fullOK)
+		assert.NotEmpty(t, fullPermitID)
+		assert.NoError(t, overErr)
+		assert.False(t, overOK)
+		assert.Empty(t, overPermitID)
+	}
+}
+
+func TestConcurrencyLimiter_Acquire_ReturnsNoErrorNotOKWhenLimitIsReached(t *testing.T) {
+	// Given
+	l := NewConcurrencyLimiter(clock.NewMock(), time.Minute, 2)
+
+	// When
+	firstPermitID, firstOK, firstErr := l.Acquire(context.Background(), 1)
+	secondPermitID, secondOK, secondErr := l.Acquire(context.Background(), 1)
+	thirdPermitID, thirdOK, thirdErr := l.Acquire(context.Background(), 1)
+
+	// Then
+	assert.NoError(t, firstErr)
+	assert.True(t, firstOK)
+	assert.NotEmpty(t, firstPermitID)
+	assert.NoError(t, secondErr)
+	assert.True(t, secondOK)
+	assert.NotEmpty(t, secondPermitID)
+	assert.NotEqual(t, firstPermitID, secondPermitID)
+	assert.NoError(t, thirdErr)
+	assert.False(t, thirdOK)
+	assert.Empty(t, thirdPermitID)
+}
+
+func TestConcurrencyLimiter_Release_ReturnsNoErrorAndOKAndFreesCapacity(t *testing.T) {
+	// Given
+	l := NewConcurrencyLimiter(clock.NewMock(), time.Minute, 1)
+	permitID, ok, err := l.Acquire(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// When
+	released, err := l.Release(context.Background(), permitID)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, released)
+
+	// When
+	_, ok, err = l.Acquire(context.Background(), 1)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestConcurrencyLimiter_Release_ReturnsNoErrorAndNotOKForUnknownPermit(t *testing.T) {
+	// Given
+	l := NewConcurrencyLimiter(clock.NewMock(), time.Minute, 1)
+
+	// When
+	released, err := l.Release(context.Background(), "unknown")
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, released)
+}
+
+func TestConcurrencyLimiter_Acquire_ReturnsNoErrorAndOKWhenPermitExpires(t *testing.T) {
+	// Given
+	startTime := time.Date(2022, time.Month(1), 11, 0, 0, 1, 0, time.UTC)
+	c := clock.NewMock()
+	c.Set(startTime)
+	l := NewConcurrencyLimiter(c, 10*time.Second, 1)
+	permitID, ok, err := l.Acquire(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// When
+	c.Set(startTime.Add(10 * time.Second))
+	_, ok, err = l.Acquire(context.Background(), 1)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// When
+	released, err := l.Release(context.Background(), permitID)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, released)
+}
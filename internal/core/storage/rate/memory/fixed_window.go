@@ -2,6 +2,7 @@ package memory
 
 import (
 	"context"
+	"encoding/json"
 	"sync"
 	"time"
 
@@ -12,6 +13,11 @@ const (
 	FixedWindowAlgorithm = "fixed-window"
 )
 
+type fixedWindowState struct {
+	WindowStart time.Time `json:"window_start"`
+	Allocated   int64     `json:"allocated"`
+}
+
 type FixedWindow struct {
 	clock       clock.Clock
 	windowStart time.Time
@@ -61,3 +67,25 @@ func (f *FixedWindow) Allow(_ context.Context, tokens int64) (waitTime time.Dura
 
 	return 0, true, nil
 }
+
+func (f *FixedWindow) Snapshot() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return json.Marshal(fixedWindowState{WindowStart: f.windowStart, Allocated: f.allocated})
+}
+
+func (f *FixedWindow) Restore(data []byte) error {
+	var state fixedWindowState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.windowStart = state.WindowStart
+	f.allocated = state.Allocated
+
+	return nil
+}
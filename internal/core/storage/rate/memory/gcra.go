@@ -0,0 +1,124 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+const (
+	GCRAAlgorithm = "gcra"
+)
+
+type gcraState struct {
+	TAT time.Time `json:"tat"`
+}
+
+// GCRA implements the generic cell rate algorithm. Instead of counting tokens, it keeps a single theoretical arrival
+// time (TAT) of the next conforming request.
+type GCRA struct {
+	clock            clock.Clock
+	tat              time.Time
+	emissionInterval time.Duration
+	burstTolerance   time.Duration
+	burst            int64
+	mu               *sync.Mutex
+}
+
+func NewGCRA(clock clock.Clock, emissionInterval time.Duration, burst int64) *GCRA {
+	if emissionInterval <= 0 {
+		panic("emission interval must be greater than 0")
+	}
+
+	if burst <= 0 {
+		panic("burst must be greater than 0")
+	}
+
+	return &GCRA{
+		clock:            clock,
+		tat:              time.Time{},
+		emissionInterval: emissionInterval,
+		burstTolerance:   time.Duration(burst) * emissionInterval,
+		burst:            burst,
+		mu:               &sync.Mutex{},
+	}
+}
+
+// Allow returns true if the request is conforming. Otherwise, it returns false and the time until the request becomes
+// conforming. Requests larger than the burst can never conform and return zero.
+func (g *GCRA) Allow(ctx context.Context, tokens int64) (time.Duration, bool, error) {
+	return g.Reserve(ctx, tokens, 0)
+}
+
+// Reserve returns true and the time until the request becomes conforming if that time is within maxWait. The request
+// is accounted for immediately. Otherwise, it returns false and the time until the request becomes conforming.
+func (g *GCRA) Reserve(_ context.Context, tokens int64, maxWait time.Duration) (time.Duration, bool, error) {
+	now := g.clock.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if tokens > g.burst {
+		return 0, false, nil
+	}
+
+	tat := g.tat
+	if tat.Before(now) {
+		tat = now
+	}
+
+	newTAT := tat.Add(time.Duration(tokens) * g.emissionInterval)
+	allowAt := newTAT.Add(-g.burstTolerance)
+	waitTime := allowAt.Sub(now)
+	if waitTime > maxWait {
+		return waitTime, false, nil
+	}
+
+	g.tat = newTAT
+
+	if waitTime < 0 {
+		return 0, true, nil
+	}
+
+	return waitTime, true, nil
+}
+
+// Refund moves the theoretical arrival time back by the tokens of a reservation that will not be used, but not before
+// now, so that a refund does not make up for time the limiter was idle.
+func (g *GCRA) Refund(_ context.Context, tokens int64) error {
+	now := g.clock.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.tat = g.tat.Add(-time.Duration(tokens) * g.emissionInterval)
+	if g.tat.Before(now) {
+		g.tat = now
+	}
+
+	return nil
+}
+
+func (g *GCRA) Snapshot() ([]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return json.Marshal(gcraState{TAT: g.tat})
+}
+
+func (g *GCRA) Restore(data []byte) error {
+	var state gcraState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.tat = state.TAT
+
+	return nil
+}
@@ -0,0 +1,193 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewGCRA_ReturnsNewGCRAWithCorrectArguments(t *testing.T) {
+	// When
+	got := NewGCRA(clock.NewMock(), 1, 1)
+
+	// Then
+	assert.NotNil(t, got)
+}
+
+func TestNewGCRA_PanicsWithInvalidEmissionInterval(t *testing.T) {
+	// When
+	panicFunc := func() { _ = NewGCRA(clock.NewMock(), 0, 1) }
+
+	// Then
+	assert.Panics(t, panicFunc)
+}
+
+func TestNewGCRA_PanicsWithInvalidBurst(t *testing.T) {
+	// When
+	panicFunc := func() { _ = NewGCRA(clock.NewMock(), 1, 0) }
+
+	// Then
+	assert.Panics(t, panicFunc)
+}
+
+func TestGCRA_Allow_ReturnsNoErrorNotOKAndZeroWithMoreTokensRequestedThanBurst(t *testing.T) {
+	// Given
+	cl := clock.NewMock()
+	g := NewGCRA(cl, 500*time.Millisecond, 4)
+
+	// When
+	wait, ok, err := g.Allow(context.Background(), 5)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Zero(t, wait)
+}
+
+func TestGCRA_Allow_ReturnsNoErrorOKAndZeroWithBurstRequested(t *testing.T) {
+	// Given
+	cl := clock.NewMock()
+	g := NewGCRA(cl, 500*time.Millisecond, 4)
+
+	// When
+	wait, ok, err := g.Allow(context.Background(), 4)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Zero(t, wait)
+}
+
+func TestGCRA_Allow_ReturnsNoErrorNotOKAndWaitTimeWhenBurstIsExhausted(t *testing.T) {
+	// Given
+	startTime := time.Date(2022, time.Month(1), 11, 0, 0, 1, 0, time.UTC)
+	c := clock.NewMock()
+	c.Set(startTime)
+	g := NewGCRA(c, 500*time.Millisecond, 4)
+
+	// When
+	wait, ok, err := g.Allow(context.Background(), 3)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Zero(t, wait)
+
+	// When
+	wait, ok, err = g.Allow(context.Background(), 3)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 1*time.Second, wait)
+
+	// When
+	c.Set(startTime.Add(wait))
+	wait, ok, err = g.Allow(context.Background(), 3)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Zero(t, wait)
+}
+
+func TestGCRA_Allow_ReturnsNoErrorAndZeroWhenIdleLongEnough(t *testing.T) {
+	// Given
+	startTime := time.Date(2022, time.Month(1), 11, 0, 0, 1, 0, time.UTC)
+	c := clock.NewMock()
+	c.Set(startTime)
+	g := NewGCRA(c, 500*time.Millisecond, 2)
+
+	_, ok, err := g.Allow(context.Background(), 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// When
+	c.Set(startTime.Add(10 * time.Second))
+	wait, ok, err := g.Allow(context.Background(), 2)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Zero(t, wait)
+
+	// When
+	wait, ok, err = g.Allow(context.Background(), 1)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+}
+
+func TestGCRA_Reserve_ReturnsNoErrorOKAndWaitTimeWhenRequestConformsWithinMaxWait(t *testing.T) {
+	// Given
+	startTime := time.Date(2022, time.Month(1), 11, 0, 0, 1, 0, time.UTC)
+	c := clock.NewMock()
+	c.Set(startTime)
+	g := NewGCRA(c, 500*time.Millisecond, 4)
+	_, ok, err := g.Allow(context.Background(), 4)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// When
+	wait, ok, err := g.Reserve(context.Background(), 2, 2*time.Second)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1*time.Second, wait)
+
+	// When
+	wait, ok, err = g.Reserve(context.Background(), 2, 1*time.Second)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 2*time.Second, wait)
+}
+
+func TestGCRA_Refund_ReturnsReservedTokensToTheLimiter(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	g := NewGCRA(c, 500*time.Millisecond, 4)
+	_, ok, err := g.Reserve(context.Background(), 4, time.Second)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// When
+	err = g.Refund(context.Background(), 4)
+
+	// Then
+	assert.NoError(t, err)
+	wait, ok, err := g.Allow(context.Background(), 4)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Zero(t, wait)
+}
+
+func TestGCRA_Refund_DoesNotMoveTheoreticalArrivalTimeBeforeNow(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	g := NewGCRA(c, 500*time.Millisecond, 4)
+	_, ok, err := g.Reserve(context.Background(), 4, time.Second)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	c.Add(time.Minute)
+
+	// When
+	err = g.Refund(context.Background(), 4)
+
+	// Then
+	assert.NoError(t, err)
+	_, ok, err = g.Allow(context.Background(), 4)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	wait, ok, err := g.Allow(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+}
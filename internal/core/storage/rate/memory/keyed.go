@@ -0,0 +1,113 @@
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultMaxKeys        = 10000
+	defaultKeyIdleTimeout = 10 * time.Minute
+)
+
+type keyedEntry struct {
+	allower  allower
+	lastUsed time.Time
+}
+
+// KeyedAllower lazily creates a separate allower for every key of a quota template. The least recently used limiters
+// are evicted once maxKeys is exceeded, and limiters that were idle for longer than idleTimeout are evicted on access.
+type KeyedAllower struct {
+	clock       clock.Clock
+	newAllower  func() allower
+	limiters    *simplelru.LRU
+	idleTimeout time.Duration
+	liveKeys    prometheus.Gauge
+	evictedKeys prometheus.Counter
+	mu          *sync.Mutex
+}
+
+func NewKeyedAllower(clock clock.Clock, newAllower func() allower, maxKeys int, idleTimeout time.Duration, liveKeys prometheus.Gauge, evictedKeys prometheus.Counter) *KeyedAllower {
+	if maxKeys <= 0 {
+		panic("max keys must be greater than 0")
+	}
+
+	if idleTimeout <= 0 {
+		panic("idle timeout must be greater than 0")
+	}
+
+	k := &KeyedAllower{
+		clock:       clock,
+		newAllower:  newAllower,
+		limiters:    nil,
+		idleTimeout: idleTimeout,
+		liveKeys:    liveKeys,
+		evictedKeys: evictedKeys,
+		mu:          &sync.Mutex{},
+	}
+
+	limiters, err := simplelru.NewLRU(maxKeys, func(_ interface{}, _ interface{}) { k.evictedKeys.Inc() })
+	if err != nil {
+		panic(err)
+	}
+
+	k.limiters = limiters
+
+	return k
+}
+
+func (k *KeyedAllower) Allow(ctx context.Context, key string, tokens int64, maxWait time.Duration) (time.Duration, bool, error) {
+	return allowOrReserve(ctx, k.allowerForKey(key), tokens, maxWait)
+}
+
+func (k *KeyedAllower) Len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.limiters.Len()
+}
+
+func (k *KeyedAllower) allowerForKey(key string) allower {
+	now := k.clock.Now()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.evictIdleLocked(now)
+
+	value, found := k.limiters.Get(key)
+	if found {
+		entry := value.(*keyedEntry)
+		entry.lastUsed = now
+
+		return entry.allower
+	}
+
+	entry := &keyedEntry{allower: k.newAllower(), lastUsed: now}
+	k.limiters.Add(key, entry)
+	k.liveKeys.Set(float64(k.limiters.Len()))
+
+	return entry.allower
+}
+
+func (k *KeyedAllower) evictIdleLocked(now time.Time) {
+	for {
+		_, value, found := k.limiters.GetOldest()
+		if !found {
+			break
+		}
+
+		if now.Sub(value.(*keyedEntry).lastUsed) < k.idleTimeout {
+			break
+		}
+
+		k.limiters.RemoveOldest()
+	}
+
+	k.liveKeys.Set(float64(k.limiters.Len()))
+}
@@ -0,0 +1,102 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestKeyedAllower(c clock.Clock, maxKeys int, idleTimeout time.Duration) (*KeyedAllower, prometheus.Gauge, prometheus.Counter) {
+	liveKeys := prometheus.NewGauge(prometheus.GaugeOpts{Name: "live_keys"})
+	evictedKeys := prometheus.NewCounter(prometheus.CounterOpts{Name: "evicted_keys_total"})
+	newAllower := func() allower { return NewFixedWindow(c, 2*time.Second, 4) }
+
+	return NewKeyedAllower(c, newAllower, maxKeys, idleTimeout, liveKeys, evictedKeys), liveKeys, evictedKeys
+}
+
+func TestNewKeyedAllower_PanicsWithInvalidMaxKeys(t *testing.T) {
+	// When
+	panicFunc := func() { _, _, _ = newTestKeyedAllower(clock.NewMock(), 0, time.Minute) }
+
+	// Then
+	assert.Panics(t, panicFunc)
+}
+
+func TestNewKeyedAllower_PanicsWithInvalidIdleTimeout(t *testing.T) {
+	// When
+	panicFunc := func() { _, _, _ = newTestKeyedAllower(clock.NewMock(), 1, 0) }
+
+	// Then
+	assert.Panics(t, panicFunc)
+}
+
+func TestKeyedAllower_Allow_LimitsEveryKeyIndependently(t *testing.T) {
+	// Given
+	k, liveKeys, _ := newTestKeyedAllower(clock.NewMock(), 10, time.Minute)
+
+	// When
+	_, firstOK, firstErr := k.Allow(context.Background(), "user1", 4, 0)
+	_, secondOK, secondErr := k.Allow(context.Background(), "user1", 1, 0)
+	_, thirdOK, thirdErr := k.Allow(context.Background(), "user2", 4, 0)
+
+	// Then
+	assert.NoError(t, firstErr)
+	assert.True(t, firstOK)
+	assert.NoError(t, secondErr)
+	assert.False(t, secondOK)
+	assert.NoError(t, thirdErr)
+	assert.True(t, thirdOK)
+	assert.Equal(t, 2, k.Len())
+	assert.EqualValues(t, 2, testutil.ToFloat64(liveKeys))
+}
+
+func TestKeyedAllower_Allow_EvictsLeastRecentlyUsedKeyWhenMaxKeysIsExceeded(t *testing.T) {
+	// Given
+	k, liveKeys, evictedKeys := newTestKeyedAllower(clock.NewMock(), 2, time.Minute)
+	_, _, _ = k.Allow(context.Background(), "user1", 4, 0)
+	_, _, _ = k.Allow(context.Background(), "user2", 4, 0)
+	_, _, _ = k.Allow(context.Background(), "user1", 0, 0)
+
+	// When
+	_, ok, err := k.Allow(context.Background(), "user3", 4, 0)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 2, k.Len())
+	assert.EqualValues(t, 2, testutil.ToFloat64(liveKeys))
+	assert.EqualValues(t, 1, testutil.ToFloat64(evictedKeys))
+
+	// When
+	_, ok, err = k.Allow(context.Background(), "user1", 1, 0)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestKeyedAllower_Allow_EvictsIdleKeys(t *testing.T) {
+	// Given
+	startTime := time.Date(2022, time.Month(1), 11, 0, 0, 1, 0, time.UTC)
+	c := clock.NewMock()
+	c.Set(startTime)
+	k, liveKeys, evictedKeys := newTestKeyedAllower(c, 10, time.Minute)
+	_, _, _ = k.Allow(context.Background(), "user1", 4, 0)
+	_, _, _ = k.Allow(context.Background(), "user2", 4, 0)
+
+	// When
+	c.Set(startTime.Add(time.Minute))
+	_, ok, err := k.Allow(context.Background(), "user3", 4, 0)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1, k.Len())
+	assert.EqualValues(t, 1, testutil.ToFloat64(liveKeys))
+	assert.EqualValues(t, 2, testutil.ToFloat64(evictedKeys))
+}
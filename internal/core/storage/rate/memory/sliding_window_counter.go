@@ -0,0 +1,137 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+const (
+	SlidingWindowCounterAlgorithm = "sliding-window-counter"
+)
+
+type slidingWindowCounterState struct {
+	WindowStart time.Time `json:"window_start"`
+	Previous    int64     `json:"previous"`
+	Current     int64     `json:"current"`
+}
+
+type SlidingWindowCounter struct {
+	clock       clock.Clock
+	windowStart time.Time
+	interval    time.Duration
+	previous    int64
+	current     int64
+	capacity    int64
+	mu          *sync.Mutex
+}
+
+func NewSlidingWindowCounter(clock clock.Clock, interval time.Duration, capacity int64) *SlidingWindowCounter {
+	if interval <= 0 {
+		panic("interval must be greater than 0")
+	}
+
+	if capacity <= 0 {
+		panic("capacity must be greater than 0")
+	}
+
+	return &SlidingWindowCounter{
+		clock:       clock,
+		windowStart: time.Time{},
+		interval:    interval,
+		previous:    0,
+		current:     0,
+		capacity:    capacity,
+		mu:          &sync.Mutex{},
+	}
+}
+
+// Allow returns true if the weighted count of the previous and the current window leaves room for the request.
+// Otherwise, it returns false and the time after which the request would fit. Requests that can never fit return zero.
+func (c *SlidingWindowCounter) Allow(_ context.Context, tokens int64) (time.Duration, bool, error) {
+	now := c.clock.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.advanceLocked(now)
+
+	if tokens > c.capacity {
+		return 0, false, nil
+	}
+
+	elapsed := now.Sub(c.windowStart)
+	if c.estimateLocked(elapsed)+float64(tokens) > float64(c.capacity) {
+		return c.waitTimeLocked(elapsed, tokens), false, nil
+	}
+
+	c.current += tokens
+
+	return 0, true, nil
+}
+
+func (c *SlidingWindowCounter) Snapshot() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return json.Marshal(slidingWindowCounterState{WindowStart: c.windowStart, Previous: c.previous, Current: c.current})
+}
+
+func (c *SlidingWindowCounter) Restore(data []byte) error {
+	var state slidingWindowCounterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.windowStart = state.WindowStart
+	c.previous = state.Previous
+	c.current = state.Current
+
+	return nil
+}
+
+func (c *SlidingWindowCounter) advanceLocked(now time.Time) {
+	windowEnd := c.windowStart.Add(c.interval)
+	if now.Before(windowEnd) {
+		return
+	}
+
+	if now.Before(windowEnd.Add(c.interval)) {
+		c.previous = c.current
+	} else {
+		c.previous = 0
+	}
+
+	c.current = 0
+	c.windowStart = now.Truncate(c.interval)
+}
+
+func (c *SlidingWindowCounter) estimateLocked(elapsed time.Duration) float64 {
+	weight := float64(c.interval-elapsed) / float64(c.interval)
+
+	return float64(c.previous)*weight + float64(c.current)
+}
+
+func (c *SlidingWindowCounter) waitTimeLocked(elapsed time.Duration, tokens int64) time.Duration {
+	interval := float64(c.interval)
+
+	// The request fits later in the current window once enough of the previous window has slid out.
+	room := float64(c.capacity - c.current - tokens)
+	if room >= 0 && c.previous > 0 {
+		untilFit := interval - float64(elapsed) - room*interval/float64(c.previous)
+		return time.Duration(math.Ceil(untilFit))
+	}
+
+	// Otherwise, the current window becomes the previous one and has to slide out far enough.
+	untilWindowEnd := interval - float64(elapsed)
+	untilFit := interval * (1 - float64(c.capacity-tokens)/float64(c.current))
+
+	return time.Duration(math.Ceil(untilWindowEnd + math.Max(untilFit, 0)))
+}
@@ -0,0 +1,162 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSlidingWindowCounter_ReturnsNewSlidingWindowCounterWithCorrectArguments(t *testing.T) {
+	// When
+	got := NewSlidingWindowCounter(clock.NewMock(), 1, 1)
+
+	// Then
+	assert.NotNil(t, got)
+}
+
+func TestNewSlidingWindowCounter_PanicsWithInvalidInterval(t *testing.T) {
+	// When
+	panicFunc := func() { _ = NewSlidingWindowCounter(clock.NewMock(), 0, 1) }
+
+	// Then
+	assert.Panics(t, panicFunc)
+}
+
+func TestNewSlidingWindowCounter_PanicsWithInvalidCapacity(t *testing.T) {
+	// When
+	panicFunc := func() { _ = NewSlidingWindowCounter(clock.NewMock(), 1, 0) }
+
+	// Then
+	assert.Panics(t, panicFunc)
+}
+
+func TestSlidingWindowCounter_Allow_ReturnsNoErrorNotOKAndZeroWithMoreTokensRequestedThanCapacity(t *testing.T) {
+	// Given
+	i := 2 * time.Second
+	c := int64(4)
+	cl := clock.NewMock()
+	w := NewSlidingWindowCounter(cl, i, c)
+
+	// When
+	wait, ok, err := w.Allow(context.Background(), 5)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Zero(t, wait)
+}
+
+func TestSlidingWindowCounter_Allow_ReturnsNoErrorOKAndZeroWithLessTokensRequestedThanCapacity(t *testing.T) {
+	// Given
+	i := 2 * time.Second
+	c := int64(4)
+	cl := clock.NewMock()
+	w := NewSlidingWindowCounter(cl, i, c)
+
+	// When
+	wait, ok, err := w.Allow(context.Background(), 3)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Zero(t, wait)
+}
+
+func TestSlidingWindowCounter_Allow_ReturnsNoErrorNotOKAndWaitTimeWhenTokensAreExhausted(t *testing.T) {
+	// Given
+	startTime := time.Date(2022, time.Month(1), 11, 0, 0, 0, 0, time.UTC)
+	c := clock.NewMock()
+	c.Set(startTime)
+	w := NewSlidingWindowCounter(c, 2*time.Second, 4)
+
+	// When
+	wait, ok, err := w.Allow(context.Background(), 3)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Zero(t, wait)
+
+	// When
+	wait, ok, err = w.Allow(context.Background(), 3)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Greater(t, wait, 2*time.Second)
+
+	// When
+	c.Set(startTime.Add(wait - time.Millisecond))
+	_, ok, err = w.Allow(context.Background(), 3)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// When
+	c.Set(startTime.Add(wait))
+	wait, ok, err = w.Allow(context.Background(), 3)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Zero(t, wait)
+}
+
+func TestSlidingWindowCounter_Allow_ReturnsWaitTimeWithinCurrentWindow(t *testing.T) {
+	// Given
+	startTime := time.Date(2022, time.Month(1), 11, 0, 0, 0, 0, time.UTC)
+	c := clock.NewMock()
+	c.Set(startTime)
+	w := NewSlidingWindowCounter(c, 2*time.Second, 4)
+
+	_, ok, err := w.Allow(context.Background(), 4)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// When
+	c.Set(startTime.Add(2 * time.Second))
+	wait, ok, err := w.Allow(context.Background(), 2)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 1*time.Second, wait)
+
+	// When
+	c.Set(startTime.Add(3 * time.Second))
+	wait, ok, err = w.Allow(context.Background(), 2)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Zero(t, wait)
+}
+
+func TestSlidingWindowCounter_Allow_ReturnsNotOKAcrossFixedWindowBoundary(t *testing.T) {
+	// Given
+	startTime := time.Date(2022, time.Month(1), 11, 0, 0, 0, 0, time.UTC)
+	c := clock.NewMock()
+	c.Set(startTime.Add(1900 * time.Millisecond))
+	w := NewSlidingWindowCounter(c, 2*time.Second, 4)
+
+	// When
+	wait, ok, err := w.Allow(context.Background(), 4)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Zero(t, wait)
+
+	// When
+	c.Set(startTime.Add(2100 * time.Millisecond))
+	wait, ok, err = w.Allow(context.Background(), 4)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 1900*time.Millisecond, wait)
+}
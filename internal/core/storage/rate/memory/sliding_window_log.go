@@ -0,0 +1,122 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+const (
+	SlidingWindowLogAlgorithm = "sliding-window-log"
+)
+
+type logEntry struct {
+	At     time.Time `json:"at"`
+	Tokens int64     `json:"tokens"`
+}
+
+type SlidingWindowLog struct {
+	clock     clock.Clock
+	entries   []logEntry
+	interval  time.Duration
+	allocated int64
+	capacity  int64
+	mu        *sync.Mutex
+}
+
+func NewSlidingWindowLog(clock clock.Clock, interval time.Duration, capacity int64) *SlidingWindowLog {
+	if interval <= 0 {
+		panic("interval must be greater than 0")
+	}
+
+	if capacity <= 0 {
+		panic("capacity must be greater than 0")
+	}
+
+	return &SlidingWindowLog{
+		clock:     clock,
+		entries:   nil,
+		interval:  interval,
+		allocated: 0,
+		capacity:  capacity,
+		mu:        &sync.Mutex{},
+	}
+}
+
+// Allow returns true if the request fits into the window ending now. Otherwise, it returns false and the time after
+// which enough of the logged requests leave the window for the request to fit. Requests that can never fit return zero.
+func (l *SlidingWindowLog) Allow(_ context.Context, tokens int64) (time.Duration, bool, error) {
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.evictLocked(now)
+
+	if tokens > l.capacity {
+		return 0, false, nil
+	}
+
+	if l.allocated+tokens > l.capacity {
+		return l.waitTimeLocked(now, tokens), false, nil
+	}
+
+	l.entries = append(l.entries, logEntry{At: now, Tokens: tokens})
+	l.allocated += tokens
+
+	return 0, true, nil
+}
+
+func (l *SlidingWindowLog) Snapshot() ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return json.Marshal(l.entries)
+}
+
+func (l *SlidingWindowLog) Restore(data []byte) error {
+	var entries []logEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = entries
+	l.allocated = 0
+	for _, e := range entries {
+		l.allocated += e.Tokens
+	}
+
+	return nil
+}
+
+func (l *SlidingWindowLog) evictLocked(now time.Time) {
+	evicted := 0
+	for _, e := range l.entries {
+		if e.At.Add(l.interval).After(now) {
+			break
+		}
+
+		l.allocated -= e.Tokens
+		evicted++
+	}
+
+	l.entries = l.entries[evicted:]
+}
+
+func (l *SlidingWindowLog) waitTimeLocked(now time.Time, tokens int64) time.Duration {
+	needed := l.allocated + tokens - l.capacity
+	for _, e := range l.entries {
+		needed -= e.Tokens
+		if needed <= 0 {
+			return e.At.Add(l.interval).Sub(now)
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,151 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSlidingWindowLog_ReturnsNewSlidingWindowLogWithCorrectArguments(t *testing.T) {
+	// When
+	got := NewSlidingWindowLog(clock.NewMock(), 1, 1)
+
+	// Then
+	assert.NotNil(t, got)
+}
+
+func TestNewSlidingWindowLog_PanicsWithInvalidInterval(t *testing.T) {
+	// When
+	panicFunc := func() { _ = NewSlidingWindowLog(clock.NewMock(), 0, 1) }
+
+	// Then
+	assert.Panics(t, panicFunc)
+}
+
+func TestNewSlidingWindowLog_PanicsWithInvalidCapacity(t *testing.T) {
+	// When
+	panicFunc := func() { _ = NewSlidingWindowLog(clock.NewMock(), 1, 0) }
+
+	// Then
+	assert.Panics(t, panicFunc)
+}
+
+func TestSlidingWindowLog_Allow_ReturnsNoErrorNotOKAndZeroWithMoreTokensRequestedThanCapacity(t *testing.T) {
+	// Given
+	i := 2 * time.Second
+	c := int64(4)
+	cl := clock.NewMock()
+	l := NewSlidingWindowLog(cl, i, c)
+
+	// When
+	wait, ok, err := l.Allow(context.Background(), 5)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Zero(t, wait)
+}
+
+func TestSlidingWindowLog_Allow_ReturnsNoErrorOKAndZeroWithLessTokensRequestedThanCapacity(t *testing.T) {
+	// Given
+	i := 2 * time.Second
+	c := int64(4)
+	cl := clock.NewMock()
+	l := NewSlidingWindowLog(cl, i, c)
+
+	// When
+	wait, ok, err := l.Allow(context.Background(), 3)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Zero(t, wait)
+}
+
+func TestSlidingWindowLog_Allow_ReturnsNoErrorNotOKAndWaitTimeWhenTokensAreExhausted(t *testing.T) {
+	// Given
+	startTime := time.Date(2022, time.Month(1), 11, 0, 0, 1, 0, time.UTC)
+	c := clock.NewMock()
+	c.Set(startTime)
+	l := NewSlidingWindowLog(c, 2*time.Second, 4)
+
+	// When
+	wait, ok, err := l.Allow(context.Background(), 3)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Zero(t, wait)
+
+	// When
+	c.Set(startTime.Add(1 * time.Second))
+	wait, ok, err = l.Allow(context.Background(), 2)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 1*time.Second, wait)
+}
+
+func TestSlidingWindowLog_Allow_ReturnsWaitTimeUntilEnoughEntriesLeaveWindow(t *testing.T) {
+	// Given
+	startTime := time.Date(2022, time.Month(1), 11, 0, 0, 1, 0, time.UTC)
+	c := clock.NewMock()
+	c.Set(startTime)
+	l := NewSlidingWindowLog(c, 2*time.Second, 4)
+
+	_, ok, err := l.Allow(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	c.Set(startTime.Add(1 * time.Second))
+	_, ok, err = l.Allow(context.Background(), 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// When
+	c.Set(startTime.Add(1500 * time.Millisecond))
+	wait, ok, err := l.Allow(context.Background(), 3)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 1500*time.Millisecond, wait)
+
+	// When
+	c.Set(startTime.Add(1500 * time.Millisecond).Add(wait))
+	wait, ok, err = l.Allow(context.Background(), 3)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Zero(t, wait)
+}
+
+func TestSlidingWindowLog_Allow_ReturnsNotOKAcrossFixedWindowBoundary(t *testing.T) {
+	// Given
+	startTime := time.Date(2022, time.Month(1), 11, 0, 0, 0, 0, time.UTC)
+	c := clock.NewMock()
+	c.Set(startTime.Add(1900 * time.Millisecond))
+	l := NewSlidingWindowLog(c, 2*time.Second, 4)
+
+	// When
+	wait, ok, err := l.Allow(context.Background(), 4)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Zero(t, wait)
+
+	// When
+	c.Set(startTime.Add(2100 * time.Millisecond))
+	wait, ok, err = l.Allow(context.Background(), 4)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 1800*time.Millisecond, wait)
+}
@@ -4,11 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/benbjohnson/clock"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	"github.com/Blinkuu/qms/internal/core/storage"
 	"github.com/Blinkuu/qms/internal/core/storage/rate/quota"
@@ -19,32 +23,125 @@ type allower interface {
 	Allow(ctx context.Context, tokens int64) (waitTime time.Duration, ok bool, err error)
 }
 
+// reserver is implemented by allowers that can account for tokens ahead of time. The caller is expected to wait
+// waitTime before using reserved tokens.
+type reserver interface {
+	Reserve(ctx context.Context, tokens int64, maxWait time.Duration) (waitTime time.Duration, ok bool, err error)
+}
+
+// refunder is implemented by allowers that can take back reserved tokens that will not be used.
+type refunder interface {
+	Refund(ctx context.Context, tokens int64) error
+}
+
+type reservable interface {
+	reserver
+	refunder
+}
+
+// snapshotter is implemented by allowers whose state can be copied to another instance.
+type snapshotter interface {
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+type reservation struct {
+	id       string
+	refunder refunder
+	tokens   int64
+	readyAt  time.Time
+}
+
+// ApproximateCount is the count of an approximate quota in a window, as seen by a single replica.
+type ApproximateCount struct {
+	Namespace   string    `json:"namespace"`
+	Resource    string    `json:"resource"`
+	WindowStart time.Time `json:"window_start"`
+	Count       int64     `json:"count"`
+}
+
+type approximateQuota struct {
+	namespace string
+	resource  string
+	window    *ApproximateFixedWindow
+}
+
 type Storage struct {
-	clock      clock.Clock
-	strategies map[string]allower
-	bucketsMu  *sync.RWMutex
+	clock          clock.Clock
+	strategies     map[string]allower
+	templates      map[string]*KeyedAllower
+	limiters       map[string]*ConcurrencyLimiter
+	approximate    map[string]approximateQuota
+	quotas         map[string]quota.Quota
+	bucketsMu      *sync.RWMutex
+	reservations   map[string]reservation
+	reservationsMu *sync.Mutex
+	liveKeys       *prometheus.GaugeVec
+	evictedKeys    *prometheus.CounterVec
+	overshoot      *prometheus.GaugeVec
+	peerStateAge   *prometheus.GaugeVec
 }
 
-func NewStorage(clock clock.Clock) *Storage {
+func NewStorage(clock clock.Clock, reg prometheus.Registerer) *Storage {
 	return &Storage{
-		clock:      clock,
-		strategies: make(map[string]allower),
-		bucketsMu:  &sync.RWMutex{},
+		clock:          clock,
+		strategies:     make(map[string]allower),
+		templates:      make(map[string]*KeyedAllower),
+		limiters:       make(map[string]*ConcurrencyLimiter),
+		approximate:    make(map[string]approximateQuota),
+		quotas:         make(map[string]quota.Quota),
+		bucketsMu:      &sync.RWMutex{},
+		reservations:   make(map[string]reservation),
+		reservationsMu: &sync.Mutex{},
+		liveKeys: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name:      "rate_live_keys",
+			Namespace: "default",
+			Subsystem: "qms",
+			Help:      "The number of live per-key limiters of a quota template",
+		}, []string{"namespace", "resource"}),
+		evictedKeys: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name:      "rate_evicted_keys_total",
+			Namespace: "default",
+			Subsystem: "qms",
+			Help:      "The total number of per-key limiters evicted from a quota template",
+		}, []string{"namespace", "resource"}),
+		overshoot: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name:      "rate_approximate_overshoot_tokens",
+			Namespace: "default",
+			Subsystem: "qms",
+			Help:      "The number of tokens allowed over the limit of an approximate quota in the current window, as known after the last sync",
+		}, []string{"namespace", "resource"}),
+		peerStateAge: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name:      "rate_approximate_peer_state_age_seconds",
+			Namespace: "default",
+			Subsystem: "qms",
+			Help:      "The age of the oldest peer count used by an approximate quota",
+		}, []string{"namespace", "resource"}),
 	}
 }
 
-func (s *Storage) Allow(ctx context.Context, namespace, resource string, tokens int64) (time.Duration, bool, error) {
+// Allow checks the quota of a namespace-resource pair. For quota templates, the key selects the per-key limiter, and
+// it is ignored for regular quotas. If maxWait is positive and the algorithm supports it, tokens available within
+// maxWait are reserved, and the returned wait time must pass before they are used.
+func (s *Storage) Allow(ctx context.Context, namespace, resource, key string, tokens int64, maxWait time.Duration) (time.Duration, bool, error) {
 	id := strings.Join([]string{namespace, resource}, "_")
 
 	s.bucketsMu.RLock()
 	defer s.bucketsMu.RUnlock()
 
-	bucket, found := s.strategies[id]
-	if !found {
+	var (
+		waitTime time.Duration
+		ok       bool
+		err      error
+	)
+	if bucket, found := s.strategies[id]; found {
+		waitTime, ok, err = allowOrReserve(ctx, bucket, tokens, maxWait)
+	} else if template, found := s.templates[id]; found {
+		waitTime, ok, err = template.Allow(ctx, key, tokens, maxWait)
+	} else {
 		return 0, false, storage.ErrNotFound
 	}
 
-	waitTime, ok, err := bucket.Allow(ctx, tokens)
 	if err != nil {
 		return 0, false, fmt.Errorf("failed to allow: %w", err)
 	}
@@ -52,35 +149,495 @@ func (s *Storage) Allow(ctx context.Context, namespace, resource string, tokens
 	return waitTime, ok, nil
 }
 
+// Reserve takes tokens that become available within maxWait, or without a bound if maxWait is not positive. Returns a
+// reservation ID and the time at which the tokens can be used. The reservation can be cancelled until that time.
+func (s *Storage) Reserve(ctx context.Context, namespace, resource, key string, tokens int64, maxWait time.Duration) (string, time.Time, bool, error) {
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	s.bucketsMu.RLock()
+	defer s.bucketsMu.RUnlock()
+
+	var a allower
+	if bucket, found := s.strategies[id]; found {
+		a = bucket
+	} else if template, found := s.templates[id]; found {
+		a = template.allowerForKey(key)
+	} else {
+		return "", time.Time{}, false, storage.ErrNotFound
+	}
+
+	r, ok := a.(reservable)
+	if !ok {
+		return "", time.Time{}, false, storage.ErrNotSupported
+	}
+
+	if maxWait <= 0 {
+		maxWait = time.Duration(math.MaxInt64)
+	}
+
+	now := s.clock.Now()
+	waitTime, ok, err := r.Reserve(ctx, tokens, maxWait)
+	if err != nil {
+		return "", time.Time{}, false, fmt.Errorf("failed to reserve: %w", err)
+	}
+
+	if !ok {
+		// The tokens are not reserved, but the caller is told when they would be available, unless they never will be.
+		if waitTime <= 0 {
+			return "", time.Time{}, false, nil
+		}
+
+		return "", now.Add(waitTime), false, nil
+	}
+
+	res := reservation{
+		id:       strings.Join([]string{id, uuid.NewString()}, "_"),
+		refunder: r,
+		tokens:   tokens,
+		readyAt:  now.Add(waitTime),
+	}
+
+	s.reservationsMu.Lock()
+	defer s.reservationsMu.Unlock()
+
+	s.evictReadyReservationsLocked(now)
+	if res.readyAt.After(now) {
+		s.reservations[res.id] = res
+	}
+
+	return res.id, res.readyAt, true, nil
+}
+
+// Cancel gives the tokens of a reservation back to its quota. Returns false if the reservation is unknown or its
+// tokens are already available for use.
+func (s *Storage) Cancel(ctx context.Context, namespace, resource, reservationID string) (bool, error) {
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	s.bucketsMu.RLock()
+	defer s.bucketsMu.RUnlock()
+
+	_, foundStrategy := s.strategies[id]
+	_, foundTemplate := s.templates[id]
+	if !foundStrategy && !foundTemplate {
+		return false, storage.ErrNotFound
+	}
+
+	if !strings.HasPrefix(reservationID, id+"_") {
+		return false, nil
+	}
+
+	s.reservationsMu.Lock()
+	defer s.reservationsMu.Unlock()
+
+	s.evictReadyReservationsLocked(s.clock.Now())
+
+	res, found := s.reservations[reservationID]
+	if !found {
+		return false, nil
+	}
+
+	delete(s.reservations, reservationID)
+
+	if err := res.refunder.Refund(ctx, res.tokens); err != nil {
+		return false, fmt.Errorf("failed to refund: %w", err)
+	}
+
+	return true, nil
+}
+
+func (s *Storage) evictReadyReservationsLocked(now time.Time) {
+	for reservationID, res := range s.reservations {
+		if res.readyAt.After(now) {
+			continue
+		}
+
+		delete(s.reservations, reservationID)
+	}
+}
+
+// Snapshot returns the encoded state of a quota. Quota templates and concurrency quotas are not supported.
+func (s *Storage) Snapshot(_ context.Context, namespace, resource string) ([]byte, error) {
+	sn, err := s.snapshotter(namespace, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := sn.Snapshot()
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot: %w", err)
+	}
+
+	return data, nil
+}
+
+// Restore replaces the state of a quota with one returned by Snapshot.
+func (s *Storage) Restore(_ context.Context, namespace, resource string, data []byte) error {
+	sn, err := s.snapshotter(namespace, resource)
+	if err != nil {
+		return err
+	}
+
+	if err := sn.Restore(data); err != nil {
+		return fmt.Errorf("failed to restore: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Storage) snapshotter(namespace, resource string) (snapshotter, error) {
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	s.bucketsMu.RLock()
+	defer s.bucketsMu.RUnlock()
+
+	bucket, found := s.strategies[id]
+	if !found {
+		_, foundTemplate := s.templates[id]
+		_, foundLimiter := s.limiters[id]
+		if foundTemplate || foundLimiter {
+			return nil, storage.ErrNotSupported
+		}
+
+		return nil, storage.ErrNotFound
+	}
+
+	sn, ok := bucket.(snapshotter)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+
+	return sn, nil
+}
+
+// ApproximateCounts returns the counts of the approximate quotas that are due for a sync with peers.
+func (s *Storage) ApproximateCounts() []ApproximateCount {
+	s.bucketsMu.RLock()
+	defer s.bucketsMu.RUnlock()
+
+	var counts []ApproximateCount
+	for _, q := range s.approximate {
+		windowStart, count, due := q.window.Report()
+		if !due {
+			continue
+		}
+
+		counts = append(counts, ApproximateCount{Namespace: q.namespace, Resource: q.resource, WindowStart: windowStart, Count: count})
+	}
+
+	return counts
+}
+
+// MergeApproximateCounts records the counts of approximate quotas reported by a peer. Unknown quotas are ignored.
+func (s *Storage) MergeApproximateCounts(peer string, counts []ApproximateCount) {
+	s.bucketsMu.RLock()
+	defer s.bucketsMu.RUnlock()
+
+	for _, c := range counts {
+		q, found := s.approximate[strings.Join([]string{c.Namespace, c.Resource}, "_")]
+		if !found {
+			continue
+		}
+
+		q.window.Merge(peer, c.WindowStart, c.Count)
+	}
+}
+
+func (s *Storage) Acquire(ctx context.Context, namespace, resource string, tokens int64) (string, bool, error) {
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	s.bucketsMu.RLock()
+	defer s.bucketsMu.RUnlock()
+
+	limiter, found := s.limiters[id]
+	if !found {
+		return "", false, storage.ErrNotFound
+	}
+
+	permitID, ok, err := limiter.Acquire(ctx, tokens)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to acquire: %w", err)
+	}
+
+	return permitID, ok, nil
+}
+
+func (s *Storage) Release(ctx context.Context, namespace, resource, permitID string) (bool, error) {
+	id := strings.Join([]string{namespace, resource}, "_")
+
+	s.bucketsMu.RLock()
+	defer s.bucketsMu.RUnlock()
+
+	limiter, found := s.limiters[id]
+	if !found {
+		return false, storage.ErrNotFound
+	}
+
+	ok, err := limiter.Release(ctx, permitID)
+	if err != nil {
+		return false, fmt.Errorf("failed to release: %w", err)
+	}
+
+	return ok, nil
+}
+
 func (s *Storage) RegisterQuota(_ context.Context, namespace, resource string, cfg quota.Config) error {
+	if err := s.validateConfig(cfg); err != nil {
+		return err
+	}
+
 	s.bucketsMu.Lock()
 	defer s.bucketsMu.Unlock()
 
 	id := strings.Join([]string{namespace, resource}, "_")
-	_, found := s.strategies[id]
-	if found {
-		return errors.New("only a single strategy for a namespace-resource pair can be registered")
+	if _, found := s.quotas[id]; found {
+		return fmt.Errorf("only a single strategy for a namespace-resource pair can be registered: %w", storage.ErrAlreadyExists)
+	}
+
+	return s.registerQuotaLocked(id, namespace, resource, cfg)
+}
+
+// UpdateQuota replaces the configuration of a quota. The state of the quota is reset, and its pending reservations are
+// dropped.
+func (s *Storage) UpdateQuota(_ context.Context, namespace, resource string, cfg quota.Config) error {
+	if err := s.validateConfig(cfg); err != nil {
+		return err
+	}
+
+	s.bucketsMu.Lock()
+	defer s.bucketsMu.Unlock()
+
+	id := strings.Join([]string{namespace, resource}, "_")
+	if _, found := s.quotas[id]; !found {
+		return storage.ErrNotFound
+	}
+
+	s.deleteQuotaLocked(id, namespace, resource)
+
+	return s.registerQuotaLocked(id, namespace, resource, cfg)
+}
+
+func (s *Storage) DeleteQuota(_ context.Context, namespace, resource string) error {
+	s.bucketsMu.Lock()
+	defer s.bucketsMu.Unlock()
+
+	id := strings.Join([]string{namespace, resource}, "_")
+	if _, found := s.quotas[id]; !found {
+		return storage.ErrNotFound
+	}
+
+	s.deleteQuotaLocked(id, namespace, resource)
+
+	return nil
+}
+
+func (s *Storage) ListQuotas(_ context.Context) ([]quota.Quota, error) {
+	s.bucketsMu.RLock()
+	defer s.bucketsMu.RUnlock()
+
+	quotas := make([]quota.Quota, 0, len(s.quotas))
+	for _, q := range s.quotas {
+		quotas = append(quotas, q)
+	}
+
+	return quotas, nil
+}
+
+func (s *Storage) deleteQuotaLocked(id, namespace, resource string) {
+	delete(s.strategies, id)
+	delete(s.templates, id)
+	delete(s.limiters, id)
+	delete(s.approximate, id)
+	delete(s.quotas, id)
+
+	s.liveKeys.DeleteLabelValues(namespace, resource)
+	s.evictedKeys.DeleteLabelValues(namespace, resource)
+	s.overshoot.DeleteLabelValues(namespace, resource)
+	s.peerStateAge.DeleteLabelValues(namespace, resource)
+
+	s.reservationsMu.Lock()
+	defer s.reservationsMu.Unlock()
+
+	for reservationID := range s.reservations {
+		if strings.HasPrefix(reservationID, id+"_") {
+			delete(s.reservations, reservationID)
+		}
+	}
+}
+
+func (s *Storage) registerQuotaLocked(id, namespace, resource string, cfg quota.Config) error {
+	if err := s.registerAllowerLocked(id, namespace, resource, cfg); err != nil {
+		return err
+	}
+
+	s.quotas[id] = quota.Quota{Namespace: namespace, Resource: resource, Strategy: cfg}
+
+	return nil
+}
+
+func (s *Storage) registerAllowerLocked(id, namespace, resource string, cfg quota.Config) error {
+	if cfg.Algorithm == ConcurrencyAlgorithm {
+		ttl := cfg.PermitTTL
+		if ttl == 0 {
+			ttl = defaultPermitTTL
+		}
+
+		s.limiters[id] = NewConcurrencyLimiter(s.clock, ttl, cfg.MaxConcurrent)
+
+		return nil
 	}
 
+	if cfg.Approximate {
+		return s.registerApproximateLocked(id, namespace, resource, cfg)
+	}
+
+	newAllower, err := s.allowerFactory(cfg)
+	if err != nil {
+		return err
+	}
+
+	if !cfg.PerKey {
+		s.strategies[id] = newAllower()
+
+		return nil
+	}
+
+	maxKeys := cfg.MaxKeys
+	if maxKeys == 0 {
+		maxKeys = defaultMaxKeys
+	}
+
+	idleTimeout := cfg.KeyIdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultKeyIdleTimeout
+	}
+
+	_ = newAllower() // Validate the configuration eagerly instead of on the first request.
+	s.templates[id] = NewKeyedAllower(
+		s.clock,
+		newAllower,
+		maxKeys,
+		idleTimeout,
+		s.liveKeys.WithLabelValues(namespace, resource),
+		s.evictedKeys.WithLabelValues(namespace, resource),
+	)
+
+	return nil
+}
+
+func (s *Storage) registerApproximateLocked(id, namespace, resource string, cfg quota.Config) error {
 	unit, err := timeunit.Parse(cfg.Unit)
 	if err != nil {
 		return fmt.Errorf("failed to parse time unit: %w", err)
 	}
 
-	switch cfg.Algorithm {
-	case FixedWindowAlgorithm:
-		s.strategies[id] = NewFixedWindow(s.clock, unit, cfg.RequestPerUnit)
+	syncInterval := cfg.SyncInterval
+	if syncInterval == 0 {
+		syncInterval = defaultApproximateSyncInterval
+	}
+
+	window := NewApproximateFixedWindow(
+		s.clock,
+		unit,
+		cfg.RequestPerUnit,
+		syncInterval,
+		s.overshoot.WithLabelValues(namespace, resource),
+		s.peerStateAge.WithLabelValues(namespace, resource),
+	)
+	s.strategies[id] = window
+	s.approximate[id] = approximateQuota{namespace: namespace, resource: resource, window: window}
+
+	return nil
+}
+
+// validateConfig rejects configurations that would make the constructors of limiters panic.
+func (s *Storage) validateConfig(cfg quota.Config) error {
+	if cfg.Algorithm == ConcurrencyAlgorithm {
+		if cfg.MaxConcurrent <= 0 {
+			return fmt.Errorf("max concurrent must be greater than 0: %w", storage.ErrInvalidConfig)
+		}
+
+		if cfg.PermitTTL < 0 {
+			return fmt.Errorf("permit ttl must not be negative: %w", storage.ErrInvalidConfig)
+		}
 
 		return nil
+	}
+
+	if cfg.Approximate && (cfg.Algorithm != FixedWindowAlgorithm || cfg.PerKey) {
+		return fmt.Errorf("approximate quotas support only the %s algorithm without per_key: %w", FixedWindowAlgorithm, storage.ErrInvalidConfig)
+	}
+
+	if cfg.RequestPerUnit <= 0 {
+		return fmt.Errorf("requests per unit must be greater than 0: %w", storage.ErrInvalidConfig)
+	}
+
+	if cfg.Burst < 0 || cfg.MaxKeys < 0 || cfg.KeyIdleTimeout < 0 || cfg.SyncInterval < 0 {
+		return fmt.Errorf("burst, max keys, key idle timeout and sync interval must not be negative: %w", storage.ErrInvalidConfig)
+	}
+
+	unit, err := timeunit.Parse(cfg.Unit)
+	if err != nil {
+		return fmt.Errorf("failed to parse time unit: %s: %w", err, storage.ErrInvalidConfig)
+	}
+
+	if cfg.Algorithm == GCRAAlgorithm && unit/time.Duration(cfg.RequestPerUnit) <= 0 {
+		return fmt.Errorf("requests per unit must not exceed the number of nanoseconds in a unit: %w", storage.ErrInvalidConfig)
+	}
+
+	if _, err := s.allowerFactory(cfg); err != nil {
+		return fmt.Errorf("%s: %w", err, storage.ErrInvalidConfig)
+	}
+
+	return nil
+}
+
+func (s *Storage) allowerFactory(cfg quota.Config) (func() allower, error) {
+	unit, err := timeunit.Parse(cfg.Unit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse time unit: %w", err)
+	}
+
+	switch cfg.Algorithm {
+	case FixedWindowAlgorithm:
+		return func() allower { return NewFixedWindow(s.clock, unit, cfg.RequestPerUnit) }, nil
 	case TokenBucketAlgorithm:
-		s.strategies[id] = NewTokenBucket(s.clock, float64(cfg.RequestPerUnit)/unit.Seconds(), cfg.RequestPerUnit)
+		return func() allower {
+			return NewTokenBucket(s.clock, float64(cfg.RequestPerUnit)/unit.Seconds(), burstOrDefault(cfg))
+		}, nil
+	case SlidingWindowLogAlgorithm:
+		return func() allower { return NewSlidingWindowLog(s.clock, unit, cfg.RequestPerUnit) }, nil
+	case SlidingWindowCounterAlgorithm:
+		return func() allower { return NewSlidingWindowCounter(s.clock, unit, cfg.RequestPerUnit) }, nil
+	case GCRAAlgorithm:
+		if cfg.RequestPerUnit <= 0 {
+			return nil, errors.New("requests per unit must be greater than 0")
+		}
 
-		return nil
+		return func() allower {
+			return NewGCRA(s.clock, unit/time.Duration(cfg.RequestPerUnit), burstOrDefault(cfg))
+		}, nil
 	default:
-		return fmt.Errorf("%s algorithm is not supported", cfg.Algorithm)
+		return nil, fmt.Errorf("%s algorithm is not supported", cfg.Algorithm)
 	}
 }
 
 func (s *Storage) Shutdown(_ context.Context) error {
 	return nil
 }
+
+func allowOrReserve(ctx context.Context, a allower, tokens int64, maxWait time.Duration) (time.Duration, bool, error) {
+	if r, ok := a.(reserver); ok && maxWait > 0 {
+		return r.Reserve(ctx, tokens, maxWait)
+	}
+
+	return a.Allow(ctx, tokens)
+}
+
+// burstOrDefault returns the configured burst, falling back to requests per unit when the burst is not set.
+func burstOrDefault(cfg quota.Config) int64 {
+	if cfg.Burst > 0 {
+		return cfg.Burst
+	}
+
+	return cfg.RequestPerUnit
+}
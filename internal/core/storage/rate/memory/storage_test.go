@@ -0,0 +1,287 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Blinkuu/qms/internal/core/storage"
+	"github.com/Blinkuu/qms/internal/core/storage/rate/quota"
+)
+
+func TestStorage_Reserve_ReturnsErrNotFoundWithUnknownQuota(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), prometheus.NewRegistry())
+
+	// When
+	_, _, ok, err := s.Reserve(context.Background(), "namespace", "resource", "", 1, 0)
+
+	// Then
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.False(t, ok)
+}
+
+func TestStorage_Reserve_ReturnsErrNotSupportedWithFixedWindow(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), prometheus.NewRegistry())
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Algorithm: FixedWindowAlgorithm, Unit: "second", RequestPerUnit: 1})
+	assert.NoError(t, err)
+
+	// When
+	_, _, ok, err := s.Reserve(context.Background(), "namespace", "resource", "", 1, 0)
+
+	// Then
+	assert.ErrorIs(t, err, storage.ErrNotSupported)
+	assert.False(t, ok)
+}
+
+func TestStorage_Cancel_ReturnsTokensOfPendingReservation(t *testing.T) {
+	// Given
+	startTime := time.Date(2022, time.Month(1), 11, 0, 0, 1, 0, time.UTC)
+	c := clock.NewMock()
+	c.Set(startTime)
+	s := NewStorage(c, prometheus.NewRegistry())
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Algorithm: TokenBucketAlgorithm, Unit: "second", RequestPerUnit: 2})
+	assert.NoError(t, err)
+	_, ok, err := s.Allow(context.Background(), "namespace", "resource", "", 2, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	reservationID, readyAt, ok, err := s.Reserve(context.Background(), "namespace", "resource", "", 2, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, startTime.Add(time.Second), readyAt)
+
+	// When
+	ok, err = s.Cancel(context.Background(), "namespace", "resource", reservationID)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// When
+	ok, err = s.Cancel(context.Background(), "namespace", "resource", reservationID)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestStorage_Cancel_ReturnsFalseWhenReservationIsReady(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	s := NewStorage(c, prometheus.NewRegistry())
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Algorithm: GCRAAlgorithm, Unit: "second", RequestPerUnit: 2})
+	assert.NoError(t, err)
+	_, ok, err := s.Allow(context.Background(), "namespace", "resource", "", 2, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	reservationID, _, ok, err := s.Reserve(context.Background(), "namespace", "resource", "", 1, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	c.Add(time.Second)
+
+	// When
+	ok, err = s.Cancel(context.Background(), "namespace", "resource", reservationID)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestStorage_Restore_ContinuesFromSnapshotOfAnotherStorage(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	cfg := quota.Config{Algorithm: TokenBucketAlgorithm, Unit: "second", RequestPerUnit: 2}
+	src := NewStorage(c, prometheus.NewRegistry())
+	dst := NewStorage(c, prometheus.NewRegistry())
+	assert.NoError(t, src.RegisterQuota(context.Background(), "namespace", "resource", cfg))
+	assert.NoError(t, dst.RegisterQuota(context.Background(), "namespace", "resource", cfg))
+	_, ok, err := src.Allow(context.Background(), "namespace", "resource", "", 2, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	data, err := src.Snapshot(context.Background(), "namespace", "resource")
+	assert.NoError(t, err)
+
+	// When
+	err = dst.Restore(context.Background(), "namespace", "resource", data)
+
+	// Then
+	assert.NoError(t, err)
+	_, ok, err = dst.Allow(context.Background(), "namespace", "resource", "", 1, 0)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestStorage_Snapshot_ReturnsErrNotSupportedWithConcurrencyQuota(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), prometheus.NewRegistry())
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Algorithm: ConcurrencyAlgorithm, MaxConcurrent: 1})
+	assert.NoError(t, err)
+
+	// When
+	_, err = s.Snapshot(context.Background(), "namespace", "resource")
+
+	// Then
+	assert.ErrorIs(t, err, storage.ErrNotSupported)
+}
+
+func TestStorage_RegisterQuota_ReturnsErrorWithApproximateTokenBucket(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), prometheus.NewRegistry())
+
+	// When
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Algorithm: TokenBucketAlgorithm, Unit: "second", RequestPerUnit: 1, Approximate: true})
+
+	// Then
+	assert.Error(t, err)
+}
+
+func TestStorage_MergeApproximateCounts_ReducesLocalShare(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	s := NewStorage(c, prometheus.NewRegistry())
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Algorithm: FixedWindowAlgorithm, Unit: "minute", RequestPerUnit: 10, Approximate: true})
+	assert.NoError(t, err)
+	_, ok, err := s.Allow(context.Background(), "namespace", "resource", "", 2, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	counts := s.ApproximateCounts()
+	assert.Equal(t, []ApproximateCount{{Namespace: "namespace", Resource: "resource", WindowStart: c.Now(), Count: 2}}, counts)
+
+	// When
+	s.MergeApproximateCounts("peer", []ApproximateCount{{Namespace: "namespace", Resource: "resource", WindowStart: c.Now(), Count: 4}})
+
+	// Then
+	_, ok1, err1 := s.Allow(context.Background(), "namespace", "resource", "", 2, 0)
+	_, ok2, err2 := s.Allow(context.Background(), "namespace", "resource", "", 1, 0)
+	assert.NoError(t, err1)
+	assert.True(t, ok1)
+	assert.NoError(t, err2)
+	assert.False(t, ok2)
+}
+
+func TestStorage_RegisterQuota_ReturnsErrAlreadyExistsWithRegisteredQuota(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), prometheus.NewRegistry())
+	cfg := quota.Config{Algorithm: FixedWindowAlgorithm, Unit: "second", RequestPerUnit: 1}
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", cfg)
+	assert.NoError(t, err)
+
+	// When
+	err = s.RegisterQuota(context.Background(), "namespace", "resource", cfg)
+
+	// Then
+	assert.ErrorIs(t, err, storage.ErrAlreadyExists)
+}
+
+func TestStorage_RegisterQuota_ReturnsErrInvalidConfigWithZeroRequestsPerUnit(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), prometheus.NewRegistry())
+
+	// When
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Algorithm: TokenBucketAlgorithm, Unit: "second"})
+
+	// Then
+	assert.ErrorIs(t, err, storage.ErrInvalidConfig)
+}
+
+func TestStorage_UpdateQuota_ReplacesAlgorithm(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), prometheus.NewRegistry())
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Algorithm: FixedWindowAlgorithm, Unit: "second", RequestPerUnit: 1})
+	assert.NoError(t, err)
+	newCfg := quota.Config{Algorithm: ConcurrencyAlgorithm, MaxConcurrent: 2}
+
+	// When
+	err = s.UpdateQuota(context.Background(), "namespace", "resource", newCfg)
+
+	// Then
+	assert.NoError(t, err)
+	_, _, allowErr := s.Allow(context.Background(), "namespace", "resource", "", 1, 0)
+	assert.ErrorIs(t, allowErr, storage.ErrNotFound)
+	_, ok, acquireErr := s.Acquire(context.Background(), "namespace", "resource", 2)
+	assert.NoError(t, acquireErr)
+	assert.True(t, ok)
+	quotas, listErr := s.ListQuotas(context.Background())
+	assert.NoError(t, listErr)
+	assert.Equal(t, []quota.Quota{{Namespace: "namespace", Resource: "resource", Strategy: newCfg}}, quotas)
+}
+
+func TestStorage_UpdateQuota_KeepsQuotaWithInvalidConfig(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), prometheus.NewRegistry())
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Algorithm: FixedWindowAlgorithm, Unit: "second", RequestPerUnit: 1})
+	assert.NoError(t, err)
+
+	// When
+	err = s.UpdateQuota(context.Background(), "namespace", "resource", quota.Config{Algorithm: "unknown", Unit: "second", RequestPerUnit: 1})
+
+	// Then
+	assert.ErrorIs(t, err, storage.ErrInvalidConfig)
+	_, ok, allowErr := s.Allow(context.Background(), "namespace", "resource", "", 1, 0)
+	assert.NoError(t, allowErr)
+	assert.True(t, ok)
+}
+
+func TestStorage_UpdateQuota_ReturnsErrNotFoundWithUnknownQuota(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), prometheus.NewRegistry())
+
+	// When
+	err := s.UpdateQuota(context.Background(), "namespace", "resource", quota.Config{Algorithm: FixedWindowAlgorithm, Unit: "second", RequestPerUnit: 1})
+
+	// Then
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestStorage_DeleteQuota_RemovesQuota(t *testing.T) {
+	// Given
+	s := NewStorage(clock.NewMock(), prometheus.NewRegistry())
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Algorithm: FixedWindowAlgorithm, Unit: "second", RequestPerUnit: 1, PerKey: true})
+	assert.NoError(t, err)
+
+	// When
+	err = s.DeleteQuota(context.Background(), "namespace", "resource")
+
+	// Then
+	assert.NoError(t, err)
+	_, _, allowErr := s.Allow(context.Background(), "namespace", "resource", "key", 1, 0)
+	assert.ErrorIs(t, allowErr, storage.ErrNotFound)
+	assert.ErrorIs(t, s.DeleteQuota(context.Background(), "namespace", "resource"), storage.ErrNotFound)
+	quotas, listErr := s.ListQuotas(context.Background())
+	assert.NoError(t, listErr)
+	assert.Empty(t, quotas)
+}
+
+func TestStorage_Reserve_ReturnsReadyAtWithoutReservingWhenTokensAreNotAvailableWithinMaxWait(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	s := NewStorage(c, prometheus.NewRegistry())
+	err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Algorithm: TokenBucketAlgorithm, Unit: "second", RequestPerUnit: 1})
+	assert.NoError(t, err)
+	_, ok, err := s.Allow(context.Background(), "namespace", "resource", "", 1, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// When
+	reservationID, readyAt, ok, err := s.Reserve(context.Background(), "namespace", "resource", "", 1, 500*time.Millisecond)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Empty(t, reservationID)
+	assert.Equal(t, c.Now().Add(time.Second), readyAt)
+
+	c.Add(time.Second)
+	_, ok, err = s.Allow(context.Background(), "namespace", "resource", "", 1, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
@@ -2,18 +2,34 @@ package memory
 
 import (
 	"context"
+	"encoding/json"
+	"math"
+	"sync"
 	"time"
 
 	"github.com/benbjohnson/clock"
-	"github.com/juju/ratelimit"
 )
 
 const (
 	TokenBucketAlgorithm = "token-bucket"
 )
 
+type tokenBucketState struct {
+	Available  float64   `json:"available"`
+	LastRefill time.Time `json:"last_refill"`
+}
+
+// TokenBucket refills continuously at refillRate up to capacity. It is kept here instead of using the bucket of
+// github.com/juju/ratelimit, which can neither take back the tokens of a cancelled reservation nor export and restore
+// its state, as reservations and the replicated and raft storages need. Unlike that bucket, which added whole tokens at
+// intervals counted from its creation, a token taken from a full bucket comes back a whole interval after it was taken.
 type TokenBucket struct {
-	tb *ratelimit.Bucket
+	clock      clock.Clock
+	refillRate float64
+	capacity   int64
+	available  float64
+	lastRefill time.Time
+	mu         *sync.Mutex
 }
 
 func NewTokenBucket(clock clock.Clock, refillRate float64, capacity int64) *TokenBucket {
@@ -26,12 +42,95 @@ func NewTokenBucket(clock clock.Clock, refillRate float64, capacity int64) *Toke
 	}
 
 	return &TokenBucket{
-		tb: ratelimit.NewBucketWithRateAndClock(refillRate, capacity, clock),
+		clock:      clock,
+		refillRate: refillRate,
+		capacity:   capacity,
+		available:  float64(capacity),
+		lastRefill: clock.Now(),
+		mu:         &sync.Mutex{},
 	}
 }
 
 // Allow true and wait time if a request is allowed. Returns false if request is not allowed.
-func (b *TokenBucket) Allow(_ context.Context, tokens int64) (time.Duration, bool, error) {
-	waitTime, ok := b.tb.TakeMaxDuration(tokens, 0)
-	return waitTime, ok, nil
+func (b *TokenBucket) Allow(ctx context.Context, tokens int64) (time.Duration, bool, error) {
+	waitTime, ok, err := b.Reserve(ctx, tokens, 0)
+	if !ok {
+		return 0, false, err
+	}
+
+	return waitTime, true, err
+}
+
+// Reserve takes tokens from the bucket if they become available within maxWait. Returns true and the time to wait
+// before the reserved tokens can be used. Otherwise, it returns false and the time until the tokens are available, like
+// GCRA does.
+func (b *TokenBucket) Reserve(_ context.Context, tokens int64, maxWait time.Duration) (time.Duration, bool, error) {
+	now := b.clock.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if tokens > b.capacity {
+		return 0, false, nil
+	}
+
+	b.refillLocked(now)
+
+	var waitTime time.Duration
+	if deficit := float64(tokens) - b.available; deficit > 0 {
+		waitTime = time.Duration(math.Ceil(deficit / b.refillRate * float64(time.Second)))
+	}
+
+	if waitTime > maxWait {
+		return waitTime, false, nil
+	}
+
+	b.available -= float64(tokens)
+
+	return waitTime, true, nil
+}
+
+// Refund gives tokens of a reservation that will not be used back to the bucket.
+func (b *TokenBucket) Refund(_ context.Context, tokens int64) error {
+	now := b.clock.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refillLocked(now)
+	b.available = math.Min(b.available+float64(tokens), float64(b.capacity))
+
+	return nil
+}
+
+func (b *TokenBucket) Snapshot() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return json.Marshal(tokenBucketState{Available: b.available, LastRefill: b.lastRefill})
+}
+
+func (b *TokenBucket) Restore(data []byte) error {
+	var state tokenBucketState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.available = math.Min(state.Available, float64(b.capacity))
+	b.lastRefill = state.LastRefill
+
+	return nil
+}
+
+func (b *TokenBucket) refillLocked(now time.Time) {
+	elapsed := now.Sub(b.lastRefill)
+	if elapsed <= 0 {
+		return
+	}
+
+	b.available = math.Min(b.available+elapsed.Seconds()*b.refillRate, float64(b.capacity))
+	b.lastRefill = now
 }
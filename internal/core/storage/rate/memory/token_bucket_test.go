@@ -121,3 +121,110 @@ func TestTokenBucket_Allow_ReturnsNoErrorAndZeroWhenBucketHasTokens(t *testing.T
 	assert.True(t, ok)
 	assert.Zero(t, wait)
 }
+
+func TestTokenBucket_Reserve_ReturnsNoErrorOKAndWaitTimeWhenTokensAreAvailableWithinMaxWait(t *testing.T) {
+	// Given
+	startTime := time.Date(2022, time.Month(1), 11, 0, 0, 1, 0, time.UTC)
+	c := clock.NewMock()
+	c.Set(startTime)
+	b := NewTokenBucket(c, 2, 4)
+	_, ok, err := b.Allow(context.Background(), 4)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// When
+	wait, ok, err := b.Reserve(context.Background(), 2, 2*time.Second)
+
+	// Then
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1*time.Second, wait)
+
+	// When
+	wait, ok, err = b.Reserve(context.Background(), 2, 1*time.Second)
+
+	// Then
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 2*time.Second, wait)
+}
+
+func TestTokenBucket_Refund_ReturnsReservedTokensToTheBucket(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	b := NewTokenBucket(c, 2, 4)
+	_, ok, err := b.Reserve(context.Background(), 4, time.Second)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// When
+	err = b.Refund(context.Background(), 4)
+
+	// Then
+	assert.NoError(t, err)
+	wait, ok, err := b.Allow(context.Background(), 4)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Zero(t, wait)
+}
+
+func TestTokenBucket_Allow_RefillsAtRefillRateUpToCapacity(t *testing.T) {
+	// Given
+	startTime := time.Date(2022, time.Month(1), 11, 0, 0, 1, 0, time.UTC)
+	c := clock.NewMock()
+	c.Set(startTime)
+	b := NewTokenBucket(c, 2, 4)
+	_, ok, err := b.Allow(context.Background(), 4)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// When
+	c.Set(startTime.Add(500 * time.Millisecond))
+
+	// Then
+	_, ok, err = b.Allow(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	_, ok, err = b.Allow(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// When
+	c.Set(startTime.Add(10 * time.Second))
+
+	// Then
+	_, ok, err = b.Allow(context.Background(), 4)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	_, ok, err = b.Allow(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestTokenBucket_Allow_RefillsTokenTakenFromFullBucketOneIntervalAfterItWasTaken(t *testing.T) {
+	// Given
+	startTime := time.Date(2022, time.Month(1), 11, 0, 0, 1, 0, time.UTC)
+	c := clock.NewMock()
+	c.Set(startTime)
+	b := NewTokenBucket(c, 1, 1)
+	c.Set(startTime.Add(500 * time.Millisecond))
+	_, ok, err := b.Allow(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// When
+	c.Set(startTime.Add(1 * time.Second))
+
+	// Then
+	_, ok, err = b.Allow(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// When
+	c.Set(startTime.Add(1500 * time.Millisecond))
+
+	// Then
+	_, ok, err = b.Allow(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
@@ -1,7 +1,60 @@
 package quota
 
+import (
+	"time"
+
+	"github.com/Blinkuu/qms/pkg/dto"
+)
+
 type Config struct {
-	Algorithm      string `yaml:"algorithm"`
-	Unit           string `yaml:"unit"`
-	RequestPerUnit int64  `yaml:"requests_per_unit"`
+	Algorithm      string        `yaml:"algorithm"`
+	Unit           string        `yaml:"unit"`
+	RequestPerUnit int64         `yaml:"requests_per_unit"`
+	Burst          int64         `yaml:"burst"`
+	MaxConcurrent  int64         `yaml:"max_concurrent"`
+	PermitTTL      time.Duration `yaml:"permit_ttl"`
+	PerKey         bool          `yaml:"per_key"`
+	MaxKeys        int           `yaml:"max_keys"`
+	KeyIdleTimeout time.Duration `yaml:"key_idle_timeout"`
+	Approximate    bool          `yaml:"approximate"`
+	SyncInterval   time.Duration `yaml:"sync_interval"`
+}
+
+// Quota is a quota registered for a namespace-resource pair.
+type Quota struct {
+	Namespace string `yaml:"namespace"`
+	Resource  string `yaml:"resource"`
+	Strategy  Config `yaml:"strategy"`
+}
+
+func NewConfigFromDTO(strategy dto.QuotaStrategy) Config {
+	return Config{
+		Algorithm:      strategy.Algorithm,
+		Unit:           strategy.Unit,
+		RequestPerUnit: strategy.RequestsPerUnit,
+		Burst:          strategy.Burst,
+		MaxConcurrent:  strategy.MaxConcurrent,
+		PermitTTL:      time.Duration(strategy.PermitTTL),
+		PerKey:         strategy.PerKey,
+		MaxKeys:        strategy.MaxKeys,
+		KeyIdleTimeout: time.Duration(strategy.KeyIdleTimeout),
+		Approximate:    strategy.Approximate,
+		SyncInterval:   time.Duration(strategy.SyncInterval),
+	}
+}
+
+func (c Config) DTO() dto.QuotaStrategy {
+	return dto.QuotaStrategy{
+		Algorithm:       c.Algorithm,
+		Unit:            c.Unit,
+		RequestsPerUnit: c.RequestPerUnit,
+		Burst:           c.Burst,
+		MaxConcurrent:   c.MaxConcurrent,
+		PermitTTL:       c.PermitTTL.Nanoseconds(),
+		PerKey:          c.PerKey,
+		MaxKeys:         c.MaxKeys,
+		KeyIdleTimeout:  c.KeyIdleTimeout.Nanoseconds(),
+		Approximate:     c.Approximate,
+		SyncInterval:    c.SyncInterval.Nanoseconds(),
+	}
 }
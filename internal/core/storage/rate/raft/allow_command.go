@@ -0,0 +1,76 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+// AllowCommand carries the time at which it was proposed, so that every replica and every replay of the raft log
+// applies it to the same state.
+type AllowCommand struct {
+	Namespace string
+	Resource  string
+	Key       string
+	Tokens    int64
+	MaxWait   time.Duration
+	Time      time.Time
+	SMResult  statemachine.Result
+}
+
+type AllowCommandResult struct {
+	WaitTime time.Duration
+	OK       bool
+	Err      string
+}
+
+func NewAllowCommand(namespace, resource, key string, tokens int64, maxWait time.Duration, now time.Time) *AllowCommand {
+	return &AllowCommand{
+		Namespace: namespace,
+		Resource:  resource,
+		Key:       key,
+		Tokens:    tokens,
+		MaxWait:   maxWait,
+		Time:      now,
+		SMResult:  statemachine.Result{},
+	}
+}
+
+func (c *AllowCommand) Type() CommandType {
+	return Allow
+}
+
+func (c *AllowCommand) RaftInvoke(ctx context.Context, nh *dragonboat.NodeHost, session *client.Session) (any, error) {
+	result, err := syncWrite[AllowCommandResult](ctx, nh, session, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync write: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *AllowCommand) LocalInvoke(sm *stateMachine) error {
+	sm.clock.advance(c.Time)
+
+	waitTime, ok, err := sm.storage.Allow(context.Background(), c.Namespace, c.Resource, c.Key, c.Tokens, c.MaxWait)
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(AllowCommandResult{WaitTime: waitTime, OK: ok, Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *AllowCommand) Result() statemachine.Result {
+	return c.SMResult
+}
@@ -0,0 +1,34 @@
+package raft
+
+import (
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// entryClock tells the rate algorithms of the state machine the time of the entry being applied instead of the wall
+// time, which differs between replicas and replays. Only Now is meant to be used; the remaining methods of clock.Clock
+// are not available.
+type entryClock struct {
+	clock.Clock
+	now time.Time
+}
+
+func (c *entryClock) Now() time.Time {
+	return c.now
+}
+
+func (c *entryClock) Since(t time.Time) time.Duration {
+	return c.now.Sub(t)
+}
+
+func (c *entryClock) Until(t time.Time) time.Duration {
+	return t.Sub(c.now)
+}
+
+// advance moves the clock forward to t. Entries proposed by replicas with skewed clocks never move it backwards.
+func (c *entryClock) advance(t time.Time) {
+	if t.After(c.now) {
+		c.now = t
+	}
+}
@@ -0,0 +1,90 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+type CommandType byte
+
+const (
+	Allow         CommandType = 1
+	RegisterQuota CommandType = 2
+)
+
+type Command interface {
+	Type() CommandType
+	RaftInvoke(ctx context.Context, nh *dragonboat.NodeHost, session *client.Session) (result any, err error)
+	LocalInvoke(sm *stateMachine) error
+	Result() statemachine.Result
+}
+
+func EncodeCommand(cmd Command) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(cmd.Type()))
+	encoder := gob.NewEncoder(&buf)
+	if err := encoder.Encode(cmd); err != nil {
+		panic(fmt.Errorf("failed to encode command: %w", err))
+	}
+
+	return buf.Bytes()
+}
+
+func DecodeCommand(data []byte) (Command, error) {
+	buf := bytes.NewBuffer(data[1:])
+	decoder := gob.NewDecoder(buf)
+
+	switch CommandType(data[0]) {
+	case Allow:
+		cmd := &AllowCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode allow command: %w", err))
+		}
+
+		return cmd, nil
+	case RegisterQuota:
+		cmd := &RegisterQuotaCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			panic(fmt.Errorf("failed to decode register quota command: %w", err))
+		}
+
+		return cmd, nil
+	default:
+		return nil, fmt.Errorf("unknown command: type=%b", CommandType(data[0]))
+	}
+}
+
+func EncodeCommandResult(v any) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		panic(fmt.Errorf("failed to encode command SMResult: %w", err))
+	}
+
+	return buf.Bytes()
+}
+
+func DecodeCommandResult[T any](data []byte) T {
+	var result T
+	buf := bytes.NewBuffer(data)
+	if err := gob.NewDecoder(buf).Decode(&result); err != nil {
+		panic(fmt.Errorf("failed to decode command SMResult: %w", err))
+	}
+
+	return result
+}
+
+func syncWrite[T any](ctx context.Context, nh *dragonboat.NodeHost, session *client.Session, cmd Command) (T, error) {
+	result, err := nh.SyncPropose(ctx, session, EncodeCommand(cmd))
+	if err != nil {
+		var zero T
+		return zero, fmt.Errorf("failed to sync propose: %w", err)
+	}
+
+	return DecodeCommandResult[T](result.Data), nil
+}
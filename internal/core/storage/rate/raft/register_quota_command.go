@@ -0,0 +1,65 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+
+	"github.com/Blinkuu/qms/internal/core/storage/rate/quota"
+)
+
+type RegisterQuotaCommand struct {
+	Namespace string
+	Resource  string
+	Cfg       quota.Config
+	SMResult  statemachine.Result
+}
+
+type RegisterQuotaCommandResult struct {
+	Err string
+}
+
+func NewRegisterQuotaCommand(namespace, resource string, cfg quota.Config) *RegisterQuotaCommand {
+	return &RegisterQuotaCommand{
+		Namespace: namespace,
+		Resource:  resource,
+		Cfg:       cfg,
+		SMResult:  statemachine.Result{},
+	}
+}
+
+func (c *RegisterQuotaCommand) Type() CommandType {
+	return RegisterQuota
+}
+
+func (c *RegisterQuotaCommand) RaftInvoke(ctx context.Context, nh *dragonboat.NodeHost, session *client.Session) (any, error) {
+	result, err := syncWrite[RegisterQuotaCommandResult](ctx, nh, session, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync write: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *RegisterQuotaCommand) LocalInvoke(sm *stateMachine) error {
+	err := sm.registerQuota(c.Namespace, c.Resource, c.Cfg)
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	data := EncodeCommandResult(RegisterQuotaCommandResult{Err: errStr})
+	c.SMResult = statemachine.Result{
+		Value: 1,
+		Data:  data,
+	}
+
+	return nil
+}
+
+func (c *RegisterQuotaCommand) Result() statemachine.Result {
+	return c.SMResult
+}
@@ -0,0 +1,124 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lni/dragonboat/v4/statemachine"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Blinkuu/qms/internal/core/storage/rate/memory"
+	"github.com/Blinkuu/qms/internal/core/storage/rate/quota"
+)
+
+type registeredQuota struct {
+	Namespace string       `json:"namespace"`
+	Resource  string       `json:"resource"`
+	Cfg       quota.Config `json:"cfg"`
+	State     []byte       `json:"state"`
+}
+
+type snapshot struct {
+	Now    time.Time         `json:"now"`
+	Quotas []registeredQuota `json:"quotas"`
+}
+
+// stateMachine applies rate commands to an in-memory rate storage. The state is rebuilt from the latest snapshot and
+// the raft log after a restart.
+type stateMachine struct {
+	clock   *entryClock
+	storage *memory.Storage
+	quotas  []registeredQuota
+}
+
+func newStateMachine() *stateMachine {
+	c := &entryClock{Clock: nil, now: time.Time{}}
+
+	return &stateMachine{
+		clock: c,
+		// Metrics of the replicated storage are not exported, since it is recreated when a snapshot is recovered.
+		storage: memory.NewStorage(c, prometheus.NewRegistry()),
+		quotas:  nil,
+	}
+}
+
+func (m *stateMachine) Update(e statemachine.Entry) (statemachine.Result, error) {
+	cmd, err := DecodeCommand(e.Cmd)
+	if err != nil {
+		return statemachine.Result{}, fmt.Errorf("failed to decode command: %w", err)
+	}
+
+	if err := cmd.LocalInvoke(m); err != nil {
+		return statemachine.Result{}, err
+	}
+
+	return cmd.Result(), nil
+}
+
+func (m *stateMachine) Lookup(_ interface{}) (interface{}, error) {
+	return nil, errors.New("lookup is not supported")
+}
+
+func (m *stateMachine) SaveSnapshot(w io.Writer, _ statemachine.ISnapshotFileCollection, _ <-chan struct{}) error {
+	s := snapshot{Now: m.clock.now, Quotas: make([]registeredQuota, 0, len(m.quotas))}
+	for _, q := range m.quotas {
+		state, err := m.storage.Snapshot(context.Background(), q.Namespace, q.Resource)
+		if err != nil {
+			return fmt.Errorf("failed to snapshot quota: namespace=%s, resource=%s: %w", q.Namespace, q.Resource, err)
+		}
+
+		q.State = state
+		s.Quotas = append(s.Quotas, q)
+	}
+
+	return json.NewEncoder(w).Encode(s)
+}
+
+func (m *stateMachine) RecoverFromSnapshot(r io.Reader, _ []statemachine.SnapshotFile, _ <-chan struct{}) error {
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+
+	recovered := newStateMachine()
+	recovered.clock.advance(s.Now)
+	for _, q := range s.Quotas {
+		if err := recovered.registerQuota(q.Namespace, q.Resource, q.Cfg); err != nil {
+			return fmt.Errorf("failed to register quota: %w", err)
+		}
+
+		if err := recovered.storage.Restore(context.Background(), q.Namespace, q.Resource, q.State); err != nil {
+			return fmt.Errorf("failed to restore quota: namespace=%s, resource=%s: %w", q.Namespace, q.Resource, err)
+		}
+	}
+
+	*m = *recovered
+
+	return nil
+}
+
+func (m *stateMachine) Close() error {
+	return nil
+}
+
+// registerQuota ignores quotas that are already registered, since every replica registers the configured quotas on
+// startup.
+func (m *stateMachine) registerQuota(namespace, resource string, cfg quota.Config) error {
+	for _, q := range m.quotas {
+		if q.Namespace == namespace && q.Resource == resource {
+			return nil
+		}
+	}
+
+	if err := m.storage.RegisterQuota(context.Background(), namespace, resource, cfg); err != nil {
+		return err
+	}
+
+	m.quotas = append(m.quotas, registeredQuota{Namespace: namespace, Resource: resource, Cfg: cfg, State: nil})
+
+	return nil
+}
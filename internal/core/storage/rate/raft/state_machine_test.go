@@ -0,0 +1,72 @@
+package raft
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/statemachine"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Blinkuu/qms/internal/core/storage/rate/memory"
+	"github.com/Blinkuu/qms/internal/core/storage/rate/quota"
+)
+
+func update[T any](t *testing.T, sm *stateMachine, cmd Command) T {
+	result, err := sm.Update(statemachine.Entry{Cmd: EncodeCommand(cmd)})
+	assert.NoError(t, err)
+
+	return DecodeCommandResult[T](result.Data)
+}
+
+func TestStateMachine_Update_AppliesAllowAtTimeOfEntry(t *testing.T) {
+	// Given
+	startTime := time.Date(2022, time.Month(1), 11, 0, 0, 0, 0, time.UTC)
+	sm := newStateMachine()
+	cfg := quota.Config{Algorithm: memory.FixedWindowAlgorithm, Unit: "day", RequestPerUnit: 2}
+	update[RegisterQuotaCommandResult](t, sm, NewRegisterQuotaCommand("namespace", "resource", cfg))
+	update[AllowCommandResult](t, sm, NewAllowCommand("namespace", "resource", "", 2, 0, startTime))
+
+	// When
+	result := update[AllowCommandResult](t, sm, NewAllowCommand("namespace", "resource", "", 1, 0, startTime.Add(time.Hour)))
+
+	// Then
+	assert.Empty(t, result.Err)
+	assert.False(t, result.OK)
+	assert.Equal(t, 23*time.Hour, result.WaitTime)
+}
+
+func TestStateMachine_Update_IgnoresQuotaRegisteredAgain(t *testing.T) {
+	// Given
+	sm := newStateMachine()
+	cfg := quota.Config{Algorithm: memory.GCRAAlgorithm, Unit: "second", RequestPerUnit: 1}
+	update[RegisterQuotaCommandResult](t, sm, NewRegisterQuotaCommand("namespace", "resource", cfg))
+
+	// When
+	result := update[RegisterQuotaCommandResult](t, sm, NewRegisterQuotaCommand("namespace", "resource", cfg))
+
+	// Then
+	assert.Empty(t, result.Err)
+}
+
+func TestStateMachine_RecoverFromSnapshot_RestoresQuotaState(t *testing.T) {
+	// Given
+	startTime := time.Date(2022, time.Month(1), 11, 0, 0, 0, 0, time.UTC)
+	sm := newStateMachine()
+	cfg := quota.Config{Algorithm: memory.TokenBucketAlgorithm, Unit: "hour", RequestPerUnit: 10}
+	update[RegisterQuotaCommandResult](t, sm, NewRegisterQuotaCommand("namespace", "resource", cfg))
+	update[AllowCommandResult](t, sm, NewAllowCommand("namespace", "resource", "", 10, 0, startTime))
+
+	var buf bytes.Buffer
+	assert.NoError(t, sm.SaveSnapshot(&buf, nil, nil))
+
+	// When
+	recovered := newStateMachine()
+	err := recovered.RecoverFromSnapshot(&buf, nil, nil)
+
+	// Then
+	assert.NoError(t, err)
+	result := update[AllowCommandResult](t, recovered, NewAllowCommand("namespace", "resource", "", 1, 0, startTime.Add(time.Minute)))
+	assert.Empty(t, result.Err)
+	assert.False(t, result.OK)
+}
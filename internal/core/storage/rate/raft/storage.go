@@ -0,0 +1,168 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/statemachine"
+
+	"github.com/Blinkuu/qms/internal/core/ports"
+	stor "github.com/Blinkuu/qms/internal/core/storage"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/raft"
+	"github.com/Blinkuu/qms/internal/core/storage/rate/memory"
+	"github.com/Blinkuu/qms/internal/core/storage/rate/quota"
+	"github.com/Blinkuu/qms/pkg/log"
+)
+
+const (
+	RaftPath = "/api/v1/internal/raft/rate"
+)
+
+// Storage replicates rate quotas with raft, so that their state survives restarts and failover. It runs on its own
+// node host, next to the one of the alloc raft storage.
+type Storage struct {
+	cfg      Config
+	clock    clock.Clock
+	logger   log.Logger
+	nh       *raft.NodeHost
+	sessions map[uint64]*client.Session
+
+	shutdownOnce sync.Once
+}
+
+func NewStorage(cfg Config, clock clock.Clock, logger log.Logger, memberlist ports.MemberlistService) (*Storage, error) {
+	nh, err := raft.NewNodeHost(cfg.nodeHostConfig(), logger, memberlist, RaftPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create node host: %w", err)
+	}
+
+	sessions := make(map[uint64]*client.Session)
+	for _, shardID := range nh.LocalShardIDs() {
+		raftCfg := raft.NewRaftConfig(nh.Config().ReplicaID, shardID)
+		err = nh.StartReplica(nh.InitialMembers(shardID), nh.Joined(shardID), func(_ uint64, _ uint64) statemachine.IStateMachine { return newStateMachine() }, raftCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start replica for shardID=%d: %w", shardID, err)
+		}
+
+		sessions[shardID] = nh.GetNoOPSession(shardID)
+	}
+
+	return &Storage{
+		cfg:          cfg,
+		clock:        clock,
+		logger:       logger,
+		nh:           nh,
+		sessions:     sessions,
+		shutdownOnce: sync.Once{},
+	}, nil
+}
+
+func (s *Storage) Allow(ctx context.Context, namespace, resource, key string, tokens int64, maxWait time.Duration) (time.Duration, bool, error) {
+	id := strings.Join([]string{namespace, resource}, "_")
+	shardID := s.nh.ShardIDFromString(id)
+
+	allowCmd := NewAllowCommand(namespace, resource, key, tokens, maxWait, s.clock.Now())
+	result, err := allowCmd.RaftInvoke(ctx, s.nh.NodeHost, s.sessions[shardID])
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to raft invoke: %w", err)
+	}
+
+	typedResult := result.(AllowCommandResult)
+	if typedResult.Err != "" {
+		switch {
+		case stor.IsErrNotFound(typedResult.Err):
+			return 0, false, stor.ErrNotFound
+		default:
+			return 0, false, errors.New(typedResult.Err)
+		}
+	}
+
+	return typedResult.WaitTime, typedResult.OK, nil
+}
+
+// Reserve is not supported, since reservation IDs are random and cannot be derived by every replica.
+func (s *Storage) Reserve(_ context.Context, _, _, _ string, _ int64, _ time.Duration) (string, time.Time, bool, error) {
+	return "", time.Time{}, false, stor.ErrNotSupported
+}
+
+func (s *Storage) Cancel(_ context.Context, _, _, _ string) (bool, error) {
+	return false, stor.ErrNotSupported
+}
+
+// Acquire is not supported, since permit IDs are random and cannot be derived by every replica.
+func (s *Storage) Acquire(_ context.Context, _, _ string, _ int64) (string, bool, error) {
+	return "", false, stor.ErrNotSupported
+}
+
+func (s *Storage) Release(_ context.Context, _, _, _ string) (bool, error) {
+	return false, stor.ErrNotSupported
+}
+
+// RegisterQuota registers a quota on all replicas. Quota templates and concurrency quotas are not supported, since
+// their state cannot be snapshotted. Approximate quotas are not supported either, since raft already keeps an exact
+// count on every replica.
+func (s *Storage) RegisterQuota(ctx context.Context, namespace, resource string, cfg quota.Config) error {
+	if cfg.PerKey || cfg.Approximate || cfg.Algorithm == memory.ConcurrencyAlgorithm {
+		return fmt.Errorf("failed to register quota: %w", stor.ErrNotSupported)
+	}
+
+	id := strings.Join([]string{namespace, resource}, "_")
+	shardID := s.nh.ShardIDFromString(id)
+
+	registerQuotaCmd := NewRegisterQuotaCommand(namespace, resource, cfg)
+	result, err := registerQuotaCmd.RaftInvoke(ctx, s.nh.NodeHost, s.sessions[shardID])
+	if err != nil {
+		return fmt.Errorf("failed to raft invoke: %w", err)
+	}
+
+	typedResult := result.(RegisterQuotaCommandResult)
+	if typedResult.Err != "" {
+		if stor.IsErrInvalidConfig(typedResult.Err) {
+			return fmt.Errorf("%s: %w", typedResult.Err, stor.ErrInvalidConfig)
+		}
+
+		return errors.New(typedResult.Err)
+	}
+
+	return nil
+}
+
+// UpdateQuota, DeleteQuota, and ListQuotas are not supported by the raft backend yet.
+func (s *Storage) UpdateQuota(_ context.Context, _, _ string, _ quota.Config) error {
+	return stor.ErrNotSupported
+}
+
+func (s *Storage) DeleteQuota(_ context.Context, _, _ string) error {
+	return stor.ErrNotSupported
+}
+
+func (s *Storage) ListQuotas(_ context.Context) ([]quota.Quota, error) {
+	return nil, stor.ErrNotSupported
+}
+
+func (s *Storage) AddRaftReplica(ctx context.Context, replicaID uint64, raftAddr string) ([]uint64, []uint64, error) {
+	return s.nh.AddReplica(ctx, replicaID, raftAddr)
+}
+
+func (s *Storage) RemoveRaftReplica(ctx context.Context, replicaID uint64, shardIDs []uint64) error {
+	return s.nh.RemoveReplica(ctx, replicaID, shardIDs)
+}
+
+func (s *Storage) AwaitHealthy(ctx context.Context) error {
+	return s.nh.AwaitHealthy(ctx)
+}
+
+func (s *Storage) Shutdown(_ context.Context) error {
+	var err error
+	s.shutdownOnce.Do(func() {
+		err = s.nh.Shutdown()
+	})
+
+	return err
+}
@@ -0,0 +1,16 @@
+package replicated
+
+import (
+	"flag"
+	"time"
+
+	"github.com/Blinkuu/qms/pkg/strutil"
+)
+
+type Config struct {
+	SyncInterval time.Duration `yaml:"sync_interval"`
+}
+
+func (c *Config) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix string) {
+	f.DurationVar(&c.SyncInterval, strutil.WithPrefixOrDefault(prefix, "sync_interval"), 100*time.Millisecond, "")
+}
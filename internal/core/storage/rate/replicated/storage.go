@@ -0,0 +1,284 @@
+package replicated
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Blinkuu/qms/internal/core/ports"
+	"github.com/Blinkuu/qms/internal/core/storage"
+	"github.com/Blinkuu/qms/internal/core/storage/rate/memory"
+	"github.com/Blinkuu/qms/internal/core/storage/rate/quota"
+	"github.com/Blinkuu/qms/pkg/log"
+)
+
+const (
+	GossipChannel = "rate"
+)
+
+type quotaState struct {
+	Namespace string `json:"namespace"`
+	Resource  string `json:"resource"`
+	Version   int64  `json:"version"`
+	Data      []byte `json:"data"`
+}
+
+type quotaRef struct {
+	namespace string
+	resource  string
+}
+
+func (r quotaRef) id() string {
+	return strings.Join([]string{r.namespace, r.resource}, "_")
+}
+
+// Storage keeps rate quotas in memory and gossips their state to the other rate instances. Every instance keeps the
+// last known state of every quota, so the instance that takes over a quota continues from it instead of a fresh one.
+// Conflicting states are resolved by their version, which is the time of the last local change.
+type Storage struct {
+	*memory.Storage
+	cfg        Config
+	clock      clock.Clock
+	logger     log.Logger
+	memberlist ports.MemberlistService
+	versions   map[quotaRef]int64
+	dirty      map[quotaRef]struct{}
+	mu         *sync.Mutex
+
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+}
+
+func NewStorage(cfg Config, clock clock.Clock, logger log.Logger, reg prometheus.Registerer, memberlist ports.MemberlistService) *Storage {
+	s := &Storage{
+		Storage:      memory.NewStorage(clock, reg),
+		cfg:          cfg,
+		clock:        clock,
+		logger:       logger,
+		memberlist:   memberlist,
+		versions:     make(map[quotaRef]int64),
+		dirty:        make(map[quotaRef]struct{}),
+		mu:           &sync.Mutex{},
+		shutdown:     make(chan struct{}),
+		shutdownOnce: sync.Once{},
+	}
+
+	memberlist.Subscribe(GossipChannel, s)
+
+	return s
+}
+
+// Run periodically gossips the state of quotas changed since the previous sync.
+func (s *Storage) Run(ctx context.Context) error {
+	ticker := s.clock.Ticker(s.cfg.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdown:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			s.Sync(ctx)
+		}
+	}
+}
+
+func (s *Storage) Allow(ctx context.Context, namespace, resource, key string, tokens int64, maxWait time.Duration) (time.Duration, bool, error) {
+	waitTime, ok, err := s.Storage.Allow(ctx, namespace, resource, key, tokens, maxWait)
+	if err == nil && ok {
+		s.markDirty(namespace, resource)
+	}
+
+	return waitTime, ok, err
+}
+
+func (s *Storage) Reserve(ctx context.Context, namespace, resource, key string, tokens int64, maxWait time.Duration) (string, time.Time, bool, error) {
+	reservationID, readyAt, ok, err := s.Storage.Reserve(ctx, namespace, resource, key, tokens, maxWait)
+	if err == nil && ok {
+		s.markDirty(namespace, resource)
+	}
+
+	return reservationID, readyAt, ok, err
+}
+
+func (s *Storage) Cancel(ctx context.Context, namespace, resource, reservationID string) (bool, error) {
+	ok, err := s.Storage.Cancel(ctx, namespace, resource, reservationID)
+	if err == nil && ok {
+		s.markDirty(namespace, resource)
+	}
+
+	return ok, err
+}
+
+// UpdateQuota resets the state of a quota, so its version is forgotten along with the state.
+func (s *Storage) UpdateQuota(ctx context.Context, namespace, resource string, cfg quota.Config) error {
+	if err := s.Storage.UpdateQuota(ctx, namespace, resource, cfg); err != nil {
+		return err
+	}
+
+	s.forget(namespace, resource)
+
+	return nil
+}
+
+func (s *Storage) DeleteQuota(ctx context.Context, namespace, resource string) error {
+	if err := s.Storage.DeleteQuota(ctx, namespace, resource); err != nil {
+		return err
+	}
+
+	s.forget(namespace, resource)
+
+	return nil
+}
+
+// Sync gossips the state of quotas changed since the previous sync.
+func (s *Storage) Sync(ctx context.Context) {
+	s.mu.Lock()
+	dirty := s.dirty
+	s.dirty = make(map[quotaRef]struct{})
+	s.mu.Unlock()
+
+	for ref := range dirty {
+		state, ok := s.quotaState(ctx, ref)
+		if !ok {
+			continue
+		}
+
+		payload, err := json.Marshal(state)
+		if err != nil {
+			s.logger.Warn("failed to encode quota state", "id", ref.id(), "err", err)
+			continue
+		}
+
+		s.memberlist.Broadcast(GossipChannel, ref.id(), payload)
+	}
+}
+
+func (s *Storage) NotifyMsg(payload []byte) {
+	var state quotaState
+	if err := json.Unmarshal(payload, &state); err != nil {
+		s.logger.Warn("failed to decode quota state", "err", err)
+		return
+	}
+
+	s.merge(state)
+}
+
+func (s *Storage) LocalState() []byte {
+	s.mu.Lock()
+	refs := make([]quotaRef, 0, len(s.versions))
+	for ref := range s.versions {
+		refs = append(refs, ref)
+	}
+	s.mu.Unlock()
+
+	states := make([]quotaState, 0, len(refs))
+	for _, ref := range refs {
+		if state, ok := s.quotaState(context.Background(), ref); ok {
+			states = append(states, state)
+		}
+	}
+
+	buf, err := json.Marshal(states)
+	if err != nil {
+		s.logger.Warn("failed to encode local state", "err", err)
+		return nil
+	}
+
+	return buf
+}
+
+func (s *Storage) MergeRemoteState(buf []byte) {
+	var states []quotaState
+	if err := json.Unmarshal(buf, &states); err != nil {
+		s.logger.Warn("failed to decode remote state", "err", err)
+		return
+	}
+
+	for _, state := range states {
+		s.merge(state)
+	}
+}
+
+func (s *Storage) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		close(s.shutdown)
+	})
+
+	return s.Storage.Shutdown(ctx)
+}
+
+// merge restores a gossiped state if it is newer than the local one.
+func (s *Storage) merge(state quotaState) {
+	ref := quotaRef{namespace: state.Namespace, resource: state.Resource}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if state.Version <= s.versions[ref] {
+		return
+	}
+
+	err := s.Storage.Restore(context.Background(), ref.namespace, ref.resource, state.Data)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			s.logger.Warn("failed to restore quota state", "id", ref.id(), "err", err)
+		}
+
+		return
+	}
+
+	s.versions[ref] = state.Version
+	delete(s.dirty, ref)
+}
+
+func (s *Storage) forget(namespace, resource string) {
+	ref := quotaRef{namespace: namespace, resource: resource}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.versions, ref)
+	delete(s.dirty, ref)
+}
+
+func (s *Storage) markDirty(namespace, resource string) {
+	ref := quotaRef{namespace: namespace, resource: resource}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The version must grow even if the clock does not, so that other instances accept every change.
+	version := s.clock.Now().UnixNano()
+	if version <= s.versions[ref] {
+		version = s.versions[ref] + 1
+	}
+
+	s.versions[ref] = version
+	s.dirty[ref] = struct{}{}
+}
+
+func (s *Storage) quotaState(ctx context.Context, ref quotaRef) (quotaState, bool) {
+	s.mu.Lock()
+	version := s.versions[ref]
+	s.mu.Unlock()
+
+	data, err := s.Storage.Snapshot(ctx, ref.namespace, ref.resource)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotSupported) {
+			s.logger.Warn("failed to snapshot quota state", "id", ref.id(), "err", err)
+		}
+
+		return quotaState{}, false
+	}
+
+	return quotaState{Namespace: ref.namespace, Resource: ref.resource, Version: version, Data: data}, true
+}
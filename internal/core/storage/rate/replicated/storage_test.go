@@ -0,0 +1,96 @@
+package replicated
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Blinkuu/qms/internal/core/ports"
+	"github.com/Blinkuu/qms/internal/core/storage/rate/memory"
+	"github.com/Blinkuu/qms/internal/core/storage/rate/quota"
+	"github.com/Blinkuu/qms/pkg/log"
+)
+
+// gossipBus delivers broadcasts of a member to all other members synchronously.
+type gossipBus struct {
+	delegates []ports.GossipDelegate
+}
+
+type fakeMemberlist struct {
+	ports.MemberlistService
+	bus *gossipBus
+	me  int
+}
+
+func (m *fakeMemberlist) Broadcast(_, _ string, payload []byte) {
+	for i, d := range m.bus.delegates {
+		if i != m.me {
+			d.NotifyMsg(payload)
+		}
+	}
+}
+
+func (m *fakeMemberlist) Subscribe(_ string, delegate ports.GossipDelegate) {
+	m.bus.delegates = append(m.bus.delegates, delegate)
+}
+
+func newReplicas(t *testing.T, c clock.Clock, n int) []*Storage {
+	bus := &gossipBus{}
+	replicas := make([]*Storage, 0, n)
+	for i := 0; i < n; i++ {
+		s := NewStorage(Config{SyncInterval: time.Second}, c, log.NewNoopLogger(), prometheus.NewRegistry(), &fakeMemberlist{bus: bus, me: i})
+		err := s.RegisterQuota(context.Background(), "namespace", "resource", quota.Config{Algorithm: memory.GCRAAlgorithm, Unit: "second", RequestPerUnit: 2})
+		assert.NoError(t, err)
+
+		replicas = append(replicas, s)
+	}
+
+	return replicas
+}
+
+func TestStorage_Sync_FollowerTakesOverWithLastKnownState(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	replicas := newReplicas(t, c, 2)
+	owner, follower := replicas[0], replicas[1]
+	_, ok, err := owner.Allow(context.Background(), "namespace", "resource", "", 2, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// When
+	owner.Sync(context.Background())
+
+	// Then
+	waitTime, ok, err := follower.Allow(context.Background(), "namespace", "resource", "", 1, 0)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, waitTime)
+}
+
+func TestStorage_MergeRemoteState_IgnoresOlderState(t *testing.T) {
+	// Given
+	c := clock.NewMock()
+	replicas := newReplicas(t, c, 2)
+	stale, fresh := replicas[0], replicas[1]
+	_, ok, err := stale.Allow(context.Background(), "namespace", "resource", "", 2, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	state := stale.LocalState()
+
+	c.Add(time.Millisecond)
+	_, ok, err = fresh.Allow(context.Background(), "namespace", "resource", "", 1, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// When
+	fresh.MergeRemoteState(state)
+
+	// Then
+	_, ok, err = fresh.Allow(context.Background(), "namespace", "resource", "", 1, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
@@ -8,7 +8,14 @@ import (
 )
 
 type Storage interface {
-	Allow(ctx context.Context, namespace, resource string, tokens int64) (waitTime time.Duration, ok bool, err error)
+	Allow(ctx context.Context, namespace, resource, key string, tokens int64, maxWait time.Duration) (waitTime time.Duration, ok bool, err error)
+	Reserve(ctx context.Context, namespace, resource, key string, tokens int64, maxWait time.Duration) (reservationID string, readyAt time.Time, ok bool, err error)
+	Cancel(ctx context.Context, namespace, resource, reservationID string) (ok bool, err error)
+	Acquire(ctx context.Context, namespace, resource string, tokens int64) (permitID string, ok bool, err error)
+	Release(ctx context.Context, namespace, resource, permitID string) (ok bool, err error)
 	RegisterQuota(ctx context.Context, namespace, resource string, cfg quota.Config) error
+	UpdateQuota(ctx context.Context, namespace, resource string, cfg quota.Config) error
+	DeleteQuota(ctx context.Context, namespace, resource string) error
+	ListQuotas(ctx context.Context) ([]quota.Quota, error)
 	Shutdown(ctx context.Context) error
 }
@@ -3,10 +3,13 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/Blinkuu/qms/internal/core/ports"
 	"github.com/Blinkuu/qms/internal/core/services/alloc"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/batch"
 	"github.com/Blinkuu/qms/pkg/dto"
 )
 
@@ -61,6 +64,197 @@ func (h *AllocHTTPHandler) View() http.HandlerFunc {
 	}
 }
 
+// ViewHolders is a variant of View listing the tokens allocated by each holder.
+func (h *AllocHTTPHandler) ViewHolders() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req dto.ViewRequestBody
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		allocated, capacity, version, holders, err := h.service.ViewHolders(r.Context(), req.Namespace, req.Resource)
+		if err != nil {
+			switch {
+			case errors.Is(err, alloc.ErrNotFound):
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(
+					dto.NewResponseBody(
+						dto.StatusAllocNotFound,
+						err.Error(),
+						dto.ViewHoldersResponseBody{},
+					),
+				)
+				return
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(
+			dto.NewOKResponseBody(
+				dto.ViewHoldersResponseBody{
+					Allocated: allocated,
+					Capacity:  capacity,
+					Version:   version,
+					Holders:   holders,
+				},
+			),
+		)
+	}
+}
+
+// Watch streams the changes of a quota as server-sent events, each carrying a JSON encoded dto.WatchEvent. The stream
+// starts with the current state of the quota and lasts until the request is done.
+func (h *AllocHTTPHandler) Watch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req dto.ViewRequestBody
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		events, err := h.service.Watch(r.Context(), req.Namespace, req.Resource)
+		if err != nil {
+			switch {
+			case errors.Is(err, alloc.ErrNotFound):
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(
+					dto.NewResponseBody(
+						dto.StatusAllocNotFound,
+						err.Error(),
+						dto.WatchEvent{},
+					),
+				)
+				return
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		flusher.Flush()
+
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+
+				data, err := json.Marshal(e.DTO())
+				if err != nil {
+					return
+				}
+
+				if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+					return
+				}
+
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// History returns the usage history of a quota. The query selects the quota with namespace and resource, the windows
+// of the history with from and to, given in RFC 3339, and the step to downsample them to, given as a duration. The
+// history defaults to the last hour, at the resolution it is stored with.
+func (h *AllocHTTPHandler) History() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		to := time.Now()
+		if v := query.Get("to"); v != "" {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid to: %s", err), http.StatusBadRequest)
+				return
+			}
+
+			to = t
+		}
+
+		from := to.Add(-time.Hour)
+		if v := query.Get("from"); v != "" {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid from: %s", err), http.StatusBadRequest)
+				return
+			}
+
+			from = t
+		}
+
+		if from.After(to) {
+			http.Error(w, "from must not be after to", http.StatusBadRequest)
+			return
+		}
+
+		var step time.Duration
+		if v := query.Get("step"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid step: %s", err), http.StatusBadRequest)
+				return
+			}
+
+			if d < 0 {
+				http.Error(w, "step must not be negative", http.StatusBadRequest)
+				return
+			}
+
+			step = d
+		}
+
+		samples, err := h.service.History(r.Context(), query.Get("namespace"), query.Get("resource"), from, to, step)
+		if err != nil {
+			var status int
+			switch {
+			case errors.Is(err, alloc.ErrNotFound):
+				status = dto.StatusHistoryNotFound
+			case errors.Is(err, alloc.ErrNotSupported):
+				status = dto.StatusHistoryNotSupported
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(
+				dto.NewResponseBody(
+					status,
+					err.Error(),
+					dto.HistoryResponseBody{},
+				),
+			)
+			return
+		}
+
+		resBody := dto.HistoryResponseBody{Samples: make([]dto.HistorySample, 0, len(samples))}
+		for _, sample := range samples {
+			resBody.Samples = append(resBody.Samples, sample.DTO())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(dto.NewOKResponseBody(resBody))
+	}
+}
+
 func (h *AllocHTTPHandler) Alloc() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req dto.AllocRequestBody
@@ -70,7 +264,17 @@ func (h *AllocHTTPHandler) Alloc() http.HandlerFunc {
 			return
 		}
 
-		remainingTokens, currentVersion, ok, err := h.service.Alloc(r.Context(), req.Namespace, req.Resource, req.Tokens, req.Version)
+		if req.TTL < 0 {
+			http.Error(w, "ttl must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		if req.MaxWait < 0 {
+			http.Error(w, "max_wait must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		remainingTokens, currentVersion, leaseID, ok, overSoftLimit, err := h.service.Alloc(r.Context(), req.Namespace, req.Resource, req.Holder, req.Tokens, req.Version, time.Duration(req.TTL), time.Duration(req.MaxWait), req.IdempotencyKey)
 		if err != nil {
 			switch {
 			case errors.Is(err, alloc.ErrNotFound):
@@ -105,6 +309,8 @@ func (h *AllocHTTPHandler) Alloc() http.HandlerFunc {
 				dto.AllocResponseBody{
 					RemainingTokens: remainingTokens,
 					CurrentVersion:  currentVersion,
+					LeaseID:         leaseID,
+					OverSoftLimit:   overSoftLimit,
 					OK:              ok,
 				},
 			),
@@ -112,6 +318,71 @@ func (h *AllocHTTPHandler) Alloc() http.HandlerFunc {
 	}
 }
 
+func (h *AllocHTTPHandler) AllocBatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req dto.AllocBatchRequestBody
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(req.Items) == 0 {
+			http.Error(w, "items must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		items := make([]batch.Item, 0, len(req.Items))
+		for _, item := range req.Items {
+			items = append(items, batch.NewItemFromDTO(item))
+		}
+
+		results, ok, err := h.service.AllocBatch(r.Context(), items)
+		if err != nil {
+			switch {
+			case errors.Is(err, alloc.ErrNotFound):
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(
+					dto.NewResponseBody(
+						dto.StatusAllocBatchNotFound,
+						err.Error(),
+						dto.AllocBatchResponseBody{},
+					),
+				)
+				return
+			case errors.Is(err, alloc.ErrInvalidVersion):
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(
+					dto.NewResponseBody(
+						dto.StatusAllocBatchInvalidVersion,
+						err.Error(),
+						dto.AllocBatchResponseBody{},
+					),
+				)
+				return
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		resultItems := make([]dto.AllocBatchItemResult, 0, len(results))
+		for _, result := range results {
+			resultItems = append(resultItems, result.DTO())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(
+			dto.NewOKResponseBody(
+				dto.AllocBatchResponseBody{
+					Items: resultItems,
+					OK:    ok,
+				},
+			),
+		)
+	}
+}
+
 func (h *AllocHTTPHandler) Free() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req dto.FreeRequestBody
@@ -121,7 +392,7 @@ func (h *AllocHTTPHandler) Free() http.HandlerFunc {
 			return
 		}
 
-		remainingTokens, currentVersion, ok, err := h.service.Free(r.Context(), req.Namespace, req.Resource, req.Tokens, req.Version)
+		remainingTokens, currentVersion, ok, err := h.service.Free(r.Context(), req.Namespace, req.Resource, req.Holder, req.Tokens, req.Version, req.LeaseID, req.IdempotencyKey)
 		if err != nil {
 			switch {
 			case errors.Is(err, alloc.ErrNotFound):
@@ -162,3 +433,48 @@ func (h *AllocHTTPHandler) Free() http.HandlerFunc {
 		)
 	}
 }
+
+func (h *AllocHTTPHandler) Renew() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req dto.RenewRequestBody
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.TTL <= 0 {
+			http.Error(w, "ttl must be greater than 0", http.StatusBadRequest)
+			return
+		}
+
+		expiresAt, ok, err := h.service.Renew(r.Context(), req.Namespace, req.Resource, req.LeaseID, time.Duration(req.TTL))
+		if err != nil {
+			switch {
+			case errors.Is(err, alloc.ErrNotFound):
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(
+					dto.NewResponseBody(
+						dto.StatusRenewNotFound,
+						err.Error(),
+						dto.RenewResponseBody{},
+					),
+				)
+				return
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(
+			dto.NewOKResponseBody(
+				dto.RenewResponseBody{
+					ExpiresAt: expiresAt,
+					OK:        ok,
+				},
+			),
+		)
+	}
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Blinkuu/qms/internal/core/ports"
+	"github.com/Blinkuu/qms/internal/core/services/alloc"
+	"github.com/Blinkuu/qms/pkg/dto"
+)
+
+type BackupHTTPHandler struct {
+	service ports.BackupService
+}
+
+func NewBackupHTTPHandler(service ports.BackupService) *BackupHTTPHandler {
+	return &BackupHTTPHandler{
+		service: service,
+	}
+}
+
+// Backup streams a backup of the storage. An error is reported with its status code if nothing has been written yet,
+// or else by aborting the response, so that the client does not mistake a truncated backup for a complete one.
+func (h *BackupHTTPHandler) Backup() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+
+		cw := &countingWriter{w: w}
+		err := h.service.Backup(r.Context(), cw)
+		if err == nil {
+			return
+		}
+
+		if cw.n > 0 {
+			panic(http.ErrAbortHandler)
+		}
+
+		http.Error(w, err.Error(), backupErrorStatus(err))
+	}
+}
+
+// Restore loads the backup in the request body into the storage.
+func (h *BackupHTTPHandler) Restore() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := h.service.Restore(r.Context(), r.Body); err != nil {
+			http.Error(w, err.Error(), backupErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(
+			dto.NewOKResponseBody(
+				dto.RestoreResponseBody{},
+			),
+		)
+	}
+}
+
+func backupErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, alloc.ErrNotSupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, alloc.ErrAlreadyExists):
+		return http.StatusConflict
+	case errors.Is(err, alloc.ErrInvalidBackup):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Blinkuu/qms/internal/core/ports"
+	"github.com/Blinkuu/qms/internal/core/storage/alloc/export"
+	"github.com/Blinkuu/qms/pkg/dto"
+)
+
+// ExportHTTPHandler exports and imports the state of alloc quotas, so that it can be moved between storage backends.
+type ExportHTTPHandler struct {
+	service ports.ExportService
+}
+
+func NewExportHTTPHandler(service ports.ExportService) *ExportHTTPHandler {
+	return &ExportHTTPHandler{
+		service: service,
+	}
+}
+
+func (h *ExportHTTPHandler) Export() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		items, err := h.service.Export(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		quotas := make([]dto.ExportedQuota, 0, len(items))
+		for _, it := range items {
+			quotas = append(quotas, it.DTO())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(
+			dto.NewOKResponseBody(
+				dto.ExportResponseBody{
+					Quotas: quotas,
+				},
+			),
+		)
+	}
+}
+
+func (h *ExportHTTPHandler) Import() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req dto.ImportRequestBody
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		items := make([]export.Item, 0, len(req.Quotas))
+		for _, q := range req.Quotas {
+			items = append(items, export.NewItemFromDTO(q))
+		}
+
+		if err := h.service.Import(r.Context(), items); err != nil {
+			writeQuotaError(w, err, dto.ImportResponseBody{})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(
+			dto.NewOKResponseBody(
+				dto.ImportResponseBody{},
+			),
+		)
+	}
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Blinkuu/qms/internal/core/ports"
+	"github.com/Blinkuu/qms/internal/core/services/alloc"
+	"github.com/Blinkuu/qms/internal/core/services/rate"
+	allocquota "github.com/Blinkuu/qms/internal/core/storage/alloc/quota"
+	ratequota "github.com/Blinkuu/qms/internal/core/storage/rate/quota"
+	"github.com/Blinkuu/qms/pkg/dto"
+)
+
+// QuotaHTTPHandler manages rate and alloc quotas at runtime. Requests select the kind of quota with the kind field,
+// or the kind query parameter for listing.
+type QuotaHTTPHandler struct {
+	rateService  ports.RateQuotaService
+	allocService ports.AllocQuotaService
+}
+
+func NewQuotaHTTPHandler(rateService ports.RateQuotaService, allocService ports.AllocQuotaService) *QuotaHTTPHandler {
+	return &QuotaHTTPHandler{
+		rateService:  rateService,
+		allocService: allocService,
+	}
+}
+
+func (h *QuotaHTTPHandler) Create() http.HandlerFunc {
+	return h.apply(func(ctx context.Context, q dto.QuotaRequestBody) error {
+		switch q.Kind {
+		case dto.QuotaKindRate:
+			return h.rateService.CreateRateQuota(ctx, q.Namespace, q.Resource, ratequota.NewConfigFromDTO(q.Strategy))
+		case dto.QuotaKindAlloc:
+			return h.allocService.CreateAllocQuota(ctx, q.Namespace, q.Resource, allocquota.NewConfigFromDTO(q.Strategy))
+		default:
+			return errUnknownQuotaKind(q.Kind)
+		}
+	})
+}
+
+func (h *QuotaHTTPHandler) Update() http.HandlerFunc {
+	return h.apply(func(ctx context.Context, q dto.QuotaRequestBody) error {
+		switch q.Kind {
+		case dto.QuotaKindRate:
+			return h.rateService.UpdateRateQuota(ctx, q.Namespace, q.Resource, ratequota.NewConfigFromDTO(q.Strategy))
+		case dto.QuotaKindAlloc:
+			return h.allocService.UpdateAllocQuota(ctx, q.Namespace, q.Resource, allocquota.NewConfigFromDTO(q.Strategy))
+		default:
+			return errUnknownQuotaKind(q.Kind)
+		}
+	})
+}
+
+func (h *QuotaHTTPHandler) Delete() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req dto.DeleteQuotaRequestBody
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch req.Kind {
+		case dto.QuotaKindRate:
+			err = h.rateService.DeleteRateQuota(r.Context(), req.Namespace, req.Resource)
+		case dto.QuotaKindAlloc:
+			err = h.allocService.DeleteAllocQuota(r.Context(), req.Namespace, req.Resource)
+		default:
+			http.Error(w, errUnknownQuotaKind(req.Kind).Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeQuotaResult(w, err)
+	}
+}
+
+// List returns quotas of the kind given in the query, or of both kinds if it is empty.
+func (h *QuotaHTTPHandler) List() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		kind := r.URL.Query().Get("kind")
+		if kind != "" && kind != dto.QuotaKindRate && kind != dto.QuotaKindAlloc {
+			http.Error(w, errUnknownQuotaKind(kind).Error(), http.StatusBadRequest)
+			return
+		}
+
+		quotas := make([]dto.Quota, 0)
+		if kind == "" || kind == dto.QuotaKindRate {
+			rateQuotas, err := h.rateService.ListRateQuotas(r.Context())
+			if err != nil {
+				writeQuotaError(w, err, dto.ListQuotasResponseBody{})
+				return
+			}
+
+			for _, q := range rateQuotas {
+				quotas = append(quotas, dto.Quota{Kind: dto.QuotaKindRate, Namespace: q.Namespace, Resource: q.Resource, Strategy: q.Strategy.DTO()})
+			}
+		}
+
+		if kind == "" || kind == dto.QuotaKindAlloc {
+			allocQuotas, err := h.allocService.ListAllocQuotas(r.Context())
+			if err != nil {
+				writeQuotaError(w, err, dto.ListQuotasResponseBody{})
+				return
+			}
+
+			for _, q := range allocQuotas {
+				quotas = append(quotas, dto.Quota{Kind: dto.QuotaKindAlloc, Namespace: q.Namespace, Resource: q.Resource, Strategy: q.Strategy.DTO()})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(
+			dto.NewOKResponseBody(
+				dto.ListQuotasResponseBody{
+					Quotas: quotas,
+				},
+			),
+		)
+	}
+}
+
+func (h *QuotaHTTPHandler) apply(fn func(ctx context.Context, q dto.QuotaRequestBody) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req dto.QuotaRequestBody
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.Kind != dto.QuotaKindRate && req.Kind != dto.QuotaKindAlloc {
+			http.Error(w, errUnknownQuotaKind(req.Kind).Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeQuotaResult(w, fn(r.Context(), req))
+	}
+}
+
+func writeQuotaResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeQuotaError(w, err, dto.QuotaResponseBody{})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(
+		dto.NewOKResponseBody(
+			dto.QuotaResponseBody{
+				OK: true,
+			},
+		),
+	)
+}
+
+func writeQuotaError[T any](w http.ResponseWriter, err error, result T) {
+	var status int
+	switch {
+	case errors.Is(err, rate.ErrNotFound), errors.Is(err, alloc.ErrNotFound):
+		status = dto.StatusQuotaNotFound
+	case errors.Is(err, rate.ErrAlreadyExists), errors.Is(err, alloc.ErrAlreadyExists):
+		status = dto.StatusQuotaAlreadyExists
+	case errors.Is(err, rate.ErrInvalidQuota), errors.Is(err, alloc.ErrInvalidQuota):
+		status = dto.StatusQuotaInvalid
+	case errors.Is(err, rate.ErrNotSupported):
+		status = dto.StatusQuotaNotSupported
+	case errors.Is(err, alloc.ErrCapacityBelowAllocated):
+		status = dto.StatusQuotaCapacityBelowAllocated
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(
+		dto.NewResponseBody(
+			status,
+			err.Error(),
+			result,
+		),
+	)
+}
+
+func errUnknownQuotaKind(kind string) error {
+	return fmt.Errorf("unknown quota kind %q, expected %s or %s", kind, dto.QuotaKindRate, dto.QuotaKindAlloc)
+}
@@ -2,7 +2,9 @@ package handlers
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
+	"strconv"
 
 	"github.com/Blinkuu/qms/internal/core/ports"
 	"github.com/Blinkuu/qms/pkg/dto"
@@ -27,7 +29,7 @@ func (h *RaftHTTPHandler) Join() http.HandlerFunc {
 			return
 		}
 
-		alreadyMember, err := h.service.Join(r.Context(), joinRequestBody.ReplicaID, joinRequestBody.RaftAddr)
+		added, members, err := h.service.Join(r.Context(), joinRequestBody.ReplicaID, joinRequestBody.RaftAddr)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -37,7 +39,8 @@ func (h *RaftHTTPHandler) Join() http.HandlerFunc {
 		_ = json.NewEncoder(w).Encode(
 			dto.NewOKResponseBody(
 				dto.JoinResponseBody{
-					AlreadyMember: alreadyMember,
+					AddedShardIDs:  added,
+					MemberShardIDs: members,
 				},
 			),
 		)
@@ -53,7 +56,7 @@ func (h *RaftHTTPHandler) Exit() http.HandlerFunc {
 			return
 		}
 
-		err = h.service.Exit(r.Context(), exitRequestBody.ReplicaID)
+		err = h.service.Exit(r.Context(), exitRequestBody.ReplicaID, exitRequestBody.ShardIDs)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -67,3 +70,40 @@ func (h *RaftHTTPHandler) Exit() http.HandlerFunc {
 		)
 	}
 }
+
+type RaftShardHTTPHandler struct {
+	service ports.RaftShardService
+}
+
+func NewRaftShardHTTPHandler(service ports.RaftShardService) *RaftShardHTTPHandler {
+	return &RaftShardHTTPHandler{
+		service: service,
+	}
+}
+
+// Invoke invokes the encoded command in the request body on the shard given by the shard_id query parameter, and
+// responds with its encoded result.
+func (h *RaftShardHTTPHandler) Invoke() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		shardID, err := strconv.ParseUint(r.URL.Query().Get("shard_id"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cmd, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result, err := h.service.InvokeShard(r.Context(), shardID, cmd)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(result)
+	}
+}
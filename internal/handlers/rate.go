@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/Blinkuu/qms/internal/core/ports"
 	"github.com/Blinkuu/qms/internal/core/services/rate"
@@ -29,7 +30,14 @@ func (h *RateHTTPHandler) Allow() http.HandlerFunc {
 			return
 		}
 
-		waitTime, ok, err := h.service.Allow(r.Context(), allowRequestBody.Namespace, allowRequestBody.Resource, allowRequestBody.Tokens)
+		waitTime, ok, err := h.service.Allow(
+			r.Context(),
+			allowRequestBody.Namespace,
+			allowRequestBody.Resource,
+			allowRequestBody.Key,
+			allowRequestBody.Tokens,
+			time.Duration(allowRequestBody.MaxWait),
+		)
 		if err != nil {
 			switch {
 			case errors.Is(err, rate.ErrNotFound):
@@ -59,3 +67,188 @@ func (h *RateHTTPHandler) Allow() http.HandlerFunc {
 		)
 	}
 }
+
+func (h *RateHTTPHandler) Reserve() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var reserveRequestBody dto.ReserveRequestBody
+		err := json.NewDecoder(r.Body).Decode(&reserveRequestBody)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		reservationID, readyAt, ok, err := h.service.Reserve(
+			r.Context(),
+			reserveRequestBody.Namespace,
+			reserveRequestBody.Resource,
+			reserveRequestBody.Key,
+			reserveRequestBody.Tokens,
+			time.Duration(reserveRequestBody.MaxWait),
+		)
+		if err != nil {
+			var status int
+			switch {
+			case errors.Is(err, rate.ErrNotFound):
+				status = dto.StatusReserveNotFound
+			case errors.Is(err, rate.ErrNotSupported):
+				status = dto.StatusReserveNotSupported
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(
+				dto.NewResponseBody(
+					status,
+					err.Error(),
+					dto.ReserveResponseBody{},
+				),
+			)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(
+			dto.NewOKResponseBody(
+				dto.ReserveResponseBody{
+					ReservationID: reservationID,
+					ReadyAt:       readyAt,
+					OK:            ok,
+				},
+			),
+		)
+	}
+}
+
+func (h *RateHTTPHandler) Cancel() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var cancelRequestBody dto.CancelRequestBody
+		err := json.NewDecoder(r.Body).Decode(&cancelRequestBody)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ok, err := h.service.Cancel(
+			r.Context(),
+			cancelRequestBody.Namespace,
+			cancelRequestBody.Resource,
+			cancelRequestBody.Key,
+			cancelRequestBody.ReservationID,
+		)
+		if err != nil {
+			switch {
+			case errors.Is(err, rate.ErrNotFound):
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(
+					dto.NewResponseBody(
+						dto.StatusCancelNotFound,
+						err.Error(),
+						dto.CancelResponseBody{},
+					),
+				)
+				return
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(
+			dto.NewOKResponseBody(
+				dto.CancelResponseBody{
+					OK: ok,
+				},
+			),
+		)
+	}
+}
+
+func (h *RateHTTPHandler) Acquire() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var acquireRequestBody dto.AcquireRequestBody
+		err := json.NewDecoder(r.Body).Decode(&acquireRequestBody)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if acquireRequestBody.Tokens <= 0 {
+			http.Error(w, "tokens must be greater than 0", http.StatusBadRequest)
+			return
+		}
+
+		permitID, ok, err := h.service.Acquire(r.Context(), acquireRequestBody.Namespace, acquireRequestBody.Resource, acquireRequestBody.Tokens)
+		if err != nil {
+			switch {
+			case errors.Is(err, rate.ErrNotFound):
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(
+					dto.NewResponseBody(
+						dto.StatusAcquireNotFound,
+						err.Error(),
+						dto.AcquireResponseBody{},
+					),
+				)
+				return
+			case errors.Is(err, rate.ErrInvalidArgument):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(
+			dto.NewOKResponseBody(
+				dto.AcquireResponseBody{
+					PermitID: permitID,
+					OK:       ok,
+				},
+			),
+		)
+	}
+}
+
+func (h *RateHTTPHandler) Release() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var releaseRequestBody dto.ReleaseRequestBody
+		err := json.NewDecoder(r.Body).Decode(&releaseRequestBody)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ok, err := h.service.Release(r.Context(), releaseRequestBody.Namespace, releaseRequestBody.Resource, releaseRequestBody.PermitID)
+		if err != nil {
+			switch {
+			case errors.Is(err, rate.ErrNotFound):
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(
+					dto.NewResponseBody(
+						dto.StatusReleaseNotFound,
+						err.Error(),
+						dto.ReleaseResponseBody{},
+					),
+				)
+				return
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(
+			dto.NewOKResponseBody(
+				dto.ReleaseResponseBody{
+					OK: ok,
+				},
+			),
+		)
+	}
+}
@@ -0,0 +1,45 @@
+package caller
+
+import (
+	"context"
+	"net/http"
+)
+
+// Header carries the identity of the caller of a request. It is set by clients, and forwarded between instances.
+const Header = "X-Qms-Caller"
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the identity of the caller.
+func NewContext(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, contextKey{}, identity)
+}
+
+// FromContext returns the identity of the caller carried by ctx, or an empty string if there is none.
+func FromContext(ctx context.Context) string {
+	identity, _ := ctx.Value(contextKey{}).(string)
+	return identity
+}
+
+// Transport sets the caller.Header of requests to the identity of the caller carried by their context.
+type Transport struct {
+	base http.RoundTripper
+}
+
+func NewTransport(base http.RoundTripper) *Transport {
+	return &Transport{
+		base: base,
+	}
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	identity := FromContext(r.Context())
+	if identity == "" {
+		return t.base.RoundTrip(r)
+	}
+
+	r = r.Clone(r.Context())
+	r.Header.Set(Header, identity)
+
+	return t.base.RoundTrip(r)
+}
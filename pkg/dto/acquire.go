@@ -0,0 +1,16 @@
+package dto
+
+const (
+	StatusAcquireNotFound = 1002
+)
+
+type AcquireRequestBody struct {
+	Namespace string `json:"namespace"`
+	Resource  string `json:"resource"`
+	Tokens    int64  `json:"tokens"`
+}
+
+type AcquireResponseBody struct {
+	PermitID string `json:"permit_id"`
+	OK       bool   `json:"ok"`
+}
@@ -6,14 +6,20 @@ const (
 )
 
 type AllocRequestBody struct {
-	Namespace string `json:"namespace"`
-	Resource  string `json:"resource"`
-	Tokens    int64  `json:"tokens"`
-	Version   int64  `json:"version"`
+	Namespace      string `json:"namespace"`
+	Resource       string `json:"resource"`
+	Holder         string `json:"holder,omitempty"`
+	Tokens         int64  `json:"tokens"`
+	Version        int64  `json:"version"`
+	TTL            int64  `json:"ttl,omitempty"`
+	MaxWait        int64  `json:"max_wait,omitempty"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
 }
 
 type AllocResponseBody struct {
-	RemainingTokens int64 `json:"remaining_tokens"`
-	CurrentVersion  int64 `json:"current_version"`
-	OK              bool  `json:"ok"`
+	RemainingTokens int64  `json:"remaining_tokens"`
+	CurrentVersion  int64  `json:"current_version"`
+	LeaseID         string `json:"lease_id,omitempty"`
+	OverSoftLimit   bool   `json:"over_soft_limit,omitempty"`
+	OK              bool   `json:"ok"`
 }
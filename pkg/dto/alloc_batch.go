@@ -0,0 +1,28 @@
+package dto
+
+const (
+	StatusAllocBatchNotFound       = 1002
+	StatusAllocBatchInvalidVersion = 1003
+)
+
+type AllocBatchItem struct {
+	Namespace string `json:"namespace"`
+	Resource  string `json:"resource"`
+	Holder    string `json:"holder,omitempty"`
+	Tokens    int64  `json:"tokens"`
+	Version   int64  `json:"version"`
+}
+
+type AllocBatchRequestBody struct {
+	Items []AllocBatchItem `json:"items"`
+}
+
+type AllocBatchItemResult struct {
+	RemainingTokens int64 `json:"remaining_tokens"`
+	CurrentVersion  int64 `json:"current_version"`
+}
+
+type AllocBatchResponseBody struct {
+	Items []AllocBatchItemResult `json:"items"`
+	OK    bool                   `json:"ok"`
+}
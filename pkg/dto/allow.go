@@ -7,7 +7,9 @@ const (
 type AllowRequestBody struct {
 	Namespace string `json:"namespace"`
 	Resource  string `json:"resource"`
+	Key       string `json:"key,omitempty"`
 	Tokens    int64  `json:"tokens"`
+	MaxWait   int64  `json:"max_wait,omitempty"`
 }
 
 type AllowResponseBody struct {
@@ -0,0 +1,16 @@
+package dto
+
+const (
+	StatusCancelNotFound = 1002
+)
+
+type CancelRequestBody struct {
+	Namespace     string `json:"namespace"`
+	Resource      string `json:"resource"`
+	Key           string `json:"key,omitempty"`
+	ReservationID string `json:"reservation_id"`
+}
+
+type CancelResponseBody struct {
+	OK bool `json:"ok"`
+}
@@ -1,7 +1,10 @@
 package dto
 
+// ExitRequestBody asks to remove a replica from the shards placed on it. With ShardIDs the replica is only removed from
+// those, which the instance receiving the request has to host.
 type ExitRequestBody struct {
-	ReplicaID uint64 `json:"replica_id"`
+	ReplicaID uint64   `json:"replica_id"`
+	ShardIDs  []uint64 `json:"shard_ids,omitempty"`
 }
 
 type ExitResponseBody struct{}
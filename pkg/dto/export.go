@@ -0,0 +1,38 @@
+package dto
+
+import (
+	"time"
+)
+
+// ExportedLease is a lease holding tokens of an exported alloc quota.
+type ExportedLease struct {
+	ID        string    `json:"id" yaml:"id"`
+	Holder    string    `json:"holder,omitempty" yaml:"holder,omitempty"`
+	Tokens    int64     `json:"tokens" yaml:"tokens"`
+	ExpiresAt time.Time `json:"expires_at" yaml:"expires_at"`
+}
+
+// ExportedQuota is the state of an alloc quota, as exported from one storage backend to be imported into another. It is
+// also written to export files, which is why it has YAML tags as well.
+type ExportedQuota struct {
+	Namespace  string           `json:"namespace" yaml:"namespace"`
+	Resource   string           `json:"resource" yaml:"resource"`
+	Capacity   int64            `json:"capacity" yaml:"capacity"`
+	Parent     string           `json:"parent,omitempty" yaml:"parent,omitempty"`
+	SoftLimit  int64            `json:"soft_limit,omitempty" yaml:"soft_limit,omitempty"`
+	Overcommit float64          `json:"overcommit,omitempty" yaml:"overcommit,omitempty"`
+	Period     string           `json:"period,omitempty" yaml:"period,omitempty"`
+	TimeZone   string           `json:"time_zone,omitempty" yaml:"time_zone,omitempty"`
+	Allocated  int64            `json:"allocated" yaml:"allocated"`
+	Version    int64            `json:"version" yaml:"version"`
+	Holders    map[string]int64 `json:"holders,omitempty" yaml:"holders,omitempty"`
+	Leases     []ExportedLease  `json:"leases,omitempty" yaml:"leases,omitempty"`
+}
+
+type ExportResponseBody struct {
+	Quotas []ExportedQuota `json:"quotas" yaml:"quotas"`
+}
+
+type ImportRequestBody = ExportResponseBody
+
+type ImportResponseBody struct{}
@@ -1,10 +1,13 @@
 package dto
 
 type FreeRequestBody struct {
-	Namespace string `json:"namespace"`
-	Resource  string `json:"resource"`
-	Tokens    int64  `json:"tokens"`
-	Version   int64  `json:"version"`
+	Namespace      string `json:"namespace"`
+	Resource       string `json:"resource"`
+	Holder         string `json:"holder,omitempty"`
+	Tokens         int64  `json:"tokens"`
+	Version        int64  `json:"version"`
+	LeaseID        string `json:"lease_id,omitempty"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
 }
 
 type FreeResponseBody struct {
@@ -0,0 +1,23 @@
+package dto
+
+import (
+	"time"
+)
+
+const (
+	StatusHistoryNotFound     = 1002
+	StatusHistoryNotSupported = 1003
+)
+
+// HistorySample is the usage of a quota over a window starting at Time. Allocated is the last value sampled in the
+// window, and MaxAllocated is the highest one.
+type HistorySample struct {
+	Time         time.Time `json:"time"`
+	Allocated    int64     `json:"allocated"`
+	MaxAllocated int64     `json:"max_allocated"`
+	Capacity     int64     `json:"capacity"`
+}
+
+type HistoryResponseBody struct {
+	Samples []HistorySample `json:"samples"`
+}
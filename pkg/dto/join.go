@@ -5,6 +5,9 @@ type JoinRequestBody struct {
 	RaftAddr  string `json:"raft_addr"`
 }
 
+// JoinResponseBody lists the shards a replica was added to, and those it was already a member of. A peer only covers the
+// shards it hosts itself.
 type JoinResponseBody struct {
-	AlreadyMember bool `json:"already_member"`
+	AddedShardIDs  []uint64 `json:"added_shard_ids"`
+	MemberShardIDs []uint64 `json:"member_shard_ids"`
 }
@@ -0,0 +1,60 @@
+package dto
+
+const (
+	QuotaKindRate  = "rate"
+	QuotaKindAlloc = "alloc"
+)
+
+const (
+	StatusQuotaNotFound               = 1002
+	StatusQuotaAlreadyExists          = 1003
+	StatusQuotaInvalid                = 1004
+	StatusQuotaNotSupported           = 1005
+	StatusQuotaCapacityBelowAllocated = 1006
+)
+
+// QuotaStrategy mirrors the strategy of a quota in the YAML configuration. Rate quotas use all fields up to
+// SyncInterval, and alloc quotas use the rest. Durations are in nanoseconds.
+type QuotaStrategy struct {
+	Algorithm       string  `json:"algorithm,omitempty"`
+	Unit            string  `json:"unit,omitempty"`
+	RequestsPerUnit int64   `json:"requests_per_unit,omitempty"`
+	Burst           int64   `json:"burst,omitempty"`
+	MaxConcurrent   int64   `json:"max_concurrent,omitempty"`
+	PermitTTL       int64   `json:"permit_ttl,omitempty"`
+	PerKey          bool    `json:"per_key,omitempty"`
+	MaxKeys         int     `json:"max_keys,omitempty"`
+	KeyIdleTimeout  int64   `json:"key_idle_timeout,omitempty"`
+	Approximate     bool    `json:"approximate,omitempty"`
+	SyncInterval    int64   `json:"sync_interval,omitempty"`
+	Capacity        int64   `json:"capacity,omitempty"`
+	Parent          string  `json:"parent,omitempty"`
+	SoftLimit       int64   `json:"soft_limit,omitempty"`
+	Overcommit      float64 `json:"overcommit,omitempty"`
+	ShrinkPolicy    string  `json:"shrink_policy,omitempty"`
+	Period          string  `json:"period,omitempty"`
+	TimeZone        string  `json:"time_zone,omitempty"`
+}
+
+type Quota struct {
+	Kind      string        `json:"kind"`
+	Namespace string        `json:"namespace"`
+	Resource  string        `json:"resource"`
+	Strategy  QuotaStrategy `json:"strategy"`
+}
+
+type QuotaRequestBody = Quota
+
+type QuotaResponseBody struct {
+	OK bool `json:"ok"`
+}
+
+type DeleteQuotaRequestBody struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Resource  string `json:"resource"`
+}
+
+type ListQuotasResponseBody struct {
+	Quotas []Quota `json:"quotas"`
+}
@@ -0,0 +1,15 @@
+package dto
+
+const (
+	StatusReleaseNotFound = 1002
+)
+
+type ReleaseRequestBody struct {
+	Namespace string `json:"namespace"`
+	Resource  string `json:"resource"`
+	PermitID  string `json:"permit_id"`
+}
+
+type ReleaseResponseBody struct {
+	OK bool `json:"ok"`
+}
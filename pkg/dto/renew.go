@@ -0,0 +1,21 @@
+package dto
+
+import (
+	"time"
+)
+
+const (
+	StatusRenewNotFound = 1002
+)
+
+type RenewRequestBody struct {
+	Namespace string `json:"namespace"`
+	Resource  string `json:"resource"`
+	LeaseID   string `json:"lease_id"`
+	TTL       int64  `json:"ttl"`
+}
+
+type RenewResponseBody struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	OK        bool      `json:"ok"`
+}
@@ -0,0 +1,24 @@
+package dto
+
+import (
+	"time"
+)
+
+const (
+	StatusReserveNotFound     = 1002
+	StatusReserveNotSupported = 1003
+)
+
+type ReserveRequestBody struct {
+	Namespace string `json:"namespace"`
+	Resource  string `json:"resource"`
+	Key       string `json:"key,omitempty"`
+	Tokens    int64  `json:"tokens"`
+	MaxWait   int64  `json:"max_wait,omitempty"`
+}
+
+type ReserveResponseBody struct {
+	ReservationID string    `json:"reservation_id"`
+	ReadyAt       time.Time `json:"ready_at"`
+	OK            bool      `json:"ok"`
+}
@@ -0,0 +1,3 @@
+package dto
+
+type RestoreResponseBody struct{}
@@ -10,3 +10,10 @@ type ViewResponseBody struct {
 	Capacity  int64 `json:"capacity"`
 	Version   int64 `json:"version"`
 }
+
+type ViewHoldersResponseBody struct {
+	Allocated int64            `json:"allocated"`
+	Capacity  int64            `json:"capacity"`
+	Version   int64            `json:"version"`
+	Holders   map[string]int64 `json:"holders"`
+}
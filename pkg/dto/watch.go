@@ -0,0 +1,9 @@
+package dto
+
+// WatchEvent is sent by the watch endpoint whenever the watched quota changes. Deleted events carry no state.
+type WatchEvent struct {
+	Allocated int64 `json:"allocated"`
+	Capacity  int64 `json:"capacity"`
+	Version   int64 `json:"version"`
+	Deleted   bool  `json:"deleted,omitempty"`
+}
@@ -0,0 +1,24 @@
+package gorillamux
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Blinkuu/qms/pkg/caller"
+)
+
+// CallerMiddleware puts the identity of the caller, taken from the caller.Header of the request, into its context.
+func CallerMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity := r.Header.Get(caller.Header)
+			if identity == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(caller.NewContext(r.Context(), identity)))
+		})
+	}
+}
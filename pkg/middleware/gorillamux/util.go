@@ -27,6 +27,13 @@ func (w *statusCodeRecordingResponseWriter) WriteHeader(statusCode int) {
 	w.ResponseWriter.WriteHeader(statusCode)
 }
 
+// Flush lets handlers streaming their responses flush them through the middlewares.
+func (w *statusCodeRecordingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func httpFlavorFromRequest(r *http.Request) string {
 	switch r.ProtoMajor {
 	case 1:
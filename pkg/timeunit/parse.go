@@ -15,6 +15,10 @@ func Parse(unit string) (time.Duration, error) {
 		return time.Hour, nil
 	case "day":
 		return 24 * time.Hour, nil
+	case "week":
+		return 7 * 24 * time.Hour, nil
+	case "month":
+		return 0, fmt.Errorf("unit %s has no fixed duration", unit)
 	default:
 		return 0, fmt.Errorf("unit %s is not supported", unit)
 	}
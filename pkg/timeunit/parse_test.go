@@ -50,6 +50,22 @@ func TestParse(t *testing.T) {
 			want:    24 * time.Hour,
 			wantErr: assert.NoError,
 		},
+		{
+			name: "ReturnsNoErrorAndWeekUnitForLowercaseWeekString",
+			args: args{
+				unit: "week",
+			},
+			want:    7 * 24 * time.Hour,
+			wantErr: assert.NoError,
+		},
+		{
+			name: "ReturnsErrorAndZeroValueForLowercaseMonthString",
+			args: args{
+				unit: "month",
+			},
+			want:    0,
+			wantErr: assert.Error,
+		},
 		{
 			name: "ReturnsErrorAndZeroValueForUppercaseSecondString",
 			args: args{
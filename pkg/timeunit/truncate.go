@@ -0,0 +1,33 @@
+package timeunit
+
+import (
+	"fmt"
+	"time"
+)
+
+// Truncate returns the start of the calendar unit containing t, in the location of t. Unlike Parse it supports months,
+// and days, weeks and months follow the calendar of the location across daylight saving time changes. Weeks start on
+// Monday.
+func Truncate(t time.Time, unit string) (time.Time, error) {
+	year, month, day := t.Date()
+	hour, minute, second := t.Clock()
+	loc := t.Location()
+
+	switch unit {
+	case "second":
+		return time.Date(year, month, day, hour, minute, second, 0, loc), nil
+	case "minute":
+		return time.Date(year, month, day, hour, minute, 0, 0, loc), nil
+	case "hour":
+		return time.Date(year, month, day, hour, 0, 0, 0, loc), nil
+	case "day":
+		return time.Date(year, month, day, 0, 0, 0, 0, loc), nil
+	case "week":
+		sinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-sinceMonday, 0, 0, 0, 0, loc), nil
+	case "month":
+		return time.Date(year, month, 1, 0, 0, 0, 0, loc), nil
+	default:
+		return time.Time{}, fmt.Errorf("unit %s is not supported", unit)
+	}
+}
@@ -0,0 +1,81 @@
+package timeunit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncate(t *testing.T) {
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	assert.NoError(t, err)
+
+	type args struct {
+		t    time.Time
+		unit string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    time.Time
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{
+			name: "ReturnsStartOfHour",
+			args: args{
+				t:    time.Date(2022, time.November, 16, 13, 45, 30, 0, time.UTC),
+				unit: "hour",
+			},
+			want:    time.Date(2022, time.November, 16, 13, 0, 0, 0, time.UTC),
+			wantErr: assert.NoError,
+		},
+		{
+			name: "ReturnsStartOfDayInLocation",
+			args: args{
+				t:    time.Date(2022, time.November, 16, 0, 30, 0, 0, warsaw),
+				unit: "day",
+			},
+			want:    time.Date(2022, time.November, 16, 0, 0, 0, 0, warsaw),
+			wantErr: assert.NoError,
+		},
+		{
+			name: "ReturnsMondayForWeek",
+			args: args{
+				t:    time.Date(2022, time.November, 20, 23, 59, 0, 0, time.UTC),
+				unit: "week",
+			},
+			want:    time.Date(2022, time.November, 14, 0, 0, 0, 0, time.UTC),
+			wantErr: assert.NoError,
+		},
+		{
+			name: "ReturnsFirstDayOfMonthAcrossDaylightSavingTimeChange",
+			args: args{
+				t:    time.Date(2022, time.November, 16, 12, 0, 0, 0, warsaw),
+				unit: "month",
+			},
+			want:    time.Date(2022, time.November, 1, 0, 0, 0, 0, warsaw),
+			wantErr: assert.NoError,
+		},
+		{
+			name: "ReturnsErrorAndZeroValueForUnknownUnit",
+			args: args{
+				t:    time.Date(2022, time.November, 16, 12, 0, 0, 0, time.UTC),
+				unit: "year",
+			},
+			want:    time.Time{},
+			wantErr: assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Truncate(tt.args.t, tt.args.unit)
+			if !tt.wantErr(t, err, fmt.Sprintf("Truncate(%v, %v)", tt.args.t, tt.args.unit)) {
+				return
+			}
+
+			assert.Truef(t, tt.want.Equal(got), "Truncate(%v, %v) = %v, want %v", tt.args.t, tt.args.unit, got, tt.want)
+		})
+	}
+}